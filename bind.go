@@ -0,0 +1,45 @@
+package xml
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+)
+
+// Unmarshal stores the element and its content in the value pointed to by v, which is typically a
+// pointer to a struct. The mapping is that of xml.Unmarshal, so the same struct tags are honoured,
+// including attr, chardata, innerxml, comment, any and nested a>b paths. For a Document, the
+// document element is unmarshalled.
+//
+// The element is first serialized, so innerxml fields receive the text as written by Encode, with
+// any namespace declarations needed by the subtree, rather than the original input.
+func (elt *Element) Unmarshal(v any) error {
+	if elt.Type != Node && elt.Type != Document {
+		return fmt.Errorf("xml: can't unmarshal from a non-element node")
+	}
+	var buf bytes.Buffer
+	if err := elt.Encode(&buf, nil); err != nil {
+		return err
+	}
+	return xml.Unmarshal(buf.Bytes(), v)
+}
+
+// MarshalElement returns the element tree for v as encoded by xml.Marshal, honouring the same struct
+// tags and Marshaler interfaces. The returned element has no parent so it can be inserted into an
+// existing tree.
+func MarshalElement(v any) (*Element, error) {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := NewXMLDecoder(bytes.NewReader(b)).BuildDocument()
+	if err != nil {
+		return nil, err
+	}
+	elt := doc.DocumentElement()
+	if elt == nil {
+		return nil, fmt.Errorf("xml: %T marshals to no element", v)
+	}
+	elt.Detach()
+	return elt, nil
+}
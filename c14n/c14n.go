@@ -0,0 +1,482 @@
+/*
+Package c14n implements Canonical XML 1.0 and 1.1 and Exclusive XML Canonicalization over the xml
+package's Element tree.
+
+A Document is canonicalized in full. Any other element is treated as the apex of a document subset
+holding the element and its descendants, as selected by the XPath expression
+(.//. | .//@* | .//namespace::*), which is the form used by enveloped signatures.
+
+The tree is assumed to have been built by the xml package's decoder, so entity and character
+references are already expanded, CDATA sections are already text and line ends are already
+normalized. The decoder doesn't normalize white space in attribute values. Prefixes are recovered
+from the namespace declarations in scope, an element or attribute in a namespace that has no
+binding in scope is an error.
+*/
+package c14n
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+
+	dom "github.com/jphsd/xml"
+)
+
+const xmlURL = "http://www.w3.org/XML/1998/namespace"
+
+// Method is a canonicalization algorithm.
+type Method int
+
+// Supported methods.
+const (
+	C14N10    Method = iota // Canonical XML 1.0
+	C14N11                  // Canonical XML 1.1
+	Exclusive               // Exclusive XML Canonicalization 1.0
+)
+
+// Algorithm identifiers used in XML signatures.
+const (
+	C14N10URI    = "http://www.w3.org/TR/2001/REC-xml-c14n-20010315"
+	C14N11URI    = "http://www.w3.org/2006/12/xml-c14n11"
+	ExclusiveURI = "http://www.w3.org/2001/10/xml-exc-c14n#"
+)
+
+// Options controls the canonicalization.
+type Options struct {
+	Method       Method
+	WithComments bool     // Include comments in the output
+	Prefixes     []string // For Exclusive, the InclusiveNamespaces PrefixList, "#default" for the default namespace
+}
+
+// Canonicalize writes the canonical form of elt to w. If opts is nil then Canonical XML 1.0 without
+// comments is used.
+func Canonicalize(w io.Writer, elt *dom.Element, opts *Options) error {
+	if opts == nil {
+		opts = &Options{}
+	}
+	c := &canon{w: bufio.NewWriter(w), opts: opts}
+	if len(opts.Prefixes) > 0 {
+		c.inclusive = make(map[string]bool)
+		for _, p := range opts.Prefixes {
+			if p == "#default" {
+				p = ""
+			}
+			c.inclusive[p] = true
+		}
+	}
+
+	var err error
+	switch elt.Type {
+	case dom.Document:
+		err = c.document(elt)
+	case dom.Node:
+		err = c.element(elt, map[string]string{}, true)
+	default:
+		c.node(elt)
+	}
+	if err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+// Bytes returns the canonical form of elt.
+func Bytes(elt *dom.Element, opts *Options) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := Canonicalize(&buf, elt, opts); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type canon struct {
+	w         *bufio.Writer
+	opts      *Options
+	inclusive map[string]bool // Exclusive prefixes treated inclusively
+}
+
+func (c *canon) document(doc *dom.Element) error {
+	before := true
+	for _, child := range doc.Children {
+		switch child.Type {
+		case dom.Node:
+			if err := c.element(child, map[string]string{}, false); err != nil {
+				return err
+			}
+			before = false
+		case dom.Comment, dom.ProcInst:
+			if !c.output(child) {
+				continue
+			}
+			if !before {
+				c.w.WriteByte('\n')
+			}
+			c.node(child)
+			if before {
+				c.w.WriteByte('\n')
+			}
+		}
+	}
+	return nil
+}
+
+// output reports whether a comment or processing instruction is in the canonical form.
+func (c *canon) output(elt *dom.Element) bool {
+	switch elt.Type {
+	case dom.Comment:
+		return c.opts.WithComments
+	case dom.ProcInst:
+		// The XML declaration isn't a processing instruction in the data model
+		return elt.Name.Local != "xml"
+	}
+	return false
+}
+
+// node writes a text, comment or processing instruction node.
+func (c *canon) node(elt *dom.Element) {
+	switch elt.Type {
+	case dom.Content:
+		escape(c.w, string(elt.Content), false)
+	case dom.Comment:
+		if c.opts.WithComments {
+			c.w.WriteString("<!--")
+			c.w.Write(elt.Content)
+			c.w.WriteString("-->")
+		}
+	case dom.ProcInst:
+		if elt.Name.Local == "xml" {
+			return
+		}
+		c.w.WriteString("<?")
+		c.w.WriteString(elt.Name.Local)
+		if len(elt.Content) > 0 {
+			c.w.WriteByte(' ')
+			c.w.Write(elt.Content)
+		}
+		c.w.WriteString("?>")
+	}
+}
+
+// element writes elt and its content. The rendered map holds the namespace bindings output by the
+// nearest output ancestor, the default namespace under "". apex is set for the top of a document
+// subset, whose ancestors aren't output.
+func (c *canon) element(elt *dom.Element, rendered map[string]string, apex bool) error {
+	scope := elt.InScopeNamespaces()
+	prefix, err := elementPrefix(elt, scope)
+	if err != nil {
+		return err
+	}
+
+	// Namespace declarations to output, keyed by prefix
+	decls := make(map[string]string)
+	render := func(p string) {
+		uri := scope[p]
+		if rendered[p] != uri {
+			decls[p] = uri
+		}
+	}
+	if c.opts.Method == Exclusive {
+		render(prefix)
+		for _, attr := range elt.Attributes {
+			if dom.IsNamespaceDecl(attr.Name) || attr.Name.Space == "" {
+				continue
+			}
+			p, err := attrPrefix(attr.Name, scope)
+			if err != nil {
+				return err
+			}
+			if p != "xml" {
+				render(p)
+			}
+		}
+		for p := range c.inclusive {
+			if _, ok := scope[p]; ok || p == "" {
+				render(p)
+			}
+		}
+	} else {
+		for p := range scope {
+			render(p)
+		}
+		if _, ok := scope[""]; !ok {
+			render("")
+		}
+	}
+
+	// Attributes, with any inherited from the ancestors of an apex
+	var attrs []xml.Attr
+	for _, attr := range elt.Attributes {
+		if !dom.IsNamespaceDecl(attr.Name) {
+			attrs = append(attrs, attr)
+		}
+	}
+	if apex && c.opts.Method != Exclusive {
+		attrs = c.inherit(elt, attrs)
+	}
+	sort.SliceStable(attrs, func(i, j int) bool {
+		a, b := attrs[i].Name, attrs[j].Name
+		if a.Space != b.Space {
+			return a.Space < b.Space
+		}
+		return a.Local < b.Local
+	})
+
+	// Start tag
+	name := qname(prefix, elt.Name.Local)
+	c.w.WriteByte('<')
+	c.w.WriteString(name)
+	prefixes := make([]string, 0, len(decls))
+	for p := range decls {
+		prefixes = append(prefixes, p)
+	}
+	sort.Strings(prefixes)
+	for _, p := range prefixes {
+		c.w.WriteString(" xmlns")
+		if p != "" {
+			c.w.WriteByte(':')
+			c.w.WriteString(p)
+		}
+		c.w.WriteString(`="`)
+		escape(c.w, decls[p], true)
+		c.w.WriteByte('"')
+	}
+	for _, attr := range attrs {
+		p, err := attrPrefix(attr.Name, scope)
+		if err != nil {
+			return err
+		}
+		c.w.WriteByte(' ')
+		c.w.WriteString(qname(p, attr.Name.Local))
+		c.w.WriteString(`="`)
+		escape(c.w, attr.Value, true)
+		c.w.WriteByte('"')
+	}
+	c.w.WriteByte('>')
+
+	// Bindings seen by the children
+	if len(decls) > 0 {
+		next := make(map[string]string, len(rendered)+len(decls))
+		for p, uri := range rendered {
+			next[p] = uri
+		}
+		for p, uri := range decls {
+			next[p] = uri
+		}
+		rendered = next
+	}
+
+	for _, child := range elt.Children {
+		switch child.Type {
+		case dom.Node:
+			if err := c.element(child, rendered, false); err != nil {
+				return err
+			}
+		case dom.Content, dom.Comment, dom.ProcInst:
+			c.node(child)
+		}
+	}
+
+	c.w.WriteString("</")
+	c.w.WriteString(name)
+	c.w.WriteByte('>')
+	return nil
+}
+
+// inherit adds the xml namespace attributes of the apex's ancestors that the apex doesn't override.
+// Canonical XML 1.1 doesn't inherit xml:id and joins the values of xml:base.
+func (c *canon) inherit(elt *dom.Element, attrs []xml.Attr) []xml.Attr {
+	have := make(map[string]bool)
+	for _, attr := range attrs {
+		if attr.Name.Space == xmlURL {
+			have[attr.Name.Local] = true
+		}
+	}
+	var bases []string
+	if v, ok := elt.LookupAttrNS(xmlURL, "base"); ok {
+		bases = append(bases, v)
+	}
+	for p := elt.Parent; p != nil; p = p.Parent {
+		if p.Type != dom.Node {
+			continue
+		}
+		for _, attr := range p.Attributes {
+			if attr.Name.Space != xmlURL {
+				continue
+			}
+			local := attr.Name.Local
+			if c.opts.Method == C14N11 {
+				switch local {
+				case "id":
+					continue
+				case "base":
+					bases = append(bases, attr.Value)
+					continue
+				}
+			}
+			if !have[local] {
+				have[local] = true
+				attrs = append(attrs, attr)
+			}
+		}
+	}
+
+	if c.opts.Method == C14N11 && len(bases) > 0 {
+		// Resolve from the outermost inwards
+		base := bases[len(bases)-1]
+		for i := len(bases) - 2; i >= 0; i-- {
+			base = joinBase(base, bases[i])
+		}
+		attrs = setAttr(attrs, xml.Name{Space: xmlURL, Local: "base"}, base)
+	}
+	return attrs
+}
+
+// joinBase resolves ref against base.
+func joinBase(base, ref string) string {
+	b, err := url.Parse(base)
+	if err != nil {
+		return ref
+	}
+	r, err := url.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	return b.ResolveReference(r).String()
+}
+
+func setAttr(attrs []xml.Attr, name xml.Name, value string) []xml.Attr {
+	for i := range attrs {
+		if attrs[i].Name == name {
+			attrs[i].Value = value
+			return attrs
+		}
+	}
+	return append(attrs, xml.Attr{Name: name, Value: value})
+}
+
+// elementPrefix returns the prefix for the element's namespace, preferring the default namespace.
+func elementPrefix(elt *dom.Element, scope map[string]string) (string, error) {
+	if scope[""] == elt.Name.Space {
+		return "", nil
+	}
+	if elt.Name.Space == "" {
+		// The output will undeclare the default namespace
+		return "", nil
+	}
+	p, ok := findPrefix(elt.Name.Space, scope)
+	if !ok {
+		return "", fmt.Errorf("c14n: no prefix bound to namespace %s for element %s", elt.Name.Space, elt.Name.Local)
+	}
+	return p, nil
+}
+
+// attrPrefix returns the prefix for the attribute's namespace.
+func attrPrefix(name xml.Name, scope map[string]string) (string, error) {
+	switch name.Space {
+	case "":
+		return "", nil
+	case xmlURL:
+		return "xml", nil
+	}
+	p, ok := findPrefix(name.Space, scope)
+	if !ok {
+		return "", fmt.Errorf("c14n: no prefix bound to namespace %s for attribute %s", name.Space, name.Local)
+	}
+	return p, nil
+}
+
+// findPrefix returns the lowest non-empty prefix bound to uri so the choice is repeatable.
+func findPrefix(uri string, scope map[string]string) (string, bool) {
+	found := ""
+	for p, u := range scope {
+		if p != "" && u == uri && (found == "" || p < found) {
+			found = p
+		}
+	}
+	return found, found != ""
+}
+
+func qname(prefix, local string) string {
+	if prefix == "" {
+		return local
+	}
+	return prefix + ":" + local
+}
+
+// escape writes s with the replacements required for text or attribute values.
+func escape(w *bufio.Writer, s string, attr bool) {
+	last := 0
+	for i := 0; i < len(s); i++ {
+		var esc string
+		switch s[i] {
+		case '&':
+			esc = "&amp;"
+		case '<':
+			esc = "&lt;"
+		case '>':
+			if attr {
+				continue
+			}
+			esc = "&gt;"
+		case '"':
+			if !attr {
+				continue
+			}
+			esc = "&quot;"
+		case '\t':
+			if !attr {
+				continue
+			}
+			esc = "&#x9;"
+		case '\n':
+			if !attr {
+				continue
+			}
+			esc = "&#xA;"
+		case '\r':
+			esc = "&#xD;"
+		default:
+			continue
+		}
+		w.WriteString(s[last:i])
+		w.WriteString(esc)
+		last = i + 1
+	}
+	w.WriteString(s[last:])
+}
+
+// String returns the algorithm identifier of the method.
+func (m Method) String() string {
+	switch m {
+	case C14N10:
+		return C14N10URI
+	case C14N11:
+		return C14N11URI
+	case Exclusive:
+		return ExclusiveURI
+	}
+	return fmt.Sprintf("Method(%d)", int(m))
+}
+
+// ParseMethod returns the method for an algorithm identifier and whether it includes comments.
+func ParseMethod(uri string) (Method, bool, error) {
+	switch uri {
+	case C14N10URI:
+		return C14N10, false, nil
+	case C14N10URI + "#WithComments":
+		return C14N10, true, nil
+	case C14N11URI:
+		return C14N11, false, nil
+	case C14N11URI + "#WithComments":
+		return C14N11, true, nil
+	case ExclusiveURI:
+		return Exclusive, false, nil
+	case ExclusiveURI + "WithComments":
+		return Exclusive, true, nil
+	}
+	return 0, false, fmt.Errorf("c14n: unknown algorithm %s", uri)
+}
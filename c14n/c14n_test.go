@@ -0,0 +1,204 @@
+package c14n
+
+import (
+	"strings"
+	"testing"
+
+	dom "github.com/jphsd/xml"
+)
+
+// The examples of section 3 of Canonical XML 1.0.
+const (
+	pis = `<?xml version="1.0"?>
+
+<?xml-stylesheet   href="doc.xsl"
+   type="text/xsl"   ?>
+
+<!DOCTYPE doc SYSTEM "doc.dtd">
+
+<doc>Hello, world!<!-- Comment 1 --></doc>
+
+<?pi-without-data     ?>
+
+<!-- Comment 2 -->
+
+<!-- Comment 3 -->`
+
+	whitespace = `<doc>
+   <clean>   </clean>
+   <dirty>   A   B   </dirty>
+   <mixed>
+      A
+      <clean>   </clean>
+      B
+      <dirty>   A   B   </dirty>
+      C
+   </mixed>
+</doc>`
+
+	tags = `<!DOCTYPE doc [<!ATTLIST e9 attr CDATA "default">]>
+<doc>
+   <e1   />
+   <e2   ></e2>
+   <e3   name = "elem3"   id="elem3"   />
+   <e4   name="elem4"   id="elem4"   ></e4>
+   <e5 a:attr="out" b:attr="sorted" attr2="all" attr="I'm"
+      xmlns:b="http://www.ietf.org"
+      xmlns:a="http://www.w3.org"
+      xmlns="http://example.org"/>
+   <e6 xmlns="" xmlns:a="http://www.w3.org">
+      <e7 xmlns="http://www.ietf.org">
+         <e8 xmlns="" xmlns:a="http://www.w3.org">
+            <e9 xmlns="" xmlns:a="http://www.ietf.org"/>
+         </e8>
+      </e7>
+   </e6>
+</doc>`
+
+	chars = `<!DOCTYPE doc [
+<!ATTLIST normId id ID #IMPLIED>
+<!ATTLIST normNames attr NMTOKENS #IMPLIED>
+]>
+<doc>
+   <text>First line&#x0d;&#10;Second line</text>
+   <value>&#x32;</value>
+   <compute><![CDATA[value>"0" && value<"10" ?"valid":"error"]]></compute>
+   <compute expr='value>"0" &amp;&amp; value&lt;"10" ?"valid":"error"'>valid</compute>
+   <norm attr=' &apos;   &#x20;&#13;&#xa;&#9;   &apos; '/>
+   <normNames attr='   A   &#x20;&#13;&#xa;&#9;   B   '/>
+   <normId id=' &apos;   &#x20;&#13;&#xa;&#9;   &apos; '/>
+</doc>`
+
+	// External entities aren't read, so ent2 is internal here
+	entities = `<!DOCTYPE doc [
+<!ATTLIST doc attrExtEnt ENTITY #IMPLIED>
+<!ENTITY ent1 "Hello">
+<!ENTITY ent2 "world">
+<!ENTITY entExt SYSTEM "earth.gif" NDATA gif>
+<!NOTATION gif SYSTEM "viewgif.exe">
+]>
+<doc attrExtEnt="entExt">
+   &ent1;, &ent2;!
+</doc>
+
+<!-- Let world.txt contain "world" (excluding the quotes) -->`
+
+	encoding = `<?xml version="1.0" encoding="ISO-8859-1"?>
+<doc>&#169;` + "\xa9" + `</doc>`
+
+	subset = `<!DOCTYPE doc [
+<!ATTLIST e2 xml:space (default|preserve) 'preserve'>
+<!ATTLIST e3 id ID #IMPLIED>
+]>
+<doc xmlns="http://www.ietf.org" xmlns:w3c="http://www.w3.org">
+   <e1>
+      <e2 xmlns="">
+         <e3 id="E3"/>
+      </e2>
+   </e1>
+</doc>`
+
+	// The example of section 2.2 of Exclusive XML Canonicalization
+	exclusive = `<n0:local xmlns:n0="foo:bar" xmlns:n3="ftp://example.org">
+  <n1:elem2 xmlns:n1="http://example.net" xml:lang="en">
+    <n3:stuff xmlns:n3="ftp://example.org"/>
+  </n1:elem2>
+</n0:local>`
+
+	base = `<a xml:base="http://www.example.org/dir/" xml:lang="en"><b xml:base="sub/"><c/></b></a>`
+)
+
+var tests = []struct {
+	name  string
+	doc   string
+	apex  string // Selector for the apex of the subset, or empty for the whole document
+	opts  *Options
+	canon string
+}{
+	{"3.1", pis, "", nil, `<?xml-stylesheet href="doc.xsl"
+   type="text/xsl"   ?>
+<doc>Hello, world!</doc>
+<?pi-without-data?>`},
+	{"3.1 with comments", pis, "", &Options{WithComments: true}, `<?xml-stylesheet href="doc.xsl"
+   type="text/xsl"   ?>
+<doc>Hello, world!<!-- Comment 1 --></doc>
+<?pi-without-data?>
+<!-- Comment 2 -->
+<!-- Comment 3 -->`},
+	{"3.2", whitespace, "", nil, whitespace},
+	{"3.3", tags, "", nil, `<doc>
+   <e1></e1>
+   <e2></e2>
+   <e3 id="elem3" name="elem3"></e3>
+   <e4 id="elem4" name="elem4"></e4>
+   <e5 xmlns="http://example.org" xmlns:a="http://www.w3.org" xmlns:b="http://www.ietf.org" attr="I'm" attr2="all" b:attr="sorted" a:attr="out"></e5>
+   <e6 xmlns:a="http://www.w3.org">
+      <e7 xmlns="http://www.ietf.org">
+         <e8 xmlns="">
+            <e9 xmlns:a="http://www.ietf.org" attr="default"></e9>
+         </e8>
+      </e7>
+   </e6>
+</doc>`},
+	{"3.4", chars, "", nil, `<doc>
+   <text>First line&#xD;
+Second line</text>
+   <value>2</value>
+   <compute>value&gt;"0" &amp;&amp; value&lt;"10" ?"valid":"error"</compute>
+   <compute expr="value>&quot;0&quot; &amp;&amp; value&lt;&quot;10&quot; ?&quot;valid&quot;:&quot;error&quot;">valid</compute>
+   <norm attr=" '    &#xD;&#xA;&#x9;   ' "></norm>
+   <normNames attr="A &#xD;&#xA;&#x9; B"></normNames>
+   <normId id="' &#xD;&#xA;&#x9; '"></normId>
+</doc>`},
+	{"3.5", entities, "", nil, `<doc attrExtEnt="entExt">
+   Hello, world!
+</doc>`},
+	{"3.6", encoding, "", nil, `<doc>©©</doc>`},
+	// Section 3.7 selects its subset with an XPath expression, so subsets with an apex are used instead
+	{"3.7 e1", subset, "e1", nil, `<e1 xmlns="http://www.ietf.org" xmlns:w3c="http://www.w3.org">
+      <e2 xmlns="" xml:space="preserve">
+         <e3 id="E3"></e3>
+      </e2>
+   </e1>`},
+	{"3.7 e2", subset, "e2", nil, `<e2 xmlns:w3c="http://www.w3.org" xml:space="preserve">
+         <e3 id="E3"></e3>
+      </e2>`},
+	{"3.7 e2 exclusive", subset, "e2", &Options{Method: Exclusive}, `<e2 xml:space="preserve">
+         <e3 id="E3"></e3>
+      </e2>`},
+	{"inclusive", exclusive, "elem2", nil, `<n1:elem2 xmlns:n0="foo:bar" xmlns:n1="http://example.net" xmlns:n3="ftp://example.org" xml:lang="en">
+    <n3:stuff></n3:stuff>
+  </n1:elem2>`},
+	{"exclusive", exclusive, "elem2", &Options{Method: Exclusive}, `<n1:elem2 xmlns:n1="http://example.net" xml:lang="en">
+    <n3:stuff xmlns:n3="ftp://example.org"></n3:stuff>
+  </n1:elem2>`},
+	{"exclusive prefixes", exclusive, "elem2", &Options{Method: Exclusive, Prefixes: []string{"n0"}}, `<n1:elem2 xmlns:n0="foo:bar" xmlns:n1="http://example.net" xml:lang="en">
+    <n3:stuff xmlns:n3="ftp://example.org"></n3:stuff>
+  </n1:elem2>`},
+	{"xml attributes", base, "c", nil, `<c xml:base="sub/" xml:lang="en"></c>`},
+	{"xml attributes 1.1", base, "c", &Options{Method: C14N11}, `<c xml:base="http://www.example.org/dir/sub/" xml:lang="en"></c>`},
+}
+
+func TestCanonicalize(t *testing.T) {
+	for _, test := range tests {
+		elt, err := dom.NewXMLDecoder(strings.NewReader(test.doc)).BuildDocument()
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if test.apex != "" {
+			if elt, err = elt.QuerySelector(test.apex); elt == nil {
+				t.Errorf("%s: no element %s: %v", test.name, test.apex, err)
+				continue
+			}
+		}
+		canon, err := Bytes(elt, test.opts)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if string(canon) != test.canon {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, canon, test.canon)
+		}
+	}
+}
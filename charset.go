@@ -0,0 +1,146 @@
+package xml
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// CharsetReader returns a reader that converts input from the named character encoding to UTF-8. It's
+// used by the decoders created by NewXMLDecoder for the encoding given in the XML declaration. Names are
+// those of the IANA character set registry, such as ISO-8859-1, windows-1252, UTF-16 or Shift_JIS, and
+// are matched without regard to case.
+func CharsetReader(charset string, input io.Reader) (io.Reader, error) {
+	enc, err := lookupCharset(charset)
+	if err != nil {
+		return nil, err
+	}
+	return transform.NewReader(input, enc.NewDecoder()), nil
+}
+
+// CharsetWriter returns a writer that converts UTF-8 to the named character encoding. Characters that
+// the encoding can't represent are an error, since they can only be written as character references in
+// text and attribute values, as Encode and XMLEncoder write them. Close must be called to flush the
+// output, it doesn't close w.
+func CharsetWriter(charset string, w io.Writer) (io.WriteCloser, error) {
+	enc, err := lookupCharset(charset)
+	if err != nil {
+		return nil, err
+	}
+	return transform.NewWriter(w, enc.NewEncoder()), nil
+}
+
+// CharsetEncodable returns a function that reports whether the named character encoding can represent
+// a character, so that a writer can use character references for those it can't.
+func CharsetEncodable(charset string) (func(rune) bool, error) {
+	enc, err := lookupCharset(charset)
+	if err != nil {
+		return nil, err
+	}
+	t := enc.NewEncoder()
+	var src [utf8.UTFMax]byte
+	var dst [16]byte
+	return func(r rune) bool {
+		t.Reset()
+		_, _, err := t.Transform(dst[:], src[:utf8.EncodeRune(src[:], r)], true)
+		return err == nil
+	}, nil
+}
+
+func lookupCharset(charset string) (encoding.Encoding, error) {
+	enc, err := ianaindex.IANA.Encoding(charset)
+	if err != nil || enc == nil {
+		return nil, fmt.Errorf("xml: unsupported encoding %q", charset)
+	}
+	return enc, nil
+}
+
+// isUTF8 reports whether the encoding name is empty or UTF-8.
+func isUTF8(charset string) bool {
+	return charset == "" || strings.EqualFold(charset, "utf-8") || strings.EqualFold(charset, "utf8")
+}
+
+// sniffReader detects UTF-16 input, from its byte order mark or the start of an XML declaration, and
+// converts it to UTF-8. A UTF-8 byte order mark is removed. The input is examined on the first Read, so
+// that creating a decoder doesn't read from it.
+type sniffReader struct {
+	r        io.Reader
+	started  bool
+	detected bool // The encoding was found from the input, overriding that declared
+}
+
+func (s *sniffReader) Read(p []byte) (int, error) {
+	if !s.started {
+		s.started = true
+		br := bufio.NewReader(s.r)
+		s.r = br
+		head, _ := br.Peek(4)
+		var enc encoding.Encoding
+		switch {
+		case bytes.HasPrefix(head, []byte{0xef, 0xbb, 0xbf}):
+			br.Discard(3)
+			s.detected = true
+		case bytes.HasPrefix(head, []byte{0xfe, 0xff}), bytes.HasPrefix(head, []byte{0xff, 0xfe}):
+			enc = unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM)
+		case bytes.Equal(head, []byte{0, '<', 0, '?'}):
+			enc = unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM)
+		case bytes.Equal(head, []byte{'<', 0, '?', 0}):
+			enc = unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)
+		}
+		if enc != nil {
+			s.r = transform.NewReader(br, enc.NewDecoder())
+			s.detected = true
+		}
+	}
+	return s.r.Read(p)
+}
+
+// charsetReader is the CharsetReader of the underlying decoder. Input whose encoding has been detected
+// is already UTF-8.
+func (s *sniffReader) charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	if s.detected {
+		return input, nil
+	}
+	return CharsetReader(charset, input)
+}
+
+// setEncoding returns the pseudo-attributes of an XML declaration with the encoding replaced by, or set
+// to, charset.
+func setEncoding(inst []byte, charset string) []byte {
+	s := string(inst)
+	decl := `encoding="` + charset + `"`
+	if _, i, j, ok := pseudoAttr(s, "encoding"); ok {
+		return []byte(s[:i] + decl + s[j:])
+	}
+	if _, _, j, ok := pseudoAttr(s, "version"); ok {
+		return []byte(s[:j] + " " + decl + s[j:])
+	}
+	return []byte(decl + " " + s)
+}
+
+// pseudoAttr returns the value of the named pseudo-attribute in s and the extent of the whole
+// pseudo-attribute, including the quoted value.
+func pseudoAttr(s, name string) (string, int, int, bool) {
+	i := strings.Index(s, name)
+	if i < 0 {
+		return "", 0, 0, false
+	}
+	k := strings.IndexAny(s[i:], `"'`)
+	if k < 0 {
+		return "", 0, 0, false
+	}
+	k += i
+	end := strings.IndexByte(s[k+1:], s[k])
+	if end < 0 {
+		return "", 0, 0, false
+	}
+	return s[k+1 : k+1+end], i, k + 1 + end + 1, true
+}
@@ -0,0 +1,59 @@
+//go:build ignore
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"github.com/jphsd/xml"
+	"os"
+	"strings"
+)
+
+// Convert between XML and JSON
+func main() {
+	toXML := flag.Bool("r", false, "convert JSON to XML")
+	badger := flag.Bool("b", false, "use the BadgerFish convention")
+	indent := flag.String("i", "  ", "indentation, empty for compact output")
+	arrays := flag.String("a", "", "comma separated element names always written as arrays")
+	flag.Parse()
+	args := flag.Args()
+	fn := "/dev/stdin"
+	if len(args) > 0 {
+		fn = args[0]
+	}
+
+	f, err := os.Open(fn)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+
+	opts := &xml.JSONOptions{BadgerFish: *badger, Indent: *indent}
+	if *arrays != "" {
+		opts.Arrays = strings.Split(*arrays, ",")
+	}
+
+	if *toXML {
+		elt, err := xml.DecodeJSON(bufio.NewReader(f), opts)
+		if err != nil {
+			panic(err)
+		}
+		err = elt.Encode(os.Stdout, &xml.EncodeOptions{Indent: *indent, Declaration: true})
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	decoder := xml.NewXMLDecoder(bufio.NewReader(f))
+
+	dom, err := decoder.BuildDOM()
+	if err != nil {
+		panic(err)
+	}
+
+	if err := dom.EncodeJSON(os.Stdout, opts); err != nil {
+		panic(err)
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"fmt"
 	"github.com/jphsd/xml"
 	"os"
-	"strings"
 )
 
 // Read in an XML file
@@ -27,32 +26,37 @@ func main() {
 	defer f.Close()
 
 	decoder := xml.NewXMLDecoder(bufio.NewReader(f))
+	decoder.Whitespace = xml.Whitespace{Merge: true, Normalize: []string{"*"}}
 
-	dom, err := decoder.BuildDOM()
+	dom, err := decoder.BuildDocument()
 	if err != nil {
 		panic(err)
 	}
 
-	dump(dom, 0)
+	for _, c := range dom.Children {
+		dump(c, 0)
+	}
 }
 
 func dump(dom *xml.Element, indent int) {
 	switch dom.Type {
 	case xml.Node:
 		res := makeInd(indent) + dom.Name.Local + ": "
-		for k, v := range dom.Attributes {
-			res += k + "=" + v + " "
+		for _, attr := range dom.Attributes {
+			res += attr.Name.Local + "=" + attr.Value + " "
 		}
 		fmt.Println(res)
 		for _, c := range dom.Children {
 			dump(c, indent+1)
 		}
 	case xml.Content:
-		txt := strings.Trim(string(dom.Content), " \t\n")
-		if len(txt) != 0 {
-			res := makeInd(indent) + txt
-			fmt.Println(res)
-		}
+		fmt.Println(makeInd(indent) + string(dom.Content))
+	case xml.Comment:
+		fmt.Println(makeInd(indent) + "<!--" + string(dom.Content) + "-->")
+	case xml.ProcInst:
+		fmt.Println(makeInd(indent) + "<?" + dom.Name.Local + " " + string(dom.Content) + "?>")
+	case xml.Directive:
+		fmt.Println(makeInd(indent) + "<!" + string(dom.Content) + ">")
 	}
 }
 
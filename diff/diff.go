@@ -0,0 +1,448 @@
+/*
+Package diff computes structural differences between two xml package Element trees as an edit script
+that can be applied to the first tree to produce the second, and reads and writes edit scripts in the
+XML patch format of RFC 5261.
+
+Nodes are addressed with XPath location paths that count positions by node kind, such as
+/*[1]/*[3]/text()[1]. Each path is relative to the tree as it is when the operation is applied.
+Directives and the XML declaration aren't compared.
+*/
+package diff
+
+import (
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+
+	dom "github.com/jphsd/xml"
+)
+
+const xmlURL = "http://www.w3.org/XML/1998/namespace"
+
+// Options controls which differences are significant.
+type Options struct {
+	IgnoreWhitespace bool // Ignore text consisting only of white space and compare other text with white space normalized
+	IgnoreAttrOrder  bool // Compare attributes as sets rather than sequences
+}
+
+// differ holds the state for a single Diff.
+type differ struct {
+	opts   *Options
+	hashes map[*dom.Element]uint64
+	match  map[*dom.Element]*dom.Element // Matched nodes in both directions
+	moves  map[*dom.Element]*dom.Element // Inserted node to the deleted node it's moved from
+	moved  map[*dom.Element]bool         // Deleted nodes that are moved
+	ops    []Op
+	ns     map[string]string // Prefixes for attribute namespaces
+}
+
+// Diff returns the edit script that transforms a into b. Both must be Documents, or both elements.
+// Neither tree is modified.
+func Diff(a, b *dom.Element, opts *Options) (*Patch, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if (a.Type == dom.Document) != (b.Type == dom.Document) || (a.Type != dom.Document && (a.Type != dom.Node || b.Type != dom.Node)) {
+		return nil, fmt.Errorf("diff: trees must both be Documents or elements")
+	}
+	d := &differ{
+		opts:   opts,
+		hashes: make(map[*dom.Element]uint64),
+		match:  make(map[*dom.Element]*dom.Element),
+		moves:  make(map[*dom.Element]*dom.Element),
+		moved:  make(map[*dom.Element]bool),
+	}
+
+	// The script is built by editing a copy of a
+	work := a.Copy()
+	if work.Type == dom.Node && work.Name != b.Name {
+		d.ops = append(d.ops, Op{Type: Replace, Sel: "/*[1]", Nodes: []*dom.Element{b.Copy()}})
+		return d.patch(), nil
+	}
+	d.pair(work, b)
+	d.findMoves(work, b)
+	d.edit(work, b)
+	return d.patch(), nil
+}
+
+func (d *differ) patch() *Patch {
+	p := &Patch{Ops: d.ops, Namespaces: make(map[string]string)}
+	for uri, prefix := range d.ns {
+		p.Namespaces[prefix] = uri
+	}
+	return p
+}
+
+// children returns the compared children of elt.
+func (d *differ) children(elt *dom.Element) []*dom.Element {
+	var res []*dom.Element
+	for _, c := range elt.Children {
+		switch {
+		case c.Type == dom.Directive, c.Type == dom.ProcInst && c.Name.Local == "xml":
+			continue
+		case c.Type == dom.Content && elt.Type == dom.Document:
+			continue
+		case c.Type == dom.Content && d.opts.IgnoreWhitespace && strings.TrimSpace(string(c.Content)) == "":
+			continue
+		}
+		res = append(res, c)
+	}
+	return res
+}
+
+// text returns the content of a text node as compared.
+func (d *differ) text(elt *dom.Element) string {
+	if d.opts.IgnoreWhitespace {
+		return strings.Join(strings.Fields(string(elt.Content)), " ")
+	}
+	return string(elt.Content)
+}
+
+// hash returns a hash of the subtree at elt, equal for subtrees that are the same under the options.
+func (d *differ) hash(elt *dom.Element) uint64 {
+	if h, ok := d.hashes[elt]; ok {
+		return h
+	}
+	h := fnv.New64a()
+	h.Write([]byte{byte(elt.Type)})
+	h.Write([]byte(elt.Name.Space + "\x00" + elt.Name.Local + "\x00"))
+	switch elt.Type {
+	case dom.Content:
+		h.Write([]byte(d.text(elt)))
+	case dom.Comment, dom.ProcInst, dom.Directive:
+		h.Write(elt.Content)
+	case dom.Node:
+		attrs := elt.Attributes
+		if d.opts.IgnoreAttrOrder {
+			attrs = sortedAttrs(attrs)
+		}
+		for _, attr := range attrs {
+			h.Write([]byte(attr.Name.Space + "\x00" + attr.Name.Local + "\x00" + attr.Value + "\x00"))
+		}
+	}
+	var buf [8]byte
+	for _, c := range d.children(elt) {
+		binary.LittleEndian.PutUint64(buf[:], d.hash(c))
+		h.Write(buf[:])
+	}
+	sum := h.Sum64()
+	d.hashes[elt] = sum
+	return sum
+}
+
+func sortedAttrs(attrs []xml.Attr) []xml.Attr {
+	res := make([]xml.Attr, len(attrs))
+	copy(res, attrs)
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Name.Space != res[j].Name.Space {
+			return res[i].Name.Space < res[j].Name.Space
+		}
+		return res[i].Name.Local < res[j].Name.Local
+	})
+	return res
+}
+
+// similar reports whether two nodes can be matched, being of the same kind and name.
+func similar(a, b *dom.Element) bool {
+	return a.Type == b.Type && a.Name == b.Name
+}
+
+// pair matches the children of a and b and recurses into matched elements. As many similar nodes
+// as possible are matched, preferring identical subtrees.
+func (d *differ) pair(a, b *dom.Element) {
+	d.match[a], d.match[b] = b, a
+	ac, bc := d.children(a), d.children(b)
+	// The weight of a match dominates any number of identical ones
+	big := len(ac) + len(bc) + 1
+	weight := func(x, y *dom.Element) int {
+		switch {
+		case !similar(x, y):
+			return 0
+		case d.hash(x) == d.hash(y):
+			return big + 1
+		}
+		return big
+	}
+	for _, p := range lcs(ac, bc, weight) {
+		x, y := ac[p[0]], bc[p[1]]
+		if x.Type == dom.Node {
+			d.pair(x, y)
+		} else {
+			d.match[x], d.match[y] = y, x
+		}
+	}
+}
+
+// lcs returns the index pairs of a common subsequence of a and b with the greatest total weight.
+func lcs(a, b []*dom.Element, weight func(x, y *dom.Element) int) [][2]int {
+	n, m := len(a), len(b)
+	if n == 0 || m == 0 {
+		return nil
+	}
+	// l[i][j] is the greatest weight for a[i:] and b[j:]
+	l := make([][]int, n+1)
+	for i := range l {
+		l[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			l[i][j] = max(l[i+1][j], l[i][j+1])
+			if w := weight(a[i], b[j]); w > 0 {
+				l[i][j] = max(l[i][j], l[i+1][j+1]+w)
+			}
+		}
+	}
+	var res [][2]int
+	for i, j := 0, 0; i < n && j < m; {
+		w := weight(a[i], b[j])
+		switch {
+		case w > 0 && l[i][j] == l[i+1][j+1]+w:
+			res = append(res, [2]int{i, j})
+			i++
+			j++
+		case l[i][j] == l[i+1][j]:
+			i++
+		default:
+			j++
+		}
+	}
+	return res
+}
+
+// findMoves pairs unmatched subtrees of a with identical unmatched subtrees of b.
+func (d *differ) findMoves(a, b *dom.Element) {
+	deleted := make(map[uint64][]*dom.Element)
+	var walkA func(elt *dom.Element)
+	walkA = func(elt *dom.Element) {
+		for _, c := range d.children(elt) {
+			if _, ok := d.match[c]; !ok {
+				h := d.hash(c)
+				deleted[h] = append(deleted[h], c)
+			} else if c.Type == dom.Node {
+				walkA(c)
+			}
+		}
+	}
+	walkA(a)
+
+	var walkB func(elt *dom.Element)
+	walkB = func(elt *dom.Element) {
+		for _, c := range d.children(elt) {
+			if _, ok := d.match[c]; ok {
+				if c.Type == dom.Node {
+					walkB(c)
+				}
+				continue
+			}
+			h := d.hash(c)
+			if cands := deleted[h]; len(cands) > 0 && !isWhitespace(c) {
+				d.moves[c] = cands[0]
+				d.moved[cands[0]] = true
+				deleted[h] = cands[1:]
+			}
+		}
+	}
+	walkB(b)
+}
+
+func isWhitespace(elt *dom.Element) bool {
+	return elt.Type == dom.Content && strings.TrimSpace(string(elt.Content)) == ""
+}
+
+// edit emits the operations that transform w, in the working tree, into its match b.
+func (d *differ) edit(w, b *dom.Element) {
+	if w.Type == dom.Node {
+		d.editAttrs(w, b)
+	}
+
+	// Delete unmatched children, last first so earlier paths are unaffected
+	wc := d.children(w)
+	for i := len(wc) - 1; i >= 0; i-- {
+		c := wc[i]
+		if _, ok := d.match[c]; ok || d.moved[c] {
+			continue
+		}
+		d.ops = append(d.ops, Op{Type: Delete, Sel: path(c)})
+		c.Detach()
+	}
+
+	// Insert or move in the missing children after their preceding sibling
+	var prev *dom.Element
+	for _, c := range d.children(b) {
+		x, ok := d.match[c]
+		if ok {
+			prev = x
+			continue
+		}
+		sel, pos := path(w), Prepend
+		if prev != nil {
+			sel, pos = path(prev), After
+		}
+		if src, ok := d.moves[c]; ok {
+			from := path(src)
+			src.Detach()
+			if prev != nil {
+				// Detaching can shift the position of prev
+				sel = path(prev)
+			} else {
+				sel = path(w)
+			}
+			d.ops = append(d.ops, Op{Type: Move, Sel: sel, Pos: pos, From: from, Nodes: []*dom.Element{src.Copy()}})
+			insertAfter(w, prev, src)
+			prev = src
+			continue
+		}
+		n := c.Copy()
+		d.ops = append(d.ops, Op{Type: Insert, Sel: sel, Pos: pos, Nodes: []*dom.Element{c.Copy()}})
+		insertAfter(w, prev, n)
+		prev = n
+	}
+
+	// Then recurse into matched children
+	for _, c := range d.children(b) {
+		x, ok := d.match[c]
+		if !ok {
+			continue
+		}
+		switch c.Type {
+		case dom.Node:
+			d.edit(x, c)
+		case dom.Content:
+			if d.text(x) != d.text(c) {
+				d.ops = append(d.ops, Op{Type: SetText, Sel: path(x), Value: string(c.Content)})
+				x.Content = c.Content
+			}
+		default:
+			if string(x.Content) != string(c.Content) {
+				n := c.Copy()
+				d.ops = append(d.ops, Op{Type: Replace, Sel: path(x), Nodes: []*dom.Element{c.Copy()}})
+				w.ReplaceChild(n, x)
+			}
+		}
+	}
+}
+
+// insertAfter adds n to w after prev, or as the first child if prev is nil.
+func insertAfter(w, prev, n *dom.Element) {
+	var ref *dom.Element
+	if prev == nil {
+		if len(w.Children) > 0 {
+			ref = w.Children[0]
+		}
+	} else {
+		ref = nextSibling(prev)
+	}
+	w.InsertBefore(n, ref)
+}
+
+// editAttrs emits the operations that transform the attributes of w into those of b.
+func (d *differ) editAttrs(w, b *dom.Element) {
+	sel := ""
+	emit := func(op Op) {
+		if sel == "" {
+			sel = path(w)
+		}
+		op.Sel = sel
+		if op.Name.Space != "" && op.Name.Space != "xmlns" && op.Name.Space != xmlURL {
+			d.prefix(op.Name.Space)
+		}
+		d.ops = append(d.ops, op)
+	}
+
+	for _, attr := range append([]xml.Attr(nil), w.Attributes...) {
+		if _, ok := b.LookupAttrNS(attr.Name.Space, attr.Name.Local); !ok {
+			emit(Op{Type: RemoveAttr, Name: attr.Name})
+			w.RemoveAttrNS(attr.Name.Space, attr.Name.Local)
+		}
+	}
+
+	// Attributes from the first out of order one are removed and added in order
+	k := len(b.Attributes)
+	if !d.opts.IgnoreAttrOrder {
+		for i, attr := range b.Attributes {
+			if i >= len(w.Attributes) || w.Attributes[i].Name != attr.Name {
+				k = i
+				break
+			}
+		}
+		for i := len(w.Attributes) - 1; i >= k; i-- {
+			name := w.Attributes[i].Name
+			emit(Op{Type: RemoveAttr, Name: name})
+			w.RemoveAttrNS(name.Space, name.Local)
+		}
+	}
+
+	for _, attr := range b.Attributes {
+		v, ok := w.LookupAttrNS(attr.Name.Space, attr.Name.Local)
+		switch {
+		case !ok:
+			emit(Op{Type: AddAttr, Name: attr.Name, Value: attr.Value})
+		case v != attr.Value:
+			emit(Op{Type: SetAttr, Name: attr.Name, Value: attr.Value})
+		default:
+			continue
+		}
+		w.SetAttrNS(attr.Name.Space, attr.Name.Local, attr.Value)
+	}
+}
+
+// prefix returns the prefix used in selectors for a namespace.
+func (d *differ) prefix(uri string) string {
+	if d.ns == nil {
+		d.ns = make(map[string]string)
+	}
+	p, ok := d.ns[uri]
+	if !ok {
+		p = "ns" + strconv.Itoa(len(d.ns)+1)
+		d.ns[uri] = p
+	}
+	return p
+}
+
+// path returns the location path of elt in its current tree.
+func path(elt *dom.Element) string {
+	if elt.Parent == nil {
+		if elt.Type == dom.Document {
+			return "/"
+		}
+		return "/*[1]"
+	}
+	var step string
+	n := 1
+	for _, c := range elt.Parent.Children {
+		if c == elt {
+			break
+		}
+		if sameKind(c, elt) {
+			n++
+		}
+	}
+	switch elt.Type {
+	case dom.Node:
+		step = "*"
+	case dom.Content:
+		step = "text()"
+	case dom.Comment:
+		step = "comment()"
+	default:
+		step = "processing-instruction()"
+	}
+	step += "[" + strconv.Itoa(n) + "]"
+	if elt.Parent.Type == dom.Document {
+		return "/" + step
+	}
+	return path(elt.Parent) + "/" + step
+}
+
+// sameKind reports whether c is counted with elt in a location step.
+func sameKind(c, elt *dom.Element) bool {
+	if c.Type != elt.Type {
+		return false
+	}
+	// The XML declaration isn't a processing instruction in the data model
+	return c.Type != dom.ProcInst || c.Name.Local != "xml"
+}
@@ -0,0 +1,448 @@
+package diff
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+
+	dom "github.com/jphsd/xml"
+	"github.com/jphsd/xml/xpath"
+)
+
+// OpType is the kind of an edit operation.
+type OpType int
+
+// Edit operations. Sel is an XPath expression that must select a single node when the operation is
+// applied, after all the preceding operations.
+const (
+	Insert     OpType = iota // Insert Nodes relative to the node selected by Sel, as directed by Pos
+	Delete                   // Delete the node selected by Sel
+	Move                     // Move the node selected by From relative to the node selected by Sel, as directed by Pos
+	Replace                  // Replace the node selected by Sel with Nodes[0]
+	AddAttr                  // Add attribute Name, with Value, to the element selected by Sel
+	SetAttr                  // Change the value of attribute Name of the element selected by Sel to Value
+	RemoveAttr               // Remove attribute Name from the element selected by Sel
+	SetText                  // Change the text node selected by Sel to Value
+)
+
+// Pos is where nodes are inserted relative to the selected node.
+type Pos int
+
+// Insert positions.
+const (
+	Append  Pos = iota // As the last children
+	Prepend            // As the first children
+	Before             // As the preceding siblings
+	After              // As the following siblings
+)
+
+// Op is a single edit operation.
+type Op struct {
+	Type  OpType
+	Sel   string
+	Pos   Pos
+	From  string         // Node to move, selected before it's detached and Sel is evaluated
+	Nodes []*dom.Element // Nodes to insert or the replacement, for Move a copy of the moved node
+	Name  xml.Name       // Attribute name
+	Value string         // Attribute value or text
+}
+
+// Patch is an edit script along with the namespace bindings for the prefixes used in its selectors.
+type Patch struct {
+	Ops        []Op
+	Namespaces map[string]string // Prefix to namespace URI
+}
+
+// Apply performs the operations in order on the tree containing root. The root of the edited tree is
+// returned, which differs from root only if root is an element without a Document that is replaced.
+// Inserted nodes are copies, so the patch can be applied to any number of trees.
+func (p *Patch) Apply(root *dom.Element) (*dom.Element, error) {
+	for i, op := range p.Ops {
+		var err error
+		root, err = p.apply(root, &op)
+		if err != nil {
+			return nil, fmt.Errorf("diff: operation %d: %v", i+1, err)
+		}
+	}
+	return root, nil
+}
+
+func (p *Patch) apply(root *dom.Element, op *Op) (*dom.Element, error) {
+	if op.Type == Move {
+		from, err := p.selectNode(root, op.From)
+		if err != nil {
+			return nil, err
+		}
+		if from.Parent == nil || from == root {
+			return nil, fmt.Errorf("can't move the root")
+		}
+		from.Detach()
+		t, err := p.selectNode(root, op.Sel)
+		if err != nil {
+			return nil, err
+		}
+		return root, insert(t, op.Pos, []*dom.Element{from})
+	}
+
+	t, err := p.selectNode(root, op.Sel)
+	if err != nil {
+		return nil, err
+	}
+	switch op.Type {
+	case Insert:
+		nodes := make([]*dom.Element, len(op.Nodes))
+		for i, n := range op.Nodes {
+			nodes[i] = n.Copy()
+		}
+		return root, insert(t, op.Pos, nodes)
+	case Delete:
+		if t.Parent == nil {
+			return nil, fmt.Errorf("can't delete the root")
+		}
+		t.Detach()
+	case Replace:
+		if len(op.Nodes) != 1 {
+			return nil, fmt.Errorf("replace requires a single node")
+		}
+		n := op.Nodes[0].Copy()
+		if t.Parent == nil {
+			if t.Type == dom.Document {
+				return nil, fmt.Errorf("can't replace the root")
+			}
+			return n, nil
+		}
+		if err := t.Parent.ReplaceChild(n, t); err != nil {
+			return nil, err
+		}
+	case AddAttr:
+		if t.Type != dom.Node {
+			return nil, fmt.Errorf("%s doesn't select an element", op.Sel)
+		}
+		if _, ok := t.LookupAttrNS(op.Name.Space, op.Name.Local); ok {
+			return nil, fmt.Errorf("attribute %s already exists", op.Name.Local)
+		}
+		t.SetAttrNS(op.Name.Space, op.Name.Local, op.Value)
+	case SetAttr:
+		if _, ok := t.LookupAttrNS(op.Name.Space, op.Name.Local); !ok || t.Type != dom.Node {
+			return nil, fmt.Errorf("attribute %s doesn't exist", op.Name.Local)
+		}
+		t.SetAttrNS(op.Name.Space, op.Name.Local, op.Value)
+	case RemoveAttr:
+		if !t.RemoveAttrNS(op.Name.Space, op.Name.Local) {
+			return nil, fmt.Errorf("attribute %s doesn't exist", op.Name.Local)
+		}
+	case SetText:
+		if t.Type != dom.Content {
+			return nil, fmt.Errorf("%s doesn't select a text node", op.Sel)
+		}
+		t.Content = xml.CharData(op.Value)
+	default:
+		return nil, fmt.Errorf("unknown operation %d", op.Type)
+	}
+	return root, nil
+}
+
+// selectNode evaluates sel and returns the single node selected.
+func (p *Patch) selectNode(root *dom.Element, sel string) (*dom.Element, error) {
+	e, err := xpath.CompileNS(sel, p.Namespaces)
+	if err != nil {
+		return nil, err
+	}
+	ns, err := e.Select(root)
+	if err != nil {
+		return nil, err
+	}
+	if len(ns) != 1 {
+		return nil, fmt.Errorf("%s selects %d nodes", sel, len(ns))
+	}
+	n := ns[0]
+	switch n.Type {
+	case xpath.AttributeNode, xpath.NamespaceNode:
+		return nil, fmt.Errorf("%s selects an attribute", sel)
+	case xpath.RootNode:
+		if n.Element.Type != dom.Document {
+			return nil, fmt.Errorf("%s selects the root of a tree without a Document", sel)
+		}
+	}
+	return n.Element, nil
+}
+
+// insert adds nodes relative to t.
+func insert(t *dom.Element, pos Pos, nodes []*dom.Element) error {
+	var parent, ref *dom.Element
+	switch pos {
+	case Append:
+		parent = t
+	case Prepend:
+		parent = t
+		if len(t.Children) > 0 {
+			ref = t.Children[0]
+		}
+	case Before, After:
+		parent = t.Parent
+		if parent == nil {
+			return fmt.Errorf("can't add siblings to the root")
+		}
+		ref = t
+		if pos == After {
+			ref = nextSibling(t)
+		}
+	}
+	for _, n := range nodes {
+		if err := parent.InsertBefore(n, ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func nextSibling(elt *dom.Element) *dom.Element {
+	sibs := elt.Parent.Children
+	for i, c := range sibs {
+		if c == elt && i+1 < len(sibs) {
+			return sibs[i+1]
+		}
+	}
+	return nil
+}
+
+// Element returns the patch in the XML patch format of RFC 5261, as a <diff> element holding <add>,
+// <replace> and <remove> operations. A move is written as a <remove> followed by an <add> of the node.
+// Namespace declarations are addressed with the namespace axis, and the default namespace
+// declaration with the pseudo attribute @xmlns.
+func (p *Patch) Element() *dom.Element {
+	root := dom.NewElement("diff")
+	for prefix, uri := range p.Namespaces {
+		root.SetAttrNS("xmlns", prefix, uri)
+	}
+	// Reverse bindings for attribute names
+	prefixes := make(map[string]string)
+	for prefix, uri := range p.Namespaces {
+		prefixes[uri] = prefix
+	}
+	attrSel := func(op *Op) string {
+		return op.Sel + "/" + attrStep(op.Name, prefixes)
+	}
+
+	add := func(name string, sel string, content ...*dom.Element) *dom.Element {
+		elt := dom.NewElement(name)
+		elt.SetAttr("sel", sel)
+		for _, c := range content {
+			elt.AppendChild(c)
+		}
+		root.AppendChild(elt)
+		return elt
+	}
+	for i := range p.Ops {
+		op := &p.Ops[i]
+		switch op.Type {
+		case Insert, Move:
+			if op.Type == Move {
+				add("remove", op.From)
+			}
+			var nodes []*dom.Element
+			for _, n := range op.Nodes {
+				nodes = append(nodes, n.Copy())
+			}
+			elt := add("add", op.Sel, nodes...)
+			switch op.Pos {
+			case Prepend:
+				elt.SetAttr("pos", "prepend")
+			case Before:
+				elt.SetAttr("pos", "before")
+			case After:
+				elt.SetAttr("pos", "after")
+			}
+		case Delete:
+			add("remove", op.Sel)
+		case Replace:
+			var nodes []*dom.Element
+			for _, n := range op.Nodes {
+				nodes = append(nodes, n.Copy())
+			}
+			add("replace", op.Sel, nodes...)
+		case AddAttr:
+			elt := add("add", op.Sel, dom.NewText(op.Value))
+			elt.SetAttr("type", attrStep(op.Name, prefixes))
+		case SetAttr:
+			add("replace", attrSel(op), dom.NewText(op.Value))
+		case RemoveAttr:
+			add("remove", attrSel(op))
+		case SetText:
+			add("replace", op.Sel, dom.NewText(op.Value))
+		}
+	}
+	// Empty text nodes serialize to nothing
+	for _, op := range root.Children {
+		if len(op.Children) == 1 && op.Children[0].Type == dom.Content && len(op.Children[0].Content) == 0 {
+			op.Children = nil
+		}
+	}
+	return root
+}
+
+// attrStep returns the location step for an attribute or namespace declaration.
+func attrStep(name xml.Name, prefixes map[string]string) string {
+	switch {
+	case name.Space == "xmlns":
+		return "namespace::" + name.Local
+	case name.Space == "" && name.Local == "xmlns":
+		return "@xmlns"
+	case name.Space == "":
+		return "@" + name.Local
+	case name.Space == xmlURL:
+		return "@xml:" + name.Local
+	}
+	return "@" + prefixes[name.Space] + ":" + name.Local
+}
+
+// ParsePatch reads a patch in the format written by Patch.Element, which is that of RFC 5261. The
+// prefixes in scope at elt are used to resolve names in selectors. The ws attribute of <remove> isn't
+// supported.
+func ParsePatch(elt *dom.Element) (*Patch, error) {
+	if elt.Type == dom.Document {
+		elt = elt.DocumentElement()
+	}
+	if elt == nil || elt.Type != dom.Node {
+		return nil, fmt.Errorf("diff: patch isn't an element")
+	}
+	p := &Patch{Namespaces: make(map[string]string)}
+	for e := elt; e != nil; e = e.Parent {
+		for _, attr := range e.Attributes {
+			if _, ok := p.Namespaces[attr.Name.Local]; attr.Name.Space == "xmlns" && !ok {
+				p.Namespaces[attr.Name.Local] = attr.Value
+			}
+		}
+	}
+
+	for _, child := range elt.Children {
+		if child.Type != dom.Node {
+			continue
+		}
+		sel, ok := child.LookupAttr("sel")
+		if !ok {
+			return nil, fmt.Errorf("diff: %s without sel", child.Name.Local)
+		}
+		op := Op{Sel: sel}
+		path, step := splitStep(sel)
+		var err error
+		switch child.Name.Local {
+		case "add":
+			if typ, ok := child.LookupAttr("type"); ok {
+				op.Type = AddAttr
+				op.Name, err = p.parseAttrStep(typ)
+				op.Value = child.Text()
+				break
+			}
+			op.Type = Insert
+			switch child.Attr("pos") {
+			case "":
+				op.Pos = Append
+			case "prepend":
+				op.Pos = Prepend
+			case "before":
+				op.Pos = Before
+			case "after":
+				op.Pos = After
+			default:
+				err = fmt.Errorf("unknown pos %q", child.Attr("pos"))
+			}
+			for _, n := range child.Children {
+				op.Nodes = append(op.Nodes, n.Copy())
+			}
+		case "replace":
+			switch {
+			case isAttrStep(step):
+				op.Type = SetAttr
+				op.Sel = path
+				op.Name, err = p.parseAttrStep(step)
+				op.Value = child.Text()
+			case step == "text()" || strings.HasPrefix(step, "text()["):
+				op.Type = SetText
+				op.Value = child.Text()
+			default:
+				op.Type = Replace
+				for _, n := range child.Children {
+					if n.Type == dom.Content && strings.TrimSpace(string(n.Content)) == "" {
+						// Formatting around the replacement
+						continue
+					}
+					op.Nodes = append(op.Nodes, n.Copy())
+				}
+			}
+		case "remove":
+			if isAttrStep(step) {
+				op.Type = RemoveAttr
+				op.Sel = path
+				op.Name, err = p.parseAttrStep(step)
+			} else {
+				op.Type = Delete
+			}
+		default:
+			err = fmt.Errorf("unknown operation")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("diff: %s %s: %v", child.Name.Local, sel, err)
+		}
+		p.Ops = append(p.Ops, op)
+	}
+	return p, nil
+}
+
+// splitStep splits a selector into the path to the parent and the last location step.
+func splitStep(sel string) (string, string) {
+	depth := 0
+	var quote byte
+	last := -1
+	for i := 0; i < len(sel); i++ {
+		c := sel[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '[' || c == '(':
+			depth++
+		case c == ']' || c == ')':
+			depth--
+		case c == '/' && depth == 0:
+			last = i
+		}
+	}
+	if last < 0 {
+		return "", sel
+	}
+	return sel[:last], sel[last+1:]
+}
+
+func isAttrStep(step string) bool {
+	return strings.HasPrefix(step, "@") || strings.HasPrefix(step, "attribute::") || strings.HasPrefix(step, "namespace::")
+}
+
+// parseAttrStep returns the attribute name addressed by an attribute or namespace step.
+func (p *Patch) parseAttrStep(step string) (xml.Name, error) {
+	if prefix, ok := strings.CutPrefix(step, "namespace::"); ok {
+		return xml.Name{Space: "xmlns", Local: prefix}, nil
+	}
+	name, ok := strings.CutPrefix(step, "@")
+	if !ok {
+		name, ok = strings.CutPrefix(step, "attribute::")
+	}
+	if !ok {
+		return xml.Name{}, fmt.Errorf("%s isn't an attribute", step)
+	}
+	prefix, local, ok := strings.Cut(name, ":")
+	if !ok {
+		return xml.Name{Local: name}, nil
+	}
+	if prefix == "xml" {
+		return xml.Name{Space: xmlURL, Local: local}, nil
+	}
+	uri, ok := p.Namespaces[prefix]
+	if !ok {
+		return xml.Name{}, fmt.Errorf("unbound prefix %s", prefix)
+	}
+	return xml.Name{Space: uri, Local: local}, nil
+}
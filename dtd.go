@@ -0,0 +1,975 @@
+package xml
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// DTD holds the declarations of a document type definition. A DTD is parsed from the DOCTYPE
+// directive by Process, which only reads the internal subset. An external subset can be added with
+// Parse.
+//
+// As for any processor that doesn't read external entities, once a parameter entity that isn't read
+// has been referred to, the entity and attribute declarations that follow are skipped. In a DTD with
+// an external subset a reference to an undeclared parameter entity is treated in the same way.
+type DTD struct {
+	Name          string                  // Name of the document element
+	PublicID      string                  // Public identifier of the external subset
+	SystemID      string                  // System identifier of the external subset
+	Elements      map[string]*ElementDecl // Element declarations by name
+	Attributes    map[string][]*AttrDecl  // Attribute declarations by element name, in declaration order
+	Entities      map[string]*EntityDecl  // General entities
+	ParamEntities map[string]*EntityDecl  // Parameter entities
+	Notations     map[string]*EntityDecl  // Notations, with only the identifiers set
+	Err           error                   // Set by Process to the error that ended parsing, the declarations before it being kept
+	unread        bool                    // A parameter entity that isn't read has been referred to
+	limits        Limits                  // MaxEntitySize and MaxEntityExpansion bound parameter entity expansion
+	peExpanded    int64                   // Total size of the parameter entity replacement text expanded
+}
+
+// ContentType is the kind of content an element declaration allows.
+type ContentType int
+
+// Content types.
+const (
+	ContentEmpty    ContentType = iota // EMPTY
+	ContentAny                         // ANY
+	ContentMixed                       // Character data optionally mixed with the elements named in Model
+	ContentChildren                    // Elements as described by Model
+)
+
+// ElementDecl is an <!ELEMENT> declaration.
+type ElementDecl struct {
+	Name  string
+	Type  ContentType
+	Model *Particle // For ContentMixed, a choice of names which may be empty
+}
+
+// ParticleType is the kind of a content model particle.
+type ParticleType int
+
+// Particle types.
+const (
+	ParticleName   ParticleType = iota // An element name
+	ParticleSeq                        // A sequence of particles
+	ParticleChoice                     // A choice of particles
+)
+
+// Particle is a node of an element content model.
+type Particle struct {
+	Type     ParticleType
+	Name     string
+	Children []*Particle
+	Occur    byte // Occurrence indicator, one of '?', '*' or '+', or 0 for exactly once
+}
+
+// DefaultType is the kind of default an attribute declaration has.
+type DefaultType int
+
+// Attribute default types.
+const (
+	AttrImplied  DefaultType = iota // #IMPLIED
+	AttrRequired                    // #REQUIRED
+	AttrFixed                       // #FIXED with Value
+	AttrDefault                     // Value
+)
+
+// AttrDecl is an attribute definition from an <!ATTLIST> declaration.
+type AttrDecl struct {
+	Name    string
+	Type    string   // CDATA, ID, IDREF, IDREFS, ENTITY, ENTITIES, NMTOKEN, NMTOKENS, NOTATION or ENUMERATION
+	Values  []string // Allowed values for NOTATION and ENUMERATION
+	Default DefaultType
+	Value   string // Normalized default value
+}
+
+// EntityDecl is an <!ENTITY> or <!NOTATION> declaration.
+type EntityDecl struct {
+	Name     string
+	Value    string // Replacement text of an internal entity, with character and parameter references expanded
+	PublicID string
+	SystemID string
+	Notation string // NDATA notation of an unparsed entity
+	Internal bool   // Value holds the replacement text
+}
+
+// predefined holds the replacement text of the predefined entities.
+var predefined = map[string]string{"lt": "<", "gt": ">", "amp": "&", "apos": "'", "quot": `"`}
+
+// ParseDTD parses the text of a DOCTYPE directive, as returned by the decoder without the enclosing
+// <! and >, including any internal subset. The replacement text of each parameter entity is limited to
+// DefaultMaxEntitySize, and the total text produced by parameter entity references, which is also
+// limited when an external subset is added with Parse, to DefaultMaxEntityExpansion. If there's an error
+// in the DOCTYPE the DTD holds the declarations before it.
+func ParseDTD(directive []byte) (*DTD, error) {
+	return parseDTD(directive, Limits{})
+}
+
+// parseDTD parses a DOCTYPE directive with the entity limits of l.
+func parseDTD(directive []byte, l Limits) (*DTD, error) {
+	dtd := &DTD{
+		Elements:      make(map[string]*ElementDecl),
+		Attributes:    make(map[string][]*AttrDecl),
+		Entities:      make(map[string]*EntityDecl),
+		ParamEntities: make(map[string]*EntityDecl),
+		Notations:     make(map[string]*EntityDecl),
+		limits:        l,
+	}
+	p := &dtdParser{dtd: dtd, s: string(directive)}
+	if !p.keyword("DOCTYPE") {
+		return nil, fmt.Errorf("xml: directive isn't a DOCTYPE")
+	}
+	p.space()
+	dtd.Name = p.name()
+	if dtd.Name == "" {
+		return dtd, p.errorf("missing document element name")
+	}
+	p.space()
+	var err error
+	if dtd.PublicID, dtd.SystemID, err = p.externalID(false); err != nil {
+		return dtd, err
+	}
+	p.space()
+	if p.consume("[") {
+		end := strings.LastIndexByte(p.s, ']')
+		if end < p.i {
+			return dtd, p.errorf("unterminated internal subset")
+		}
+		if err := dtd.parse(p.s[p.i:end], 0); err != nil {
+			return dtd, err
+		}
+		p.i = end + 1
+		p.space()
+	}
+	if p.i < len(p.s) {
+		return dtd, p.errorf("unexpected %q", p.rest())
+	}
+	return dtd, nil
+}
+
+// Parse adds the declarations in an external subset or external parameter entity to the DTD. As in
+// the internal subset, the first declaration of an entity or attribute is binding.
+func (dtd *DTD) Parse(subset []byte) error {
+	return dtd.parse(string(subset), 0)
+}
+
+// maxPERefDepth bounds the nesting of parameter entity references between declarations.
+const maxPERefDepth = 16
+
+func (dtd *DTD) parse(s string, depth int) error {
+	if depth > maxPERefDepth {
+		return fmt.Errorf("xml: DTD parameter entity references nested too deeply")
+	}
+	p := &dtdParser{dtd: dtd, s: s}
+	for {
+		p.space()
+		switch {
+		case p.i >= len(p.s):
+			return nil
+		case p.consume("%"):
+			name := p.name()
+			if !p.consume(";") {
+				return p.errorf("malformed parameter entity reference")
+			}
+			pe, ok := dtd.ParamEntities[name]
+			if !ok && dtd.complete() {
+				return p.errorf("undeclared parameter entity %%%s;", name)
+			}
+			// External parameter entities aren't read
+			if !ok || !pe.Internal {
+				dtd.unread = true
+			} else {
+				v, err := dtd.peText(pe)
+				if err != nil {
+					return err
+				}
+				if err := dtd.parse(v, depth+1); err != nil {
+					return err
+				}
+			}
+		case p.consume("<?"):
+			end := strings.Index(p.s[p.i:], "?>")
+			if end < 0 {
+				return p.errorf("unterminated processing instruction")
+			}
+			p.i += end + 2
+		case p.consume("<!["):
+			if err := p.conditional(depth); err != nil {
+				return err
+			}
+		case p.consume("<!"):
+			body, err := p.decl()
+			if err != nil {
+				return err
+			}
+			if err := dtd.declaration(body); err != nil {
+				return err
+			}
+		default:
+			return p.errorf("unexpected %q", p.rest())
+		}
+	}
+}
+
+// declaration parses the body of a markup declaration, after expanding parameter entity references.
+// Declarations that depend on parameter entities that aren't read are skipped.
+func (dtd *DTD) declaration(body string) error {
+	if dtd.unread && (strings.HasPrefix(body, "ENTITY") || strings.HasPrefix(body, "ATTLIST")) {
+		return nil
+	}
+	body, err := dtd.expandPERefs(body)
+	if err == nil {
+		p := &dtdParser{dtd: dtd, s: body}
+		switch {
+		case p.keyword("ELEMENT"):
+			err = p.elementDecl()
+		case p.keyword("ATTLIST"):
+			err = p.attlistDecl()
+		case p.keyword("ENTITY"):
+			err = p.entityDecl()
+		case p.keyword("NOTATION"):
+			err = p.notationDecl()
+		default:
+			err = p.errorf("unknown declaration <!%s>", body)
+		}
+	}
+	if err == errUnread {
+		return nil
+	}
+	return err
+}
+
+// expandPERefs replaces parameter entity references outside of literals with their replacement text
+// padded with spaces.
+func (dtd *DTD) expandPERefs(s string) (string, error) {
+	if !strings.Contains(s, "%") {
+		return s, nil
+	}
+	var sb strings.Builder
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '%':
+			end := strings.IndexByte(s[i:], ';')
+			if end < 0 || !isName(s[i+1:i+end]) {
+				// The % of a parameter entity declaration
+				break
+			}
+			name := s[i+1 : i+end]
+			pe, ok := dtd.ParamEntities[name]
+			if !ok && dtd.complete() {
+				return "", fmt.Errorf("xml: undeclared parameter entity %%%s;", name)
+			}
+			if !ok || !pe.Internal {
+				dtd.unread = true
+				return "", errUnread
+			}
+			v, err := dtd.peText(pe)
+			if err != nil {
+				return "", err
+			}
+			sb.WriteByte(' ')
+			sb.WriteString(v)
+			sb.WriteByte(' ')
+			i += end
+			continue
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String(), nil
+}
+
+// errUnread is returned for a declaration that refers to a parameter entity that isn't read.
+var errUnread = errors.New("xml: parameter entity isn't read")
+
+// errMarkup is wrapped in the error for a reference to an entity whose replacement text contains
+// markup, which the decoder can't parse into nodes.
+var errMarkup = errors.New("contains markup, which isn't supported")
+
+// complete reports whether the DTD can have no declarations that aren't read, so that referring to an
+// undeclared parameter entity is an error.
+func (dtd *DTD) complete() bool {
+	return dtd.SystemID == "" && !dtd.unread
+}
+
+// peText returns the replacement text of an internal parameter entity that's referred to, counting it
+// towards MaxEntityExpansion.
+func (dtd *DTD) peText(pe *EntityDecl) (string, error) {
+	max := dtd.limits.maxEntityExpansion()
+	dtd.peExpanded += int64(len(pe.Value))
+	if dtd.peExpanded > max {
+		return "", &LimitError{"MaxEntityExpansion", max}
+	}
+	return pe.Value, nil
+}
+
+// dtdParser scans declarations.
+type dtdParser struct {
+	dtd *DTD
+	s   string
+	i   int
+}
+
+func (p *dtdParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("xml: DTD: "+format, args...)
+}
+
+func (p *dtdParser) rest() string {
+	r := p.s[p.i:]
+	if len(r) > 20 {
+		r = r[:20] + "..."
+	}
+	return r
+}
+
+func (p *dtdParser) space() bool {
+	start := p.i
+	for p.i < len(p.s) && isSpace(p.s[p.i]) {
+		p.i++
+	}
+	return p.i > start
+}
+
+func (p *dtdParser) consume(s string) bool {
+	if strings.HasPrefix(p.s[p.i:], s) {
+		p.i += len(s)
+		return true
+	}
+	return false
+}
+
+// keyword consumes s if it isn't followed by a name character.
+func (p *dtdParser) keyword(s string) bool {
+	if !strings.HasPrefix(p.s[p.i:], s) {
+		return false
+	}
+	if j := p.i + len(s); j < len(p.s) {
+		if r, _ := utf8.DecodeRuneInString(p.s[j:]); isNameChar(r) {
+			return false
+		}
+	}
+	p.i += len(s)
+	return true
+}
+
+func (p *dtdParser) name() string {
+	start := p.i
+	for p.i < len(p.s) {
+		r, n := utf8.DecodeRuneInString(p.s[p.i:])
+		if !isNameChar(r) || (p.i == start && !isNameStart(r)) {
+			break
+		}
+		p.i += n
+	}
+	return p.s[start:p.i]
+}
+
+func (p *dtdParser) nmtoken() string {
+	start := p.i
+	for p.i < len(p.s) {
+		r, n := utf8.DecodeRuneInString(p.s[p.i:])
+		if !isNameChar(r) {
+			break
+		}
+		p.i += n
+	}
+	return p.s[start:p.i]
+}
+
+func (p *dtdParser) literal() (string, error) {
+	if p.i >= len(p.s) || (p.s[p.i] != '"' && p.s[p.i] != '\'') {
+		return "", p.errorf("expected quoted literal at %q", p.rest())
+	}
+	q := p.s[p.i]
+	end := strings.IndexByte(p.s[p.i+1:], q)
+	if end < 0 {
+		return "", p.errorf("unterminated literal")
+	}
+	lit := p.s[p.i+1 : p.i+1+end]
+	p.i += end + 2
+	return lit, nil
+}
+
+// externalID parses an optional SYSTEM or PUBLIC identifier. For notations the system literal of a
+// public identifier is optional.
+func (p *dtdParser) externalID(notation bool) (string, string, error) {
+	switch {
+	case p.keyword("SYSTEM"):
+		p.space()
+		sys, err := p.literal()
+		return "", sys, err
+	case p.keyword("PUBLIC"):
+		p.space()
+		pub, err := p.literal()
+		if err != nil {
+			return "", "", err
+		}
+		sp := p.space()
+		if notation && (p.i >= len(p.s) || (p.s[p.i] != '"' && p.s[p.i] != '\'')) {
+			return pub, "", nil
+		}
+		if !sp {
+			return "", "", p.errorf("missing space after public identifier")
+		}
+		sys, err := p.literal()
+		return pub, sys, err
+	}
+	return "", "", nil
+}
+
+// decl returns the body of a markup declaration, up to the closing > outside of any literal.
+func (p *dtdParser) decl() (string, error) {
+	var quote byte
+	for j := p.i; j < len(p.s); j++ {
+		c := p.s[j]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '>':
+			body := p.s[p.i:j]
+			p.i = j + 1
+			return body, nil
+		}
+	}
+	return "", p.errorf("unterminated declaration")
+}
+
+// conditional parses an INCLUDE or IGNORE section, after the <![.
+func (p *dtdParser) conditional(depth int) error {
+	p.space()
+	kw := p.name()
+	if kw == "" && p.consume("%") {
+		name := p.name()
+		p.consume(";")
+		pe, ok := p.dtd.ParamEntities[name]
+		switch {
+		case ok && pe.Internal:
+			kw = strings.TrimSpace(pe.Value)
+		case ok || !p.dtd.complete():
+			// The section is skipped as its keyword isn't known
+			p.dtd.unread = true
+			kw = "IGNORE"
+		}
+	}
+	p.space()
+	if !p.consume("[") {
+		return p.errorf("malformed conditional section")
+	}
+	// Find the matching ]]>, allowing for nested sections
+	nest := 1
+	start := p.i
+	for nest > 0 {
+		open := strings.Index(p.s[p.i:], "<![")
+		end := strings.Index(p.s[p.i:], "]]>")
+		if end < 0 {
+			return p.errorf("unterminated conditional section")
+		}
+		if open >= 0 && open < end {
+			nest++
+			p.i += open + 3
+			continue
+		}
+		nest--
+		p.i += end + 3
+	}
+	body := p.s[start : p.i-3]
+	switch kw {
+	case "INCLUDE":
+		return p.dtd.parse(body, depth+1)
+	case "IGNORE":
+		return nil
+	}
+	return p.errorf("unknown conditional section %q", kw)
+}
+
+func (p *dtdParser) elementDecl() error {
+	p.space()
+	decl := &ElementDecl{Name: p.name()}
+	if decl.Name == "" {
+		return p.errorf("missing element name")
+	}
+	p.space()
+	switch {
+	case p.keyword("EMPTY"):
+		decl.Type = ContentEmpty
+	case p.keyword("ANY"):
+		decl.Type = ContentAny
+	case p.consume("("):
+		p.space()
+		if p.consume("#PCDATA") {
+			decl.Type = ContentMixed
+			decl.Model = &Particle{Type: ParticleChoice, Occur: '*'}
+			for {
+				p.space()
+				if p.consume(")") {
+					p.consume("*")
+					break
+				}
+				if !p.consume("|") {
+					return p.errorf("malformed mixed content in %s", decl.Name)
+				}
+				p.space()
+				name := p.name()
+				if name == "" {
+					return p.errorf("malformed mixed content in %s", decl.Name)
+				}
+				decl.Model.Children = append(decl.Model.Children, &Particle{Type: ParticleName, Name: name})
+			}
+			break
+		}
+		decl.Type = ContentChildren
+		m, err := p.group()
+		if err != nil {
+			return err
+		}
+		decl.Model = m
+	default:
+		return p.errorf("malformed content specification for %s", decl.Name)
+	}
+	p.space()
+	if p.i < len(p.s) {
+		return p.errorf("unexpected %q in declaration of %s", p.rest(), decl.Name)
+	}
+	if _, ok := p.dtd.Elements[decl.Name]; ok {
+		return p.errorf("element %s declared more than once", decl.Name)
+	}
+	p.dtd.Elements[decl.Name] = decl
+	return nil
+}
+
+// group parses a choice or sequence after its opening parenthesis.
+func (p *dtdParser) group() (*Particle, error) {
+	g := &Particle{Type: ParticleSeq}
+	var sep byte
+	for {
+		p.space()
+		var cp *Particle
+		if p.consume("(") {
+			var err error
+			if cp, err = p.group(); err != nil {
+				return nil, err
+			}
+		} else {
+			name := p.name()
+			if name == "" {
+				return nil, p.errorf("malformed content model at %q", p.rest())
+			}
+			cp = &Particle{Type: ParticleName, Name: name}
+			p.occur(cp)
+		}
+		g.Children = append(g.Children, cp)
+		p.space()
+		if p.consume(")") {
+			break
+		}
+		if p.i >= len(p.s) || (p.s[p.i] != '|' && p.s[p.i] != ',') || (sep != 0 && p.s[p.i] != sep) {
+			return nil, p.errorf("malformed content model at %q", p.rest())
+		}
+		sep = p.s[p.i]
+		p.i++
+	}
+	if sep == '|' {
+		g.Type = ParticleChoice
+	}
+	p.occur(g)
+	return g, nil
+}
+
+func (p *dtdParser) occur(cp *Particle) {
+	if p.i < len(p.s) && strings.IndexByte("?*+", p.s[p.i]) >= 0 {
+		cp.Occur = p.s[p.i]
+		p.i++
+	}
+}
+
+func (p *dtdParser) attlistDecl() error {
+	p.space()
+	elt := p.name()
+	if elt == "" {
+		return p.errorf("missing element name in ATTLIST")
+	}
+	for {
+		p.space()
+		if p.i >= len(p.s) {
+			return nil
+		}
+		decl := &AttrDecl{Name: p.name()}
+		if decl.Name == "" {
+			return p.errorf("malformed attribute definition for %s at %q", elt, p.rest())
+		}
+		p.space()
+		switch {
+		case p.consume("("):
+			decl.Type = "ENUMERATION"
+		case p.keyword("NOTATION"):
+			decl.Type = "NOTATION"
+			p.space()
+			if !p.consume("(") {
+				return p.errorf("malformed NOTATION type for %s", decl.Name)
+			}
+		default:
+			decl.Type = p.name()
+			switch decl.Type {
+			case "CDATA", "ID", "IDREF", "IDREFS", "ENTITY", "ENTITIES", "NMTOKEN", "NMTOKENS":
+			default:
+				return p.errorf("unknown attribute type %q for %s", decl.Type, decl.Name)
+			}
+		}
+		if decl.Type == "ENUMERATION" || decl.Type == "NOTATION" {
+			for {
+				p.space()
+				v := p.nmtoken()
+				if v == "" {
+					return p.errorf("malformed enumeration for %s", decl.Name)
+				}
+				decl.Values = append(decl.Values, v)
+				p.space()
+				if p.consume(")") {
+					break
+				}
+				if !p.consume("|") {
+					return p.errorf("malformed enumeration for %s", decl.Name)
+				}
+			}
+		}
+		p.space()
+		switch {
+		case p.consume("#REQUIRED"):
+			decl.Default = AttrRequired
+		case p.consume("#IMPLIED"):
+			decl.Default = AttrImplied
+		default:
+			decl.Default = AttrDefault
+			if p.consume("#FIXED") {
+				decl.Default = AttrFixed
+				p.space()
+			}
+			lit, err := p.literal()
+			if err != nil {
+				return err
+			}
+			v, err := p.dtd.attrValue(lit)
+			if err != nil {
+				return err
+			}
+			decl.Value = normalizeAttr(decl.Type, v)
+		}
+
+		// The first definition is binding
+		dup := false
+		for _, d := range p.dtd.Attributes[elt] {
+			dup = dup || d.Name == decl.Name
+		}
+		if !dup {
+			p.dtd.Attributes[elt] = append(p.dtd.Attributes[elt], decl)
+		}
+	}
+}
+
+func (p *dtdParser) entityDecl() error {
+	p.space()
+	param := p.consume("%")
+	if param && !p.space() {
+		return p.errorf("missing space after %%")
+	}
+	decl := &EntityDecl{Name: p.name()}
+	if decl.Name == "" {
+		return p.errorf("missing entity name")
+	}
+	p.space()
+	var err error
+	if p.i < len(p.s) && (p.s[p.i] == '"' || p.s[p.i] == '\'') {
+		lit, _ := p.literal()
+		decl.Internal = true
+		if decl.Value, err = p.dtd.entityValue(lit); err != nil {
+			return err
+		}
+	} else {
+		if decl.PublicID, decl.SystemID, err = p.externalID(false); err != nil {
+			return err
+		}
+		if decl.SystemID == "" {
+			return p.errorf("malformed declaration of entity %s", decl.Name)
+		}
+		p.space()
+		if !param && p.keyword("NDATA") {
+			p.space()
+			decl.Notation = p.name()
+		}
+	}
+	p.space()
+	if p.i < len(p.s) {
+		return p.errorf("unexpected %q in declaration of entity %s", p.rest(), decl.Name)
+	}
+
+	// The first declaration is binding
+	m := p.dtd.Entities
+	if param {
+		m = p.dtd.ParamEntities
+	}
+	if _, ok := m[decl.Name]; !ok {
+		m[decl.Name] = decl
+	}
+	return nil
+}
+
+func (p *dtdParser) notationDecl() error {
+	p.space()
+	decl := &EntityDecl{Name: p.name()}
+	if decl.Name == "" {
+		return p.errorf("missing notation name")
+	}
+	p.space()
+	var err error
+	if decl.PublicID, decl.SystemID, err = p.externalID(true); err != nil {
+		return err
+	}
+	p.dtd.Notations[decl.Name] = decl
+	return nil
+}
+
+// entityValue expands the character and parameter entity references in an entity literal. General
+// entity references are left to be expanded when the entity is used. The result is limited to
+// MaxEntitySize.
+func (dtd *DTD) entityValue(lit string) (string, error) {
+	max := dtd.limits.maxEntitySize()
+	var sb strings.Builder
+	for i := 0; i < len(lit); i++ {
+		if sb.Len() > max {
+			return "", &LimitError{"MaxEntitySize", int64(max)}
+		}
+		switch lit[i] {
+		case '&':
+			if i+1 < len(lit) && lit[i+1] == '#' {
+				r, n, err := charRef(lit[i:])
+				if err != nil {
+					return "", err
+				}
+				sb.WriteRune(r)
+				i += n - 1
+				continue
+			}
+		case '%':
+			end := strings.IndexByte(lit[i:], ';')
+			if end < 0 {
+				return "", fmt.Errorf("xml: DTD: malformed parameter entity reference in entity value")
+			}
+			name := lit[i+1 : i+end]
+			pe, ok := dtd.ParamEntities[name]
+			switch {
+			case !ok && dtd.complete():
+				return "", fmt.Errorf("xml: DTD: undeclared parameter entity %%%s;", name)
+			case !ok || !pe.Internal:
+				dtd.unread = true
+				return "", errUnread
+			}
+			v, err := dtd.peText(pe)
+			if err != nil {
+				return "", err
+			}
+			sb.WriteString(v)
+			i += end
+			continue
+		}
+		sb.WriteByte(lit[i])
+	}
+	if sb.Len() > max {
+		return "", &LimitError{"MaxEntitySize", int64(max)}
+	}
+	return sb.String(), nil
+}
+
+// attrValue expands the references in a default attribute value and replaces white space characters
+// with spaces.
+func (dtd *DTD) attrValue(lit string) (string, error) {
+	v, err := dtd.expander(dtd.limits.maxEntitySize()).text(lit)
+	if err != nil {
+		return "", err
+	}
+	return strings.Map(func(r rune) rune {
+		if r == '\t' || r == '\n' || r == '\r' {
+			return ' '
+		}
+		return r
+	}, v), nil
+}
+
+// normalizeAttr applies the additional normalization of attribute values that aren't CDATA. Only
+// spaces are affected, as other white space in the value came from character references.
+func normalizeAttr(typ, v string) string {
+	if typ == "CDATA" {
+		return v
+	}
+	return strings.Join(strings.FieldsFunc(v, func(r rune) bool { return r == ' ' }), " ")
+}
+
+// charRef decodes the character reference at the start of s and returns its length.
+func charRef(s string) (rune, int, error) {
+	end := strings.IndexByte(s, ';')
+	if end < 0 {
+		return 0, 0, fmt.Errorf("xml: malformed character reference")
+	}
+	var r rune
+	var err error
+	if strings.HasPrefix(s, "&#x") {
+		_, err = fmt.Sscanf(s[3:end], "%x", &r)
+	} else {
+		_, err = fmt.Sscanf(s[2:end], "%d", &r)
+	}
+	if err != nil || s[2:end] == "" || !utf8.ValidRune(r) {
+		return 0, 0, fmt.Errorf("xml: malformed character reference %s", s[:end+1])
+	}
+	return r, end + 1, nil
+}
+
+// DefaultMaxEntitySize is the limit on the size of expanded entity replacement text used when
+// Limits.MaxEntitySize isn't set.
+const DefaultMaxEntitySize = 1 << 16
+
+// Expand returns the replacement text of the general entity with all references in it expanded. The
+// expansion fails if the entity refers to itself or its size exceeds max. Markup in the replacement
+// text is treated as text.
+func (dtd *DTD) Expand(name string, max int) (string, error) {
+	return dtd.expander(max).entity(name)
+}
+
+// expander expands general entity references. Each entity is expanded once, so that the time taken
+// is bounded by the size of the replacement text rather than the number of references.
+type expander struct {
+	dtd    *DTD
+	max    int
+	open   map[string]bool   // Entities being expanded
+	done   map[string]string // Replacement text of the entities expanded
+	markup bool              // Markup in the replacement text is an error rather than text
+}
+
+func (dtd *DTD) expander(max int) *expander {
+	return &expander{dtd, max, make(map[string]bool), make(map[string]string), false}
+}
+
+func (x *expander) entity(name string) (string, error) {
+	if v, ok := predefined[name]; ok {
+		return v, nil
+	}
+	if v, ok := x.done[name]; ok {
+		return v, nil
+	}
+	e, ok := x.dtd.Entities[name]
+	switch {
+	case !ok:
+		return "", fmt.Errorf("xml: undeclared entity &%s;", name)
+	case !e.Internal:
+		return "", fmt.Errorf("xml: external entity &%s; isn't read", name)
+	case x.open[name]:
+		return "", fmt.Errorf("xml: entity &%s; refers to itself", name)
+	case x.markup && strings.Contains(e.Value, "<"):
+		return "", fmt.Errorf("xml: entity &%s; %w", name, errMarkup)
+	}
+	x.open[name] = true
+	v, err := x.text(e.Value)
+	delete(x.open, name)
+	if err != nil {
+		return "", err
+	}
+	x.done[name] = v
+	return v, nil
+}
+
+// text expands the references in s, failing if the result is larger than max.
+func (x *expander) text(s string) (string, error) {
+	if !strings.Contains(s, "&") {
+		if len(s) > x.max {
+			return "", &LimitError{"MaxEntitySize", int64(x.max)}
+		}
+		return s, nil
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if sb.Len() > x.max {
+			return "", &LimitError{"MaxEntitySize", int64(x.max)}
+		}
+		if s[i] != '&' {
+			sb.WriteByte(s[i])
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == '#' {
+			r, n, err := charRef(s[i:])
+			if err != nil {
+				return "", err
+			}
+			sb.WriteRune(r)
+			i += n - 1
+			continue
+		}
+		end := strings.IndexByte(s[i:], ';')
+		if end < 0 {
+			return "", fmt.Errorf("xml: malformed entity reference")
+		}
+		v, err := x.entity(s[i+1 : i+end])
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(v)
+		i += end
+	}
+	if sb.Len() > x.max {
+		return "", &LimitError{"MaxEntitySize", int64(x.max)}
+	}
+	return sb.String(), nil
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// isChar reports whether r is a character allowed in an XML document.
+func isChar(r rune) bool {
+	return r == '\t' || r == '\n' || r == '\r' || (r >= 0x20 && r <= 0xD7FF) || (r >= 0xE000 && r <= 0xFFFD) ||
+		(r >= 0x10000 && r <= 0x10FFFF)
+}
+
+func isNameStart(r rune) bool {
+	return r == ':' || r == '_' || (r >= 'A' && r <= 'Z') || (r >= 'a' && r <= 'z') ||
+		(r >= 0xC0 && r <= 0xD6) || (r >= 0xD8 && r <= 0xF6) || (r >= 0xF8 && r <= 0x2FF) ||
+		(r >= 0x370 && r <= 0x37D) || (r >= 0x37F && r <= 0x1FFF) || (r >= 0x200C && r <= 0x200D) ||
+		(r >= 0x2070 && r <= 0x218F) || (r >= 0x2C00 && r <= 0x2FEF) || (r >= 0x3001 && r <= 0xD7FF) ||
+		(r >= 0xF900 && r <= 0xFDCF) || (r >= 0xFDF0 && r <= 0xFFFD) || (r >= 0x10000 && r <= 0xEFFFF)
+}
+
+func isNameChar(r rune) bool {
+	return isNameStart(r) || r == '-' || r == '.' || (r >= '0' && r <= '9') || r == 0xB7 ||
+		(r >= 0x300 && r <= 0x36F) || (r >= 0x203F && r <= 0x2040)
+}
+
+// isName reports whether s is an XML Name.
+func isName(s string) bool {
+	for i, r := range s {
+		if !isNameChar(r) || (i == 0 && !isNameStart(r)) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// isNmtoken reports whether s is an XML Nmtoken.
+func isNmtoken(s string) bool {
+	for _, r := range s {
+		if !isNameChar(r) {
+			return false
+		}
+	}
+	return s != ""
+}
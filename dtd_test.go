@@ -0,0 +1,141 @@
+package xml
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nested returns a DOCTYPE declaring entity a0 with value v, and levels more, each holding ten
+// references to the one before, followed by body.
+func nested(param bool, v string, levels int, body string) string {
+	pct, ref := "", "&"
+	if param {
+		pct, ref = "% ", "%"
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `<!DOCTYPE r [<!ENTITY %sa0 "%s">`, pct, v)
+	for i := 1; i <= levels; i++ {
+		fmt.Fprintf(&sb, `<!ENTITY %sa%d "%s">`, pct, i, strings.Repeat(fmt.Sprintf("%sa%d;", ref, i-1), 10))
+	}
+	sb.WriteString("]>" + body)
+	return sb.String()
+}
+
+// build parses doc with the default limits, failing the test if it takes longer than a second.
+func build(t *testing.T, doc string) error {
+	t.Helper()
+	start := time.Now()
+	_, err := NewXMLDecoder(strings.NewReader(doc)).BuildDocument()
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("parsing took %v", d)
+	}
+	return err
+}
+
+func wantLimit(t *testing.T, err error, limit string) {
+	t.Helper()
+	var le *LimitError
+	if !errors.As(err, &le) || le.Limit != limit {
+		t.Errorf("got error %v, want %s exceeded", err, limit)
+	}
+}
+
+func TestNestedParamEntities(t *testing.T) {
+	err := build(t, nested(true, "xxxxxxxxxx", 10, "<r/>"))
+	wantLimit(t, err, "MaxEntitySize")
+}
+
+func TestRepeatedParamEntities(t *testing.T) {
+	doc := `<!DOCTYPE r [<!ENTITY % a "<!ATTLIST x a CDATA #IMPLIED>` + strings.Repeat(" ", 60000) + `">` +
+		strings.Repeat("%a;", 400) + "]><r/>"
+	wantLimit(t, build(t, doc), "MaxEntityExpansion")
+}
+
+func TestNestedEmptyEntities(t *testing.T) {
+	if err := build(t, nested(false, "", 9, "<r>&a9;</r>")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEntityReferences(t *testing.T) {
+	doc, err := NewXMLDecoder(strings.NewReader(`<!DOCTYPE r [<!ENTITY e "x&f;y"><!ENTITY f "&#38;#60;">]><r a="&e;">&e;&f;</r>`)).BuildDocument()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := doc.DocumentElement()
+	if got := r.Attr("a"); got != "x<y" {
+		t.Errorf("attribute is %q, want %q", got, "x<y")
+	}
+	if got := r.Text(); got != "x<y<" {
+		t.Errorf("text is %q, want %q", got, "x<y<")
+	}
+}
+
+func TestUnusedEntities(t *testing.T) {
+	var sb strings.Builder
+	sb.WriteString(`<!DOCTYPE r [<!ENTITY a "` + strings.Repeat("x", 60000) + `">`)
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&sb, `<!ENTITY b%d "&a;">`, i)
+	}
+	sb.WriteString("]><r>&b1;</r>")
+	d := NewXMLDecoder(strings.NewReader(sb.String()))
+	if _, err := d.BuildDocument(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(d.Decoder.Entity); n != 1 {
+		t.Errorf("%d entities expanded, want 1", n)
+	}
+}
+
+func TestEntityExpansion(t *testing.T) {
+	doc := `<!DOCTYPE r [<!ENTITY a "` + strings.Repeat("x", 60000) + `">]><r>` + strings.Repeat("&a;", 2000) + "</r>"
+	wantLimit(t, build(t, doc), "MaxEntityExpansion")
+}
+
+func TestUnreadParamEntity(t *testing.T) {
+	d := NewXMLDecoder(strings.NewReader(`<!DOCTYPE r [<!ENTITY % ext SYSTEM "x.ent"> %ext;
+<!ATTLIST r a CDATA %undeclared;> <!ENTITY e "x"> <!ELEMENT r ANY>]><r/>`))
+	if _, err := d.BuildDocument(); err != nil {
+		t.Fatal(err)
+	}
+	if d.DTD.Err != nil {
+		t.Error(d.DTD.Err)
+	}
+	if len(d.DTD.Attributes) != 0 || d.DTD.Entities["e"] != nil {
+		t.Error("declarations after an unread parameter entity weren't skipped")
+	}
+	if d.DTD.Elements["r"] == nil {
+		t.Error("element declaration was skipped")
+	}
+}
+
+func TestDTDError(t *testing.T) {
+	d := NewXMLDecoder(strings.NewReader(`<!DOCTYPE r [<!ENTITY e "x"> <!FOO>]><r>&e;</r>`))
+	doc, err := d.BuildDocument()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.DTD.Err == nil {
+		t.Error("no error recorded for the DTD")
+	}
+	if got := doc.DocumentElement().Text(); got != "x" {
+		t.Errorf("text is %q, want %q", got, "x")
+	}
+}
+
+func TestMarkupEntity(t *testing.T) {
+	for _, doc := range []string{
+		`<!DOCTYPE r [<!ENTITY e "<b>bold</b>">]><r>&e;</r>`,
+		`<!DOCTYPE r [<!ENTITY e "x&f;"><!ENTITY f "&#60;b/>">]><r a="&e;"/>`,
+	} {
+		if err := build(t, doc); !errors.Is(err, errMarkup) {
+			t.Errorf("%s: got error %v, want markup error", doc, err)
+		}
+	}
+	if err := build(t, `<!DOCTYPE r [<!ENTITY e "<b>bold</b>">]><r/>`); err != nil {
+		t.Errorf("unreferenced entity: %v", err)
+	}
+}
@@ -2,34 +2,78 @@ package xml
 
 import (
 	"encoding/xml"
+	"strconv"
+	"strings"
 )
 
 // TT represents the element type.
 type TT int
 
 const (
-	Node TT = iota
-	Content
+	Node      TT = iota // Element with a name, attributes and children
+	Content             // Character data
+	Comment             // Comment, the text is held in Content
+	ProcInst            // Processing instruction, the target is held in Name.Local and the instruction in Content
+	Directive           // Directive such as <!DOCTYPE ...>, the text between <! and > is held in Content
+	Document            // Document root, its children are the prolog, the document element and the epilog
 )
 
 // Element is used to form the tree structure of the Document Object Model.
 type Element struct {
-	Type       TT                // Node or Content
-	Name       xml.Name          // Node name
-	Attributes map[string]string // Node attributes
-	Content    xml.CharData      // CDATA content
-	Parent     *Element          // Parent node
-	Children   []*Element        // List of child nodes and contents for this node
+	Type       TT           // Node, Content, Comment, ProcInst, Directive or Document
+	Name       xml.Name     // Node name or ProcInst target
+	Attributes []xml.Attr   // Node attributes in document order
+	Content    xml.CharData // CDATA, comment, directive or processing instruction content
+	Parent     *Element     // Parent node
+	Children   []*Element   // List of child nodes and contents for this node
+	Pos        Position     // Start of the element in the source, zero if not built by a decoder
+	CDATA      bool         // Content that was read from, and is written as, a CDATA section
 }
 
-// Copy returns a deep copy of this element and its children.
+// NewElement returns an empty Node with the local name, which is in no namespace.
+func NewElement(local string) *Element {
+	return &Element{Type: Node, Name: xml.Name{Local: local}}
+}
+
+// NewElementNS returns an empty Node with the namespace URI and local name.
+func NewElementNS(space, local string) *Element {
+	return &Element{Type: Node, Name: xml.Name{Space: space, Local: local}}
+}
+
+// NewText returns a Content element holding the text.
+func NewText(text string) *Element {
+	return &Element{Type: Content, Content: xml.CharData(text)}
+}
+
+// NewCDATA returns a Content element holding the text, which is written as a CDATA section.
+func NewCDATA(text string) *Element {
+	return &Element{Type: Content, Content: xml.CharData(text), CDATA: true}
+}
+
+// NewComment returns a Comment element holding the text.
+func NewComment(text string) *Element {
+	return &Element{Type: Comment, Content: xml.CharData(text)}
+}
+
+// NewProcInst returns a ProcInst element with the target and instruction.
+func NewProcInst(target, inst string) *Element {
+	return &Element{Type: ProcInst, Name: xml.Name{Local: target}, Content: xml.CharData(inst)}
+}
+
+// NewDocument returns an empty Document.
+func NewDocument() *Element {
+	return &Element{Type: Document}
+}
+
+// Copy returns a deep copy of this element and its children. The copy has no parent.
 func (elt *Element) Copy() *Element {
-	attrs := make(map[string]string)
-	for k, v := range elt.Attributes {
-		attrs[k] = v
+	var attrs []xml.Attr
+	if elt.Attributes != nil {
+		attrs = make([]xml.Attr, len(elt.Attributes))
+		copy(attrs, elt.Attributes)
 	}
 
-	res := &Element{elt.Type, elt.Name, attrs, nil, elt.Parent, nil}
+	res := &Element{elt.Type, elt.Name, attrs, nil, nil, nil, elt.Pos, elt.CDATA}
 
 	nc := len(elt.Children)
 	var children []*Element
@@ -48,3 +92,132 @@ func (elt *Element) Copy() *Element {
 
 	return res
 }
+
+// Root returns the top of the tree containing the element, which is the Document if the tree was built
+// by BuildDocument or BuildDOM.
+func (elt *Element) Root() *Element {
+	for elt.Parent != nil {
+		elt = elt.Parent
+	}
+	return elt
+}
+
+// Path returns the location of the element as a /-separated list of local names from the top of its
+// tree, for use in diagnostics. Where an element has siblings with the same name its position amongst
+// them is given as [n]. Other types of element return the path of their parent.
+func (elt *Element) Path() string {
+	switch {
+	case elt.Type == Document:
+		return "/"
+	case elt.Type != Node:
+		if elt.Parent == nil {
+			return "/"
+		}
+		return elt.Parent.Path()
+	}
+	var sb strings.Builder
+	var walk func(e *Element)
+	walk = func(e *Element) {
+		p := e.Parent
+		if p != nil && p.Type == Node {
+			walk(p)
+		}
+		sb.WriteByte('/')
+		sb.WriteString(e.Name.Local)
+		if p == nil {
+			return
+		}
+		n, count := 0, 0
+		for _, c := range p.Children {
+			if c.Type == Node && c.Name == e.Name {
+				count++
+				if c == e {
+					n = count
+				}
+			}
+		}
+		if count > 1 {
+			sb.WriteString("[" + strconv.Itoa(n) + "]")
+		}
+	}
+	walk(elt)
+	return sb.String()
+}
+
+// DocumentElement returns the single top level Node of a Document, or nil if there isn't one.
+func (elt *Element) DocumentElement() *Element {
+	for _, child := range elt.Children {
+		if child.Type == Node {
+			return child
+		}
+	}
+	return nil
+}
+
+// Attr returns the value of the named attribute, which is in no namespace, or "" if it isn't present.
+func (elt *Element) Attr(local string) string {
+	v, _ := elt.LookupAttrNS("", local)
+	return v
+}
+
+// LookupAttr returns the value of the named attribute, which is in no namespace, and whether it was present.
+func (elt *Element) LookupAttr(local string) (string, bool) {
+	return elt.LookupAttrNS("", local)
+}
+
+// AttrNS returns the value of the attribute with the namespace URI and local name, or "" if it isn't present.
+func (elt *Element) AttrNS(space, local string) string {
+	v, _ := elt.LookupAttrNS(space, local)
+	return v
+}
+
+// LookupAttrNS returns the value of the attribute with the namespace URI and local name, and whether it
+// was present.
+func (elt *Element) LookupAttrNS(space, local string) (string, bool) {
+	i := elt.attrIndex(space, local)
+	if i < 0 {
+		return "", false
+	}
+	return elt.Attributes[i].Value, true
+}
+
+// SetAttr sets the value of the named attribute, which is in no namespace. An existing attribute keeps
+// its position, otherwise the attribute is added after the others.
+func (elt *Element) SetAttr(local, value string) {
+	elt.SetAttrNS("", local, value)
+}
+
+// SetAttrNS sets the value of the attribute with the namespace URI and local name. An existing attribute
+// keeps its position, otherwise the attribute is added after the others.
+func (elt *Element) SetAttrNS(space, local, value string) {
+	i := elt.attrIndex(space, local)
+	if i < 0 {
+		elt.Attributes = append(elt.Attributes, xml.Attr{Name: xml.Name{Space: space, Local: local}, Value: value})
+		return
+	}
+	elt.Attributes[i].Value = value
+}
+
+// RemoveAttr removes the named attribute, which is in no namespace, and reports whether it was present.
+func (elt *Element) RemoveAttr(local string) bool {
+	return elt.RemoveAttrNS("", local)
+}
+
+// RemoveAttrNS removes the attribute with the namespace URI and local name, and reports whether it was present.
+func (elt *Element) RemoveAttrNS(space, local string) bool {
+	i := elt.attrIndex(space, local)
+	if i < 0 {
+		return false
+	}
+	elt.Attributes = append(elt.Attributes[:i], elt.Attributes[i+1:]...)
+	return true
+}
+
+func (elt *Element) attrIndex(space, local string) int {
+	for i, attr := range elt.Attributes {
+		if attr.Name.Local == local && attr.Name.Space == space {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,665 @@
+package xml
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Header is the XML declaration written by Encode when EncodeOptions.Declaration is set and the
+// element isn't a Document that already has one.
+const Header = `<?xml version="1.0" encoding="UTF-8"?>` + "\n"
+
+// EncodeOptions controls how an element tree is serialized.
+type EncodeOptions struct {
+	Prefix      string // Written at the start of every indented line
+	Indent      string // Written once per nesting level, an empty string disables indentation
+	Declaration bool   // Write the XML declaration before the element
+	Encoding    string // Character encoding of the output, named as for CharsetWriter, UTF-8 if empty
+	NoConvert   bool   // Write UTF-8 for the caller to convert to Encoding, as when several trees share a CharsetWriter
+}
+
+// Encode writes the element and its children to w as XML text.
+// If opts is nil then the tree is written without a declaration or indentation.
+// An error is returned if the text or attribute values hold characters that XML doesn't allow, or
+// if a comment or processing instruction can't be written as one. Characters that the encoding can't
+// represent are written as character references in text and attribute values, and are an error
+// elsewhere.
+func (elt *Element) Encode(w io.Writer, opts *EncodeOptions) error {
+	if opts == nil {
+		opts = &EncodeOptions{}
+	}
+	if isUTF8(opts.Encoding) || opts.NoConvert {
+		return elt.encode(w, opts)
+	}
+	cw, err := CharsetWriter(opts.Encoding, w)
+	if err != nil {
+		return err
+	}
+	if err := elt.encode(cw, opts); err != nil {
+		return err
+	}
+	return cw.Close()
+}
+
+// encode writes the tree to w as UTF-8.
+func (elt *Element) encode(w io.Writer, opts *EncodeOptions) error {
+	bw := bufio.NewWriter(w)
+	e := &encoder{w: bw, opts: opts}
+	if !isUTF8(opts.Encoding) {
+		encodable, err := CharsetEncodable(opts.Encoding)
+		if err != nil {
+			return err
+		}
+		e.encodable = encodable
+	}
+	if opts.Declaration && !hasDeclaration(elt) {
+		if isUTF8(opts.Encoding) {
+			bw.WriteString(Header)
+		} else {
+			bw.WriteString(`<?xml version="1.0" encoding="` + opts.Encoding + `"?>` + "\n")
+		}
+	}
+	if elt.Type == Document {
+		// Top level items are separated by newlines
+		for i, child := range elt.Children {
+			if i > 0 {
+				bw.WriteByte('\n')
+			}
+			e.element(child, 0)
+		}
+		if e.err != nil {
+			return e.err
+		}
+		if len(elt.Children) > 0 {
+			bw.WriteByte('\n')
+		}
+		return bw.Flush()
+	}
+	if elt.Type == Node && elt.Parent != nil {
+		e.inherit = inherited(elt)
+	}
+	e.element(elt, 0)
+	if e.err != nil {
+		return e.err
+	}
+	if len(opts.Indent) > 0 || len(opts.Prefix) > 0 {
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
+
+// WriteTo implements io.WriterTo and writes the element and its children to w without indentation.
+func (elt *Element) WriteTo(w io.Writer) (int64, error) {
+	cw := &countWriter{w, 0}
+	err := elt.Encode(cw, nil)
+	return cw.n, err
+}
+
+// Marshal returns the XML encoding of the element and its children.
+func Marshal(elt *Element) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := elt.Encode(&buf, nil); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// MarshalIndent works like Marshal but each element starts on a new line beginning with prefix
+// and followed by one or more copies of indent according to the nesting depth.
+func MarshalIndent(elt *Element, prefix, indent string) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := elt.Encode(&buf, &EncodeOptions{Prefix: prefix, Indent: indent}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Well known namespaces which are bound without declaration.
+const (
+	xmlURL   = "http://www.w3.org/XML/1998/namespace"
+	xmlnsURL = "http://www.w3.org/2000/xmlns/"
+)
+
+type encoder struct {
+	w       *bufio.Writer
+	opts    *EncodeOptions
+	ns      []binding // In-scope namespace declarations, innermost last
+	seq     int       // Used to generate unique prefixes
+	inherit []binding // Declarations from the ancestors of the top element that it needs
+	err     error     // The first error, which ends the encoding
+
+	encodable func(rune) bool // Reports whether the output encoding can represent a character, nil for UTF-8
+}
+
+// binding maps a prefix to a namespace URI. The default namespace has an empty prefix.
+type binding struct {
+	prefix, uri string
+}
+
+func (e *encoder) indenting() bool {
+	return len(e.opts.Indent) > 0 || len(e.opts.Prefix) > 0
+}
+
+func (e *encoder) newline(depth int) {
+	e.w.WriteByte('\n')
+	e.w.WriteString(e.opts.Prefix)
+	for ; depth > 0; depth-- {
+		e.w.WriteString(e.opts.Indent)
+	}
+}
+
+// check records err, if it's the first, and reports whether the encoding can continue.
+func (e *encoder) check(err error) bool {
+	if e.err == nil {
+		e.err = err
+	}
+	return e.err == nil
+}
+
+func (e *encoder) element(elt *Element, depth int) {
+	if e.err != nil {
+		return
+	}
+	switch elt.Type {
+	case Content:
+		if !e.check(checkChars(string(elt.Content), "text")) {
+			return
+		}
+		if elt.CDATA {
+			e.writeCDATA(elt.Content)
+		} else {
+			e.escapeText(elt.Content)
+		}
+		return
+	case Comment:
+		if !e.check(checkComment(string(elt.Content))) || !e.check(e.checkEncodable(string(elt.Content), "comment")) {
+			return
+		}
+		e.w.WriteString("<!--")
+		e.w.Write(elt.Content)
+		e.w.WriteString("-->")
+		return
+	case ProcInst:
+		if !e.check(checkProcInst(elt.Name.Local, string(elt.Content))) ||
+			!e.check(e.checkEncodable(elt.Name.Local+" "+string(elt.Content), "processing instruction")) {
+			return
+		}
+		inst := elt.Content
+		if elt.Name.Local == "xml" {
+			inst = e.declaration(inst)
+		}
+		e.w.WriteString("<?")
+		e.w.WriteString(elt.Name.Local)
+		if len(inst) > 0 {
+			e.w.WriteByte(' ')
+			e.w.Write(inst)
+		}
+		e.w.WriteString("?>")
+		return
+	case Directive:
+		if !e.check(checkChars(string(elt.Content), "directive")) || !e.check(e.checkEncodable(string(elt.Content), "directive")) {
+			return
+		}
+		e.w.WriteString("<!")
+		e.w.Write(elt.Content)
+		e.w.WriteByte('>')
+		return
+	case Node:
+	default:
+		return
+	}
+
+	for _, attr := range elt.Attributes {
+		if !e.check(checkChars(attr.Value, "attribute value")) {
+			return
+		}
+	}
+	mark := len(e.ns)
+	name := e.startTag(elt)
+	if e.err != nil {
+		return
+	}
+	if len(elt.Children) == 0 {
+		e.w.WriteString("/>")
+		e.ns = e.ns[:mark]
+		return
+	}
+	e.w.WriteByte('>')
+
+	// Only indent children if doing so won't alter any significant text
+	indent := e.indenting() && !hasText(elt)
+	for _, child := range elt.Children {
+		if indent {
+			if child.Type == Content {
+				continue
+			}
+			e.newline(depth + 1)
+		}
+		e.element(child, depth+1)
+	}
+	if indent {
+		e.newline(depth)
+	}
+
+	e.w.WriteString("</")
+	e.w.WriteString(name)
+	e.w.WriteByte('>')
+	e.ns = e.ns[:mark]
+}
+
+// startTag writes the start tag of elt without its closing > and returns its qualified name. The
+// element's namespace declarations, and any that are added, remain in scope. Nothing is written if a
+// name can't be represented in the output encoding.
+func (e *encoder) startTag(elt *Element) string {
+	// Bring the element's own declarations into scope before resolving any names, dropping any that
+	// repeat a binding already in scope. A default namespace can't be declared on an element in no
+	// namespace, as it would then apply to the element's name.
+	skip := make([]bool, len(elt.Attributes))
+	for i, attr := range elt.Attributes {
+		if !IsNamespaceDecl(attr.Name) {
+			continue
+		}
+		prefix := declPrefix(attr.Name)
+		if cur, _ := e.lookupURI(prefix); cur == attr.Value || prefix == "" && attr.Value != "" && elt.Name.Space == "" {
+			skip[i] = true
+			continue
+		}
+		e.ns = append(e.ns, binding{prefix, attr.Value})
+	}
+
+	// Resolve names, adding declarations for any namespaces not yet in scope
+	var decls []xml.Attr
+	name := e.elementName(elt, &decls)
+	for _, b := range e.inherit {
+		if _, ok := elt.LookupAttrNS(declName(b.prefix)); !ok && !declared(decls, b.prefix) {
+			e.declare(b.prefix, b.uri, &decls)
+		}
+	}
+	e.inherit = nil
+	names := make([]string, len(elt.Attributes))
+	for i, attr := range elt.Attributes {
+		if !skip[i] {
+			names[i] = e.attrName(elt, attr.Name, &decls)
+		}
+	}
+
+	if !e.check(e.checkEncodable(name, "element name")) {
+		return name
+	}
+	for _, n := range names {
+		if !e.check(e.checkEncodable(n, "attribute name")) {
+			return name
+		}
+	}
+
+	e.w.WriteByte('<')
+	e.w.WriteString(name)
+	for i, attr := range elt.Attributes {
+		if !skip[i] {
+			e.attr(names[i], attr.Value)
+		}
+	}
+	for _, decl := range decls {
+		e.attr(decl.Name.Local, decl.Value)
+	}
+	return name
+}
+
+// elementName returns the qualified name for an element. A namespace that isn't bound is declared
+// with the prefix it has in the element's tree, or as the default namespace unless the element
+// declares a different default namespace itself, when a prefix is generated.
+func (e *encoder) elementName(elt *Element, decls *[]xml.Attr) string {
+	name := elt.Name
+	switch {
+	case name.Space == "":
+		if uri, _ := e.lookupURI(""); uri != "" {
+			// Undeclare the default namespace
+			e.declare("", "", decls)
+		}
+		return name.Local
+	case name.Space == xmlURL:
+		return "xml:" + name.Local
+	}
+	if uri, _ := e.lookupURI(""); uri == name.Space {
+		return name.Local
+	}
+	if prefix, ok := e.lookupPrefix(name.Space); ok {
+		return prefix + ":" + name.Local
+	}
+	_, fixed := elt.LookupAttrNS(declName(""))
+	if prefix, ok := elt.lookupPrefix(name.Space, fixed); ok && prefix != "" {
+		if _, bound := e.lookupURI(prefix); !bound {
+			e.declare(prefix, name.Space, decls)
+			return prefix + ":" + name.Local
+		}
+	}
+	if fixed {
+		prefix := e.newPrefix()
+		e.declare(prefix, name.Space, decls)
+		return prefix + ":" + name.Local
+	}
+	e.declare("", name.Space, decls)
+	return name.Local
+}
+
+// attrName returns the qualified name for an attribute. Since unprefixed attributes are in no namespace,
+// a namespace that isn't bound to a prefix is declared with the prefix it has in the element's tree,
+// or a generated one.
+func (e *encoder) attrName(elt *Element, name xml.Name, decls *[]xml.Attr) string {
+	switch name.Space {
+	case "":
+		return name.Local
+	case "xmlns", xmlnsURL:
+		return "xmlns:" + name.Local
+	case xmlURL:
+		return "xml:" + name.Local
+	}
+	if prefix, ok := e.lookupPrefix(name.Space); ok {
+		return prefix + ":" + name.Local
+	}
+	prefix, ok := elt.lookupPrefix(name.Space, true)
+	if _, bound := e.lookupURI(prefix); !ok || bound {
+		prefix = e.newPrefix()
+	}
+	e.declare(prefix, name.Space, decls)
+	return prefix + ":" + name.Local
+}
+
+// newPrefix returns a generated prefix that isn't bound.
+func (e *encoder) newPrefix() string {
+	for {
+		e.seq++
+		prefix := "ns" + strconv.Itoa(e.seq)
+		if _, ok := e.lookupURI(prefix); !ok {
+			return prefix
+		}
+	}
+}
+
+// declared reports whether decls holds a declaration of prefix.
+func declared(decls []xml.Attr, prefix string) bool {
+	for _, decl := range decls {
+		if decl.Name.Local == "xmlns" && prefix == "" || decl.Name.Local == "xmlns:"+prefix {
+			return true
+		}
+	}
+	return false
+}
+
+// declare binds prefix to uri and adds the declaration to decls.
+func (e *encoder) declare(prefix, uri string, decls *[]xml.Attr) {
+	e.ns = append(e.ns, binding{prefix, uri})
+	local := "xmlns"
+	if prefix != "" {
+		local += ":" + prefix
+	}
+	*decls = append(*decls, xml.Attr{Name: xml.Name{Local: local}, Value: uri})
+}
+
+// declName returns the attribute name of the declaration of prefix.
+func declName(prefix string) (string, string) {
+	if prefix == "" {
+		return "", "xmlns"
+	}
+	return "xmlns", prefix
+}
+
+// inherited returns the bindings in scope at the parent of elt for the namespaces used within elt,
+// so that a subtree is written with the prefixes it has in its tree.
+func inherited(elt *Element) []binding {
+	used := make(map[string]bool)
+	var walk func(e *Element)
+	walk = func(e *Element) {
+		if e.Type != Node {
+			return
+		}
+		used[e.Name.Space] = true
+		for _, attr := range e.Attributes {
+			if !IsNamespaceDecl(attr.Name) {
+				used[attr.Name.Space] = true
+			}
+		}
+		for _, c := range e.Children {
+			walk(c)
+		}
+	}
+	walk(elt)
+
+	var res []binding
+	for prefix, uri := range elt.Parent.InScopeNamespaces() {
+		if used[uri] {
+			res = append(res, binding{prefix, uri})
+		}
+	}
+	// Map order isn't repeatable
+	sort.Slice(res, func(i, j int) bool { return res[i].prefix < res[j].prefix })
+	return res
+}
+
+// lookupURI returns the namespace URI currently bound to prefix.
+func (e *encoder) lookupURI(prefix string) (string, bool) {
+	for i := len(e.ns) - 1; i >= 0; i-- {
+		if e.ns[i].prefix == prefix {
+			return e.ns[i].uri, true
+		}
+	}
+	return "", false
+}
+
+// lookupPrefix returns a non-empty prefix currently bound to uri.
+func (e *encoder) lookupPrefix(uri string) (string, bool) {
+	for i := len(e.ns) - 1; i >= 0; i-- {
+		b := e.ns[i]
+		if b.prefix == "" || b.uri != uri {
+			continue
+		}
+		// Check the prefix hasn't been rebound by an inner declaration
+		if cur, _ := e.lookupURI(b.prefix); cur == uri {
+			return b.prefix, true
+		}
+	}
+	return "", false
+}
+
+func (e *encoder) attr(name, value string) {
+	e.w.WriteByte(' ')
+	e.w.WriteString(name)
+	e.w.WriteString(`="`)
+	e.escapeAttr(value)
+	e.w.WriteByte('"')
+}
+
+// declaration returns the pseudo-attributes of an XML declaration in the tree with the encoding
+// corrected to that of the output.
+func (e *encoder) declaration(inst []byte) []byte {
+	enc, _, _, ok := pseudoAttr(string(inst), "encoding")
+	switch {
+	case !isUTF8(e.opts.Encoding):
+		if ok && strings.EqualFold(enc, e.opts.Encoding) {
+			return inst
+		}
+		return setEncoding(inst, e.opts.Encoding)
+	case ok && !isUTF8(enc):
+		return setEncoding(inst, "UTF-8")
+	}
+	return inst
+}
+
+// hasDeclaration returns true if elt is a Document which starts with an XML declaration.
+func hasDeclaration(elt *Element) bool {
+	if elt.Type != Document || len(elt.Children) == 0 {
+		return false
+	}
+	first := elt.Children[0]
+	return first.Type == ProcInst && first.Name.Local == "xml"
+}
+
+// hasText returns true if any of the element's content children contain non-whitespace or are CDATA
+// sections.
+func hasText(elt *Element) bool {
+	for _, child := range elt.Children {
+		if child.Type == Content && (child.CDATA || len(strings.TrimSpace(string(child.Content))) > 0) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkChars returns an error if s isn't valid UTF-8 or holds a character that XML doesn't allow.
+func checkChars(s, what string) error {
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			return fmt.Errorf("xml: invalid UTF-8 in %s", what)
+		case !isChar(r):
+			return fmt.Errorf("xml: invalid character %U in %s", r, what)
+		}
+		i += size
+	}
+	return nil
+}
+
+// checkComment returns an error if text can't be written as a comment.
+func checkComment(text string) error {
+	if strings.Contains(text, "--") || strings.HasSuffix(text, "-") {
+		return fmt.Errorf("xml: invalid comment %q", text)
+	}
+	return checkChars(text, "comment")
+}
+
+// checkProcInst returns an error if target and inst can't be written as a processing instruction.
+func checkProcInst(target, inst string) error {
+	switch {
+	case !isName(target) || strings.Contains(target, ":"):
+		return fmt.Errorf("xml: invalid processing instruction target %q", target)
+	case target != "xml" && strings.EqualFold(target, "xml"):
+		return fmt.Errorf("xml: reserved processing instruction target %q", target)
+	case strings.Contains(inst, "?>"):
+		return fmt.Errorf("xml: invalid processing instruction %q", inst)
+	}
+	return checkChars(inst, "processing instruction")
+}
+
+// checkEncodable returns an error if s holds a character that the output encoding can't represent,
+// where a character reference can't be used instead.
+func (e *encoder) checkEncodable(s, what string) error {
+	if e.encodable == nil {
+		return nil
+	}
+	for _, r := range s {
+		if !e.encodable(r) {
+			return fmt.Errorf("xml: character %U in %s can't be written in %s", r, what, e.opts.Encoding)
+		}
+	}
+	return nil
+}
+
+// writeRune writes a character of text or an attribute value, as a character reference if the output
+// encoding can't represent it.
+func (e *encoder) writeRune(r rune) {
+	if e.encodable != nil && !e.encodable(r) {
+		fmt.Fprintf(e.w, "&#x%X;", r)
+		return
+	}
+	e.w.WriteRune(r)
+}
+
+// escapeText writes CharData with &, < and > escaped. Carriage returns are escaped so that
+// they survive line-end normalization when read back.
+func (e *encoder) escapeText(s []byte) {
+	for _, c := range string(s) {
+		switch c {
+		case '&':
+			e.w.WriteString("&amp;")
+		case '<':
+			e.w.WriteString("&lt;")
+		case '>':
+			e.w.WriteString("&gt;")
+		case '\r':
+			e.w.WriteString("&#xD;")
+		default:
+			e.writeRune(c)
+		}
+	}
+}
+
+// writeCDATA writes CharData as a CDATA section. Any ]]> in the text is split across two sections,
+// and characters that the output encoding can't represent are written as character references
+// between sections.
+func (e *encoder) writeCDATA(s []byte) {
+	start, open := 0, false
+	for i, c := range string(s) {
+		ref := e.encodable != nil && !e.encodable(c)
+		if !ref && !open {
+			e.w.WriteString("<![CDATA[")
+			open = true
+		}
+		switch {
+		case ref:
+			e.w.Write(s[start:i])
+			if open {
+				e.w.WriteString("]]>")
+				open = false
+			}
+			fmt.Fprintf(e.w, "&#x%X;", c)
+			start = i + utf8.RuneLen(c)
+		case c == '>' && bytes.HasSuffix(s[start:i], []byte("]]")):
+			e.w.Write(s[start:i])
+			e.w.WriteString("]]><![CDATA[")
+			start = i
+		}
+	}
+	if len(s) == 0 {
+		e.w.WriteString("<![CDATA[")
+		open = true
+	}
+	e.w.Write(s[start:])
+	if open {
+		e.w.WriteString("]]>")
+	}
+}
+
+// escapeAttr writes an attribute value for use within double quotes. Whitespace other than
+// space is escaped so that it survives attribute value normalization when read back.
+func (e *encoder) escapeAttr(s string) {
+	for _, c := range s {
+		switch c {
+		case '&':
+			e.w.WriteString("&amp;")
+		case '<':
+			e.w.WriteString("&lt;")
+		case '>':
+			e.w.WriteString("&gt;")
+		case '"':
+			e.w.WriteString("&quot;")
+		case '\t':
+			e.w.WriteString("&#x9;")
+		case '\n':
+			e.w.WriteString("&#xA;")
+		case '\r':
+			e.w.WriteString("&#xD;")
+		default:
+			e.writeRune(c)
+		}
+	}
+}
+
+// countWriter tracks the number of bytes written for WriteTo.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -2,10 +2,12 @@ module github.com/jphsd/xml
 
 go 1.26.4
 
-require github.com/jphsd/graphics2d v0.0.0-20260707182105-6a020383ffe9
+require (
+	github.com/jphsd/graphics2d v0.0.0-20260707182105-6a020383ffe9
+	golang.org/x/text v0.40.0
+)
 
 require (
 	github.com/jphsd/texture v0.0.0-20260401033658-576f627a3571 // indirect
 	golang.org/x/image v0.43.0 // indirect
-	golang.org/x/text v0.39.0 // indirect
 )
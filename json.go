@@ -0,0 +1,484 @@
+package xml
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// JSONOptions controls the mapping between an element tree and JSON used by EncodeJSON and DecodeJSON.
+//
+// In the default convention an element is written as a member of its parent's object, named by the
+// element's qualified name. Attributes, including namespace declarations, are members named by the
+// attribute's qualified name with AttrPrefix prepended. Text is held in a member named TextKey. An
+// element without attributes or child elements is written as just its text, or null if it's empty.
+// Siblings with the same name are collected into an array at the position of the first of them.
+// For example
+//
+//	<item id="1"><name>A</name><tag>x</tag><tag>y</tag><note/></item>
+//
+// becomes
+//
+//	{"item":{"@id":"1","name":"A","tag":["x","y"],"note":null}}
+//
+// In the BadgerFish convention every element is written as an object, text is held in a member named
+// "$" and namespace declarations are collected into an object named "@xmlns" whose "$" member holds
+// the default namespace.
+//
+// Comments, processing instructions and the interleaving of text with child elements aren't
+// represented. Text consisting only of white space in an element with child elements is dropped.
+// All values are written as strings, and numbers or booleans are read as their JSON text.
+type JSONOptions struct {
+	BadgerFish bool     // Use the BadgerFish convention
+	AttrPrefix string   // Prefix of attribute member names, "@" if empty
+	TextKey    string   // Name of the text member, "#text", or "$" for BadgerFish, if empty
+	Arrays     []string // Qualified names of elements that are always written as arrays
+	Indent     string   // Indentation for each nesting level, an empty string writes compact JSON
+}
+
+func (o *JSONOptions) attrPrefix() string {
+	if o.AttrPrefix == "" {
+		return "@"
+	}
+	return o.AttrPrefix
+}
+
+func (o *JSONOptions) textKey() string {
+	switch {
+	case o.TextKey != "":
+		return o.TextKey
+	case o.BadgerFish:
+		return "$"
+	}
+	return "#text"
+}
+
+func (o *JSONOptions) isArray(name string) bool {
+	for _, n := range o.Arrays {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonObject is a JSON object that keeps the order of its members. Values are one of nil, string,
+// jsonObject or []any.
+type jsonObject []jsonMember
+
+type jsonMember struct {
+	key string
+	val any
+}
+
+// EncodeJSON writes the element, or the document element of a Document, to w as a JSON object with a
+// single member. If opts is nil then the default convention is used.
+func (elt *Element) EncodeJSON(w io.Writer, opts *JSONOptions) error {
+	if opts == nil {
+		opts = &JSONOptions{}
+	}
+	if elt.Type == Document {
+		elt = elt.DocumentElement()
+	}
+	if elt == nil || elt.Type != Node {
+		return fmt.Errorf("xml: can't encode a non-element node as JSON")
+	}
+	name, err := jsonName(elt, elt.Name, false)
+	if err != nil {
+		return err
+	}
+	val, err := toJSON(elt, opts)
+	if err != nil {
+		return err
+	}
+	if opts.isArray(name) {
+		val = []any{val}
+	}
+
+	var buf bytes.Buffer
+	if err := writeJSON(&buf, jsonObject{{name, val}}); err != nil {
+		return err
+	}
+	if opts.Indent != "" {
+		var ibuf bytes.Buffer
+		if err := json.Indent(&ibuf, buf.Bytes(), "", opts.Indent); err != nil {
+			return err
+		}
+		buf = ibuf
+	}
+	buf.WriteByte('\n')
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+// MarshalJSON returns the JSON encoding of the element using the default convention.
+func MarshalJSON(elt *Element) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := elt.EncodeJSON(&buf, nil); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// toJSON returns the value representing the content of elt.
+func toJSON(elt *Element, opts *JSONOptions) (any, error) {
+	var obj jsonObject
+	var xmlns jsonObject
+	for _, attr := range elt.Attributes {
+		if opts.BadgerFish && IsNamespaceDecl(attr.Name) {
+			prefix := attr.Name.Local
+			if attr.Name.Space == "" {
+				prefix = "$"
+			}
+			xmlns = append(xmlns, jsonMember{prefix, attr.Value})
+			continue
+		}
+		name, err := jsonName(elt, attr.Name, true)
+		if err != nil {
+			return nil, err
+		}
+		obj = append(obj, jsonMember{opts.attrPrefix() + name, attr.Value})
+	}
+	if xmlns != nil {
+		obj = append(obj, jsonMember{opts.attrPrefix() + "xmlns", xmlns})
+	}
+
+	// Children are grouped by name in order of first appearance
+	var text strings.Builder
+	hasElts := false
+	index := make(map[string]int)
+	for _, child := range elt.Children {
+		switch child.Type {
+		case Content:
+			text.Write(child.Content)
+			continue
+		case Node:
+		default:
+			continue
+		}
+		hasElts = true
+		name, err := jsonName(child, child.Name, false)
+		if err != nil {
+			return nil, err
+		}
+		val, err := toJSON(child, opts)
+		if err != nil {
+			return nil, err
+		}
+		if i, ok := index[name]; ok {
+			if arr, ok := obj[i].val.([]any); ok {
+				obj[i].val = append(arr, val)
+			} else {
+				obj[i].val = []any{obj[i].val, val}
+			}
+			continue
+		}
+		if opts.isArray(name) {
+			val = []any{val}
+		}
+		index[name] = len(obj)
+		obj = append(obj, jsonMember{name, val})
+	}
+
+	s := text.String()
+	if hasElts && strings.TrimSpace(s) == "" {
+		s = ""
+	}
+	if !opts.BadgerFish && len(obj) == 0 {
+		if s == "" {
+			return nil, nil
+		}
+		return s, nil
+	}
+	if s != "" {
+		obj = append(obj, jsonMember{opts.textKey(), s})
+	}
+	if obj == nil {
+		obj = jsonObject{}
+	}
+	return obj, nil
+}
+
+// jsonName returns the qualified name for name using the prefixes in scope at elt.
+func jsonName(elt *Element, name xml.Name, attr bool) (string, error) {
+	switch {
+	case IsNamespaceDecl(name):
+		if name.Space == "" {
+			return "xmlns", nil
+		}
+		return "xmlns:" + name.Local, nil
+	case name.Space == "":
+		return name.Local, nil
+	case name.Space == xmlURL:
+		return "xml:" + name.Local, nil
+	}
+	prefix, ok := elt.lookupPrefix(name.Space, attr)
+	if !ok {
+		return "", fmt.Errorf("xml: no prefix bound to namespace %s for %s", name.Space, name.Local)
+	}
+	if prefix == "" {
+		return name.Local, nil
+	}
+	return prefix + ":" + name.Local, nil
+}
+
+// writeJSON writes v without escaping the HTML special characters that are common in XML text.
+func writeJSON(buf *bytes.Buffer, v any) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case string:
+		enc := json.NewEncoder(buf)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		// Remove the newline added by Encode
+		buf.Truncate(buf.Len() - 1)
+	case []any:
+		buf.WriteByte('[')
+		for i, item := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeJSON(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case jsonObject:
+		buf.WriteByte('{')
+		for i, m := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeJSON(buf, m.key); err != nil {
+				return err
+			}
+			buf.WriteByte(':')
+			if err := writeJSON(buf, m.val); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	default:
+		return fmt.Errorf("xml: unexpected JSON value %T", v)
+	}
+	return nil
+}
+
+// DecodeJSON reads a JSON object with a single member from r and returns the element it represents.
+// If opts is nil then the default convention is used. Qualified names are resolved against the
+// namespace declarations in the JSON, and member names that aren't valid qualified names are an error.
+func DecodeJSON(r io.Reader, opts *JSONOptions) (*Element, error) {
+	if opts == nil {
+		opts = &JSONOptions{}
+	}
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	v, err := readJSON(dec)
+	if err != nil {
+		return nil, err
+	}
+	obj, ok := v.(jsonObject)
+	if !ok || len(obj) != 1 {
+		return nil, fmt.Errorf("xml: JSON must be an object with a single member")
+	}
+	val := obj[0].val
+	if arr, ok := val.([]any); ok {
+		if len(arr) != 1 {
+			return nil, fmt.Errorf("xml: JSON must hold a single document element")
+		}
+		val = arr[0]
+	}
+	elt, err := fromJSON(obj[0].key, val, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := resolveNames(elt); err != nil {
+		return nil, err
+	}
+	return elt, nil
+}
+
+// UnmarshalJSON returns the element represented by data using the default convention.
+func UnmarshalJSON(data []byte) (*Element, error) {
+	return DecodeJSON(bytes.NewReader(data), nil)
+}
+
+// readJSON reads the next value from dec, keeping the order of object members.
+func readJSON(dec *json.Decoder) (any, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok := tok.(type) {
+	case json.Delim:
+		switch tok {
+		case '{':
+			obj := jsonObject{}
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				val, err := readJSON(dec)
+				if err != nil {
+					return nil, err
+				}
+				obj = append(obj, jsonMember{key.(string), val})
+			}
+			_, err = dec.Token()
+			return obj, err
+		case '[':
+			arr := []any{}
+			for dec.More() {
+				val, err := readJSON(dec)
+				if err != nil {
+					return nil, err
+				}
+				arr = append(arr, val)
+			}
+			_, err = dec.Token()
+			return arr, err
+		}
+	case json.Number:
+		return tok.String(), nil
+	case bool:
+		if tok {
+			return "true", nil
+		}
+		return "false", nil
+	case string:
+		return tok, nil
+	case nil:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("xml: unexpected JSON token %v", tok)
+}
+
+// fromJSON returns the element named name whose content is represented by v. Names are left as
+// qualified names in Local until resolveNames is called.
+func fromJSON(name string, v any, opts *JSONOptions) (*Element, error) {
+	if !isQName(name) {
+		return nil, fmt.Errorf("xml: JSON member %q isn't a valid element name", name)
+	}
+	elt := &Element{Type: Node, Name: xml.Name{Local: name}}
+	switch v := v.(type) {
+	case nil:
+	case string:
+		elt.Children = []*Element{{Type: Content, Content: xml.CharData(v), Parent: elt}}
+	case []any:
+		return nil, fmt.Errorf("xml: nested JSON array in %s", name)
+	case jsonObject:
+		for _, m := range v {
+			if err := addJSONMember(elt, m, opts); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return elt, nil
+}
+
+func addJSONMember(elt *Element, m jsonMember, opts *JSONOptions) error {
+	switch {
+	case m.key == opts.textKey():
+		s, ok := m.val.(string)
+		if !ok {
+			return fmt.Errorf("xml: text of %s isn't a JSON scalar", elt.Name.Local)
+		}
+		elt.Children = append(elt.Children, &Element{Type: Content, Content: xml.CharData(s), Parent: elt})
+	case strings.HasPrefix(m.key, opts.attrPrefix()):
+		name := m.key[len(opts.attrPrefix()):]
+		if decls, ok := m.val.(jsonObject); ok && opts.BadgerFish && name == "xmlns" {
+			for _, d := range decls {
+				if d.key != "$" && !isNCName(d.key) {
+					return fmt.Errorf("xml: JSON member %q isn't a valid namespace prefix", d.key)
+				}
+				uri, ok := d.val.(string)
+				if !ok {
+					return fmt.Errorf("xml: namespace %s isn't a JSON string", d.key)
+				}
+				if d.key == "$" {
+					elt.Attributes = append(elt.Attributes, xml.Attr{Name: xml.Name{Local: "xmlns"}, Value: uri})
+				} else {
+					elt.Attributes = append(elt.Attributes, xml.Attr{Name: xml.Name{Space: "xmlns", Local: d.key}, Value: uri})
+				}
+			}
+			return nil
+		}
+		if !isQName(name) {
+			return fmt.Errorf("xml: JSON member %q isn't a valid attribute name", m.key)
+		}
+		val, ok := m.val.(string)
+		if !ok && m.val != nil {
+			return fmt.Errorf("xml: attribute %s isn't a JSON scalar", name)
+		}
+		elt.Attributes = append(elt.Attributes, xml.Attr{Name: xml.Name{Local: name}, Value: val})
+	default:
+		items, ok := m.val.([]any)
+		if !ok {
+			items = []any{m.val}
+		}
+		for _, item := range items {
+			child, err := fromJSON(m.key, item, opts)
+			if err != nil {
+				return err
+			}
+			child.Parent = elt
+			elt.Children = append(elt.Children, child)
+		}
+	}
+	return nil
+}
+
+// isQName reports whether s is a qualified name, an NCName optionally preceded by a prefix and a colon.
+func isQName(s string) bool {
+	prefix, local, ok := strings.Cut(s, ":")
+	if !ok {
+		return isNCName(s)
+	}
+	return isNCName(prefix) && isNCName(local)
+}
+
+// resolveNames replaces the qualified names in the tree with namespace and local names.
+func resolveNames(elt *Element) error {
+	// Declarations first, as they may follow attributes using them
+	for i := range elt.Attributes {
+		a := &elt.Attributes[i]
+		if prefix, local, ok := strings.Cut(a.Name.Local, ":"); ok && prefix == "xmlns" {
+			a.Name = xml.Name{Space: "xmlns", Local: local}
+		}
+	}
+	for i := range elt.Attributes {
+		a := &elt.Attributes[i]
+		prefix, local, ok := strings.Cut(a.Name.Local, ":")
+		if ok && a.Name.Space == "" {
+			uri, found := elt.LookupNamespaceURI(prefix)
+			if !found {
+				return fmt.Errorf("xml: unbound prefix in %s", a.Name.Local)
+			}
+			a.Name = xml.Name{Space: uri, Local: local}
+		}
+	}
+	prefix, local, ok := strings.Cut(elt.Name.Local, ":")
+	if !ok {
+		prefix, local = "", elt.Name.Local
+	}
+	uri, found := elt.LookupNamespaceURI(prefix)
+	if !found && ok {
+		return fmt.Errorf("xml: unbound prefix in %s", elt.Name.Local)
+	}
+	elt.Name = xml.Name{Space: uri, Local: local}
+	for _, child := range elt.Children {
+		if child.Type == Node {
+			if err := resolveNames(child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
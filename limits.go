@@ -0,0 +1,128 @@
+package xml
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+)
+
+// Limits bounds the resources consumed by Process, for use with untrusted input. A zero value for
+// any field means that quantity isn't limited.
+//
+// MaxBytes is enforced as the input is read. The other limits are checked as each token is returned
+// by the underlying decoder, so MaxTextSize should be used together with MaxBytes to bound the memory
+// needed to hold a single token.
+//
+// MaxEntitySize bounds the expanded replacement text of each entity declared in the DOCTYPE, and
+// MaxEntityExpansion the total replacement text of all the references to them in the document, and
+// separately that of the parameter entity references in the DTD. Unlike the others a zero value for
+// these means DefaultMaxEntitySize or DefaultMaxEntityExpansion, so that entity references can't
+// expand without bound. MaxEntityExpansion is enforced as the input is read, before the references are
+// expanded, by decoders created by NewXMLDecoder.
+type Limits struct {
+	MaxDepth           int   // Maximum nesting depth of elements
+	MaxElements        int   // Maximum number of elements in the document
+	MaxAttributes      int   // Maximum number of attributes, including namespace declarations, on an element
+	MaxTextSize        int   // Maximum size of a single CharData, Comment, ProcInst or Directive token
+	MaxBytes           int64 // Maximum number of bytes read from the input
+	MaxEntitySize      int   // Maximum size of the replacement text of an entity, see DefaultMaxEntitySize
+	MaxEntityExpansion int64 // Maximum total size of the expanded entity references, see DefaultMaxEntityExpansion
+}
+
+// DefaultMaxEntityExpansion is the limit on the total size of the replacement text of the entity
+// references in a document used when Limits.MaxEntityExpansion isn't set.
+const DefaultMaxEntityExpansion = 1 << 24
+
+// maxEntitySize returns MaxEntitySize or its default.
+func (l *Limits) maxEntitySize() int {
+	if l.MaxEntitySize <= 0 {
+		return DefaultMaxEntitySize
+	}
+	return l.MaxEntitySize
+}
+
+// maxEntityExpansion returns MaxEntityExpansion or its default.
+func (l *Limits) maxEntityExpansion() int64 {
+	if l.MaxEntityExpansion <= 0 {
+		return DefaultMaxEntityExpansion
+	}
+	return l.MaxEntityExpansion
+}
+
+// LimitError is returned, wrapped in a *PosError, when the input exceeds one of the decoder's Limits.
+type LimitError struct {
+	Limit string // Name of the field in Limits that was exceeded
+	Value int64  // The configured limit
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("xml: input exceeds %s of %d", e.Limit, e.Value)
+}
+
+// limitReader enforces the decoder's MaxBytes limit. The limit is read on each call so it can be set
+// after the decoder has been created.
+type limitReader struct {
+	r io.Reader
+	d *XMLDecoder
+	n int64
+}
+
+func (lr *limitReader) Read(p []byte) (int, error) {
+	max := lr.d.Limits.MaxBytes
+	if max <= 0 {
+		n, err := lr.r.Read(p)
+		lr.n += int64(n)
+		return n, err
+	}
+	if lr.n > max {
+		return 0, &LimitError{"MaxBytes", max}
+	}
+	// Read one byte past the limit to tell whether the input ends exactly at it
+	if rem := max - lr.n + 1; int64(len(p)) > rem {
+		p = p[:rem]
+	}
+	n, err := lr.r.Read(p)
+	lr.n += int64(n)
+	if lr.n > max {
+		return n - int(lr.n-max), &LimitError{"MaxBytes", max}
+	}
+	return n, err
+}
+
+// checkLimits checks a token against the decoder's Limits and updates the depth and element counts.
+func (d *XMLDecoder) checkLimits(tok any) error {
+	l := &d.Limits
+	size := 0
+	switch t := tok.(type) {
+	case xml.StartElement:
+		d.depth++
+		d.elements++
+		if l.MaxDepth > 0 && d.depth > l.MaxDepth {
+			return &LimitError{"MaxDepth", int64(l.MaxDepth)}
+		}
+		if l.MaxElements > 0 && d.elements > l.MaxElements {
+			return &LimitError{"MaxElements", int64(l.MaxElements)}
+		}
+		if l.MaxAttributes > 0 && len(t.Attr) > l.MaxAttributes {
+			return &LimitError{"MaxAttributes", int64(l.MaxAttributes)}
+		}
+	case xml.EndElement:
+		d.depth--
+	case xml.CharData:
+		size = len(t)
+	case xml.Comment:
+		size = len(t)
+	case xml.ProcInst:
+		size = len(t.Inst)
+	case xml.Directive:
+		size = len(t)
+	}
+	if l.MaxTextSize > 0 && size > l.MaxTextSize {
+		return &LimitError{"MaxTextSize", int64(l.MaxTextSize)}
+	}
+	if l.MaxBytes > 0 && d.Decoder.InputOffset() > l.MaxBytes {
+		// Catches decoders not created by NewXMLDecoder
+		return &LimitError{"MaxBytes", l.MaxBytes}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package xml
+
+import (
+	"errors"
+	"strings"
+)
+
+// Errors returned by the tree mutation functions.
+var (
+	ErrNotChild    = errors.New("xml: element is not a child of this element")
+	ErrNoChildren  = errors.New("xml: element type can't have children")
+	ErrHierarchy   = errors.New("xml: element can't be inserted into itself or its descendants")
+	ErrNilArgument = errors.New("xml: nil element")
+)
+
+// AppendChild adds child as the last child of elt. If child already has a parent it's first removed
+// from there.
+func (elt *Element) AppendChild(child *Element) error {
+	return elt.InsertBefore(child, nil)
+}
+
+// InsertBefore adds child to elt immediately before ref, or as the last child if ref is nil. If child
+// already has a parent it's first removed from there.
+func (elt *Element) InsertBefore(child, ref *Element) error {
+	if err := elt.canInsert(child); err != nil {
+		return err
+	}
+	if ref == child {
+		return nil
+	}
+	if ref != nil && ref.Parent != elt {
+		return ErrNotChild
+	}
+	child.Detach()
+	i := len(elt.Children)
+	if ref != nil {
+		i = indexOf(elt.Children, ref)
+	}
+	elt.Children = append(elt.Children, nil)
+	copy(elt.Children[i+1:], elt.Children[i:])
+	elt.Children[i] = child
+	child.Parent = elt
+	return nil
+}
+
+// RemoveChild removes child from elt, leaving it without a parent.
+func (elt *Element) RemoveChild(child *Element) error {
+	if child == nil {
+		return ErrNilArgument
+	}
+	if child.Parent != elt {
+		return ErrNotChild
+	}
+	child.Detach()
+	return nil
+}
+
+// ReplaceChild puts child in the place of old, which is left without a parent. If child already has
+// a parent it's first removed from there.
+func (elt *Element) ReplaceChild(child, old *Element) error {
+	if err := elt.canInsert(child); err != nil {
+		return err
+	}
+	if old == nil {
+		return ErrNilArgument
+	}
+	if old.Parent != elt {
+		return ErrNotChild
+	}
+	if child == old {
+		return nil
+	}
+	child.Detach()
+	elt.Children[indexOf(elt.Children, old)] = child
+	child.Parent = elt
+	old.Parent = nil
+	return nil
+}
+
+// Detach removes elt from its parent's children. Detaching an element without a parent has no effect.
+func (elt *Element) Detach() {
+	p := elt.Parent
+	if p == nil {
+		return
+	}
+	elt.Parent = nil
+	i := indexOf(p.Children, elt)
+	if i < 0 {
+		// Parent link without a matching child, as used by svg for <use> clones
+		return
+	}
+	copy(p.Children[i:], p.Children[i+1:])
+	p.Children[len(p.Children)-1] = nil
+	p.Children = p.Children[:len(p.Children)-1]
+}
+
+// canInsert checks child can become a child of elt.
+func (elt *Element) canInsert(child *Element) error {
+	if child == nil {
+		return ErrNilArgument
+	}
+	if elt.Type != Node && elt.Type != Document {
+		return ErrNoChildren
+	}
+	for p := elt; p != nil; p = p.Parent {
+		if p == child {
+			return ErrHierarchy
+		}
+	}
+	return nil
+}
+
+// Text returns the concatenated content of all the Content elements below elt, or elt's own content
+// if it's a Content element.
+func (elt *Element) Text() string {
+	if elt.Type == Content {
+		return string(elt.Content)
+	}
+	var sb strings.Builder
+	var walk func(e *Element)
+	walk = func(e *Element) {
+		for _, child := range e.Children {
+			switch child.Type {
+			case Content:
+				sb.Write(child.Content)
+			case Node:
+				walk(child)
+			}
+		}
+	}
+	walk(elt)
+	return sb.String()
+}
+
+// SetText replaces the children of elt with a single Content element holding text, or none if text is
+// empty. For Content, Comment and ProcInst elements the content is replaced instead.
+func (elt *Element) SetText(text string) {
+	switch elt.Type {
+	case Content, Comment, ProcInst, Directive:
+		elt.Content = []byte(text)
+		return
+	}
+	for _, child := range elt.Children {
+		child.Parent = nil
+	}
+	elt.Children = nil
+	if len(text) > 0 {
+		elt.AppendChild(NewText(text))
+	}
+}
+
+// AppendText adds text after the existing children of elt, extending the last child if it's a Content element.
+func (elt *Element) AppendText(text string) {
+	n := len(elt.Children)
+	if n > 0 && elt.Children[n-1].Type == Content {
+		last := elt.Children[n-1]
+		last.Content = append(last.Content, text...)
+		return
+	}
+	elt.AppendChild(NewText(text))
+}
@@ -0,0 +1,120 @@
+package xml
+
+import (
+	"encoding/xml"
+)
+
+// Namespace declarations are held as attributes, xmlns:prefix="uri" with a Name.Space of "xmlns" and
+// xmlns="uri" with an empty Name.Space and a Name.Local of "xmlns", as produced by encoding/xml. The
+// scope of an element is made up of its own declarations and those of its ancestors.
+
+// IsNamespaceDecl returns true if the attribute name is that of a namespace declaration.
+func IsNamespaceDecl(name xml.Name) bool {
+	return name.Space == "xmlns" || (name.Space == "" && name.Local == "xmlns")
+}
+
+// declPrefix returns the prefix declared by a namespace declaration, "" for the default namespace.
+func declPrefix(name xml.Name) string {
+	if name.Space == "" {
+		return ""
+	}
+	return name.Local
+}
+
+// LookupNamespaceURI returns the namespace URI bound to prefix in the scope of elt, the empty prefix
+// being the default namespace. The xml and xmlns prefixes are always bound. A prefix that is
+// undeclared, with xmlns="" or xmlns:prefix="", isn't bound.
+func (elt *Element) LookupNamespaceURI(prefix string) (string, bool) {
+	switch prefix {
+	case "xml":
+		return xmlURL, true
+	case "xmlns":
+		return xmlnsURL, true
+	}
+	for e := elt; e != nil; e = e.Parent {
+		for _, attr := range e.Attributes {
+			if IsNamespaceDecl(attr.Name) && declPrefix(attr.Name) == prefix {
+				return attr.Value, attr.Value != ""
+			}
+		}
+	}
+	return "", false
+}
+
+// LookupPrefix returns the prefix bound to uri by the nearest declaration in the scope of elt, the
+// empty prefix being the default namespace.
+func (elt *Element) LookupPrefix(uri string) (string, bool) {
+	return elt.lookupPrefix(uri, false)
+}
+
+// lookupPrefix returns a prefix bound to uri in the scope of elt, excluding the default namespace if
+// the prefix is for an attribute.
+func (elt *Element) lookupPrefix(uri string, attr bool) (string, bool) {
+	switch uri {
+	case "":
+		return "", false
+	case xmlURL:
+		return "xml", true
+	case xmlnsURL:
+		return "xmlns", true
+	}
+	for e := elt; e != nil; e = e.Parent {
+		for _, a := range e.Attributes {
+			if !IsNamespaceDecl(a.Name) || a.Value != uri {
+				continue
+			}
+			prefix := declPrefix(a.Name)
+			if attr && prefix == "" {
+				continue
+			}
+			// Check the prefix isn't rebound closer to elt
+			if cur, _ := elt.LookupNamespaceURI(prefix); cur == uri {
+				return prefix, true
+			}
+		}
+	}
+	return "", false
+}
+
+// InScopeNamespaces returns the namespace bindings in the scope of elt as a map of prefix to URI, with
+// the default namespace under the empty prefix. The always bound xml prefix isn't included.
+func (elt *Element) InScopeNamespaces() map[string]string {
+	res := make(map[string]string)
+	seen := make(map[string]bool)
+	for e := elt; e != nil; e = e.Parent {
+		for _, attr := range e.Attributes {
+			if !IsNamespaceDecl(attr.Name) {
+				continue
+			}
+			prefix := declPrefix(attr.Name)
+			if seen[prefix] {
+				continue
+			}
+			seen[prefix] = true
+			if attr.Value != "" {
+				res[prefix] = attr.Value
+			}
+		}
+	}
+	return res
+}
+
+// ElementsByNameNS returns the descendants of elt, in document order, with the namespace URI space and
+// the local name local. Either may be "*" to match any value.
+func (elt *Element) ElementsByNameNS(space, local string) []*Element {
+	var res []*Element
+	var walk func(e *Element)
+	walk = func(e *Element) {
+		for _, c := range e.Children {
+			if c.Type != Node {
+				continue
+			}
+			if (space == "*" || c.Name.Space == space) && (local == "*" || c.Name.Local == local) {
+				res = append(res, c)
+			}
+			walk(c)
+		}
+	}
+	walk(elt)
+	return res
+}
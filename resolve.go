@@ -0,0 +1,56 @@
+package xml
+
+import (
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Resolver returns the content of the resource referenced by href, which has been resolved with
+// ResolveURI against the location of the document that refers to it. It's used to read the schemas,
+// documents and stylesheets referred to by the rng, xinclude and xslt packages.
+type Resolver func(href string) ([]byte, error)
+
+// FSResolver returns a Resolver that reads from the file system.
+func FSResolver(fsys fs.FS) Resolver {
+	return func(href string) ([]byte, error) {
+		return fs.ReadFile(fsys, href)
+	}
+}
+
+// FileResolver returns a Resolver that reads files relative to dir, or the working directory if dir is
+// empty. Absolute paths and file URLs are read as they are.
+func FileResolver(dir string) Resolver {
+	return func(href string) ([]byte, error) {
+		if u, err := url.Parse(href); err == nil && u.Scheme == "file" {
+			href = u.Path
+		}
+		name := filepath.FromSlash(href)
+		if !filepath.IsAbs(name) && dir != "" {
+			name = filepath.Join(dir, name)
+		}
+		return os.ReadFile(name)
+	}
+}
+
+// ResolveURI returns href relative to base, which may be a URL or a slash separated file name. An
+// empty href refers to base itself.
+func ResolveURI(base, href string) string {
+	ref, err := url.Parse(href)
+	if err != nil || base == "" || ref.IsAbs() {
+		return href
+	}
+	if b, err := url.Parse(base); err == nil && b.IsAbs() {
+		return b.ResolveReference(ref).String()
+	}
+	switch {
+	case href == "":
+		return base
+	case strings.HasPrefix(href, "/"):
+		return href
+	}
+	return path.Join(path.Dir(base), href)
+}
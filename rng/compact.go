@@ -0,0 +1,705 @@
+package rng
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	dom "github.com/jphsd/xml"
+)
+
+// The compact syntax is translated into the equivalent XML syntax, with names and datatypes fully
+// resolved, which is then read as any other schema.
+
+// Token kinds.
+const (
+	tEOF     = iota
+	tIdent   // Identifier or keyword
+	tEscaped // Identifier escaped with \
+	tCName   // prefix:local
+	tNsName  // prefix:*
+	tLiteral
+	tOp
+)
+
+type token struct {
+	kind int
+	s    string
+	pos  dom.Position
+}
+
+var charEscape = regexp.MustCompile(`\\x+\{([0-9a-fA-F]+)\}`)
+
+// lex splits compact syntax into tokens.
+func lex(src []byte) ([]token, error) {
+	s := string(src)
+	var err error
+	s = charEscape.ReplaceAllStringFunc(s, func(m string) string {
+		hex := charEscape.FindStringSubmatch(m)[1]
+		n, perr := strconv.ParseUint(hex, 16, 32)
+		if perr != nil || !utf8.ValidRune(rune(n)) {
+			err = fmt.Errorf("rng: invalid escape %s", m)
+			return m
+		}
+		return string(rune(n))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var toks []token
+	line, col := 1, 1
+	i := 0
+	adv := func(n int) {
+		for _, r := range s[i : i+n] {
+			if r == '\n' {
+				line++
+				col = 1
+			} else {
+				col++
+			}
+		}
+		i += n
+	}
+	isNameRune := func(r rune, first bool) bool {
+		if unicode.IsLetter(r) || r == '_' {
+			return true
+		}
+		return !first && (unicode.IsDigit(r) || r == '-' || r == '.' || unicode.Is(unicode.Mn, r) || unicode.Is(unicode.Mc, r))
+	}
+	ncname := func(j int) int {
+		for k, r := range s[j:] {
+			if !isNameRune(r, k == 0) {
+				return j + k
+			}
+		}
+		return len(s)
+	}
+	for i < len(s) {
+		pos := dom.Position{Line: line, Column: col, Offset: int64(i)}
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			adv(1)
+		case c == '#':
+			end := strings.IndexAny(s[i:], "\r\n")
+			if end < 0 {
+				end = len(s) - i
+			}
+			adv(end)
+		case c == '"' || c == '\'':
+			q := string(c)
+			if strings.HasPrefix(s[i:], q+q+q) {
+				q = q + q + q
+			}
+			end := strings.Index(s[i+len(q):], q)
+			if end < 0 || (len(q) == 1 && strings.ContainsAny(s[i+1:i+1+end], "\r\n")) {
+				return nil, fmt.Errorf("rng: %s: unterminated literal", pos)
+			}
+			toks = append(toks, token{tLiteral, s[i+len(q) : i+len(q)+end], pos})
+			adv(end + 2*len(q))
+		case strings.HasPrefix(s[i:], "|=") || strings.HasPrefix(s[i:], "&=") || strings.HasPrefix(s[i:], ">>"):
+			toks = append(toks, token{tOp, s[i : i+2], pos})
+			adv(2)
+		case strings.IndexByte("={}()[],&|?*+-~", c) >= 0:
+			toks = append(toks, token{tOp, s[i : i+1], pos})
+			adv(1)
+		default:
+			kind := tIdent
+			j := i
+			if c == '\\' {
+				kind = tEscaped
+				j++
+			}
+			end := ncname(j)
+			if end == j {
+				r, _ := utf8.DecodeRuneInString(s[i:])
+				return nil, fmt.Errorf("rng: %s: unexpected %q", pos, r)
+			}
+			if kind == tIdent && end < len(s) && s[end] == ':' {
+				switch {
+				case end+1 < len(s) && s[end+1] == '*':
+					toks = append(toks, token{tNsName, s[i:end], pos})
+					adv(end + 2 - i)
+					continue
+				case ncname(end+1) > end+1:
+					kind = tCName
+					end = ncname(end + 1)
+				}
+			}
+			toks = append(toks, token{kind, s[j:end], pos})
+			adv(end - i)
+		}
+	}
+	toks = append(toks, token{tEOF, "", dom.Position{Line: line, Column: col, Offset: int64(i)}})
+	return toks, nil
+}
+
+type compactParser struct {
+	toks      []token
+	i         int
+	href      string
+	ns        map[string]string
+	dts       map[string]string
+	defaultNS *string
+}
+
+// compact translates a schema in the compact syntax into the XML syntax.
+func compact(src []byte, href string) (*dom.Element, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	cp := &compactParser{
+		toks: toks,
+		href: href,
+		ns:   map[string]string{"xml": "http://www.w3.org/XML/1998/namespace"},
+		dts:  map[string]string{"xsd": DatatypesURL},
+	}
+	return cp.topLevel()
+}
+
+func (cp *compactParser) peek() token {
+	return cp.toks[cp.i]
+}
+
+func (cp *compactParser) next() token {
+	t := cp.toks[cp.i]
+	if t.kind != tEOF {
+		cp.i++
+	}
+	return t
+}
+
+func (cp *compactParser) errorf(t token, format string, args ...any) error {
+	if cp.href != "" {
+		return fmt.Errorf("rng: %s:%s: %s", cp.href, t.pos, fmt.Sprintf(format, args...))
+	}
+	return fmt.Errorf("rng: %s: %s", t.pos, fmt.Sprintf(format, args...))
+}
+
+// is reports whether the next token is the operator or unescaped keyword s.
+func (cp *compactParser) is(s string) bool {
+	t := cp.peek()
+	return (t.kind == tOp || t.kind == tIdent) && t.s == s
+}
+
+func (cp *compactParser) expect(s string) error {
+	cp.annotations()
+	if !cp.is(s) {
+		return cp.errorf(cp.peek(), "expected %s", s)
+	}
+	cp.next()
+	return nil
+}
+
+// annotations skips documentation, annotations in brackets and following annotations.
+func (cp *compactParser) annotations() {
+	for {
+		switch {
+		case cp.is("["):
+			depth := 0
+			for {
+				t := cp.next()
+				if t.kind == tEOF {
+					return
+				}
+				if t.kind == tOp && t.s == "[" {
+					depth++
+				} else if t.kind == tOp && t.s == "]" {
+					if depth--; depth == 0 {
+						break
+					}
+				}
+			}
+		case cp.is(">>"):
+			cp.next()
+			cp.next() // Annotation element name
+		default:
+			return
+		}
+	}
+}
+
+func (cp *compactParser) literal() (string, error) {
+	cp.annotations()
+	t := cp.next()
+	if t.kind != tLiteral {
+		return "", cp.errorf(t, "expected a literal")
+	}
+	s := t.s
+	for cp.is("~") {
+		cp.next()
+		t = cp.next()
+		if t.kind != tLiteral {
+			return "", cp.errorf(t, "expected a literal after ~")
+		}
+		s += t.s
+	}
+	return s, nil
+}
+
+// elt returns a new RELAX NG element located at t.
+func elt(local string, t token, attrs ...string) *dom.Element {
+	e := dom.NewElementNS(RNGURL, local)
+	e.Pos = t.pos
+	for i := 0; i+1 < len(attrs); i += 2 {
+		e.SetAttr(attrs[i], attrs[i+1])
+	}
+	return e
+}
+
+func add(parent *dom.Element, kids ...*dom.Element) *dom.Element {
+	for _, k := range kids {
+		parent.AppendChild(k)
+	}
+	return parent
+}
+
+func (cp *compactParser) topLevel() (*dom.Element, error) {
+	for {
+		cp.annotations()
+		t := cp.peek()
+		if t.kind != tIdent || (t.s != "namespace" && t.s != "default" && t.s != "datatypes") {
+			break
+		}
+		cp.next()
+		switch t.s {
+		case "default":
+			if err := cp.expect("namespace"); err != nil {
+				return nil, err
+			}
+			prefix := ""
+			if k := cp.peek().kind; k == tIdent || k == tEscaped {
+				prefix = cp.next().s
+			}
+			if err := cp.expect("="); err != nil {
+				return nil, err
+			}
+			uri, err := cp.nsURI()
+			if err != nil {
+				return nil, err
+			}
+			cp.defaultNS = &uri
+			if prefix != "" {
+				cp.ns[prefix] = uri
+			}
+		case "namespace", "datatypes":
+			prefix := cp.next()
+			if prefix.kind != tIdent && prefix.kind != tEscaped {
+				return nil, cp.errorf(prefix, "expected a prefix")
+			}
+			if err := cp.expect("="); err != nil {
+				return nil, err
+			}
+			var uri string
+			var err error
+			if t.s == "namespace" {
+				uri, err = cp.nsURI()
+				cp.ns[prefix.s] = uri
+			} else {
+				uri, err = cp.literal()
+				cp.dts[prefix.s] = uri
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	t := cp.peek()
+	var root *dom.Element
+	if cp.grammarStart() {
+		root = elt("grammar", t)
+		if err := cp.grammarContent(root, false); err != nil {
+			return nil, err
+		}
+	} else {
+		p, err := cp.pattern()
+		if err != nil {
+			return nil, err
+		}
+		root = p
+	}
+	if t := cp.peek(); t.kind != tEOF {
+		return nil, cp.errorf(t, "unexpected %s", t.s)
+	}
+	return root, nil
+}
+
+// nsURI reads a namespace URI literal, the inherit keyword giving no namespace.
+func (cp *compactParser) nsURI() (string, error) {
+	if cp.is("inherit") {
+		cp.next()
+		return "", nil
+	}
+	return cp.literal()
+}
+
+// grammarStart reports whether the input continues with grammar content rather than a pattern.
+func (cp *compactParser) grammarStart() bool {
+	cp.annotations()
+	t := cp.peek()
+	if t.kind == tEOF {
+		return true
+	}
+	n := cp.toks[cp.i+1]
+	switch {
+	case t.kind == tIdent && (t.s == "div" || t.s == "include"):
+		return n.kind != tOp || n.s == "{"
+	case t.kind == tIdent || t.kind == tEscaped:
+		return n.kind == tOp && (n.s == "=" || n.s == "|=" || n.s == "&=")
+	}
+	return false
+}
+
+// grammarContent reads start, define, div and include components into parent until a closing brace,
+// or the end of the input if not braced.
+func (cp *compactParser) grammarContent(parent *dom.Element, braced bool) error {
+	for {
+		cp.annotations()
+		t := cp.peek()
+		switch {
+		case braced && cp.is("}"):
+			cp.next()
+			return nil
+		case !braced && t.kind == tEOF:
+			return nil
+		case t.kind == tEOF:
+			return cp.errorf(t, "expected }")
+		case t.kind == tIdent && t.s == "div":
+			cp.next()
+			if err := cp.expect("{"); err != nil {
+				return err
+			}
+			div := elt("div", t)
+			if err := cp.grammarContent(div, true); err != nil {
+				return err
+			}
+			add(parent, div)
+		case t.kind == tIdent && t.s == "include":
+			cp.next()
+			href, err := cp.literal()
+			if err != nil {
+				return err
+			}
+			inc := elt("include", t, "href", href)
+			if err := cp.inherit(inc); err != nil {
+				return err
+			}
+			cp.annotations()
+			if cp.is("{") {
+				cp.next()
+				if err := cp.grammarContent(inc, true); err != nil {
+					return err
+				}
+			}
+			add(parent, inc)
+		case t.kind == tIdent || t.kind == tEscaped:
+			cp.next()
+			op := cp.next()
+			if op.kind != tOp || (op.s != "=" && op.s != "|=" && op.s != "&=") {
+				return cp.errorf(op, "expected =, |= or &=")
+			}
+			var def *dom.Element
+			if t.kind == tIdent && t.s == "start" {
+				def = elt("start", t)
+			} else {
+				def = elt("define", t, "name", t.s)
+			}
+			switch op.s {
+			case "|=":
+				def.SetAttr("combine", "choice")
+			case "&=":
+				def.SetAttr("combine", "interleave")
+			}
+			p, err := cp.pattern()
+			if err != nil {
+				return err
+			}
+			add(parent, add(def, p))
+		default:
+			return cp.errorf(t, "unexpected %s in grammar", t.s)
+		}
+	}
+}
+
+// inherit sets the ns attribute of an include or externalRef.
+func (cp *compactParser) inherit(e *dom.Element) error {
+	if cp.is("inherit") {
+		cp.next()
+		if err := cp.expect("="); err != nil {
+			return err
+		}
+		t := cp.next()
+		uri, ok := cp.ns[t.s]
+		if !ok {
+			return cp.errorf(t, "prefix %s isn't declared", t.s)
+		}
+		e.SetAttr("ns", uri)
+	} else if cp.defaultNS != nil {
+		e.SetAttr("ns", *cp.defaultNS)
+	}
+	return nil
+}
+
+func (cp *compactParser) pattern() (*dom.Element, error) {
+	first, err := cp.particle()
+	if err != nil {
+		return nil, err
+	}
+	cp.annotations()
+	t := cp.peek()
+	if t.kind != tOp || (t.s != "," && t.s != "&" && t.s != "|") {
+		return first, nil
+	}
+	op := t.s
+	local := map[string]string{",": "group", "&": "interleave", "|": "choice"}[op]
+	res := add(elt(local, t), first)
+	for cp.is(op) {
+		cp.next()
+		p, err := cp.particle()
+		if err != nil {
+			return nil, err
+		}
+		add(res, p)
+		cp.annotations()
+	}
+	if t := cp.peek(); t.kind == tOp && (t.s == "," || t.s == "&" || t.s == "|") {
+		return nil, cp.errorf(t, "mixed operators %s and %s need parentheses", op, t.s)
+	}
+	return res, nil
+}
+
+func (cp *compactParser) particle() (*dom.Element, error) {
+	p, err := cp.primary()
+	if err != nil {
+		return nil, err
+	}
+	cp.annotations()
+	t := cp.peek()
+	if t.kind == tOp {
+		local := map[string]string{"?": "optional", "*": "zeroOrMore", "+": "oneOrMore"}[t.s]
+		if local != "" {
+			cp.next()
+			return add(elt(local, t), p), nil
+		}
+	}
+	return p, nil
+}
+
+func (cp *compactParser) primary() (*dom.Element, error) {
+	cp.annotations()
+	t := cp.next()
+	switch t.kind {
+	case tOp:
+		if t.s == "(" {
+			p, err := cp.pattern()
+			if err != nil {
+				return nil, err
+			}
+			return p, cp.expect(")")
+		}
+	case tLiteral:
+		cp.i--
+		v, err := cp.literal()
+		if err != nil {
+			return nil, err
+		}
+		e := elt("value", t, "type", "token", "datatypeLibrary", "")
+		e.SetText(v)
+		return e, nil
+	case tCName:
+		return cp.datatype(t)
+	case tEscaped:
+		return elt("ref", t, "name", t.s), nil
+	case tIdent:
+		switch t.s {
+		case "element", "attribute":
+			nc, err := cp.nameClass(t.s == "attribute")
+			if err != nil {
+				return nil, err
+			}
+			if err := cp.expect("{"); err != nil {
+				return nil, err
+			}
+			p, err := cp.pattern()
+			if err != nil {
+				return nil, err
+			}
+			return add(elt(t.s, t), nc, p), cp.expect("}")
+		case "mixed", "list":
+			if err := cp.expect("{"); err != nil {
+				return nil, err
+			}
+			p, err := cp.pattern()
+			if err != nil {
+				return nil, err
+			}
+			return add(elt(t.s, t), p), cp.expect("}")
+		case "parent":
+			n := cp.next()
+			if n.kind != tIdent && n.kind != tEscaped {
+				return nil, cp.errorf(n, "expected a name after parent")
+			}
+			return elt("parentRef", t, "name", n.s), nil
+		case "empty", "text", "notAllowed":
+			return elt(t.s, t), nil
+		case "string", "token":
+			return cp.datatype(t)
+		case "external":
+			href, err := cp.literal()
+			if err != nil {
+				return nil, err
+			}
+			e := elt("externalRef", t, "href", href)
+			return e, cp.inherit(e)
+		case "grammar":
+			if err := cp.expect("{"); err != nil {
+				return nil, err
+			}
+			g := elt("grammar", t)
+			return g, cp.grammarContent(g, true)
+		}
+		return elt("ref", t, "name", t.s), nil
+	}
+	return nil, cp.errorf(t, "unexpected %q", t.s)
+}
+
+// datatype reads a data or value pattern after its datatype name.
+func (cp *compactParser) datatype(t token) (*dom.Element, error) {
+	lib, typ := "", t.s
+	if t.kind == tCName {
+		prefix, local, _ := strings.Cut(t.s, ":")
+		uri, ok := cp.dts[prefix]
+		if !ok {
+			return nil, cp.errorf(t, "datatypes prefix %s isn't declared", prefix)
+		}
+		lib, typ = uri, local
+	}
+	cp.annotations()
+	if cp.peek().kind == tLiteral {
+		v, err := cp.literal()
+		if err != nil {
+			return nil, err
+		}
+		e := elt("value", t, "type", typ, "datatypeLibrary", lib)
+		e.SetText(v)
+		return e, nil
+	}
+	e := elt("data", t, "type", typ, "datatypeLibrary", lib)
+	if cp.is("{") {
+		cp.next()
+		for {
+			cp.annotations()
+			if cp.is("}") {
+				cp.next()
+				break
+			}
+			n := cp.next()
+			if n.kind != tIdent && n.kind != tEscaped {
+				return nil, cp.errorf(n, "expected a parameter name")
+			}
+			if err := cp.expect("="); err != nil {
+				return nil, err
+			}
+			v, err := cp.literal()
+			if err != nil {
+				return nil, err
+			}
+			param := elt("param", n, "name", n.s)
+			param.SetText(v)
+			add(e, param)
+		}
+	}
+	cp.annotations()
+	if cp.is("-") {
+		x := cp.next()
+		p, err := cp.primary()
+		if err != nil {
+			return nil, err
+		}
+		add(e, add(elt("except", x), p))
+	}
+	return e, nil
+}
+
+// nameClass reads a name class, unprefixed names being in the default namespace for elements and in
+// no namespace for attributes.
+func (cp *compactParser) nameClass(attr bool) (*dom.Element, error) {
+	first, err := cp.nameClassItem(attr)
+	if err != nil {
+		return nil, err
+	}
+	cp.annotations()
+	if !cp.is("|") {
+		return first, nil
+	}
+	res := add(elt("choice", cp.peek()), first)
+	for cp.is("|") {
+		cp.next()
+		nc, err := cp.nameClassItem(attr)
+		if err != nil {
+			return nil, err
+		}
+		add(res, nc)
+		cp.annotations()
+	}
+	return res, nil
+}
+
+func (cp *compactParser) nameClassItem(attr bool) (*dom.Element, error) {
+	cp.annotations()
+	t := cp.next()
+	var nc *dom.Element
+	switch {
+	case t.kind == tOp && t.s == "(":
+		inner, err := cp.nameClass(attr)
+		if err != nil {
+			return nil, err
+		}
+		return inner, cp.expect(")")
+	case t.kind == tOp && t.s == "*":
+		nc = elt("anyName", t)
+	case t.kind == tNsName:
+		uri, ok := cp.ns[t.s]
+		if !ok {
+			return nil, cp.errorf(t, "prefix %s isn't declared", t.s)
+		}
+		nc = elt("nsName", t, "ns", uri)
+	case t.kind == tCName:
+		prefix, local, _ := strings.Cut(t.s, ":")
+		uri, ok := cp.ns[prefix]
+		if !ok {
+			return nil, cp.errorf(t, "prefix %s isn't declared", prefix)
+		}
+		nc = elt("name", t, "ns", uri)
+		nc.SetText(local)
+		return nc, nil
+	case t.kind == tIdent || t.kind == tEscaped:
+		nc = elt("name", t)
+		switch {
+		case attr:
+			nc.SetAttr("ns", "")
+		case cp.defaultNS != nil:
+			nc.SetAttr("ns", *cp.defaultNS)
+		}
+		nc.SetText(t.s)
+		return nc, nil
+	default:
+		return nil, cp.errorf(t, "expected a name class")
+	}
+	cp.annotations()
+	if cp.is("-") {
+		x := cp.next()
+		except, err := cp.nameClassItem(attr)
+		if err != nil {
+			return nil, err
+		}
+		add(nc, add(elt("except", x), except))
+	}
+	return nc, nil
+}
@@ -0,0 +1,543 @@
+package rng
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"strings"
+
+	dom "github.com/jphsd/xml"
+	"github.com/jphsd/xml/xsd"
+)
+
+// Parse reads a schema in the XML syntax, elt being either a Document or the top level pattern.
+// Includes and external references are read with load, which may be nil if there are none. A file
+// name ending in .rnc is read as compact syntax.
+func Parse(elt *dom.Element, load dom.Resolver) (*Schema, error) {
+	return newParser(load).schema(elt, "")
+}
+
+// ParseCompact reads a schema in the compact syntax. Includes and external references are read with
+// load, which may be nil if there are none.
+func ParseCompact(src []byte, load dom.Resolver) (*Schema, error) {
+	elt, err := compact(src, "")
+	if err != nil {
+		return nil, err
+	}
+	return newParser(load).schema(elt, "")
+}
+
+type parser struct {
+	b        *builder
+	load     dom.Resolver
+	elements []*pattern
+	pending  []pending
+	open     map[string]bool // Schemas being read, to detect loops
+}
+
+// pending is an element pattern whose content is yet to be built.
+type pending struct {
+	elem *pattern
+	kids []*dom.Element
+	env  env
+}
+
+// env is the context inherited by a schema element.
+type env struct {
+	ns    string
+	dtLib string
+	g     *grammar
+	href  string // Location of the schema document
+}
+
+type grammar struct {
+	parent  *grammar
+	defines map[string]*define
+	start   *define
+}
+
+type define struct {
+	name    string
+	bodies  []body
+	combine string
+	p       *pattern
+	state   int
+}
+
+type body struct {
+	elt *dom.Element
+	env env
+}
+
+// Define states.
+const (
+	unbuilt = iota
+	building
+	built
+)
+
+func newParser(load dom.Resolver) *parser {
+	return &parser{b: newBuilder(), load: load, open: make(map[string]bool)}
+}
+
+// errorf returns an error located at the schema element e.
+func errorf(e *dom.Element, format string, args ...any) error {
+	msg := fmt.Sprintf(format, args...)
+	if e.Pos.Line > 0 {
+		return fmt.Errorf("rng: schema %s %s: %s", e.Pos, e.Path(), msg)
+	}
+	return fmt.Errorf("rng: schema %s: %s", e.Path(), msg)
+}
+
+func (p *parser) schema(elt *dom.Element, href string) (*Schema, error) {
+	if elt.Type == dom.Document {
+		elt = elt.DocumentElement()
+		if elt == nil {
+			return nil, fmt.Errorf("rng: schema has no document element")
+		}
+	}
+	start, err := p.pattern(elt, env{href: href})
+	if err != nil {
+		return nil, err
+	}
+	// Element content is built once the definitions it may refer to are known
+	for len(p.pending) > 0 {
+		pe := p.pending[0]
+		p.pending = p.pending[1:]
+		if pe.elem.p1, err = p.group(pe.kids, pe.env); err != nil {
+			return nil, err
+		}
+	}
+	return &Schema{b: p.b, start: start, elements: p.elements}, nil
+}
+
+// kids returns the RELAX NG elements in e, foreign elements being annotations.
+func kids(e *dom.Element) []*dom.Element {
+	var res []*dom.Element
+	for _, c := range e.Children {
+		if c.Type == dom.Node && c.Name.Space == RNGURL {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+// inherit returns the env for e's content, applying its ns and datatypeLibrary attributes.
+func inherit(e *dom.Element, en env) env {
+	if ns, ok := e.LookupAttr("ns"); ok {
+		en.ns = ns
+	}
+	if lib, ok := e.LookupAttr("datatypeLibrary"); ok {
+		en.dtLib = lib
+	}
+	return en
+}
+
+// text returns the text content of a schema element.
+func text(e *dom.Element) string {
+	var sb strings.Builder
+	for _, c := range e.Children {
+		if c.Type == dom.Content {
+			sb.Write(c.Content)
+		}
+	}
+	return sb.String()
+}
+
+// group returns the patterns in elts as a group.
+func (p *parser) group(elts []*dom.Element, en env) (*pattern, error) {
+	res := p.b.empty
+	for _, e := range elts {
+		q, err := p.pattern(e, en)
+		if err != nil {
+			return nil, err
+		}
+		res = p.b.group(res, q)
+	}
+	return res, nil
+}
+
+func (p *parser) pattern(e *dom.Element, en env) (*pattern, error) {
+	if e.Name.Space != RNGURL {
+		return nil, errorf(e, "%s isn't a RELAX NG pattern", name(e.Name))
+	}
+	en = inherit(e, en)
+	b := p.b
+	elts := kids(e)
+	switch e.Name.Local {
+	case "element":
+		nc, rest, err := p.named(e, elts, en, false)
+		if err != nil {
+			return nil, err
+		}
+		elem := b.element(nc, e)
+		p.elements = append(p.elements, elem)
+		p.pending = append(p.pending, pending{elem, rest, en})
+		return elem, nil
+	case "attribute":
+		nc, rest, err := p.named(e, elts, en, true)
+		if err != nil {
+			return nil, err
+		}
+		content := b.text
+		if len(rest) > 0 {
+			if content, err = p.group(rest, en); err != nil {
+				return nil, err
+			}
+		}
+		return b.attribute(nc, content), nil
+	case "group", "interleave", "choice", "optional", "zeroOrMore", "oneOrMore", "list", "mixed":
+		if len(elts) == 0 {
+			return nil, errorf(e, "%s has no patterns", e.Name.Local)
+		}
+		res, err := p.pattern(elts[0], en)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range elts[1:] {
+			q, err := p.pattern(c, en)
+			if err != nil {
+				return nil, err
+			}
+			switch e.Name.Local {
+			case "choice":
+				res = b.choice(res, q)
+			case "interleave":
+				res = b.interleave(res, q)
+			default:
+				res = b.group(res, q)
+			}
+		}
+		switch e.Name.Local {
+		case "optional":
+			res = b.choice(res, b.empty)
+		case "zeroOrMore":
+			res = b.choice(b.oneOrMore(res), b.empty)
+		case "oneOrMore":
+			res = b.oneOrMore(res)
+		case "list":
+			res = b.list(res)
+		case "mixed":
+			res = b.interleave(res, b.text)
+		}
+		return res, nil
+	case "ref", "parentRef":
+		g := en.g
+		if e.Name.Local == "parentRef" && g != nil {
+			g = g.parent
+		}
+		ref := strings.TrimSpace(e.Attr("name"))
+		if g == nil || g.defines[ref] == nil {
+			return nil, errorf(e, "%s isn't defined", ref)
+		}
+		return p.ref(g.defines[ref], e)
+	case "empty":
+		return b.empty, nil
+	case "text":
+		return b.text, nil
+	case "notAllowed":
+		return b.notAllowed, nil
+	case "value":
+		lib, typ := en.dtLib, strings.TrimSpace(e.Attr("type"))
+		if typ == "" {
+			lib, typ = "", "token"
+		}
+		dt, err := newDatatype(lib, typ, nil)
+		if err != nil {
+			return nil, errorf(e, "%v", err)
+		}
+		return b.val(dt, text(e)), nil
+	case "data":
+		var params []xsd.Facet
+		var except *pattern
+		for _, c := range elts {
+			switch c.Name.Local {
+			case "param":
+				params = append(params, xsd.Facet{Name: strings.TrimSpace(c.Attr("name")), Value: text(c)})
+			case "except":
+				x, err := p.choice(kids(c), inherit(c, en))
+				if err != nil {
+					return nil, err
+				}
+				except = x
+			}
+		}
+		dt, err := newDatatype(en.dtLib, strings.TrimSpace(e.Attr("type")), params)
+		if err != nil {
+			return nil, errorf(e, "%v", err)
+		}
+		return b.data(dt, except), nil
+	case "externalRef":
+		root, href, err := p.external(e, en)
+		if err != nil {
+			return nil, err
+		}
+		defer delete(p.open, href)
+		en.href = href
+		return p.pattern(root, en)
+	case "grammar":
+		g := &grammar{parent: en.g, defines: make(map[string]*define)}
+		en.g = g
+		if err := p.grammarContent(elts, en, nil); err != nil {
+			return nil, err
+		}
+		if g.start == nil {
+			return nil, errorf(e, "grammar has no start")
+		}
+		return p.ref(g.start, e)
+	}
+	return nil, errorf(e, "unexpected %s", e.Name.Local)
+}
+
+// choice returns the patterns in elts as a choice.
+func (p *parser) choice(elts []*dom.Element, en env) (*pattern, error) {
+	res := p.b.notAllowed
+	for _, e := range elts {
+		q, err := p.pattern(e, en)
+		if err != nil {
+			return nil, err
+		}
+		res = p.b.choice(res, q)
+	}
+	return res, nil
+}
+
+// named returns the name class of an element or attribute pattern, from its name attribute or first
+// child, and the remaining children.
+func (p *parser) named(e *dom.Element, elts []*dom.Element, en env, attr bool) (*nameClass, []*dom.Element, error) {
+	if n, ok := e.LookupAttr("name"); ok {
+		ns := en.ns
+		if attr {
+			ns = e.Attr("ns")
+		}
+		qn, err := qname(e, strings.TrimSpace(n), ns)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &nameClass{kind: ncName, name: qn}, elts, nil
+	}
+	if len(elts) == 0 {
+		return nil, nil, errorf(e, "%s has no name", e.Name.Local)
+	}
+	nc, err := p.nameClass(elts[0], en)
+	return nc, elts[1:], err
+}
+
+// qname resolves a QName in the scope of e, an unprefixed name being in the namespace ns.
+func qname(e *dom.Element, v, ns string) (xml.Name, error) {
+	prefix, local, ok := strings.Cut(v, ":")
+	if !ok {
+		return xml.Name{Space: ns, Local: v}, nil
+	}
+	uri, bound := e.LookupNamespaceURI(prefix)
+	if !bound {
+		return xml.Name{}, errorf(e, "prefix %s isn't bound", prefix)
+	}
+	return xml.Name{Space: uri, Local: local}, nil
+}
+
+func (p *parser) nameClass(e *dom.Element, en env) (*nameClass, error) {
+	en = inherit(e, en)
+	elts := kids(e)
+	except := func() (*nameClass, error) {
+		for _, c := range elts {
+			if c.Name.Local == "except" {
+				return p.nameClassChoice(kids(c), inherit(c, en))
+			}
+		}
+		return nil, nil
+	}
+	switch e.Name.Local {
+	case "name":
+		qn, err := qname(e, strings.TrimSpace(text(e)), en.ns)
+		if err != nil {
+			return nil, err
+		}
+		return &nameClass{kind: ncName, name: qn}, nil
+	case "anyName":
+		x, err := except()
+		return &nameClass{kind: ncAnyName, except: x}, err
+	case "nsName":
+		x, err := except()
+		return &nameClass{kind: ncNsName, name: xml.Name{Space: en.ns}, except: x}, err
+	case "choice":
+		return p.nameClassChoice(elts, en)
+	}
+	return nil, errorf(e, "unexpected %s in name class", e.Name.Local)
+}
+
+func (p *parser) nameClassChoice(elts []*dom.Element, en env) (*nameClass, error) {
+	var res *nameClass
+	for _, c := range elts {
+		nc, err := p.nameClass(c, en)
+		if err != nil {
+			return nil, err
+		}
+		if res == nil {
+			res = nc
+		} else {
+			res = &nameClass{kind: ncChoice, nc1: res, nc2: nc}
+		}
+	}
+	if res == nil {
+		return nil, fmt.Errorf("rng: empty name class choice")
+	}
+	return res, nil
+}
+
+// grammarContent adds the start, define, div and include elements to the grammar in en. Components
+// named in skip are overridden by an include and are ignored, start being named "".
+func (p *parser) grammarContent(elts []*dom.Element, en env, skip map[string]bool) error {
+	g := en.g
+	for _, e := range elts {
+		een := inherit(e, en)
+		switch e.Name.Local {
+		case "start":
+			if skip[""] {
+				continue
+			}
+			if g.start == nil {
+				g.start = &define{}
+			}
+			if err := g.start.add(e, een); err != nil {
+				return err
+			}
+		case "define":
+			n := strings.TrimSpace(e.Attr("name"))
+			if skip[n] {
+				continue
+			}
+			d := g.defines[n]
+			if d == nil {
+				d = &define{name: n}
+				g.defines[n] = d
+			}
+			if err := d.add(e, een); err != nil {
+				return err
+			}
+		case "div":
+			if err := p.grammarContent(kids(e), een, skip); err != nil {
+				return err
+			}
+		case "include":
+			root, href, err := p.external(e, een)
+			if err != nil {
+				return err
+			}
+			if root.Name != (xml.Name{Space: RNGURL, Local: "grammar"}) {
+				delete(p.open, href)
+				return errorf(e, "included schema %s isn't a grammar", href)
+			}
+			// Components in the include replace those of the included grammar
+			over := make(map[string]bool)
+			for k := range skip {
+				over[k] = true
+			}
+			overrides(kids(e), over)
+			ien := inherit(root, een)
+			ien.href = href
+			err = p.grammarContent(kids(root), ien, over)
+			delete(p.open, href)
+			if err != nil {
+				return err
+			}
+			if err := p.grammarContent(kids(e), een, skip); err != nil {
+				return err
+			}
+		default:
+			return errorf(e, "unexpected %s in grammar", e.Name.Local)
+		}
+	}
+	return nil
+}
+
+// overrides adds the names of the components in an include to over.
+func overrides(elts []*dom.Element, over map[string]bool) {
+	for _, e := range elts {
+		switch e.Name.Local {
+		case "start":
+			over[""] = true
+		case "define":
+			over[strings.TrimSpace(e.Attr("name"))] = true
+		case "div":
+			overrides(kids(e), over)
+		}
+	}
+}
+
+func (d *define) add(e *dom.Element, en env) error {
+	if c, ok := e.LookupAttr("combine"); ok {
+		if d.combine != "" && d.combine != c {
+			return errorf(e, "conflicting combine for %s", d.name)
+		}
+		d.combine = c
+	} else {
+		for _, b := range d.bodies {
+			if _, ok := b.elt.LookupAttr("combine"); !ok {
+				return errorf(e, "%s is defined more than once without combine", d.name)
+			}
+		}
+	}
+	d.bodies = append(d.bodies, body{e, en})
+	return nil
+}
+
+// ref returns the pattern of a definition, building it on first use.
+func (p *parser) ref(d *define, e *dom.Element) (*pattern, error) {
+	switch d.state {
+	case built:
+		return d.p, nil
+	case building:
+		return nil, errorf(e, "reference to %s is recursive without an intervening element", d.name)
+	}
+	d.state = building
+	var res *pattern
+	for _, bd := range d.bodies {
+		q, err := p.group(kids(bd.elt), bd.env)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case res == nil:
+			res = q
+		case d.combine == "interleave":
+			res = p.b.interleave(res, q)
+		default:
+			res = p.b.choice(res, q)
+		}
+	}
+	d.p = res
+	d.state = built
+	return res, nil
+}
+
+// external reads the schema referenced by the href attribute of e, returning its top level element
+// and resolved href, which is marked as open until the caller is done with it.
+func (p *parser) external(e *dom.Element, en env) (*dom.Element, string, error) {
+	href := strings.TrimSpace(e.Attr("href"))
+	href = dom.ResolveURI(en.href, href)
+	if p.load == nil {
+		return nil, "", errorf(e, "no loader to read %s", href)
+	}
+	if p.open[href] {
+		return nil, "", errorf(e, "%s refers to itself", href)
+	}
+	data, err := p.load(href)
+	if err != nil {
+		return nil, "", errorf(e, "%v", err)
+	}
+	var root *dom.Element
+	if strings.HasSuffix(href, ".rnc") {
+		// Errors in the compact syntax already give the href
+		if root, err = compact(data, href); err != nil {
+			return nil, "", err
+		}
+	} else if root, err = dom.NewXMLDecoder(bytes.NewReader(data)).BuildDOM(); err != nil {
+		return nil, "", fmt.Errorf("rng: %s: %v", href, err)
+	}
+	if root.Type == dom.Document {
+		root = root.DocumentElement()
+	}
+	p.open[href] = true
+	return root, href, nil
+}
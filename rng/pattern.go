@@ -0,0 +1,441 @@
+package rng
+
+import (
+	"encoding/xml"
+	"sort"
+	"strings"
+
+	dom "github.com/jphsd/xml"
+)
+
+// Pattern kinds.
+const (
+	pEmpty = iota
+	pNotAllowed
+	pText
+	pChoice
+	pInterleave
+	pGroup
+	pOneOrMore
+	pList
+	pData
+	pDataExcept
+	pValue
+	pAttribute
+	pElement
+	pAfter
+)
+
+// pattern is a node of a simplified schema or of a derivative. All patterns other than elements are
+// interned, so structurally equal patterns are the same pointer.
+type pattern struct {
+	kind   int
+	id     int
+	p1, p2 *pattern
+	nc     *nameClass
+	dt     *datatype
+	value  string
+	src    *dom.Element // Schema element of an element pattern
+}
+
+type patKey struct {
+	kind   int
+	p1, p2 *pattern
+	nc     *nameClass
+	dt     *datatype
+	value  string
+}
+
+// builder interns patterns. Derivatives are built with the schema's builder so that the patterns
+// they share with the schema stay interned.
+type builder struct {
+	patterns                map[patKey]*pattern
+	n                       int
+	empty, notAllowed, text *pattern
+}
+
+func newBuilder() *builder {
+	b := &builder{patterns: make(map[patKey]*pattern)}
+	b.empty = b.intern(patKey{kind: pEmpty})
+	b.notAllowed = b.intern(patKey{kind: pNotAllowed})
+	b.text = b.intern(patKey{kind: pText})
+	return b
+}
+
+func (b *builder) intern(k patKey) *pattern {
+	if p, ok := b.patterns[k]; ok {
+		return p
+	}
+	b.n++
+	p := &pattern{kind: k.kind, id: b.n, p1: k.p1, p2: k.p2, nc: k.nc, dt: k.dt, value: k.value}
+	b.patterns[k] = p
+	return p
+}
+
+// element returns a new element pattern, its content is set once built.
+func (b *builder) element(nc *nameClass, src *dom.Element) *pattern {
+	b.n++
+	return &pattern{kind: pElement, id: b.n, nc: nc, src: src}
+}
+
+func (b *builder) choice(p1, p2 *pattern) *pattern {
+	switch {
+	case p1.kind == pNotAllowed:
+		return p2
+	case p2.kind == pNotAllowed, p1 == p2:
+		return p1
+	}
+	// Keep choices as a sorted list of distinct alternatives
+	var alts []*pattern
+	var collect func(p *pattern)
+	collect = func(p *pattern) {
+		if p.kind == pChoice {
+			collect(p.p1)
+			collect(p.p2)
+			return
+		}
+		for _, a := range alts {
+			if a == p {
+				return
+			}
+		}
+		alts = append(alts, p)
+	}
+	collect(p1)
+	collect(p2)
+	sort.Slice(alts, func(i, j int) bool { return alts[i].id < alts[j].id })
+	res := alts[len(alts)-1]
+	for i := len(alts) - 2; i >= 0; i-- {
+		res = b.intern(patKey{kind: pChoice, p1: alts[i], p2: res})
+	}
+	return res
+}
+
+func (b *builder) group(p1, p2 *pattern) *pattern {
+	switch {
+	case p1.kind == pNotAllowed || p2.kind == pNotAllowed:
+		return b.notAllowed
+	case p1.kind == pEmpty:
+		return p2
+	case p2.kind == pEmpty:
+		return p1
+	}
+	return b.intern(patKey{kind: pGroup, p1: p1, p2: p2})
+}
+
+func (b *builder) interleave(p1, p2 *pattern) *pattern {
+	switch {
+	case p1.kind == pNotAllowed || p2.kind == pNotAllowed:
+		return b.notAllowed
+	case p1.kind == pEmpty:
+		return p2
+	case p2.kind == pEmpty:
+		return p1
+	}
+	return b.intern(patKey{kind: pInterleave, p1: p1, p2: p2})
+}
+
+func (b *builder) after(p1, p2 *pattern) *pattern {
+	if p1.kind == pNotAllowed || p2.kind == pNotAllowed {
+		return b.notAllowed
+	}
+	return b.intern(patKey{kind: pAfter, p1: p1, p2: p2})
+}
+
+func (b *builder) oneOrMore(p *pattern) *pattern {
+	if p.kind == pNotAllowed || p.kind == pEmpty {
+		return p
+	}
+	return b.intern(patKey{kind: pOneOrMore, p1: p})
+}
+
+func (b *builder) list(p *pattern) *pattern {
+	if p.kind == pNotAllowed {
+		return p
+	}
+	return b.intern(patKey{kind: pList, p1: p})
+}
+
+func (b *builder) data(dt *datatype, except *pattern) *pattern {
+	if except == nil || except.kind == pNotAllowed {
+		return b.intern(patKey{kind: pData, dt: dt})
+	}
+	return b.intern(patKey{kind: pDataExcept, dt: dt, p1: except})
+}
+
+func (b *builder) val(dt *datatype, v string) *pattern {
+	return b.intern(patKey{kind: pValue, dt: dt, value: v})
+}
+
+func (b *builder) attribute(nc *nameClass, p *pattern) *pattern {
+	if p.kind == pNotAllowed {
+		return p
+	}
+	return b.intern(patKey{kind: pAttribute, nc: nc, p1: p})
+}
+
+func nullable(p *pattern) bool {
+	switch p.kind {
+	case pGroup, pInterleave:
+		return nullable(p.p1) && nullable(p.p2)
+	case pChoice:
+		return nullable(p.p1) || nullable(p.p2)
+	case pOneOrMore:
+		return nullable(p.p1)
+	case pEmpty, pText:
+		return true
+	}
+	return false
+}
+
+// Name class kinds.
+const (
+	ncAnyName = iota
+	ncName
+	ncNsName
+	ncChoice
+)
+
+type nameClass struct {
+	kind     int
+	name     xml.Name // For ncName, and the namespace of ncNsName
+	except   *nameClass
+	nc1, nc2 *nameClass
+}
+
+func (nc *nameClass) contains(n xml.Name) bool {
+	switch nc.kind {
+	case ncAnyName:
+		return nc.except == nil || !nc.except.contains(n)
+	case ncName:
+		return nc.name == n
+	case ncNsName:
+		return nc.name.Space == n.Space && (nc.except == nil || !nc.except.contains(n))
+	}
+	return nc.nc1.contains(n) || nc.nc2.contains(n)
+}
+
+// String returns the name class for messages.
+func (nc *nameClass) String() string {
+	switch nc.kind {
+	case ncAnyName:
+		return "*"
+	case ncName:
+		return name(nc.name)
+	case ncNsName:
+		return "{" + nc.name.Space + "}*"
+	}
+	return nc.nc1.String() + "|" + nc.nc2.String()
+}
+
+// name formats an expanded name for messages.
+func name(n xml.Name) string {
+	if n.Space == "" {
+		return n.Local
+	}
+	return "{" + n.Space + "}" + n.Local
+}
+
+// Derivatives, following James Clark's "An algorithm for RELAX NG validation".
+
+// ctx is the element providing the namespace context of a value.
+func (b *builder) textDeriv(p *pattern, s string, ctx *dom.Element) *pattern {
+	switch p.kind {
+	case pChoice:
+		return b.choice(b.textDeriv(p.p1, s, ctx), b.textDeriv(p.p2, s, ctx))
+	case pInterleave:
+		return b.choice(b.interleave(b.textDeriv(p.p1, s, ctx), p.p2), b.interleave(p.p1, b.textDeriv(p.p2, s, ctx)))
+	case pGroup:
+		res := b.group(b.textDeriv(p.p1, s, ctx), p.p2)
+		if nullable(p.p1) {
+			res = b.choice(res, b.textDeriv(p.p2, s, ctx))
+		}
+		return res
+	case pAfter:
+		return b.after(b.textDeriv(p.p1, s, ctx), p.p2)
+	case pOneOrMore:
+		return b.group(b.textDeriv(p.p1, s, ctx), b.choice(p, b.empty))
+	case pText:
+		return p
+	case pValue:
+		if p.dt.equal(p.value, s, ctx) {
+			return b.empty
+		}
+	case pData:
+		if p.dt.allows(s, ctx) {
+			return b.empty
+		}
+	case pDataExcept:
+		if p.dt.allows(s, ctx) && !nullable(b.textDeriv(p.p1, s, ctx)) {
+			return b.empty
+		}
+	case pList:
+		if nullable(b.listDeriv(p.p1, strings.Fields(s), ctx)) {
+			return b.empty
+		}
+	}
+	return b.notAllowed
+}
+
+func (b *builder) listDeriv(p *pattern, toks []string, ctx *dom.Element) *pattern {
+	for _, t := range toks {
+		p = b.textDeriv(p, t, ctx)
+	}
+	return p
+}
+
+// applyAfter applies f to the second pattern of each After in p.
+func (b *builder) applyAfter(f func(*pattern) *pattern, p *pattern) *pattern {
+	switch p.kind {
+	case pAfter:
+		return b.after(p.p1, f(p.p2))
+	case pChoice:
+		return b.choice(b.applyAfter(f, p.p1), b.applyAfter(f, p.p2))
+	}
+	return b.notAllowed
+}
+
+func (b *builder) startTagOpenDeriv(p *pattern, n xml.Name) *pattern {
+	switch p.kind {
+	case pChoice:
+		return b.choice(b.startTagOpenDeriv(p.p1, n), b.startTagOpenDeriv(p.p2, n))
+	case pElement:
+		if p.nc.contains(n) {
+			return b.after(p.p1, b.empty)
+		}
+	case pInterleave:
+		return b.choice(
+			b.applyAfter(func(x *pattern) *pattern { return b.interleave(x, p.p2) }, b.startTagOpenDeriv(p.p1, n)),
+			b.applyAfter(func(x *pattern) *pattern { return b.interleave(p.p1, x) }, b.startTagOpenDeriv(p.p2, n)))
+	case pOneOrMore:
+		return b.applyAfter(func(x *pattern) *pattern { return b.group(x, b.choice(p, b.empty)) }, b.startTagOpenDeriv(p.p1, n))
+	case pGroup:
+		res := b.applyAfter(func(x *pattern) *pattern { return b.group(x, p.p2) }, b.startTagOpenDeriv(p.p1, n))
+		if nullable(p.p1) {
+			res = b.choice(res, b.startTagOpenDeriv(p.p2, n))
+		}
+		return res
+	case pAfter:
+		return b.applyAfter(func(x *pattern) *pattern { return b.after(x, p.p2) }, b.startTagOpenDeriv(p.p1, n))
+	}
+	return b.notAllowed
+}
+
+// attDeriv returns the derivative for an attribute. If anyValue is set the value isn't checked.
+func (b *builder) attDeriv(p *pattern, attr xml.Attr, ctx *dom.Element, anyValue bool) *pattern {
+	switch p.kind {
+	case pAfter:
+		return b.after(b.attDeriv(p.p1, attr, ctx, anyValue), p.p2)
+	case pChoice:
+		return b.choice(b.attDeriv(p.p1, attr, ctx, anyValue), b.attDeriv(p.p2, attr, ctx, anyValue))
+	case pGroup:
+		return b.choice(b.group(b.attDeriv(p.p1, attr, ctx, anyValue), p.p2), b.group(p.p1, b.attDeriv(p.p2, attr, ctx, anyValue)))
+	case pInterleave:
+		return b.choice(b.interleave(b.attDeriv(p.p1, attr, ctx, anyValue), p.p2), b.interleave(p.p1, b.attDeriv(p.p2, attr, ctx, anyValue)))
+	case pOneOrMore:
+		return b.group(b.attDeriv(p.p1, attr, ctx, anyValue), b.choice(p, b.empty))
+	case pAttribute:
+		if p.nc.contains(attr.Name) && (anyValue || b.valueMatch(p.p1, attr.Value, ctx)) {
+			return b.empty
+		}
+	}
+	return b.notAllowed
+}
+
+func (b *builder) valueMatch(p *pattern, s string, ctx *dom.Element) bool {
+	return (nullable(p) && strings.TrimSpace(s) == "") || nullable(b.textDeriv(p, s, ctx))
+}
+
+// startTagCloseDeriv removes the attribute patterns once all the attributes have been seen. If
+// recover is set missing attributes are treated as present.
+func (b *builder) startTagCloseDeriv(p *pattern, recover bool) *pattern {
+	switch p.kind {
+	case pAfter:
+		return b.after(b.startTagCloseDeriv(p.p1, recover), p.p2)
+	case pChoice:
+		return b.choice(b.startTagCloseDeriv(p.p1, recover), b.startTagCloseDeriv(p.p2, recover))
+	case pGroup:
+		return b.group(b.startTagCloseDeriv(p.p1, recover), b.startTagCloseDeriv(p.p2, recover))
+	case pInterleave:
+		return b.interleave(b.startTagCloseDeriv(p.p1, recover), b.startTagCloseDeriv(p.p2, recover))
+	case pOneOrMore:
+		return b.oneOrMore(b.startTagCloseDeriv(p.p1, recover))
+	case pAttribute:
+		if recover {
+			return b.empty
+		}
+		return b.notAllowed
+	}
+	return p
+}
+
+// endTagDeriv completes an element. If recover is set the element is treated as complete.
+func (b *builder) endTagDeriv(p *pattern, recover bool) *pattern {
+	switch p.kind {
+	case pChoice:
+		return b.choice(b.endTagDeriv(p.p1, recover), b.endTagDeriv(p.p2, recover))
+	case pAfter:
+		if recover || nullable(p.p1) {
+			return p.p2
+		}
+	}
+	return b.notAllowed
+}
+
+// expected returns the names of the elements that p can accept next.
+func expected(p *pattern) []string {
+	var res []string
+	seen := make(map[*pattern]bool)
+	var walk func(p *pattern)
+	walk = func(p *pattern) {
+		if seen[p] {
+			return
+		}
+		seen[p] = true
+		switch p.kind {
+		case pChoice, pInterleave:
+			walk(p.p1)
+			walk(p.p2)
+		case pGroup:
+			walk(p.p1)
+			if nullable(p.p1) {
+				walk(p.p2)
+			}
+		case pOneOrMore, pAfter:
+			walk(p.p1)
+		case pElement:
+			res = append(res, p.nc.String())
+		}
+	}
+	walk(p)
+	return dedup(res)
+}
+
+// required returns the names of the attributes that p still requires.
+func required(p *pattern) []string {
+	var res []string
+	switch p.kind {
+	case pGroup, pInterleave:
+		res = append(required(p.p1), required(p.p2)...)
+	case pChoice:
+		r1, r2 := required(p.p1), required(p.p2)
+		if len(r1) > 0 && len(r2) > 0 {
+			res = append(r1, r2...)
+		}
+	case pOneOrMore, pAfter:
+		res = required(p.p1)
+	case pAttribute:
+		res = []string{p.nc.String()}
+	}
+	return dedup(res)
+}
+
+func dedup(s []string) []string {
+	sort.Strings(s)
+	for i := len(s) - 1; i > 0; i-- {
+		if s[i] == s[i-1] {
+			s = append(s[:i], s[i+1:]...)
+		}
+	}
+	return s
+}
@@ -0,0 +1,297 @@
+/*
+Package rng validates the xml package's Element trees against RELAX NG schemas, written in either
+the XML or the compact syntax, using the derivative algorithm.
+
+Validation doesn't stop at the first error. After reporting an error the validator recovers by
+ignoring the offending element, attribute or text, or by treating an incomplete element as complete,
+so all the errors in a document are reported along with their locations.
+
+The built-in datatype library and the XML Schema datatype library, by way of the xsd package, are
+supported. The ID, IDREF and IDREFS datatypes are validated lexically but not for uniqueness or
+matching references, and most of the restrictions of section 7 of the specification aren't checked.
+*/
+package rng
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"sync"
+
+	dom "github.com/jphsd/xml"
+	"github.com/jphsd/xml/xsd"
+)
+
+// Namespace URIs of RELAX NG and the XML Schema datatype library.
+const (
+	RNGURL       = "http://relaxng.org/ns/structure/1.0"
+	DatatypesURL = "http://www.w3.org/2001/XMLSchema-datatypes"
+)
+
+// Schema is a simplified RELAX NG schema. A schema can be used by concurrent calls to Validate.
+type Schema struct {
+	mu       sync.Mutex
+	b        *builder
+	start    *pattern
+	elements []*pattern // All element patterns, used to check elements after an error
+}
+
+// Error reports a violation of the schema by an element, or by one of its attributes if Attr is set.
+type Error struct {
+	Element *dom.Element
+	Attr    xml.Name
+	Msg     string
+}
+
+func (e *Error) Error() string {
+	path := e.Element.Path()
+	if e.Attr.Local != "" {
+		path += "/@" + e.Attr.Local
+	}
+	if e.Element.Pos.Line > 0 {
+		return fmt.Sprintf("rng: %s %s: %s", e.Element.Pos, path, e.Msg)
+	}
+	return fmt.Sprintf("rng: %s: %s", path, e.Msg)
+}
+
+// Validate checks elt, a Document or the element to be validated, against the schema and returns all
+// the violations found as *Error values.
+func (s *Schema) Validate(elt *dom.Element) []error {
+	if elt.Type == dom.Document {
+		elt = elt.DocumentElement()
+		if elt == nil {
+			return []error{fmt.Errorf("rng: no document element")}
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v := &validator{s: s, b: s.b}
+	p := v.element(s.start, elt)
+	if p.kind == pNotAllowed && len(v.errs) == 0 {
+		v.errorf(elt, "element %s isn't valid", name(elt.Name))
+	}
+	return v.errs
+}
+
+type validator struct {
+	s    *Schema
+	b    *builder
+	errs []error
+}
+
+func (v *validator) errorf(elt *dom.Element, format string, args ...any) {
+	v.errs = append(v.errs, &Error{elt, xml.Name{}, fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) attrErrorf(elt *dom.Element, attr xml.Name, format string, args ...any) {
+	v.errs = append(v.errs, &Error{elt, attr, fmt.Sprintf(format, args...)})
+}
+
+// element returns the derivative of p with respect to elt, reporting errors and recovering from them.
+func (v *validator) element(p *pattern, elt *dom.Element) *pattern {
+	b := v.b
+	d := b.startTagOpenDeriv(p, elt.Name)
+	if d.kind == pNotAllowed {
+		msg := fmt.Sprintf("element %s isn't allowed here", name(elt.Name))
+		if exp := expected(p); len(exp) > 0 {
+			msg += ", expected " + strings.Join(exp, ", ")
+		}
+		v.errorf(elt, "%s", msg)
+		v.orphan(elt)
+		return p
+	}
+	d = v.attributes(d, elt)
+	d, reported := v.children(d, elt)
+	res := b.endTagDeriv(d, false)
+	if res.kind == pNotAllowed && reported {
+		// Invalid text content has already been reported
+		res = b.endTagDeriv(d, true)
+	} else if res.kind == pNotAllowed {
+		msg := fmt.Sprintf("element %s is incomplete", name(elt.Name))
+		if exp := expected(d); len(exp) > 0 {
+			msg += ", expected " + strings.Join(exp, ", ")
+		}
+		v.errorf(elt, "%s", msg)
+		res = b.endTagDeriv(d, true)
+	}
+	return res
+}
+
+// orphan checks an element that isn't allowed where it occurs against any element patterns for its
+// name, so that errors within it are still reported.
+func (v *validator) orphan(elt *dom.Element) {
+	p := v.b.notAllowed
+	for _, e := range v.s.elements {
+		if e.nc.contains(elt.Name) {
+			p = v.b.choice(p, e)
+		}
+	}
+	if p.kind != pNotAllowed {
+		v.element(p, elt)
+	}
+}
+
+func (v *validator) attributes(p *pattern, elt *dom.Element) *pattern {
+	b := v.b
+	for _, attr := range elt.Attributes {
+		if dom.IsNamespaceDecl(attr.Name) {
+			continue
+		}
+		d := b.attDeriv(p, attr, elt, false)
+		if d.kind == pNotAllowed {
+			if d = b.attDeriv(p, attr, elt, true); d.kind == pNotAllowed {
+				v.attrErrorf(elt, attr.Name, "attribute %s isn't allowed", name(attr.Name))
+				continue
+			}
+			v.attrErrorf(elt, attr.Name, "invalid value %q", attr.Value)
+		}
+		p = d
+	}
+	d := b.startTagCloseDeriv(p, false)
+	if d.kind == pNotAllowed {
+		msg := "missing required attribute"
+		if req := required(p); len(req) > 0 {
+			msg += " " + strings.Join(req, ", ")
+		}
+		v.errorf(elt, "%s", msg)
+		d = b.startTagCloseDeriv(p, true)
+	}
+	return d
+}
+
+// children returns the derivative of p with respect to elt's children, and whether invalid text
+// content, for which p is left incomplete, was reported.
+func (v *validator) children(p *pattern, elt *dom.Element) (*pattern, bool) {
+	b := v.b
+	// Adjacent text, separated only by comments or processing instructions, is a single string
+	type item struct {
+		elt  *dom.Element
+		text string
+	}
+	var items []item
+	nodes := false
+	pending := false
+	var sb strings.Builder
+	var first *dom.Element
+	flush := func() {
+		if pending {
+			items = append(items, item{first, sb.String()})
+			sb.Reset()
+			pending = false
+		}
+	}
+	for _, c := range elt.Children {
+		switch c.Type {
+		case dom.Node:
+			flush()
+			items = append(items, item{elt: c})
+			nodes = true
+		case dom.Content:
+			if !pending {
+				first = c
+			}
+			pending = true
+			sb.Write(c.Content)
+		}
+	}
+	flush()
+
+	if !nodes {
+		s := ""
+		if len(items) > 0 {
+			s = items[0].text
+		}
+		d := b.textDeriv(p, s, elt)
+		if strings.TrimSpace(s) == "" {
+			d = b.choice(p, d)
+		}
+		if d.kind == pNotAllowed {
+			v.textError(p, elt, s)
+			return p, true
+		}
+		return d, false
+	}
+	for _, it := range items {
+		if it.text == "" && it.elt.Type == dom.Node {
+			p = v.element(p, it.elt)
+			continue
+		}
+		if strings.TrimSpace(it.text) == "" {
+			continue
+		}
+		d := b.textDeriv(p, it.text, elt)
+		if d.kind == pNotAllowed {
+			v.textError(p, elt, it.text)
+			continue
+		}
+		p = d
+	}
+	return p, false
+}
+
+func (v *validator) textError(p *pattern, elt *dom.Element, s string) {
+	if accepts(p) {
+		v.errorf(elt, "invalid value %q", strings.TrimSpace(s))
+		return
+	}
+	v.errorf(elt, "text isn't allowed in element %s", name(elt.Name))
+}
+
+// accepts reports whether p, in its current state, has a pattern for text.
+func accepts(p *pattern) bool {
+	switch p.kind {
+	case pChoice, pInterleave:
+		return accepts(p.p1) || accepts(p.p2)
+	case pGroup:
+		return accepts(p.p1) || (nullable(p.p1) && accepts(p.p2))
+	case pOneOrMore, pAfter:
+		return accepts(p.p1)
+	case pText, pData, pDataExcept, pValue, pList:
+		return true
+	}
+	return false
+}
+
+// datatype is a datatype from the built-in or XML Schema library.
+type datatype struct {
+	lib, name string
+	xsd       *xsd.Datatype
+}
+
+func (dt *datatype) allows(s string, ctx *dom.Element) bool {
+	if dt.xsd == nil {
+		return true
+	}
+	return dt.xsd.Validate(s, ctx) == nil
+}
+
+func (dt *datatype) equal(value, s string, ctx *dom.Element) bool {
+	switch {
+	case dt.xsd != nil:
+		return dt.xsd.Validate(s, ctx) == nil && dt.xsd.Equal(value, s)
+	case dt.name == "token":
+		return strings.Join(strings.Fields(value), " ") == strings.Join(strings.Fields(s), " ")
+	}
+	return value == s
+}
+
+// newDatatype returns the datatype with the params, which for the XML Schema library are facets.
+func newDatatype(lib, name string, params []xsd.Facet) (*datatype, error) {
+	switch lib {
+	case "":
+		if name != "string" && name != "token" {
+			return nil, fmt.Errorf("unknown datatype %s", name)
+		}
+		if len(params) > 0 {
+			return nil, fmt.Errorf("datatype %s doesn't take parameters", name)
+		}
+		return &datatype{lib, name, nil}, nil
+	case DatatypesURL:
+		dt, err := xsd.NewDatatype(name, params...)
+		if err != nil {
+			return nil, err
+		}
+		return &datatype{lib, name, dt}, nil
+	}
+	return nil, fmt.Errorf("unknown datatype library %s", lib)
+}
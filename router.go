@@ -0,0 +1,326 @@
+package xml
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Router dispatches the decoder's element and character data tokens to handlers registered against
+// element paths, tracking the stack of open elements so handlers don't need to.
+//
+// Patterns are a sequence of names separated by / or //, as in XPath abbreviated syntax. A leading /
+// anchors the pattern at the document element, otherwise it can match at any depth. A name of *
+// matches any element, a name of the form {uri}local also matches the namespace and a plain name
+// matches the local name in any namespace. For example "/svg/g/path", "//item" and "feed//entry/*".
+type Router struct {
+	routes   []*route
+	stack    []xml.StartElement
+	subtrees []*subtree
+}
+
+// Handler holds the functions to be called for elements matching a route. The stack holds the open
+// elements from the document element down to, and including, the matched element. It's reused between
+// calls so must be copied if retained. Functions that are left as nil are skipped. As with XMLDecoder,
+// StartElement can return SkipChildren to skip the content of the element, and any function can return
+// Stop to end processing. The content is skipped for every route, but the other routes matching the
+// element are still called.
+//
+// If Element is set then the matched element and everything within it is built into a detached tree
+// which is passed to Element once the end of the element has been read, and then discarded. This
+// allows a stream of records to be processed as small DOMs without holding the whole document. The
+// decoder's Whitespace settings apply to these trees as they do to BuildDocument.
+type Handler struct {
+	StartElement func(token xml.StartElement, stack []xml.StartElement) error
+	EndElement   func(token xml.EndElement, stack []xml.StartElement) error
+	CharData     func(token xml.CharData, stack []xml.StartElement) error // Text directly within the element
+	Element      func(elt *Element, stack []xml.StartElement) error
+}
+
+// subtree is an element being built for a Handler.Element function.
+type subtree struct {
+	b *builder
+	h *Handler
+}
+
+type route struct {
+	pattern string
+	steps   []routeStep
+	handler *Handler
+}
+
+type routeStep struct {
+	name xml.Name // Local of * matches any name
+	any  bool     // Match any namespace
+	desc bool     // Preceded by // so any number of elements may intervene
+}
+
+// NewRouter creates a Router with no routes.
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// Handle registers the handler for elements matching the pattern. When several routes match an element
+// their handlers are called in the order they were registered.
+func (r *Router) Handle(pattern string, h *Handler) error {
+	steps, err := parseRoute(pattern)
+	if err != nil {
+		return err
+	}
+	r.routes = append(r.routes, &route{pattern, steps, h})
+	return nil
+}
+
+// Process inserts the router's functions into the decoder and processes its input. Any StartElement,
+// EndElement or CharData functions already set on the decoder are restored afterwards. Comment and
+// ProcInst functions are still called.
+func (r *Router) Process(d *XMLDecoder) error {
+	return r.ProcessContext(context.Background(), d)
+}
+
+// ProcessContext is like Process but stops once the context is done.
+func (r *Router) ProcessContext(ctx context.Context, d *XMLDecoder) error {
+	// Save existing functions
+	sef := d.StartElement
+	eef := d.EndElement
+	cdf := d.CharData
+	cf := d.Comment
+	pif := d.ProcInst
+
+	ws, err := d.Whitespace.compile()
+	if err != nil {
+		return err
+	}
+	r.stack = r.stack[:0]
+	r.subtrees = r.subtrees[:0]
+	d.StartElement = func(se xml.StartElement) error {
+		r.stack = append(r.stack, se)
+		for i, st := range r.subtrees {
+			if i > 0 {
+				// Trees mustn't share attribute slices
+				se = se.Copy()
+			}
+			st.b.start(se, d.pos)
+		}
+		// Every matching route is called even if one skips the children
+		var skip error
+		for _, rt := range r.routes {
+			if !rt.match(r.stack) {
+				continue
+			}
+			if rt.handler.Element != nil {
+				st := &subtree{&builder{nil, nil, ws}, rt.handler}
+				st.b.start(se.Copy(), d.pos)
+				r.subtrees = append(r.subtrees, st)
+			}
+			if rt.handler.StartElement != nil {
+				err := rt.handler.StartElement(se, r.stack)
+				switch {
+				case errors.Is(err, SkipChildren):
+					skip = err
+				case err != nil:
+					return err
+				}
+			}
+		}
+		return skip
+	}
+	d.EndElement = func(ee xml.EndElement) error {
+		defer func() {
+			r.stack = r.stack[:len(r.stack)-1]
+		}()
+		for _, rt := range r.routes {
+			if rt.handler.EndElement != nil && rt.match(r.stack) {
+				if err := rt.handler.EndElement(ee, r.stack); err != nil {
+					return err
+				}
+			}
+		}
+
+		// Deliver and discard any completed subtrees
+		var done []*subtree
+		n := 0
+		for _, st := range r.subtrees {
+			if st.b.end() {
+				done = append(done, st)
+			} else {
+				r.subtrees[n] = st
+				n++
+			}
+		}
+		r.subtrees = r.subtrees[:n]
+		for _, st := range done {
+			if err := st.h.Element(st.b.root, r.stack); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	d.CharData = func(cd xml.CharData) error {
+		if len(r.stack) == 0 {
+			return nil
+		}
+		for i, st := range r.subtrees {
+			if i > 0 {
+				cd = cd.Copy()
+			}
+			st.b.charData(cd, d.pos, d.cdata)
+		}
+		for _, rt := range r.routes {
+			if rt.handler.CharData != nil && rt.match(r.stack) {
+				if err := rt.handler.CharData(cd, r.stack); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	d.Comment = func(c xml.Comment) error {
+		for _, st := range r.subtrees {
+			st.b.add(&Element{Comment, xml.Name{}, nil, xml.CharData(c.Copy()), nil, nil, d.pos, false})
+		}
+		if cf != nil {
+			return cf(c)
+		}
+		return nil
+	}
+	d.ProcInst = func(pi xml.ProcInst) error {
+		for _, st := range r.subtrees {
+			pi := pi.Copy()
+			st.b.add(&Element{ProcInst, xml.Name{Local: pi.Target}, nil, pi.Inst, nil, nil, d.pos, false})
+		}
+		if pif != nil {
+			return pif(pi)
+		}
+		return nil
+	}
+
+	err = d.ProcessContext(ctx)
+
+	// Restore previous functions
+	d.StartElement = sef
+	d.EndElement = eef
+	d.CharData = cdf
+	d.Comment = cf
+	d.ProcInst = pif
+
+	return err
+}
+
+// Path returns the stack as a /-separated path of local names.
+func Path(stack []xml.StartElement) string {
+	var sb strings.Builder
+	for _, se := range stack {
+		sb.WriteByte('/')
+		sb.WriteString(se.Name.Local)
+	}
+	return sb.String()
+}
+
+// parseRoute splits a pattern into steps.
+func parseRoute(pattern string) ([]routeStep, error) {
+	if pattern == "" {
+		return nil, fmt.Errorf("xml: empty route pattern")
+	}
+	s := pattern
+	desc := true
+	if strings.HasPrefix(s, "//") {
+		s = s[2:]
+	} else if strings.HasPrefix(s, "/") {
+		s = s[1:]
+		desc = false
+	}
+
+	var steps []routeStep
+	for {
+		var name string
+		i := nextSep(s)
+		if i < 0 {
+			name, s = s, ""
+		} else {
+			name, s = s[:i], s[i:]
+		}
+		step, err := parseRouteName(name)
+		if err != nil {
+			return nil, fmt.Errorf("xml: bad route pattern %q: %v", pattern, err)
+		}
+		step.desc = desc
+		steps = append(steps, step)
+		if s == "" {
+			return steps, nil
+		}
+		if strings.HasPrefix(s, "//") {
+			s, desc = s[2:], true
+		} else {
+			s, desc = s[1:], false
+		}
+	}
+}
+
+// nextSep returns the index of the next / that isn't within a {uri}.
+func nextSep(s string) int {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case '/':
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func parseRouteName(name string) (routeStep, error) {
+	if name == "" {
+		return routeStep{}, fmt.Errorf("empty step")
+	}
+	if name == "*" {
+		return routeStep{name: xml.Name{Local: "*"}, any: true}, nil
+	}
+	if strings.HasPrefix(name, "{") {
+		i := strings.IndexByte(name, '}')
+		if i < 0 || i == len(name)-1 {
+			return routeStep{}, fmt.Errorf("malformed {uri}local name %q", name)
+		}
+		return routeStep{name: xml.Name{Space: name[1:i], Local: name[i+1:]}}, nil
+	}
+	return routeStep{name: xml.Name{Local: name}, any: true}, nil
+}
+
+func (s *routeStep) match(name xml.Name) bool {
+	if s.name.Local != "*" && s.name.Local != name.Local {
+		return false
+	}
+	return s.any || s.name.Space == name.Space
+}
+
+// match reports whether the route matches the element at the top of the stack.
+func (rt *route) match(stack []xml.StartElement) bool {
+	return matchSteps(rt.steps, len(rt.steps)-1, stack, len(stack)-1)
+}
+
+// matchSteps matches steps[:i+1] against stack[:j+1] with step i matching element j.
+func matchSteps(steps []routeStep, i int, stack []xml.StartElement, j int) bool {
+	if j < 0 || !steps[i].match(stack[j].Name) {
+		return false
+	}
+	if i == 0 {
+		return steps[0].desc || j == 0
+	}
+	if !steps[i].desc {
+		return matchSteps(steps, i-1, stack, j-1)
+	}
+	for k := j - 1; k >= 0; k-- {
+		if matchSteps(steps, i-1, stack, k) {
+			return true
+		}
+	}
+	return false
+}
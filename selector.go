@@ -0,0 +1,645 @@
+package xml
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Selector is a compiled CSS selector list, such as "svg > g.layer, #logo path:first-child".
+// Type selectors match the local name of an element in any namespace.
+type Selector struct {
+	src     string
+	complex [][]compound // Each complex selector is held right to left
+}
+
+// compound is a sequence of simple selectors and the combinator joining it to the compound on its left.
+type compound struct {
+	local string // Type selector, "" or "*" matches any element
+	conds []cond
+	comb  byte // ' ', '>', '+', '~' or 0 for the leftmost compound
+}
+
+// cond is a single attribute, class, id or pseudo-class test.
+type cond struct {
+	kind  byte   // '#', '.', '[' or ':'
+	name  string // Attribute or pseudo-class name
+	op    string // Attribute match operator, "" for presence only
+	value string
+	a, b  int       // nth-* parameters, matching positions a*n+b
+	not   *compound // Argument of :not()
+}
+
+// CompileSelector parses a CSS selector list.
+func CompileSelector(src string) (*Selector, error) {
+	p := &selParser{src: src}
+	sel := &Selector{src: src}
+	for {
+		p.skipSpace()
+		cpx, err := p.complex()
+		if err != nil {
+			return nil, err
+		}
+		// Reverse into right to left order for matching
+		for i, j := 0, len(cpx)-1; i < j; i, j = i+1, j-1 {
+			cpx[i], cpx[j] = cpx[j], cpx[i]
+		}
+		sel.complex = append(sel.complex, cpx)
+		p.skipSpace()
+		if p.eof() {
+			return sel, nil
+		}
+		if p.peek() != ',' {
+			return nil, p.errorf("unexpected %q", p.peek())
+		}
+		p.pos++
+	}
+}
+
+// MustCompileSelector is like CompileSelector but panics if the selector can't be parsed.
+func MustCompileSelector(src string) *Selector {
+	sel, err := CompileSelector(src)
+	if err != nil {
+		panic(err)
+	}
+	return sel
+}
+
+// String returns the source text of the selector.
+func (sel *Selector) String() string {
+	return sel.src
+}
+
+// Match reports whether the element matches any of the selectors in the list.
+func (sel *Selector) Match(elt *Element) bool {
+	if elt.Type != Node {
+		return false
+	}
+	for _, cpx := range sel.complex {
+		if matchComplex(elt, cpx) {
+			return true
+		}
+	}
+	return false
+}
+
+// Specificity returns the (id, class, type) specificity of the most specific selector in the list
+// that matches elt, or of the first selector if elt is nil.
+func (sel *Selector) Specificity(elt *Element) [3]int {
+	var res [3]int
+	for i, cpx := range sel.complex {
+		if elt != nil && !matchComplex(elt, cpx) {
+			continue
+		}
+		spec := specificity(cpx)
+		if elt == nil && i == 0 {
+			return spec
+		}
+		if spec[0] > res[0] || (spec[0] == res[0] && (spec[1] > res[1] || (spec[1] == res[1] && spec[2] > res[2]))) {
+			res = spec
+		}
+	}
+	return res
+}
+
+func specificity(cpx []compound) [3]int {
+	var res [3]int
+	for i := range cpx {
+		c := &cpx[i]
+		if c.local != "" && c.local != "*" {
+			res[2]++
+		}
+		for _, cd := range c.conds {
+			switch cd.kind {
+			case '#':
+				res[0]++
+			case ':':
+				if cd.name == "not" {
+					// :not() takes the specificity of its argument
+					spec := specificity([]compound{*cd.not})
+					for j := range res {
+						res[j] += spec[j]
+					}
+					continue
+				}
+				res[1]++
+			default:
+				res[1]++
+			}
+		}
+	}
+	return res
+}
+
+// Select returns the descendants of elt that match, in document order.
+func (sel *Selector) Select(elt *Element) []*Element {
+	var res []*Element
+	for _, child := range elt.Children {
+		res = sel.selectAll(child, res, false)
+	}
+	return res
+}
+
+// selectAll walks the tree in document order collecting matches, stopping after the first if first is set.
+func (sel *Selector) selectAll(elt *Element, res []*Element, first bool) []*Element {
+	if elt.Type != Node {
+		return res
+	}
+	if sel.Match(elt) {
+		res = append(res, elt)
+		if first {
+			return res
+		}
+	}
+	for _, child := range elt.Children {
+		res = sel.selectAll(child, res, first)
+		if first && len(res) > 0 {
+			return res
+		}
+	}
+	return res
+}
+
+// QuerySelector returns the first descendant of elt, in document order, that matches the selector
+// list, or nil if there isn't one.
+func (elt *Element) QuerySelector(src string) (*Element, error) {
+	sel, err := CompileSelector(src)
+	if err != nil {
+		return nil, err
+	}
+	var res []*Element
+	for _, child := range elt.Children {
+		res = sel.selectAll(child, res, true)
+		if len(res) > 0 {
+			return res[0], nil
+		}
+	}
+	return nil, nil
+}
+
+// QuerySelectorAll returns all the descendants of elt, in document order, that match the selector list.
+func (elt *Element) QuerySelectorAll(src string) ([]*Element, error) {
+	sel, err := CompileSelector(src)
+	if err != nil {
+		return nil, err
+	}
+	return sel.Select(elt), nil
+}
+
+// Matches reports whether elt matches the selector list.
+func (elt *Element) Matches(src string) (bool, error) {
+	sel, err := CompileSelector(src)
+	if err != nil {
+		return false, err
+	}
+	return sel.Match(elt), nil
+}
+
+// matchComplex matches the right to left compounds against elt, backtracking over ancestors and
+// siblings for the descendant and general sibling combinators.
+func matchComplex(elt *Element, cpx []compound) bool {
+	if !cpx[0].match(elt) {
+		return false
+	}
+	if len(cpx) == 1 {
+		return true
+	}
+	rest := cpx[1:]
+	switch cpx[0].comb {
+	case '>':
+		p := elt.Parent
+		return p != nil && p.Type == Node && matchComplex(p, rest)
+	case ' ':
+		for p := elt.Parent; p != nil && p.Type == Node; p = p.Parent {
+			if matchComplex(p, rest) {
+				return true
+			}
+		}
+	case '+':
+		sibs, i := siblings(elt)
+		i = prevSibling(sibs, i)
+		return i >= 0 && matchComplex(sibs[i], rest)
+	case '~':
+		sibs, i := siblings(elt)
+		for i = prevSibling(sibs, i); i >= 0; i = prevSibling(sibs, i) {
+			if matchComplex(sibs[i], rest) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *compound) match(elt *Element) bool {
+	if elt.Type != Node {
+		return false
+	}
+	if c.local != "" && c.local != "*" && c.local != elt.Name.Local {
+		return false
+	}
+	for i := range c.conds {
+		if !c.conds[i].match(elt) {
+			return false
+		}
+	}
+	return true
+}
+
+func (cd *cond) match(elt *Element) bool {
+	switch cd.kind {
+	case '#':
+		id, ok := elt.LookupAttr("id")
+		return ok && id == cd.name
+	case '.':
+		return hasWord(elt.Attr("class"), cd.name)
+	case '[':
+		v, ok := elt.LookupAttr(cd.name)
+		if !ok {
+			return false
+		}
+		switch cd.op {
+		case "":
+			return true
+		case "=":
+			return v == cd.value
+		case "~=":
+			return hasWord(v, cd.value)
+		case "|=":
+			return v == cd.value || strings.HasPrefix(v, cd.value+"-")
+		case "^=":
+			return cd.value != "" && strings.HasPrefix(v, cd.value)
+		case "$=":
+			return cd.value != "" && strings.HasSuffix(v, cd.value)
+		case "*=":
+			return cd.value != "" && strings.Contains(v, cd.value)
+		}
+		return false
+	}
+
+	// Pseudo-classes
+	switch cd.name {
+	case "root":
+		return elt.Parent == nil || elt.Parent.Type != Node
+	case "empty":
+		for _, child := range elt.Children {
+			if child.Type == Node || (child.Type == Content && len(child.Content) > 0) {
+				return false
+			}
+		}
+		return true
+	case "not":
+		return !cd.not.match(elt)
+	case "first-child":
+		return position(elt, false, false) == 1
+	case "last-child":
+		return position(elt, true, false) == 1
+	case "only-child":
+		return position(elt, false, false) == 1 && position(elt, true, false) == 1
+	case "first-of-type":
+		return cd.nth(position(elt, false, true), 0, 1)
+	case "last-of-type":
+		return cd.nth(position(elt, true, true), 0, 1)
+	case "only-of-type":
+		return position(elt, false, true) == 1 && position(elt, true, true) == 1
+	case "nth-child":
+		return cd.nth(position(elt, false, false), cd.a, cd.b)
+	case "nth-last-child":
+		return cd.nth(position(elt, true, false), cd.a, cd.b)
+	case "nth-of-type":
+		return cd.nth(position(elt, false, true), cd.a, cd.b)
+	case "nth-last-of-type":
+		return cd.nth(position(elt, true, true), cd.a, cd.b)
+	}
+	return false
+}
+
+// nth reports whether pos = a*n + b for some n >= 0.
+func (cd *cond) nth(pos, a, b int) bool {
+	if a == 0 {
+		return pos == b
+	}
+	d := pos - b
+	return d%a == 0 && d/a >= 0
+}
+
+// position returns the 1-based index of elt amongst its element siblings, counting from the end if
+// last is set, and only counting siblings with the same name if sameType is set.
+func position(elt *Element, last, sameType bool) int {
+	pos := 1
+	sibs, i := siblings(elt)
+	for {
+		if last {
+			i = nextSibling(sibs, i)
+		} else {
+			i = prevSibling(sibs, i)
+		}
+		if i < 0 {
+			return pos
+		}
+		if !sameType || sibs[i].Name == elt.Name {
+			pos++
+		}
+	}
+}
+
+// siblings returns the children of elt's parent and the index of elt amongst them, or -1 if it has
+// no parent.
+func siblings(elt *Element) ([]*Element, int) {
+	if elt.Parent == nil {
+		return nil, -1
+	}
+	sibs := elt.Parent.Children
+	return sibs, indexOf(sibs, elt)
+}
+
+// prevSibling returns the index of the element preceding sibs[i], skipping content, or -1 if there's
+// none.
+func prevSibling(sibs []*Element, i int) int {
+	for i--; i >= 0; i-- {
+		if sibs[i].Type == Node {
+			return i
+		}
+	}
+	return -1
+}
+
+// nextSibling returns the index of the element following sibs[i], skipping content, or -1 if there's
+// none or i is -1.
+func nextSibling(sibs []*Element, i int) int {
+	if i < 0 {
+		return -1
+	}
+	for i++; i < len(sibs); i++ {
+		if sibs[i].Type == Node {
+			return i
+		}
+	}
+	return -1
+}
+
+func indexOf(elts []*Element, elt *Element) int {
+	for i, e := range elts {
+		if e == elt {
+			return i
+		}
+	}
+	return -1
+}
+
+func hasWord(list, word string) bool {
+	if word == "" {
+		return false
+	}
+	for _, w := range strings.Fields(list) {
+		if w == word {
+			return true
+		}
+	}
+	return false
+}
+
+type selParser struct {
+	src string
+	pos int
+}
+
+func (p *selParser) eof() bool {
+	return p.pos >= len(p.src)
+}
+
+func (p *selParser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *selParser) skipSpace() bool {
+	start := p.pos
+	for !p.eof() && strings.IndexByte(" \t\n\r\f", p.src[p.pos]) >= 0 {
+		p.pos++
+	}
+	return p.pos > start
+}
+
+func (p *selParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("selector: %s at %d in %q", fmt.Sprintf(format, args...), p.pos, p.src)
+}
+
+// complex parses compounds joined by combinators, returned left to right.
+func (p *selParser) complex() ([]compound, error) {
+	var res []compound
+	var comb byte
+	for {
+		c, err := p.compound()
+		if err != nil {
+			return nil, err
+		}
+		c.comb = comb
+		res = append(res, *c)
+
+		space := p.skipSpace()
+		switch p.peek() {
+		case '>', '+', '~':
+			comb = p.peek()
+			p.pos++
+			p.skipSpace()
+		case ',', 0:
+			return res, nil
+		default:
+			if !space {
+				return nil, p.errorf("unexpected %q", p.peek())
+			}
+			comb = ' '
+		}
+	}
+}
+
+func (p *selParser) compound() (*compound, error) {
+	c := &compound{}
+	if p.peek() == '*' {
+		p.pos++
+		c.local = "*"
+	} else if name := p.ident(); name != "" {
+		c.local = name
+	}
+	for {
+		switch p.peek() {
+		case '#':
+			p.pos++
+			name := p.ident()
+			if name == "" {
+				return nil, p.errorf("expected id")
+			}
+			c.conds = append(c.conds, cond{kind: '#', name: name})
+		case '.':
+			p.pos++
+			name := p.ident()
+			if name == "" {
+				return nil, p.errorf("expected class")
+			}
+			c.conds = append(c.conds, cond{kind: '.', name: name})
+		case '[':
+			p.pos++
+			cd, err := p.attr()
+			if err != nil {
+				return nil, err
+			}
+			c.conds = append(c.conds, *cd)
+		case ':':
+			p.pos++
+			cd, err := p.pseudo()
+			if err != nil {
+				return nil, err
+			}
+			c.conds = append(c.conds, *cd)
+		default:
+			if c.local == "" && len(c.conds) == 0 {
+				return nil, p.errorf("expected selector")
+			}
+			return c, nil
+		}
+	}
+}
+
+func (p *selParser) attr() (*cond, error) {
+	p.skipSpace()
+	name := p.ident()
+	if name == "" {
+		return nil, p.errorf("expected attribute name")
+	}
+	cd := &cond{kind: '[', name: name}
+	p.skipSpace()
+	if p.peek() == ']' {
+		p.pos++
+		return cd, nil
+	}
+	for _, op := range []string{"=", "~=", "|=", "^=", "$=", "*="} {
+		if strings.HasPrefix(p.src[p.pos:], op) {
+			cd.op = op
+			p.pos += len(op)
+			break
+		}
+	}
+	if cd.op == "" {
+		return nil, p.errorf("expected attribute operator")
+	}
+	p.skipSpace()
+	if q := p.peek(); q == '"' || q == '\'' {
+		end := strings.IndexByte(p.src[p.pos+1:], q)
+		if end < 0 {
+			return nil, p.errorf("unterminated string")
+		}
+		cd.value = p.src[p.pos+1 : p.pos+1+end]
+		p.pos += end + 2
+	} else {
+		cd.value = p.ident()
+		if cd.value == "" {
+			return nil, p.errorf("expected attribute value")
+		}
+	}
+	p.skipSpace()
+	if p.peek() != ']' {
+		return nil, p.errorf("expected ]")
+	}
+	p.pos++
+	return cd, nil
+}
+
+func (p *selParser) pseudo() (*cond, error) {
+	name := p.ident()
+	cd := &cond{kind: ':', name: name}
+	switch name {
+	case "root", "empty", "first-child", "last-child", "only-child", "first-of-type", "last-of-type", "only-of-type":
+		return cd, nil
+	case "nth-child", "nth-last-child", "nth-of-type", "nth-last-of-type", "not":
+	default:
+		return nil, p.errorf("unsupported pseudo-class :%s", name)
+	}
+
+	if p.peek() != '(' {
+		return nil, p.errorf("expected (")
+	}
+	p.pos++
+	p.skipSpace()
+	if name == "not" {
+		arg, err := p.compound()
+		if err != nil {
+			return nil, err
+		}
+		cd.not = arg
+	} else {
+		end := strings.IndexByte(p.src[p.pos:], ')')
+		if end < 0 {
+			return nil, p.errorf("expected )")
+		}
+		a, b, err := parseNth(p.src[p.pos : p.pos+end])
+		if err != nil {
+			return nil, p.errorf("%s", err)
+		}
+		cd.a, cd.b = a, b
+		p.pos += end
+	}
+	p.skipSpace()
+	if p.peek() != ')' {
+		return nil, p.errorf("expected )")
+	}
+	p.pos++
+	return cd, nil
+}
+
+// ident reads a CSS identifier, allowing backslash escapes of single characters.
+func (p *selParser) ident() string {
+	var sb strings.Builder
+	for !p.eof() {
+		c := p.src[p.pos]
+		switch {
+		case c == '\\' && p.pos+1 < len(p.src):
+			sb.WriteByte(p.src[p.pos+1])
+			p.pos += 2
+			continue
+		case c == '-' || c == '_' || c >= 0x80 || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z'):
+		case '0' <= c && c <= '9' && sb.Len() > 0:
+		default:
+			return sb.String()
+		}
+		sb.WriteByte(c)
+		p.pos++
+	}
+	return sb.String()
+}
+
+// parseNth parses the an+b notation, including odd and even.
+func parseNth(s string) (int, int, error) {
+	s = strings.ReplaceAll(strings.TrimSpace(s), " ", "")
+	switch s {
+	case "odd":
+		return 2, 1, nil
+	case "even":
+		return 2, 0, nil
+	}
+	i := strings.IndexByte(s, 'n')
+	if i < 0 {
+		b, err := strconv.Atoi(s)
+		return 0, b, err
+	}
+	var a, b int
+	switch as := s[:i]; as {
+	case "", "+":
+		a = 1
+	case "-":
+		a = -1
+	default:
+		var err error
+		if a, err = strconv.Atoi(as); err != nil {
+			return 0, 0, err
+		}
+	}
+	if bs := s[i+1:]; bs != "" {
+		var err error
+		if b, err = strconv.Atoi(bs); err != nil {
+			return 0, 0, err
+		}
+	}
+	return a, b, nil
+}
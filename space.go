@@ -0,0 +1,124 @@
+package xml
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+)
+
+// Whitespace controls how BuildDocument and Router subtrees treat the character data of elements. The
+// zero value keeps every CharData token as its own Content element, exactly as read.
+//
+// Strip and Normalize apply to the text directly within the named elements, other than CDATA sections,
+// which are always kept as read. Elements are named as in Router patterns: a plain name matches the
+// local name in any namespace, {uri}local also matches the namespace and * matches every element. Text
+// within the elements named by Preserve, or within the scope of xml:space="preserve", is left as read.
+type Whitespace struct {
+	Merge     bool     // Join adjacent CharData into one Content, which is only a CDATA section if they all were
+	Strip     []string // Elements from which Content that is entirely whitespace is removed
+	Normalize []string // Elements whose Content is trimmed, and removed if empty, with runs of whitespace replaced by a space
+	Preserve  []string // Elements excepted from Strip and Normalize
+}
+
+// spacePolicy is the compiled form of Whitespace.
+type spacePolicy struct {
+	merge                      bool
+	strip, normalize, preserve []routeStep
+}
+
+// compile returns the policy for ws, or nil if it keeps all the character data as read.
+func (ws *Whitespace) compile() (*spacePolicy, error) {
+	if !ws.Merge && len(ws.Strip) == 0 && len(ws.Normalize) == 0 {
+		return nil, nil
+	}
+	p := &spacePolicy{merge: ws.Merge}
+	var err error
+	if p.strip, err = spaceNames(ws.Strip); err != nil {
+		return nil, err
+	}
+	if p.normalize, err = spaceNames(ws.Normalize); err != nil {
+		return nil, err
+	}
+	if p.preserve, err = spaceNames(ws.Preserve); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func spaceNames(names []string) ([]routeStep, error) {
+	var res []routeStep
+	for _, name := range names {
+		step, err := parseRouteName(name)
+		if err != nil {
+			return nil, fmt.Errorf("xml: bad whitespace element name %q: %v", name, err)
+		}
+		res = append(res, step)
+	}
+	return res, nil
+}
+
+func matchName(steps []routeStep, name xml.Name) bool {
+	for i := range steps {
+		if steps[i].match(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply rewrites the character data of elt, which has just been completed.
+func (p *spacePolicy) apply(elt *Element) {
+	if p.merge {
+		mergeContent(elt)
+	}
+	strip, norm := matchName(p.strip, elt.Name), matchName(p.normalize, elt.Name)
+	if !strip && !norm || matchName(p.preserve, elt.Name) || spacePreserved(elt) {
+		return
+	}
+	children := elt.Children[:0]
+	for _, child := range elt.Children {
+		if child.Type == Content && !child.CDATA {
+			if norm {
+				child.Content = xml.CharData(strings.Join(strings.FieldsFunc(string(child.Content), isSpaceRune), " "))
+			}
+			if strings.TrimFunc(string(child.Content), isSpaceRune) == "" {
+				child.Parent = nil
+				continue
+			}
+		}
+		children = append(children, child)
+	}
+	clear(elt.Children[len(children):])
+	elt.Children = children
+}
+
+// mergeContent joins adjacent Content children of elt.
+func mergeContent(elt *Element) {
+	children := elt.Children[:0]
+	for _, child := range elt.Children {
+		if n := len(children); n > 0 && child.Type == Content && children[n-1].Type == Content {
+			prev := children[n-1]
+			prev.Content = append(prev.Content[:len(prev.Content):len(prev.Content)], child.Content...)
+			prev.CDATA = prev.CDATA && child.CDATA
+			child.Parent = nil
+			continue
+		}
+		children = append(children, child)
+	}
+	clear(elt.Children[len(children):])
+	elt.Children = children
+}
+
+// spacePreserved reports whether elt is within the scope of xml:space="preserve".
+func spacePreserved(elt *Element) bool {
+	for e := elt; e != nil && e.Type == Node; e = e.Parent {
+		if v, ok := e.LookupAttrNS(xmlURL, "space"); ok {
+			return v == "preserve"
+		}
+	}
+	return false
+}
+
+func isSpaceRune(r rune) bool {
+	return r < 0x80 && isSpace(byte(r))
+}
@@ -11,6 +11,9 @@ import (
 	"math"
 )
 
+// XLinkNS is the XLink namespace used by SVG11 for href attributes.
+const XLinkNS = "http://www.w3.org/1999/xlink"
+
 // Draw is a convenience function to render the svg dom into an image. The svg is scaled to the image size.
 func Draw(dst draw.Image, dom *xml.Element) *SVG {
 	// Render the DOM
@@ -63,7 +66,7 @@ func (svg *SVG) Copy() *SVG {
 }
 
 func (svg *SVG) Process(elt *xml.Element) {
-	if elt.Type != xml.Node || elt.Attributes["display"] == "none" {
+	if elt.Type != xml.Node || elt.Attr("display") == "none" {
 		return
 	}
 
@@ -98,7 +101,7 @@ func (svg *SVG) Process(elt *xml.Element) {
 	case "clipPath":
 		svg.ClipPathElt(elt)
 	default:
-		fmt.Printf("%s not implemented\n", name)
+		fmt.Printf("%s: %s not implemented\n", elt.Pos, name)
 	}
 }
 
@@ -108,37 +111,37 @@ func (svg *SVG) SVGElt(elt *xml.Element) {
 	orig := svg.Xfm.Copy()
 
 	// Set/Capture initial fill and style
-	_, ok := elt.Attributes["fill"]
+	_, ok := elt.LookupAttr("fill")
 	if !ok {
-		elt.Attributes["fill"] = "#000"
+		elt.SetAttr("fill", "#000")
 	}
-	_, ok = elt.Attributes["fill-opacity"]
+	_, ok = elt.LookupAttr("fill-opacity")
 	if !ok {
-		elt.Attributes["fill-opacity"] = "1"
+		elt.SetAttr("fill-opacity", "1")
 	}
-	_, ok = elt.Attributes["stroke"]
+	_, ok = elt.LookupAttr("stroke")
 	if !ok {
-		elt.Attributes["stroke"] = "none"
+		elt.SetAttr("stroke", "none")
 	}
-	_, ok = elt.Attributes["stroke-opacity"]
+	_, ok = elt.LookupAttr("stroke-opacity")
 	if !ok {
-		elt.Attributes["stroke-opacity"] = "1"
+		elt.SetAttr("stroke-opacity", "1")
 	}
-	_, ok = elt.Attributes["stroke-linecap"]
+	_, ok = elt.LookupAttr("stroke-linecap")
 	if !ok {
-		elt.Attributes["stroke-linecap"] = "butt"
+		elt.SetAttr("stroke-linecap", "butt")
 	}
-	_, ok = elt.Attributes["stroke-linejoin"]
+	_, ok = elt.LookupAttr("stroke-linejoin")
 	if !ok {
-		elt.Attributes["stroke-linejoin"] = "miter"
+		elt.SetAttr("stroke-linejoin", "miter")
 	}
-	_, ok = elt.Attributes["stroke-miterlimit"]
+	_, ok = elt.LookupAttr("stroke-miterlimit")
 	if !ok {
-		elt.Attributes["stroke-miterlimit"] = "4"
+		elt.SetAttr("stroke-miterlimit", "4")
 	}
-	_, ok = elt.Attributes["clip-path"]
+	_, ok = elt.LookupAttr("clip-path")
 	if !ok {
-		elt.Attributes["clip-path"] = ""
+		elt.SetAttr("clip-path", "")
 	}
 
 	// Process all children
@@ -161,7 +164,7 @@ func (svg *SVG) GroupElt(elt *xml.Element) {
 }
 
 func (svg *SVG) PathElt(elt *xml.Element) {
-	paths := PathsFromDescription(elt.Attributes["d"])
+	paths := PathsFromDescription(elt.Attr("d"))
 
 	// Can't use renderPath since there might be multiple paths
 	xfm := svg.Transform(elt)
@@ -180,7 +183,7 @@ func (svg *SVG) PathElt(elt *xml.Element) {
 
 	fill, pen := svg.FillStroke(elt, shape.BoundingBox())
 
-	cid := ParseUrlId(elt.Attributes["clip-path"])
+	cid := ParseUrlId(elt.Attr("clip-path"))
 	clip := svg.Clip[cid]
 	if fill != nil {
 		svg.Rend.AddClippedShape(shape, clip, fill.Filler, nil)
@@ -192,16 +195,16 @@ func (svg *SVG) PathElt(elt *xml.Element) {
 }
 
 func (svg *SVG) RectElt(elt *xml.Element) {
-	x1 := ParseValue(elt.Attributes["x"])
-	y1 := ParseValue(elt.Attributes["y"])
-	w := ParseValue(elt.Attributes["width"])
-	h := ParseValue(elt.Attributes["height"])
+	x1 := ParseValue(elt.Attr("x"))
+	y1 := ParseValue(elt.Attr("y"))
+	w := ParseValue(elt.Attr("width"))
+	h := ParseValue(elt.Attr("height"))
 	x2, y2 := x1+w, y1+h
 
 	// Handle optional rx, ry
 	var rxp, ryp bool
-	rxa, rxp := elt.Attributes["rx"]
-	rya, ryp := elt.Attributes["ry"]
+	rxa, rxp := elt.LookupAttr("rx")
+	rya, ryp := elt.LookupAttr("ry")
 
 	var path *g2d.Path
 	if rxp || ryp {
@@ -241,36 +244,36 @@ func (svg *SVG) RectElt(elt *xml.Element) {
 }
 
 func (svg *SVG) CircleElt(elt *xml.Element) {
-	cx := ParseValue(elt.Attributes["cx"])
-	cy := ParseValue(elt.Attributes["cy"])
-	r := ParseValue(elt.Attributes["r"])
+	cx := ParseValue(elt.Attr("cx"))
+	cy := ParseValue(elt.Attr("cy"))
+	r := ParseValue(elt.Attr("r"))
 	path := g2d.Circle([]float64{cx, cy}, r)
 
 	svg.renderPath(path, elt)
 }
 
 func (svg *SVG) EllipseElt(elt *xml.Element) {
-	cx := ParseValue(elt.Attributes["cx"])
-	cy := ParseValue(elt.Attributes["cy"])
-	rx := ParseValue(elt.Attributes["rx"])
-	ry := ParseValue(elt.Attributes["ry"])
+	cx := ParseValue(elt.Attr("cx"))
+	cy := ParseValue(elt.Attr("cy"))
+	rx := ParseValue(elt.Attr("rx"))
+	ry := ParseValue(elt.Attr("ry"))
 	path := g2d.Ellipse([]float64{cx, cy}, rx, ry, 0)
 
 	svg.renderPath(path, elt)
 }
 
 func (svg *SVG) LineElt(elt *xml.Element) {
-	x1 := ParseValue(elt.Attributes["x1"])
-	y1 := ParseValue(elt.Attributes["y1"])
-	x2 := ParseValue(elt.Attributes["x2"])
-	y2 := ParseValue(elt.Attributes["y2"])
+	x1 := ParseValue(elt.Attr("x1"))
+	y1 := ParseValue(elt.Attr("y1"))
+	x2 := ParseValue(elt.Attr("x2"))
+	y2 := ParseValue(elt.Attr("y2"))
 	path := g2d.Line([]float64{x1, y1}, []float64{x2, y2})
 
 	svg.renderPath(path, elt)
 }
 
 func (svg *SVG) PolylineElt(elt *xml.Element) {
-	pstr := elt.Attributes["points"]
+	pstr := elt.Attr("points")
 	pstr = wscpat.ReplaceAllString(pstr, " ")
 	pstr = "X" + cpat.ReplaceAllString(pstr, "$1 -") // Add dummy command
 	_, coords := commandCoords(pstr)
@@ -283,7 +286,7 @@ func (svg *SVG) PolylineElt(elt *xml.Element) {
 }
 
 func (svg *SVG) PolygonElt(elt *xml.Element) {
-	pstr := elt.Attributes["points"]
+	pstr := elt.Attr("points")
 	pstr = wscpat.ReplaceAllString(pstr, " ")
 	pstr = "X" + cpat.ReplaceAllString(pstr, "$1 -") // Add dummy command
 	_, coords := commandCoords(pstr)
@@ -299,7 +302,7 @@ func (svg *SVG) PolygonElt(elt *xml.Element) {
 func (svg *SVG) DefsElt(elt *xml.Element) {
 	for _, child := range elt.Children {
 		if child.Type == xml.Node {
-			id, ok := child.Attributes["id"]
+			id, ok := child.LookupAttr("id")
 			if ok {
 				svg.Defs[id] = child
 			}
@@ -310,16 +313,19 @@ func (svg *SVG) DefsElt(elt *xml.Element) {
 func (svg *SVG) UseElt(elt *xml.Element) {
 	nsvg := svg.Copy()
 
-	// Find href
-	id, ok := elt.Attributes["href"]
+	// Find href, SVG11 uses xlink:href
+	id, ok := elt.LookupAttrNS(XLinkNS, "href")
+	if !ok {
+		id, ok = elt.LookupAttr("href")
+	}
 	if !ok {
-		fmt.Println("no id attribute in <use>")
+		fmt.Printf("%s: no id attribute in <use>\n", elt.Pos)
 		return
 	}
 	id = id[1:]
 	delt, ok := svg.Defs[id]
 	if !ok {
-		fmt.Printf("id %s not defined\n", id)
+		fmt.Printf("%s: id %s not defined\n", elt.Pos, id)
 		return
 	}
 
@@ -329,8 +335,8 @@ func (svg *SVG) UseElt(elt *xml.Element) {
 		nsvg.Xfm.Concatenate(*xfm)
 	}
 	// Add <use> x, y translation
-	x := ParseValue(elt.Attributes["x"])
-	y := ParseValue(elt.Attributes["y"])
+	x := ParseValue(elt.Attr("x"))
+	y := ParseValue(elt.Attr("y"))
 	nsvg.Xfm.Concatenate(*g2d.Translate(x, y))
 
 	// Clone and attach current as parent
@@ -345,7 +351,7 @@ func (svg *SVG) ClipPathElt(elt *xml.Element) {
 	// All paths are or'd together
 	// clip-path can be specified (intersection of the two) - ignore since that would yield an image and not a shape
 
-	id, ok := elt.Attributes["id"]
+	id, ok := elt.LookupAttr("id")
 	if !ok {
 		return
 	}
@@ -365,27 +371,27 @@ func (svg *SVG) ClipPathElt(elt *xml.Element) {
 // End of Element functions
 
 func (svg *SVG) Transform(elt *xml.Element) *g2d.Aff3 {
-	return ParseTransform(elt.Attributes["transform"])
+	return ParseTransform(elt.Attr("transform"))
 }
 
 func (svg *SVG) FillStroke(elt *xml.Element, bb [][]float64) (*g2d.Pen, *g2d.Pen) {
 	var fill, pen *g2d.Pen
 
 	//fmt.Printf("\n<%s>\n", elt.Name.Local)
-	//for k, v := range elt.Attributes {
-	//	fmt.Printf("%s: %s\n", k, v)
+	//for _, attr := range elt.Attributes {
+	//	fmt.Printf("%s: %s\n", attr.Name.Local, attr.Value)
 	//}
 
 	// visibility
-	if elt.Attributes["visibility"] == "hidden" {
+	if elt.Attr("visibility") == "hidden" {
 		return fill, pen
 	}
 
 	// fill and fill-opacity
-	col := ParseColor(elt.Attributes["fill"])
+	col := ParseColor(elt.Attr("fill"))
 	if col != nil {
 		fcol, _ := col.(color.RGBA)
-		fop := ParseValue(elt.Attributes["fill-opacity"])
+		fop := ParseValue(elt.Attr("fill-opacity"))
 		if fop < 0 {
 			fop = 0
 		} else if fop > 1 {
@@ -400,12 +406,12 @@ func (svg *SVG) FillStroke(elt *xml.Element, bb [][]float64) (*g2d.Pen, *g2d.Pen
 	}
 
 	// stroke and stroke-opacity
-	col = ParseColor(elt.Attributes["stroke"])
+	col = ParseColor(elt.Attr("stroke"))
 	if col == nil {
 		return fill, pen
 	}
 	scol, _ := col.(color.RGBA)
-	sop := ParseValue(elt.Attributes["stroke-opacity"])
+	sop := ParseValue(elt.Attr("stroke-opacity"))
 	if sop < 0 {
 		sop = 0
 	} else if sop > 1 {
@@ -418,13 +424,13 @@ func (svg *SVG) FillStroke(elt *xml.Element, bb [][]float64) (*g2d.Pen, *g2d.Pen
 	}
 
 	// stroke-width
-	sw, _ := ParseValueUnit(elt.Attributes["stroke-width"])
+	sw, _ := ParseValueUnit(elt.Attr("stroke-width"))
 	if util.Equals(sw, 0) {
 		sw = 1
 	}
 
 	// vector-effect attribute is from SVG12
-	if elt.Attributes["vector-effect"] != "non-scaling-stroke" {
+	if elt.Attr("vector-effect") != "non-scaling-stroke" {
 		// Per SVG spec sw is scaled by the current xfm
 		// Calc sx and sy by transforming points sw in x and y away from
 		// the shape's minimum and then combining them
@@ -442,7 +448,7 @@ func (svg *SVG) FillStroke(elt *xml.Element, bb [][]float64) (*g2d.Pen, *g2d.Pen
 	pen = g2d.NewPen(scol, sw)
 
 	// stroke-linecap: butt, [round, square]
-	attr, ok := elt.Attributes["stroke-linecap"]
+	attr, ok := elt.LookupAttr("stroke-linecap")
 	if ok {
 		tsp, _ := pen.Stroke.(*g2d.StrokeProc)
 		switch attr {
@@ -465,7 +471,7 @@ func (svg *SVG) FillStroke(elt *xml.Element, bb [][]float64) (*g2d.Pen, *g2d.Pen
 
 	// stroke-linejoin: miter, [round, bevel]
 	// stroke-miterlimit: 4 [1,) ratio of miter length to stroke width
-	attr, ok = elt.Attributes["stroke-linejoin"]
+	attr, ok = elt.LookupAttr("stroke-linejoin")
 	if ok {
 		tsp, _ := pen.Stroke.(*g2d.StrokeProc)
 		rhs, _ := tsp.RHSProc.(g2d.TraceProc)
@@ -475,7 +481,7 @@ func (svg *SVG) FillStroke(elt *xml.Element, bb [][]float64) (*g2d.Pen, *g2d.Pen
 			fallthrough
 		case "miter":
 			ml := 4.0
-			attr = elt.Attributes["stroke-miterlimit"]
+			attr = elt.Attr("stroke-miterlimit")
 			if attr != "" {
 				ml = ParseValue(attr)
 				if ml < 1 {
@@ -514,7 +520,7 @@ func (svg *SVG) renderPath(path *g2d.Path, elt *xml.Element) {
 
 	fill, pen := svg.FillStroke(elt, shape.BoundingBox())
 
-	cid := ParseUrlId(elt.Attributes["clip-path"])
+	cid := ParseUrlId(elt.Attr("clip-path"))
 	clip := svg.Clip[cid]
 	if fill != nil {
 		svg.Rend.AddClippedShape(shape, clip, fill.Filler, nil)
@@ -527,7 +533,11 @@ func (svg *SVG) renderPath(path *g2d.Path, elt *xml.Element) {
 
 func inheritAttributes(elt *xml.Element) {
 	// style stomps on presentation attributes
-	ParseStyle(elt.Attributes["style"], elt.Attributes)
+	style := make(map[string]string)
+	ParseStyle(elt.Attr("style"), style)
+	for k, v := range style {
+		elt.SetAttr(k, v)
+	}
 
 	if elt.Parent == nil {
 		return
@@ -545,27 +555,24 @@ func inheritAttributes(elt *xml.Element) {
 		"stroke-miterlimit",
 	}
 
-	// Make a new map with the preserved elements from the parent and then update with the child
-	cattrs := elt.Attributes
-	pattrs := elt.Parent.Attributes
-	attrs := make(map[string]string)
+	// Copy the preserved attributes from the parent unless the child already has them
 	for _, attr := range preserve {
-		v, ok := pattrs[attr]
+		_, ok := elt.LookupAttr(attr)
 		if ok {
-			attrs[attr] = v
+			continue
+		}
+		v, ok := elt.Parent.LookupAttr(attr)
+		if ok {
+			elt.SetAttr(attr, v)
 		}
 	}
-	for k, v := range cattrs {
-		attrs[k] = v
-	}
-	elt.Attributes = attrs
 }
 
 func insideClipPath(elt *xml.Element) (bool, string) {
 	for elt != nil {
 		elt = elt.Parent
 		if elt != nil && elt.Name.Local == "clipPath" {
-			return true, elt.Attributes["id"]
+			return true, elt.Attr("id")
 		}
 	}
 	return false, ""
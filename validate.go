@@ -0,0 +1,457 @@
+package xml
+
+import (
+	"encoding/xml"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ValidityError reports an element that doesn't conform to a DTD.
+type ValidityError struct {
+	Element *Element
+	Msg     string
+}
+
+func (e *ValidityError) Error() string {
+	if e.Element.Pos.Line > 0 {
+		return fmt.Sprintf("xml: %s %s: %s", e.Element.Pos, e.Element.Path(), e.Msg)
+	}
+	return fmt.Sprintf("xml: %s: %s", e.Element.Path(), e.Msg)
+}
+
+// Validate checks elt and its descendants against the element and attribute declarations of the DTD
+// and returns the validity errors found. If elt is a Document its document element must also have
+// the name given in the DOCTYPE. Names are compared as qualified names, using the prefixes in scope
+// in the tree.
+func (dtd *DTD) Validate(elt *Element) []error {
+	v := &validator{dtd: dtd, ids: make(map[string]bool)}
+	if elt.Type == Document {
+		root := elt.DocumentElement()
+		if root == nil {
+			return []error{&ValidityError{elt, "no document element"}}
+		}
+		if dtd.Name != "" && qname(root) != dtd.Name {
+			v.errorf(root, "document element isn't %s", dtd.Name)
+		}
+		elt = root
+	}
+	v.element(elt)
+	for _, ref := range v.refs {
+		if !v.ids[ref.id] {
+			v.errorf(ref.elt, "IDREF %q has no matching ID", ref.id)
+		}
+	}
+	return v.errs
+}
+
+type validator struct {
+	dtd  *DTD
+	ids  map[string]bool
+	refs []idref
+	errs []error
+}
+
+type idref struct {
+	elt *Element
+	id  string
+}
+
+func (v *validator) errorf(elt *Element, format string, args ...any) {
+	v.errs = append(v.errs, &ValidityError{elt, fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) element(elt *Element) {
+	name := qname(elt)
+	decl, ok := v.dtd.Elements[name]
+	if !ok {
+		v.errorf(elt, "element %s isn't declared", name)
+	} else {
+		v.content(elt, decl)
+	}
+	v.attributes(elt, name)
+	for _, c := range elt.Children {
+		if c.Type == Node {
+			v.element(c)
+		}
+	}
+}
+
+// content checks the children of elt against its content model.
+func (v *validator) content(elt *Element, decl *ElementDecl) {
+	switch decl.Type {
+	case ContentAny:
+		return
+	case ContentEmpty:
+		if len(elt.Children) > 0 {
+			v.errorf(elt, "element %s is declared EMPTY but has content", decl.Name)
+		}
+		return
+	}
+	var names []string
+	for _, c := range elt.Children {
+		switch c.Type {
+		case Node:
+			names = append(names, qname(c))
+		case Content:
+			if decl.Type == ContentChildren && strings.TrimLeft(string(c.Content), " \t\r\n") != "" {
+				v.errorf(elt, "character data isn't allowed in element %s", decl.Name)
+				return
+			}
+		}
+	}
+	if decl.Type == ContentMixed {
+		for _, n := range names {
+			allowed := false
+			for _, p := range decl.Model.Children {
+				allowed = allowed || p.Name == n
+			}
+			if !allowed {
+				v.errorf(elt, "element %s isn't allowed in element %s", n, decl.Name)
+			}
+		}
+		return
+	}
+	for _, end := range decl.Model.match(names, 0) {
+		if end == len(names) {
+			return
+		}
+	}
+	v.errorf(elt, "content (%s) of element %s doesn't match %s", strings.Join(names, ","), decl.Name, decl.Model)
+}
+
+func (v *validator) attributes(elt *Element, name string) {
+	decls := v.dtd.Attributes[name]
+	seen := make(map[string]bool)
+	for _, attr := range elt.Attributes {
+		aname := attrQName(elt, attr.Name)
+		var decl *AttrDecl
+		for _, d := range decls {
+			if d.Name == aname {
+				decl = d
+			}
+		}
+		if decl == nil {
+			if !IsNamespaceDecl(attr.Name) {
+				v.errorf(elt, "attribute %s isn't declared", aname)
+			}
+			continue
+		}
+		seen[aname] = true
+		v.attrValue(elt, decl, normalizeAttr(decl.Type, attr.Value))
+	}
+	for _, d := range decls {
+		if d.Default == AttrRequired && !seen[d.Name] {
+			v.errorf(elt, "required attribute %s is missing", d.Name)
+		}
+	}
+}
+
+func (v *validator) attrValue(elt *Element, decl *AttrDecl, val string) {
+	if decl.Default == AttrFixed && val != decl.Value {
+		v.errorf(elt, "attribute %s must have the value %q", decl.Name, decl.Value)
+		return
+	}
+	switch decl.Type {
+	case "ID":
+		switch {
+		case !isName(val):
+			v.errorf(elt, "ID %q isn't a name", val)
+		case v.ids[val]:
+			v.errorf(elt, "ID %q isn't unique", val)
+		default:
+			v.ids[val] = true
+		}
+	case "IDREF", "IDREFS":
+		vals := strings.Fields(val)
+		if len(vals) == 0 || (decl.Type == "IDREF" && len(vals) > 1) {
+			v.errorf(elt, "attribute %s value %q isn't valid for %s", decl.Name, val, decl.Type)
+		}
+		for _, id := range vals {
+			if !isName(id) {
+				v.errorf(elt, "IDREF %q isn't a name", id)
+				continue
+			}
+			v.refs = append(v.refs, idref{elt, id})
+		}
+	case "ENTITY", "ENTITIES":
+		vals := strings.Fields(val)
+		if len(vals) == 0 || (decl.Type == "ENTITY" && len(vals) > 1) {
+			v.errorf(elt, "attribute %s value %q isn't valid for %s", decl.Name, val, decl.Type)
+		}
+		for _, name := range vals {
+			if e, ok := v.dtd.Entities[name]; !ok || e.Notation == "" {
+				v.errorf(elt, "attribute %s refers to %q which isn't an unparsed entity", decl.Name, name)
+			}
+		}
+	case "NMTOKEN", "NMTOKENS":
+		vals := strings.Fields(val)
+		if len(vals) == 0 || (decl.Type == "NMTOKEN" && len(vals) > 1) {
+			v.errorf(elt, "attribute %s value %q isn't valid for %s", decl.Name, val, decl.Type)
+		}
+		for _, tok := range vals {
+			if !isNmtoken(tok) {
+				v.errorf(elt, "attribute %s value %q isn't a name token", decl.Name, tok)
+			}
+		}
+	case "ENUMERATION", "NOTATION":
+		for _, allowed := range decl.Values {
+			if val == allowed {
+				return
+			}
+		}
+		v.errorf(elt, "attribute %s value %q isn't one of %s", decl.Name, val, strings.Join(decl.Values, "|"))
+	}
+}
+
+// match returns the positions in names at which a match of the particle starting at i can end.
+func (p *Particle) match(names []string, i int) []int {
+	once := func(i int) []int {
+		switch p.Type {
+		case ParticleName:
+			if i < len(names) && names[i] == p.Name {
+				return []int{i + 1}
+			}
+			return nil
+		case ParticleSeq:
+			cur := []int{i}
+			for _, c := range p.Children {
+				var next []int
+				for _, j := range cur {
+					next = union(next, c.match(names, j))
+				}
+				cur = next
+			}
+			return cur
+		}
+		var res []int
+		for _, c := range p.Children {
+			res = union(res, c.match(names, i))
+		}
+		return res
+	}
+
+	switch p.Occur {
+	case '?':
+		return union([]int{i}, once(i))
+	case '*', '+':
+		var res []int
+		if p.Occur == '*' {
+			res = []int{i}
+		}
+		frontier := once(i)
+		for len(frontier) > 0 {
+			var next []int
+			for _, j := range frontier {
+				var added bool
+				if res, added = insert(res, j); added {
+					next = union(next, once(j))
+				}
+			}
+			frontier = next
+		}
+		return res
+	}
+	return once(i)
+}
+
+// String returns the particle in DTD syntax.
+func (p *Particle) String() string {
+	s := p.Name
+	if p.Type != ParticleName {
+		sep := ","
+		if p.Type == ParticleChoice {
+			sep = "|"
+		}
+		parts := make([]string, len(p.Children))
+		for i, c := range p.Children {
+			parts[i] = c.String()
+		}
+		s = "(" + strings.Join(parts, sep) + ")"
+	}
+	if p.Occur != 0 {
+		s += string(p.Occur)
+	}
+	return s
+}
+
+// Sets of positions are kept as sorted slices, which positions are mostly added to in increasing
+// order, so that repeated particles over many children aren't quadratic.
+
+// union adds the positions in b to a.
+func union(a, b []int) []int {
+	for _, j := range b {
+		a, _ = insert(a, j)
+	}
+	return a
+}
+
+// insert adds j to a and reports whether it wasn't already present.
+func insert(a []int, j int) ([]int, bool) {
+	i, found := slices.BinarySearch(a, j)
+	if found {
+		return a, false
+	}
+	return slices.Insert(a, i, j), true
+}
+
+// qname returns the qualified name of a Node, as used in a DTD, from the prefixes in scope.
+func qname(elt *Element) string {
+	if elt.Name.Space == "" {
+		return elt.Name.Local
+	}
+	if prefix, ok := elt.LookupPrefix(elt.Name.Space); ok {
+		if prefix == "" {
+			return elt.Name.Local
+		}
+		return prefix + ":" + elt.Name.Local
+	}
+	// An undeclared prefix is left in Space by the decoder
+	return elt.Name.Space + ":" + elt.Name.Local
+}
+
+// attrQName returns the qualified name of an attribute of elt.
+func attrQName(elt *Element, name xml.Name) string {
+	switch {
+	case IsNamespaceDecl(name) && name.Space == "":
+		return "xmlns"
+	case name.Space == "":
+		return name.Local
+	}
+	if prefix, ok := elt.lookupPrefix(name.Space, true); ok {
+		return prefix + ":" + name.Local
+	}
+	return name.Space + ":" + name.Local
+}
+
+// AddDefaults adds the attributes that have a default or fixed value in the DTD and are missing from
+// elt. Prefixed names are resolved in the scope of elt, after any namespace declarations have been
+// added. The names of elt and its other attributes aren't resolved again, as BuildDocument does.
+func (dtd *DTD) AddDefaults(elt *Element) {
+	dtd.addDefaults(elt, true)
+	dtd.addDefaults(elt, false)
+}
+
+// addDefaults adds either the defaulted namespace declarations or the other defaulted attributes to
+// elt, and reports whether any were added.
+func (dtd *DTD) addDefaults(elt *Element, decls bool) bool {
+	added := false
+	for _, d := range dtd.Attributes[qname(elt)] {
+		if d.Default != AttrDefault && d.Default != AttrFixed {
+			continue
+		}
+		if decl := d.Name == "xmlns" || strings.HasPrefix(d.Name, "xmlns:"); decl != decls {
+			continue
+		}
+		var name xml.Name
+		prefix, local, ok := strings.Cut(d.Name, ":")
+		switch {
+		case !ok:
+			name.Local = d.Name
+		case prefix == "xmlns":
+			name = xml.Name{Space: prefix, Local: local}
+		default:
+			name = xml.Name{Space: prefix, Local: local}
+			if uri, ok := elt.LookupNamespaceURI(prefix); ok {
+				name.Space = uri
+			}
+		}
+		if elt.attrIndex(name.Space, name.Local) < 0 {
+			elt.Attributes = append(elt.Attributes, xml.Attr{Name: name, Value: d.Value})
+			added = true
+		}
+	}
+	return added
+}
+
+// normalize applies the additional normalization of values that aren't CDATA to the attributes of elt
+// that the DTD declares with another type.
+func (dtd *DTD) normalize(elt *Element) {
+	for _, d := range dtd.Attributes[qname(elt)] {
+		if d.Type == "CDATA" {
+			continue
+		}
+		for i, attr := range elt.Attributes {
+			if attrQName(elt, attr.Name) == d.Name {
+				elt.Attributes[i].Value = normalizeAttr(d.Type, attr.Value)
+			}
+		}
+	}
+}
+
+// nsScope tracks the namespace declarations read by the underlying decoder, which doesn't know of
+// those defaulted by the DTD. Once any have been defaulted, the names the decoder resolves are mapped
+// back to their prefixes and resolved again in the scope of the tree.
+type nsScope struct {
+	decls     []binding // Declarations read, innermost last
+	marks     []int     // Length of decls outside each open element
+	defaulted bool      // A namespace declaration has been defaulted
+}
+
+func (s *nsScope) start(se xml.StartElement) {
+	s.marks = append(s.marks, len(s.decls))
+	for _, attr := range se.Attr {
+		if IsNamespaceDecl(attr.Name) {
+			s.decls = append(s.decls, binding{declPrefix(attr.Name), attr.Value})
+		}
+	}
+}
+
+func (s *nsScope) end() {
+	n := len(s.marks) - 1
+	s.decls = s.decls[:s.marks[n]]
+	s.marks = s.marks[:n]
+}
+
+// lookup returns the URI the decoder has bound to prefix.
+func (s *nsScope) lookup(prefix string) string {
+	for i := len(s.decls) - 1; i >= 0; i-- {
+		if s.decls[i].prefix == prefix {
+			return s.decls[i].uri
+		}
+	}
+	return ""
+}
+
+// prefix returns the prefix that the decoder resolved to space. Prefixes that aren't bound are left
+// in Space by the decoder.
+func (s *nsScope) prefix(space string, attr bool) string {
+	if space == "" {
+		return ""
+	}
+	for i := len(s.decls) - 1; i >= 0; i-- {
+		b := s.decls[i]
+		if b.uri == space && !(attr && b.prefix == "") && s.lookup(b.prefix) == space {
+			return b.prefix
+		}
+	}
+	return space
+}
+
+// resolve resolves the names of elt, just started, and its attributes in the scope of the tree.
+func (s *nsScope) resolve(elt *Element) {
+	uri := func(space string, attr bool) string {
+		if space == xmlURL {
+			return space
+		}
+		prefix := s.prefix(space, attr)
+		if prefix == "" && attr {
+			return ""
+		}
+		if uri, ok := elt.LookupNamespaceURI(prefix); ok {
+			return uri
+		}
+		if prefix == "" {
+			return ""
+		}
+		return prefix
+	}
+	elt.Name.Space = uri(elt.Name.Space, false)
+	attrs := slices.Clone(elt.Attributes)
+	for i, attr := range attrs {
+		if !IsNamespaceDecl(attr.Name) {
+			attrs[i].Name.Space = uri(attr.Name.Space, true)
+		}
+	}
+	elt.Attributes = attrs
+}
@@ -0,0 +1,591 @@
+/*
+Package xinclude implements XInclude 1.0 processing of the xml package's Element trees.
+
+Each xi:include element is replaced by the document, or the elements selected from it by an
+xpointer attribute, or the text read from the resource referenced by its href attribute. The
+xpointer attribute may use the element() scheme and shorthand pointers, which match xml:id
+attributes and, in included documents, attributes declared as IDs in their internal subset. Other
+schemes are skipped. A resource that can't be read or selected from is replaced by the content of
+the include's xi:fallback element if it has one.
+
+Included elements get xml:base and xml:lang attributes where their base URI or language would
+otherwise change, and the namespace declarations in scope in their source.
+*/
+package xinclude
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	dom "github.com/jphsd/xml"
+)
+
+// NamespaceURL is the XInclude namespace URI.
+const NamespaceURL = "http://www.w3.org/2001/XInclude"
+
+const xmlURL = "http://www.w3.org/XML/1998/namespace"
+
+// Process replaces the xi:include elements in elt, a Document or any element, with what they include.
+// The href is the location of elt's document, against which the href attributes are resolved. Included
+// documents are read with resolve, and are processed in turn. Processing stops at the first fatal
+// error, such as an inclusion loop or a resource error with no fallback.
+func Process(elt *dom.Element, href string, resolve dom.Resolver) error {
+	p := &processor{resolve: resolve, docs: make(map[string][]byte), open: make(map[string]bool)}
+	if isXI(elt, "include") {
+		if elt.Parent == nil {
+			return errorf(elt, href, "can't replace an include without a parent")
+		}
+		return p.replace(elt, href)
+	}
+	return p.walk(elt, href)
+}
+
+type processor struct {
+	resolve dom.Resolver
+	docs    map[string][]byte // Resources read so far
+	open    map[string]bool   // Inclusions in progress, by href and xpointer
+}
+
+// resourceError is a failure to read or select from a resource, which is recovered from by a fallback.
+type resourceError struct {
+	err error
+}
+
+func (e *resourceError) Error() string {
+	return e.err.Error()
+}
+
+// errorf returns an error located at e in the document at href.
+func errorf(e *dom.Element, href string, format string, args ...any) error {
+	msg := fmt.Sprintf(format, args...)
+	loc := href
+	if e.Pos.Line > 0 {
+		if loc != "" {
+			loc += ":"
+		}
+		loc += e.Pos.String()
+	}
+	if loc != "" {
+		return fmt.Errorf("xinclude: %s %s: %s", loc, e.Path(), msg)
+	}
+	return fmt.Errorf("xinclude: %s: %s", e.Path(), msg)
+}
+
+func isXI(e *dom.Element, local string) bool {
+	return e.Type == dom.Node && e.Name.Space == NamespaceURL && e.Name.Local == local
+}
+
+// walk processes the descendants of e, whose document is at href.
+func (p *processor) walk(e *dom.Element, href string) error {
+	// Replacement changes the children so iterate over a copy
+	kids := append([]*dom.Element(nil), e.Children...)
+	for _, c := range kids {
+		switch {
+		case c.Type != dom.Node:
+		case isXI(c, "include"):
+			if err := p.replace(c, href); err != nil {
+				return err
+			}
+		case isXI(c, "fallback"):
+			return errorf(c, href, "fallback isn't the child of an include")
+		default:
+			if err := p.walk(c, href); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// replace puts the result of the include inc in its place.
+func (p *processor) replace(inc *dom.Element, href string) error {
+	nodes, err := p.include(inc, href)
+	if err != nil {
+		return err
+	}
+	parent := inc.Parent
+	if parent.Type == dom.Document {
+		n := 0
+		for _, c := range nodes {
+			if c.Type == dom.Node {
+				n++
+			}
+			if c.Type == dom.Content {
+				return errorf(inc, href, "text can't replace the document element")
+			}
+		}
+		if n != 1 {
+			return errorf(inc, href, "include of the document element must give a single element")
+		}
+	}
+	for _, c := range nodes {
+		parent.InsertBefore(c, inc)
+	}
+	inc.Detach()
+	return nil
+}
+
+// include returns the nodes that replace inc, processed and fixed up for their new location.
+func (p *processor) include(inc *dom.Element, docHref string) ([]*dom.Element, error) {
+	var fallback *dom.Element
+	for _, c := range inc.Children {
+		switch {
+		case isXI(c, "fallback"):
+			if fallback != nil {
+				return nil, errorf(c, docHref, "include has more than one fallback")
+			}
+			fallback = c
+		case c.Type == dom.Node && c.Name.Space == NamespaceURL:
+			return nil, errorf(c, docHref, "%s isn't allowed in an include", c.Name.Local)
+		}
+	}
+
+	ref := inc.Attr("href")
+	ptr, hasPtr := inc.LookupAttr("xpointer")
+	parse, ok := inc.LookupAttr("parse")
+	if !ok {
+		parse = "xml"
+	}
+	switch {
+	case parse != "xml" && parse != "text":
+		return nil, errorf(inc, docHref, "invalid parse %q", parse)
+	case strings.Contains(ref, "#"):
+		return nil, errorf(inc, docHref, "href %q has a fragment identifier", ref)
+	case ref == "" && !hasPtr:
+		return nil, errorf(inc, docHref, "include has neither href nor xpointer")
+	case parse == "text" && hasPtr:
+		return nil, errorf(inc, docHref, "xpointer isn't allowed with parse=\"text\"")
+	case parse == "text" && ref == "":
+		return nil, errorf(inc, docHref, "parse=\"text\" needs an href")
+	}
+
+	var nodes []*dom.Element
+	var err error
+	loc := ""
+	if ref != "" {
+		loc = dom.ResolveURI(base(inc, docHref), ref)
+	}
+	if parse == "text" {
+		nodes, err = p.text(inc, loc)
+	} else {
+		key := loc
+		if loc == "" {
+			key = docHref
+		}
+		if ptr != "" {
+			key += "#" + ptr
+		}
+		if p.open[key] {
+			return nil, errorf(inc, docHref, "inclusion loop including %s", key)
+		}
+		p.open[key] = true
+		nodes, err = p.xml(inc, ref, loc, ptr, docHref)
+		delete(p.open, key)
+	}
+	if _, ok := err.(*resourceError); ok && fallback != nil {
+		nodes = nil
+		for _, c := range append([]*dom.Element(nil), fallback.Children...) {
+			switch {
+			case isXI(c, "include"):
+				res, err := p.include(c, docHref)
+				if err != nil {
+					return nil, err
+				}
+				nodes = append(nodes, res...)
+			case isXI(c, "fallback"):
+				return nil, errorf(c, docHref, "fallback isn't the child of an include")
+			default:
+				if c.Type == dom.Node {
+					if err := p.walk(c, docHref); err != nil {
+						return nil, err
+					}
+				}
+				nodes = append(nodes, c)
+			}
+		}
+		return nodes, nil
+	}
+	if _, ok := err.(*resourceError); ok {
+		return nil, errorf(inc, docHref, "%v", err)
+	}
+	return nodes, err
+}
+
+// read returns the content of the resource at loc.
+func (p *processor) read(loc string) ([]byte, error) {
+	if data, ok := p.docs[loc]; ok {
+		return data, nil
+	}
+	if p.resolve == nil {
+		return nil, &resourceError{fmt.Errorf("no resolver to read %s", loc)}
+	}
+	data, err := p.resolve(loc)
+	if err != nil {
+		return nil, &resourceError{err}
+	}
+	p.docs[loc] = data
+	return data, nil
+}
+
+// text returns the resource at loc as a Content element.
+func (p *processor) text(inc *dom.Element, loc string) ([]*dom.Element, error) {
+	data, err := p.read(loc)
+	if err != nil {
+		return nil, err
+	}
+	s, err := decode(data, inc.Attr("encoding"))
+	if err != nil {
+		return nil, &resourceError{fmt.Errorf("%s: %v", loc, err)}
+	}
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.ReplaceAll(s, "\r", "\n")
+	if s == "" {
+		return nil, nil
+	}
+	return []*dom.Element{dom.NewText(s)}, nil
+}
+
+// decode returns data, in the named encoding or UTF-8 if it's empty, as a string.
+func decode(data []byte, enc string) (string, error) {
+	switch strings.ToLower(enc) {
+	case "", "utf-8", "utf8":
+		data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+		if !utf8.Valid(data) {
+			return "", fmt.Errorf("invalid UTF-8")
+		}
+		return string(data), nil
+	case "us-ascii", "ascii":
+		for _, b := range data {
+			if b >= 0x80 {
+				return "", fmt.Errorf("invalid US-ASCII")
+			}
+		}
+		return string(data), nil
+	case "iso-8859-1", "latin1":
+		r := make([]rune, len(data))
+		for i, b := range data {
+			r[i] = rune(b)
+		}
+		return string(r), nil
+	}
+	return "", fmt.Errorf("unsupported encoding %s", enc)
+}
+
+// xml returns the nodes of the document at loc, or of inc's own document if loc is empty, selected
+// by the pointer ptr.
+func (p *processor) xml(inc *dom.Element, ref, loc, ptr, docHref string) ([]*dom.Element, error) {
+	var doc *dom.Element
+	var dtd *dom.DTD
+	if loc == "" {
+		loc = docHref
+		doc = inc.Root()
+	} else {
+		data, err := p.read(loc)
+		if err != nil {
+			return nil, err
+		}
+		d := dom.NewXMLDecoder(bytes.NewReader(data))
+		if doc, err = d.BuildDocument(); err != nil {
+			return nil, errorf(inc, docHref, "%s: %v", loc, err)
+		}
+		dtd = d.DTD
+	}
+
+	var sel []*dom.Element
+	if ptr == "" {
+		for _, c := range doc.Children {
+			// The XML declaration is returned by the decoder as a processing instruction
+			if c.Type == dom.Node || c.Type == dom.Comment || c.Type == dom.ProcInst && c.Name.Local != "xml" {
+				sel = append(sel, c)
+			}
+		}
+	} else {
+		e, err := pointer(doc, ptr, dtd)
+		if err != nil {
+			return nil, &resourceError{fmt.Errorf("xpointer %s: %v", ptr, err)}
+		}
+		for a := inc; a != nil; a = a.Parent {
+			if a == e {
+				return nil, errorf(inc, docHref, "xpointer %s selects an ancestor of the include", ptr)
+			}
+		}
+		sel = []*dom.Element{e}
+	}
+
+	var nodes []*dom.Element
+	for _, s := range sel {
+		// The copy keeps a link to the original's parent, without being one of its children, for the
+		// context needed by processing and fixup
+		c := s.Copy()
+		c.Parent = s.Parent
+		var res []*dom.Element
+		switch {
+		case isXI(c, "include"):
+			r, err := p.include(c, loc)
+			if err != nil {
+				return nil, err
+			}
+			res = r
+		case c.Type == dom.Node:
+			if err := p.walk(c, loc); err != nil {
+				return nil, err
+			}
+			res = []*dom.Element{c}
+		default:
+			res = []*dom.Element{c}
+		}
+		for _, r := range res {
+			if r.Type == dom.Node {
+				fixup(r, inc, ref)
+			}
+			r.Parent = nil
+		}
+		nodes = append(nodes, res...)
+	}
+	return nodes, nil
+}
+
+// fixup adds the attributes r needs to keep its base URI, language and namespaces when it replaces inc.
+// The href is that given by inc, empty for the same document.
+func fixup(r, inc *dom.Element, href string) {
+	dst := inc.Parent
+	if href != "" {
+		// The base relative to inc's
+		rel := href
+		var bases []string
+		for a := r; a != nil; a = a.Parent {
+			if b, ok := a.LookupAttrNS(xmlURL, "base"); ok {
+				bases = append(bases, b)
+			}
+		}
+		for i := len(bases) - 1; i >= 0; i-- {
+			rel = dom.ResolveURI(rel, bases[i])
+		}
+		r.SetAttrNS(xmlURL, "base", rel)
+	}
+
+	if _, ok := r.LookupAttrNS(xmlURL, "lang"); !ok {
+		if l := lang(r); l != lang(dst) {
+			r.SetAttrNS(xmlURL, "lang", l)
+		}
+	}
+
+	if _, ok := r.LookupAttrNS("", "xmlns"); !ok {
+		src, _ := r.LookupNamespaceURI("")
+		cur, _ := dst.LookupNamespaceURI("")
+		if src != cur {
+			r.Attributes = append(r.Attributes, xml.Attr{Name: xml.Name{Local: "xmlns"}, Value: src})
+		}
+	}
+	for prefix, uri := range r.InScopeNamespaces() {
+		if prefix == "" {
+			continue
+		}
+		if _, ok := r.LookupAttrNS("xmlns", prefix); ok {
+			continue
+		}
+		if cur, _ := dst.LookupNamespaceURI(prefix); cur != uri {
+			r.Attributes = append(r.Attributes, xml.Attr{Name: xml.Name{Space: "xmlns", Local: prefix}, Value: uri})
+		}
+	}
+}
+
+// lang returns the xml:lang in scope of e.
+func lang(e *dom.Element) string {
+	for ; e != nil; e = e.Parent {
+		if l, ok := e.LookupAttrNS(xmlURL, "lang"); ok {
+			return l
+		}
+	}
+	return ""
+}
+
+// base returns the base URI of e, from the xml:base attributes in its scope and the document href.
+func base(e *dom.Element, href string) string {
+	var bases []string
+	for a := e; a != nil; a = a.Parent {
+		if b, ok := a.LookupAttrNS(xmlURL, "base"); ok {
+			bases = append(bases, b)
+		}
+	}
+	for i := len(bases) - 1; i >= 0; i-- {
+		href = dom.ResolveURI(href, bases[i])
+	}
+	return href
+}
+
+// pointer returns the element of doc identified by the XPointer ptr, using the first of its parts
+// with a supported scheme that identifies one.
+func pointer(doc *dom.Element, ptr string, dtd *dom.DTD) (*dom.Element, error) {
+	ptr = strings.TrimSpace(ptr)
+	if isNCName(ptr) {
+		if e := byID(doc, ptr, dtd); e != nil {
+			return e, nil
+		}
+		return nil, fmt.Errorf("no element with ID %s", ptr)
+	}
+	for ptr != "" {
+		i := strings.IndexByte(ptr, '(')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid xpointer %q", ptr)
+		}
+		scheme := strings.TrimSpace(ptr[:i])
+		// The scheme data ends at the matching parenthesis, ^ escaping parentheses and itself
+		var data strings.Builder
+		depth := 1
+		j := i + 1
+		for ; j < len(ptr) && depth > 0; j++ {
+			c := ptr[j]
+			switch c {
+			case '^':
+				if j+1 >= len(ptr) || strings.IndexByte("()^", ptr[j+1]) < 0 {
+					return nil, fmt.Errorf("invalid escape in xpointer %q", ptr)
+				}
+				j++
+				c = ptr[j]
+			case '(':
+				depth++
+			case ')':
+				if depth--; depth == 0 {
+					continue
+				}
+			}
+			data.WriteByte(c)
+		}
+		if depth > 0 {
+			return nil, fmt.Errorf("unbalanced parentheses in xpointer %q", ptr)
+		}
+		if scheme == "element" {
+			if e := elementScheme(doc, data.String(), dtd); e != nil {
+				return e, nil
+			}
+		}
+		ptr = strings.TrimSpace(ptr[j:])
+	}
+	return nil, fmt.Errorf("xpointer identifies no element")
+}
+
+// elementScheme returns the element identified by the data of an element() pointer part, an ID
+// followed by an optional child sequence such as /1/2, or a child sequence alone, or nil.
+func elementScheme(doc *dom.Element, data string, dtd *dom.DTD) *dom.Element {
+	id, seq, _ := strings.Cut(data, "/")
+	e := doc
+	if id != "" {
+		if e = byID(doc, id, dtd); e == nil {
+			return nil
+		}
+	} else if !strings.HasPrefix(data, "/") {
+		return nil
+	}
+	if seq == "" {
+		if id == "" {
+			return nil
+		}
+		return e
+	}
+	for _, s := range strings.Split(seq, "/") {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return nil
+		}
+		var next *dom.Element
+		for _, c := range e.Children {
+			if c.Type == dom.Node {
+				if n--; n == 0 {
+					next = c
+					break
+				}
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		e = next
+	}
+	return e
+}
+
+// byID returns the element of doc with an xml:id, or an attribute declared as an ID in dtd, of id.
+func byID(doc *dom.Element, id string, dtd *dom.DTD) *dom.Element {
+	var res *dom.Element
+	var walk func(e *dom.Element) bool
+	walk = func(e *dom.Element) bool {
+		for _, c := range e.Children {
+			if c.Type != dom.Node {
+				continue
+			}
+			if isID(c, id, dtd) {
+				res = c
+				return true
+			}
+			if walk(c) {
+				return true
+			}
+		}
+		return false
+	}
+	walk(doc)
+	return res
+}
+
+func isID(e *dom.Element, id string, dtd *dom.DTD) bool {
+	if v, ok := e.LookupAttrNS(xmlURL, "id"); ok && strings.TrimSpace(v) == id {
+		return true
+	}
+	if dtd == nil {
+		return false
+	}
+	for _, decl := range dtd.Attributes[qname(e, e.Name, false)] {
+		if decl.Type != "ID" {
+			continue
+		}
+		for _, a := range e.Attributes {
+			if qname(e, a.Name, true) == decl.Name && a.Value == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// qname returns the name as written in the document, as used by the DTD.
+func qname(e *dom.Element, name xml.Name, attr bool) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	for a := e; a != nil; a = a.Parent {
+		for _, d := range a.Attributes {
+			if !dom.IsNamespaceDecl(d.Name) || d.Value != name.Space {
+				continue
+			}
+			if d.Name.Space == "" {
+				if !attr {
+					return name.Local
+				}
+				continue
+			}
+			return d.Name.Local + ":" + name.Local
+		}
+	}
+	// An undeclared prefix is left in Space by the decoder
+	return name.Space + ":" + name.Local
+}
+
+func isNCName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		switch {
+		case r == '_' || r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= 0xc0:
+		case i > 0 && (r == '-' || r == '.' || r >= '0' && r <= '9' || r == 0xb7):
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -1,12 +1,17 @@
 package xml
 
 import (
+	"bytes"
+	"context"
 	"encoding/xml"
+	"errors"
+	"fmt"
 	"io"
 )
 
 // XMLDecoder is a wrapper around xml.Decoder and holds the functions to be called when tokens are encountered.
-// Functions that are left as nil are skipped by Process().
+// Functions that are left as nil are skipped by Process(). Functions may return SkipChildren or Stop
+// to control the processing.
 type XMLDecoder struct {
 	Decoder      *xml.Decoder
 	StartElement func(token xml.StartElement) error
@@ -15,29 +20,141 @@ type XMLDecoder struct {
 	Comment      func(token xml.Comment) error
 	ProcInst     func(token xml.ProcInst) error
 	Directive    func(token xml.Directive) error
+	Limits       Limits     // Bounds on the input accepted by Process
+	Whitespace   Whitespace // Treatment of character data in the trees built by BuildDocument and Router
+	DTD          *DTD       // Set by Process from the DOCTYPE directive
+	pos          Position   // Start of the current token
+	cdata        bool       // The current token is a CDATA section
+	raw          *rawReader // Records the input so that CDATA sections can be recognized
+	entities     entityRefs
+	depth        int // Number of open elements
+	elements     int // Number of elements seen
 }
 
-// NewXMLDecoder creates a new XMLDecoder that will read from the supplied io.Reader.
+// Sentinel results that the decoder's functions can return to control Process. Neither is returned
+// by Process.
+var (
+	// SkipChildren, when returned by the StartElement function, causes the element's content to be
+	// skipped without being tokenized. The EndElement function is still called for the element. When
+	// returned by the CharData, Comment, ProcInst or Directive functions the token is left out of any
+	// tree being built. It's otherwise ignored.
+	SkipChildren = errors.New("xml: skip children")
+
+	// Stop ends processing without error.
+	Stop = errors.New("xml: stop")
+)
+
+// Position is a location in the decoder's input.
+type Position struct {
+	Line   int   // 1 based line number
+	Column int   // 1 based byte position within the line
+	Offset int64 // Byte offset from the start of the input
+}
+
+// String returns the position as line:column.
+func (p Position) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// PosError records where in the input a decoding error, or an error returned by a callback, occurred.
+type PosError struct {
+	Pos Position
+	Err error
+}
+
+func (e *PosError) Error() string {
+	return e.Pos.String() + ": " + e.Err.Error()
+}
+
+func (e *PosError) Unwrap() error {
+	return e.Err
+}
+
+// NewXMLDecoder creates a new XMLDecoder that will read from the supplied io.Reader. UTF-16 input is
+// recognized from its byte order mark or XML declaration, and other encodings are converted to UTF-8
+// by CharsetReader as given in the XML declaration. Positions are then those in the UTF-8 text.
 func NewXMLDecoder(r io.Reader) *XMLDecoder {
-	return &XMLDecoder{xml.NewDecoder(r), nil, nil, nil, nil, nil, nil}
+	d := &XMLDecoder{}
+	sr := &sniffReader{r: &limitReader{r, d, 0}}
+	d.raw = &rawReader{r: sr, d: d}
+	d.Decoder = xml.NewDecoder(d.raw)
+	d.Decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		cr, err := sr.charsetReader(charset, input)
+		if err != nil || cr == input {
+			return cr, err
+		}
+		// Offsets are now those of the converted input
+		d.raw.stop = true
+		d.raw = &rawReader{r: cr, d: d, base: d.Decoder.InputOffset()}
+		return d.raw, nil
+	}
+	return d
+}
+
+// Pos returns the start position of the token being processed. It's intended for use by the callback functions.
+func (d *XMLDecoder) Pos() Position {
+	return d.pos
+}
+
+// CDATA reports whether the CharData token being processed was a CDATA section. It's intended for use
+// by the CharData function, and is always false for decoders not created by NewXMLDecoder.
+func (d *XMLDecoder) CDATA() bool {
+	return d.cdata
+}
+
+// inputPos returns the current position of the underlying decoder.
+func (d *XMLDecoder) inputPos() Position {
+	line, col := d.Decoder.InputPos()
+	return Position{line, col, d.Decoder.InputOffset()}
 }
 
 // Process performs the tokenization of the reader data and calls the user supplied functions.
+// Errors are returned as a *PosError.
+//
+// A DOCTYPE directive is parsed into DTD before the Directive function is called, which may add an
+// external subset to it. An error in the DOCTYPE, other than exceeding a limit, doesn't stop processing
+// but is recorded in the DTD's Err, which holds the declarations before the error. The internal general
+// entities are then declared to the underlying decoder, each being expanded, within Limits.MaxEntitySize,
+// when it's first referred to. External entities aren't read, and a reference to an entity whose
+// replacement text contains markup, such as an element, is an error rather than being parsed.
 func (d *XMLDecoder) Process() error {
+	return d.ProcessContext(context.Background())
+}
+
+// ProcessContext is like Process but stops with the context's error, wrapped in a *PosError, once
+// the context is done. The context is checked before each token is read.
+func (d *XMLDecoder) ProcessContext(ctx context.Context) error {
 	for {
+		d.pos = d.inputPos()
+		if err := ctx.Err(); err != nil {
+			return &PosError{d.pos, err}
+		}
+		if d.raw != nil {
+			d.raw.start(d.pos.Offset)
+		}
 		tok, err := d.Decoder.Token()
 		if tok == nil {
 			if err == io.EOF {
 				break
 			}
-			return err
+			return &PosError{d.inputPos(), err}
+		}
+		if err := d.checkLimits(tok); err != nil {
+			return &PosError{d.pos, err}
+		}
+		if d.raw != nil {
+			_, text := tok.(xml.CharData)
+			d.cdata = text && string(d.raw.head) == cdataStart
 		}
 		switch tok.(type) {
 		case xml.StartElement:
+			se, _ := tok.(xml.StartElement)
 			if d.StartElement != nil {
-				se, _ := tok.(xml.StartElement)
 				err = d.StartElement(se.Copy())
 			}
+			if errors.Is(err, SkipChildren) {
+				err = d.skip(se.Name)
+			}
 		case xml.EndElement:
 			if d.EndElement != nil {
 				ee, _ := tok.(xml.EndElement)
@@ -59,66 +176,395 @@ func (d *XMLDecoder) Process() error {
 				err = d.ProcInst(pi.Copy())
 			}
 		case xml.Directive:
+			dir, _ := tok.(xml.Directive)
+			doctype := bytes.HasPrefix(dir, []byte("DOCTYPE"))
+			if doctype {
+				if d.DTD, err = parseDTD(dir, d.Limits); err != nil {
+					var le *LimitError
+					if errors.As(err, &le) {
+						return &PosError{d.pos, err}
+					}
+					if d.DTD != nil {
+						d.DTD.Err = &PosError{d.pos, err}
+					}
+					err = nil
+				}
+				doctype = d.DTD != nil
+			}
 			if d.Directive != nil {
-				dir, _ := tok.(xml.Directive)
 				err = d.Directive(dir.Copy())
 			}
+			if doctype && err == nil {
+				err = d.declareEntities()
+			}
 		}
 		if err != nil {
-			return err
+			if errors.Is(err, Stop) {
+				return nil
+			}
+			if errors.Is(err, SkipChildren) {
+				continue
+			}
+			var pe *PosError
+			if errors.As(err, &pe) {
+				return err
+			}
+			return &PosError{d.pos, err}
 		}
 	}
 	return nil
 }
 
-// BuildDOM inserts its own functions into the decoder in order to build the Domain Object Model.
-func (d *XMLDecoder) BuildDOM() (*Element, error) {
-	var root, cur *Element
+// declareEntities makes the internal entities of the DTD known to the underlying decoder. Decoders
+// created by NewXMLDecoder expand each entity as the first reference to it is read. Others have all
+// the entities expanded beforehand, with their total size limited to MaxEntityExpansion.
+func (d *XMLDecoder) declareEntities() error {
+	// Copy rather than modify a map such as xml.HTMLEntity
+	m := make(map[string]string, len(d.Decoder.Entity))
+	for k, v := range d.Decoder.Entity {
+		m[k] = v
+	}
+	d.Decoder.Entity = m
+	x := d.DTD.expander(d.Limits.maxEntitySize())
+	x.markup = true
+	d.entities = entityRefs{x, 0, 0}
+	for k, e := range d.DTD.Entities {
+		if e.Internal && len(k) > d.entities.maxName {
+			d.entities.maxName = len(k)
+		}
+	}
+	if d.raw == nil {
+		for k, e := range d.DTD.Entities {
+			if !e.Internal {
+				continue
+			}
+			// Entities containing markup are left undeclared so that references to them are errors
+			if err := d.entities.expand(k, m, &d.Limits); err != nil && !errors.Is(err, errMarkup) {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Count the references already read ahead of the decoder
+	d.raw.in = false
+	pending := d.raw.buf
+	if i := d.Decoder.InputOffset() - d.raw.base; i > 0 && i <= int64(len(pending)) {
+		pending = pending[i:]
+	}
+	return d.raw.count(pending)
+}
+
+// skip consumes the content of the element just started, including its end, and calls the EndElement
+// function for it.
+func (d *XMLDecoder) skip(name xml.Name) error {
+	if err := d.Decoder.Skip(); err != nil {
+		return &PosError{d.inputPos(), err}
+	}
+	d.depth--
+	if d.Limits.MaxBytes > 0 && d.Decoder.InputOffset() > d.Limits.MaxBytes {
+		return &PosError{d.inputPos(), &LimitError{"MaxBytes", d.Limits.MaxBytes}}
+	}
+	if d.EndElement != nil {
+		return d.EndElement(xml.EndElement{Name: name})
+	}
+	return nil
+}
+
+// BuildDocument inserts its own functions into the decoder in order to build the Domain Object Model
+// of the entire document. The returned Document holds the document element along with any comments,
+// processing instructions and directives that precede or follow it.
+//
+// Any functions already set on the decoder are called before each token is added to the tree, and
+// restored afterwards. They can return SkipChildren to leave content out of the tree, or Stop to
+// return the document built so far.
+//
+// If the document has a DOCTYPE, attributes with default or fixed values in the DTD are added to the
+// elements that don't have them, and the values of attributes it declares with a type other than CDATA
+// are normalized, with leading and trailing spaces removed and runs of spaces replaced by one.
+//
+// The character data of each element is merged, stripped or normalized as set by Whitespace once the
+// element has ended.
+func (d *XMLDecoder) BuildDocument() (*Element, error) {
+	return d.BuildDocumentContext(context.Background())
+}
+
+// BuildDocumentContext is like BuildDocument but stops once the context is done.
+func (d *XMLDecoder) BuildDocumentContext(ctx context.Context) (*Element, error) {
+	ws, err := d.Whitespace.compile()
+	if err != nil {
+		return nil, err
+	}
+	doc := &Element{Type: Document}
+	b := &builder{doc, doc, ws}
 
 	// Save existing functions
 	sef := d.StartElement
 	eef := d.EndElement
 	cdf := d.CharData
+	cf := d.Comment
+	pif := d.ProcInst
+	df := d.Directive
 
-	// Setup StartElement/EndElement/CharData
+	// Setup handlers for all token types
+	var scope nsScope
 	d.StartElement = func(se xml.StartElement) error {
-		if root == nil {
-			root = &Element{Node, se.Name, make(map[string]string), nil, nil, nil}
-			cur = root
-		} else {
-			tmp := &Element{Node, se.Name, make(map[string]string), nil, cur, nil}
-			cur.Children = append(cur.Children, tmp)
-			cur = tmp
+		var err error
+		if sef != nil {
+			err = sef(se)
+			if err != nil && !errors.Is(err, SkipChildren) {
+				return err
+			}
 		}
-		for _, attr := range se.Attr {
-			cur.Attributes[attr.Name.Local] = attr.Value
+		b.start(se, d.pos)
+		scope.start(se)
+		if d.DTD != nil {
+			if d.DTD.addDefaults(b.cur, true) {
+				scope.defaulted = true
+			}
+			if scope.defaulted {
+				scope.resolve(b.cur)
+			}
+			d.DTD.addDefaults(b.cur, false)
+			d.DTD.normalize(b.cur)
 		}
-		return nil
+		return err
 	}
 	d.EndElement = func(ee xml.EndElement) error {
-		cur = cur.Parent
+		b.end()
+		scope.end()
+		if eef != nil {
+			return eef(ee)
+		}
 		return nil
 	}
 	d.CharData = func(cd xml.CharData) error {
-		if cur == nil {
-			// Ignore CDATA outside of a Node
-			return nil
+		if cdf != nil {
+			if err := cdf(cd); err != nil {
+				return err
+			}
 		}
-		tmp := &Element{Content, xml.Name{}, nil, cd, cur, nil}
-		cur.Children = append(cur.Children, tmp)
+		b.charData(cd, d.pos, d.cdata)
+		return nil
+	}
+	d.Comment = func(c xml.Comment) error {
+		if cf != nil {
+			if err := cf(c); err != nil {
+				return err
+			}
+		}
+		b.add(&Element{Comment, xml.Name{}, nil, xml.CharData(c), nil, nil, d.pos, false})
+		return nil
+	}
+	d.ProcInst = func(pi xml.ProcInst) error {
+		if pif != nil {
+			if err := pif(pi); err != nil {
+				return err
+			}
+		}
+		b.add(&Element{ProcInst, xml.Name{Local: pi.Target}, nil, pi.Inst, nil, nil, d.pos, false})
+		return nil
+	}
+	d.Directive = func(dir xml.Directive) error {
+		if df != nil {
+			if err := df(dir); err != nil {
+				return err
+			}
+		}
+		b.add(&Element{Directive, xml.Name{}, nil, xml.CharData(dir), nil, nil, d.pos, false})
 		return nil
 	}
 
 	// Parse tokens into DOM tree
-	err := d.Process()
+	err = d.ProcessContext(ctx)
 
 	// Restore previous functions
 	d.StartElement = sef
 	d.EndElement = eef
 	d.CharData = cdf
+	d.Comment = cf
+	d.ProcInst = pif
+	d.Directive = df
+
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// BuildDOM builds the Domain Object Model of the document and returns the document element. Its Parent
+// is the Document holding the prolog and epilog.
+func (d *XMLDecoder) BuildDOM() (*Element, error) {
+	return d.BuildDOMContext(context.Background())
+}
 
+// BuildDOMContext is like BuildDOM but stops once the context is done.
+func (d *XMLDecoder) BuildDOMContext(ctx context.Context) (*Element, error) {
+	doc, err := d.BuildDocumentContext(ctx)
 	if err != nil {
 		return nil, err
 	}
-	return root, nil
+	return doc.DocumentElement(), nil
+}
+
+// builder assembles a tree from tokens. The root is either a Document, or nil until the first
+// StartElement which then becomes the root. The whitespace policy, if any, is applied to each element
+// as it ends.
+type builder struct {
+	root, cur *Element
+	ws        *spacePolicy
+}
+
+// add appends elt to the children of the current element. Tokens seen before the root has been
+// started are dropped.
+func (b *builder) add(elt *Element) {
+	if b.cur == nil {
+		return
+	}
+	elt.Parent = b.cur
+	b.cur.Children = append(b.cur.Children, elt)
+}
+
+func (b *builder) start(se xml.StartElement, pos Position) {
+	elt := &Element{Node, se.Name, se.Attr, nil, nil, nil, pos, false}
+	if b.root == nil {
+		b.root = elt
+	} else {
+		b.add(elt)
+	}
+	b.cur = elt
+}
+
+// end closes the current element and reports whether it was the root.
+func (b *builder) end() bool {
+	done := b.cur == b.root
+	if b.ws != nil {
+		b.ws.apply(b.cur)
+	}
+	b.cur = b.cur.Parent
+	return done
+}
+
+func (b *builder) charData(cd xml.CharData, pos Position, cdata bool) {
+	if b.cur == nil || b.cur.Type == Document {
+		// Ignore CDATA outside of a Node
+		return
+	}
+	b.add(&Element{Content, xml.Name{}, nil, cd, nil, nil, pos, cdata})
+}
+
+// cdataStart is the start of a CDATA section.
+const cdataStart = "<![CDATA["
+
+// rawReader keeps the input read by the underlying decoder that it hasn't yet consumed, along with the
+// start of the current token, so that CDATA sections can be recognized. The input is discarded as the
+// decoder consumes it, so that little is held even while content is skipped. Recording ends once stop
+// is set.
+type rawReader struct {
+	r    io.Reader
+	d    *XMLDecoder
+	buf  []byte // Input from offset base onwards
+	base int64
+	mark int64  // Offset of the current token
+	head []byte // Start of the current token, up to the length of cdataStart
+	stop bool
+	ref  []byte // Name of the entity reference being read
+	in   bool   // An entity reference is being read
+}
+
+// entityRefs expands the entities declared in the DTD as they're referred to, and holds the total
+// size of the references read for the decoder's MaxEntityExpansion limit.
+type entityRefs struct {
+	x        *expander // Nil until the DTD has been read
+	maxName  int       // Length of the longest entity name
+	expanded int64
+}
+
+// expand adds the replacement text of a reference to the entity name to the decoder's map, m, if it's
+// an internal general entity, and counts its size.
+func (er *entityRefs) expand(name string, m map[string]string, l *Limits) error {
+	if e, ok := er.x.dtd.Entities[name]; !ok || !e.Internal {
+		return nil
+	}
+	v, err := er.x.entity(name)
+	if err != nil {
+		return err
+	}
+	m[name] = v
+	er.expanded += int64(len(v))
+	if max := l.maxEntityExpansion(); er.expanded > max {
+		return &LimitError{"MaxEntityExpansion", max}
+	}
+	return nil
+}
+
+func (rr *rawReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	if rr.stop {
+		return n, err
+	}
+	if err := rr.count(p[:n]); err != nil {
+		return 0, err
+	}
+	// The decoder can unread the last byte it consumed
+	rr.discard(rr.d.Decoder.InputOffset() - 1)
+	rr.buf = append(rr.buf, p[:n]...)
+	rr.fill()
+	return n, err
+}
+
+// count expands the entities referred to in b for the decoder before it reads them, and adds their
+// sizes to the total expanded. References within comments and CDATA sections are counted too.
+func (rr *rawReader) count(b []byte) error {
+	ents := &rr.d.entities
+	if ents.x == nil {
+		return nil
+	}
+	for _, c := range b {
+		switch {
+		case c == '&':
+			rr.ref, rr.in = rr.ref[:0], true
+		case !rr.in:
+		case c == ';':
+			rr.in = false
+			if err := ents.expand(string(rr.ref), rr.d.Decoder.Entity, &rr.d.Limits); err != nil {
+				return err
+			}
+		case len(rr.ref) < ents.maxName:
+			rr.ref = append(rr.ref, c)
+		default:
+			// Longer than any entity name
+			rr.in = false
+		}
+	}
+	return nil
+}
+
+// start records that a token starts at offset.
+func (rr *rawReader) start(offset int64) {
+	rr.mark = offset
+	rr.head = rr.head[:0]
+	rr.fill()
+}
+
+// fill copies what's available of the start of the current token to head.
+func (rr *rawReader) fill() {
+	i := rr.mark + int64(len(rr.head)) - rr.base
+	for len(rr.head) < len(cdataStart) && i >= 0 && i < int64(len(rr.buf)) {
+		rr.head = append(rr.head, rr.buf[i])
+		i++
+	}
+}
+
+// discard drops the input before offset.
+func (rr *rawReader) discard(offset int64) {
+	i := offset - rr.base
+	if i <= 0 {
+		return
+	}
+	if i > int64(len(rr.buf)) {
+		i = int64(len(rr.buf))
+	}
+	rr.buf = rr.buf[:copy(rr.buf, rr.buf[i:])]
+	rr.base += i
 }
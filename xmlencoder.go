@@ -0,0 +1,371 @@
+package xml
+
+import (
+	"bufio"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// XMLEncoder writes a document as a stream of tokens, the counterpart of XMLDecoder's functions, so
+// that documents of any size can be generated without building a tree. Namespaces are declared as
+// they're needed, as by Encode, and EncodeOptions are applied as they are by Encode, except that
+// indentation stops within an element once text has been written to it.
+//
+// The tokens are checked for well-formedness: end elements must match their start elements, attributes
+// mustn't be repeated, names must be valid, text and attribute values mustn't hold characters that XML
+// doesn't allow and there must be a single document element with only comments, processing
+// instructions and directives outside it. The first error ends the document and
+// is returned by all later calls.
+type XMLEncoder struct {
+	e       encoder
+	cw      io.WriteCloser // Converts the output to its encoding, nil for UTF-8
+	open    []openElement  // Elements started but not yet ended, innermost last
+	pending bool           // The start tag of the innermost element is still to be closed with >
+	started bool           // Something has been written outside the document element
+	root    bool           // The document element has been started
+	err     error
+}
+
+// openElement is an element that has been started by an XMLEncoder.
+type openElement struct {
+	name     xml.Name
+	qname    string // Name as written in the start tag
+	mark     int    // Number of namespace bindings in scope outside the element
+	text     bool   // Text has been written within the element, so it's no longer indented
+	children bool   // Elements, comments or processing instructions have been written within it
+}
+
+// errClosed is returned by an XMLEncoder once it has been closed.
+var errClosed = errors.New("xml: encoder is closed")
+
+// NewXMLEncoder creates a new XMLEncoder that writes to w. If opts is nil the document is written
+// without a declaration or indentation. Nothing is written to w until the encoder is flushed or
+// closed, or its buffer fills.
+func NewXMLEncoder(w io.Writer, opts *EncodeOptions) (*XMLEncoder, error) {
+	if opts == nil {
+		opts = &EncodeOptions{}
+	}
+	x := &XMLEncoder{}
+	var encodable func(rune) bool
+	if !isUTF8(opts.Encoding) {
+		var err error
+		if encodable, err = CharsetEncodable(opts.Encoding); err != nil {
+			return nil, err
+		}
+		if !opts.NoConvert {
+			cw, err := CharsetWriter(opts.Encoding, w)
+			if err != nil {
+				return nil, err
+			}
+			x.cw, w = cw, cw
+		}
+	}
+	x.e = encoder{w: bufio.NewWriter(w), opts: opts, encodable: encodable}
+	if opts.Declaration {
+		if isUTF8(opts.Encoding) {
+			x.e.w.WriteString(Header)
+		} else {
+			x.e.w.WriteString(`<?xml version="1.0" encoding="` + opts.Encoding + `"?>` + "\n")
+		}
+	}
+	return x, nil
+}
+
+// StartElement writes the start tag of an element. Attributes in the xmlns namespace, or named xmlns,
+// declare namespace prefixes. Namespaces that aren't already bound are declared as for Encode.
+func (x *XMLEncoder) StartElement(se xml.StartElement) error {
+	if x.err != nil {
+		return x.err
+	}
+	if err := checkStart(se); err != nil {
+		return x.fail(err)
+	}
+	if len(x.open) == 0 && x.root {
+		return x.fail(fmt.Errorf("xml: element %s after the document element", nameString(se.Name)))
+	}
+	x.child()
+	mark := len(x.e.ns)
+	qname := x.e.startTag(&Element{Type: Node, Name: se.Name, Attributes: se.Attr})
+	if x.e.err != nil {
+		return x.fail(x.e.err)
+	}
+	x.open = append(x.open, openElement{se.Name, qname, mark, false, false})
+	x.pending = true
+	x.root = true
+	return nil
+}
+
+// EndElement writes the end tag of the innermost open element, which must have the same name. An
+// element without content is written as an empty-element tag.
+func (x *XMLEncoder) EndElement(ee xml.EndElement) error {
+	if x.err != nil {
+		return x.err
+	}
+	n := len(x.open)
+	if n == 0 {
+		return x.fail(fmt.Errorf("xml: end element %s without a start element", nameString(ee.Name)))
+	}
+	cur := x.open[n-1]
+	if ee.Name != cur.name {
+		return x.fail(fmt.Errorf("xml: end element %s doesn't match start element %s", nameString(ee.Name), nameString(cur.name)))
+	}
+	x.open = x.open[:n-1]
+	x.e.ns = x.e.ns[:cur.mark]
+	if x.pending {
+		x.pending = false
+		x.e.w.WriteString("/>")
+		return nil
+	}
+	if x.e.indenting() && cur.children && !cur.text {
+		x.e.newline(n - 1)
+	}
+	x.e.w.WriteString("</" + cur.qname + ">")
+	return nil
+}
+
+// Text writes character data, escaped as necessary. Outside the document element only whitespace may
+// be written.
+func (x *XMLEncoder) Text(text string) error {
+	if err := x.text(text); err != nil {
+		return err
+	}
+	x.e.escapeText([]byte(text))
+	return nil
+}
+
+// CDATA writes character data as a CDATA section, split into several if it contains ]]>.
+func (x *XMLEncoder) CDATA(text string) error {
+	if len(x.open) == 0 && x.err == nil {
+		return x.fail(errors.New("xml: CDATA section outside the document element"))
+	}
+	if err := x.text(text); err != nil {
+		return err
+	}
+	x.e.writeCDATA([]byte(text))
+	return nil
+}
+
+// text prepares for character data to be written.
+func (x *XMLEncoder) text(text string) error {
+	if x.err != nil {
+		return x.err
+	}
+	if err := checkChars(text, "text"); err != nil {
+		return x.fail(err)
+	}
+	n := len(x.open)
+	if n == 0 {
+		if strings.TrimFunc(text, isSpaceRune) != "" {
+			return x.fail(errors.New("xml: text outside the document element"))
+		}
+		return nil
+	}
+	x.closeStart()
+	x.open[n-1].text = true
+	return nil
+}
+
+// Comment writes a comment, which mustn't contain -- or end with -.
+func (x *XMLEncoder) Comment(text string) error {
+	if x.err != nil {
+		return x.err
+	}
+	if err := checkComment(text); err != nil {
+		return x.fail(err)
+	}
+	if err := x.e.checkEncodable(text, "comment"); err != nil {
+		return x.fail(err)
+	}
+	x.child()
+	x.e.w.WriteString("<!--" + text + "-->")
+	return nil
+}
+
+// ProcInst writes a processing instruction. A target of xml writes the XML declaration, with its
+// encoding corrected to that of the output, which must come first in the document.
+func (x *XMLEncoder) ProcInst(target, inst string) error {
+	if x.err != nil {
+		return x.err
+	}
+	if err := checkProcInst(target, inst); err != nil {
+		return x.fail(err)
+	}
+	if err := x.e.checkEncodable(target+" "+inst, "processing instruction"); err != nil {
+		return x.fail(err)
+	}
+	if target == "xml" && (x.started || x.root || x.e.opts.Declaration) {
+		return x.fail(errors.New("xml: XML declaration isn't at the start of the document"))
+	}
+	x.child()
+	b := []byte(inst)
+	if target == "xml" {
+		b = x.e.declaration(b)
+	}
+	x.e.w.WriteString("<?" + target)
+	if len(b) > 0 {
+		x.e.w.WriteByte(' ')
+		x.e.w.Write(b)
+	}
+	x.e.w.WriteString("?>")
+	return nil
+}
+
+// Directive writes a directive such as a DOCTYPE, the text between <! and >. Directives can only
+// precede the document element.
+func (x *XMLEncoder) Directive(dir string) error {
+	if x.err != nil {
+		return x.err
+	}
+	if x.root {
+		return x.fail(errors.New("xml: directive after the start of the document element"))
+	}
+	if err := checkChars(dir, "directive"); err != nil {
+		return x.fail(err)
+	}
+	if err := x.e.checkEncodable(dir, "directive"); err != nil {
+		return x.fail(err)
+	}
+	x.child()
+	x.e.w.WriteString("<!" + dir + ">")
+	return nil
+}
+
+// Element writes elt, a Node, and its children, such as a tree built by a Router Handler. Its content is
+// checked as by Encode, but its names aren't.
+func (x *XMLEncoder) Element(elt *Element) error {
+	if x.err != nil {
+		return x.err
+	}
+	if elt.Type != Node {
+		return x.fail(errors.New("xml: encoded element isn't a Node"))
+	}
+	if len(x.open) == 0 && x.root {
+		return x.fail(fmt.Errorf("xml: element %s after the document element", nameString(elt.Name)))
+	}
+	x.child()
+	x.e.element(elt, len(x.open))
+	if x.e.err != nil {
+		return x.fail(x.e.err)
+	}
+	x.root = true
+	return nil
+}
+
+// Flush writes any buffered output to the underlying writer. An open start tag isn't completed, and
+// output in an encoding other than UTF-8 may be held until Close.
+func (x *XMLEncoder) Flush() error {
+	if x.err != nil {
+		return x.err
+	}
+	if err := x.e.w.Flush(); err != nil {
+		return x.fail(err)
+	}
+	return nil
+}
+
+// Close ends any open elements and flushes the output. It doesn't close the underlying writer. The
+// document must have a document element.
+func (x *XMLEncoder) Close() error {
+	if x.err != nil {
+		return x.err
+	}
+	if !x.root {
+		return x.fail(errors.New("xml: document has no document element"))
+	}
+	for len(x.open) > 0 {
+		if err := x.EndElement(xml.EndElement{Name: x.open[len(x.open)-1].name}); err != nil {
+			return err
+		}
+	}
+	x.e.w.WriteByte('\n')
+	if err := x.e.w.Flush(); err != nil {
+		return x.fail(err)
+	}
+	if x.cw != nil {
+		if err := x.cw.Close(); err != nil {
+			return x.fail(err)
+		}
+	}
+	x.err = errClosed
+	return nil
+}
+
+// fail ends the document with err.
+func (x *XMLEncoder) fail(err error) error {
+	x.err = err
+	return err
+}
+
+// closeStart completes the start tag of the innermost element, if it's still open.
+func (x *XMLEncoder) closeStart() {
+	if x.pending {
+		x.pending = false
+		x.e.w.WriteByte('>')
+	}
+}
+
+// child prepares for an element, comment, processing instruction or directive to be written, starting
+// a new line outside the document element or, when indenting, within an element without text.
+func (x *XMLEncoder) child() {
+	x.closeStart()
+	n := len(x.open)
+	if n == 0 {
+		if x.started || x.root {
+			x.e.w.WriteByte('\n')
+		}
+		x.started = true
+		return
+	}
+	cur := &x.open[n-1]
+	cur.children = true
+	if x.e.indenting() && !cur.text {
+		x.e.newline(n)
+	}
+}
+
+// checkStart checks the names of an element and its attributes, their values, and that no attribute is
+// repeated.
+func checkStart(se xml.StartElement) error {
+	if !isNCName(se.Name.Local) {
+		return fmt.Errorf("xml: invalid element name %q", se.Name.Local)
+	}
+	for i, attr := range se.Attr {
+		if !isNCName(attr.Name.Local) {
+			return fmt.Errorf("xml: invalid attribute name %q", attr.Name.Local)
+		}
+		if err := checkChars(attr.Value, "attribute value"); err != nil {
+			return err
+		}
+		for _, prev := range se.Attr[:i] {
+			if attrKey(prev.Name) == attrKey(attr.Name) {
+				return fmt.Errorf("xml: duplicate attribute %s on element %s", nameString(attr.Name), nameString(se.Name))
+			}
+		}
+	}
+	return nil
+}
+
+// attrKey returns the attribute name as written by the encoder, which writes names in the xmlns
+// namespace as declarations.
+func attrKey(name xml.Name) xml.Name {
+	if name.Space == xmlnsURL {
+		name.Space = "xmlns"
+	}
+	return name
+}
+
+// isNCName reports whether s is a Name without a colon.
+func isNCName(s string) bool {
+	return isName(s) && !strings.Contains(s, ":")
+}
+
+// nameString returns name in the form {uri}local, or just local if it's in no namespace.
+func nameString(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return "{" + name.Space + "}" + name.Local
+}
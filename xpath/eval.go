@@ -0,0 +1,449 @@
+package xpath
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	dom "github.com/jphsd/xml"
+)
+
+// evalContext is the dynamic context threaded through evaluation.
+type evalContext struct {
+	Context
+	ord *order // Document order, built on first use and shared by derived contexts
+}
+
+// with returns a copy of c with a new context node, position and size.
+func (c *evalContext) with(n Node, pos, size int) *evalContext {
+	nc := *c
+	nc.Node, nc.Position, nc.Size = n, pos, size
+	return &nc
+}
+
+func (c *evalContext) order() order {
+	if *c.ord == nil {
+		*c.ord = newOrder(Root(c.Node))
+	}
+	return *c.ord
+}
+
+func (e *literalExpr) eval(c *evalContext) (any, error) {
+	return e.s, nil
+}
+
+func (e *numberExpr) eval(c *evalContext) (any, error) {
+	return e.f, nil
+}
+
+func (e *varExpr) eval(c *evalContext) (any, error) {
+	v, ok := c.Variables[e.name]
+	if !ok {
+		return nil, fmt.Errorf("xpath: undefined variable %s", e.name.Local)
+	}
+	return normalize(v)
+}
+
+func (e *negExpr) eval(c *evalContext) (any, error) {
+	v, err := e.e.eval(c)
+	if err != nil {
+		return nil, err
+	}
+	return -Number(v), nil
+}
+
+func (e *binaryExpr) eval(c *evalContext) (any, error) {
+	l, err := e.l.eval(c)
+	if err != nil {
+		return nil, err
+	}
+
+	// Short circuit logical operators
+	switch e.op {
+	case "or":
+		if Boolean(l) {
+			return true, nil
+		}
+	case "and":
+		if !Boolean(l) {
+			return false, nil
+		}
+	}
+
+	r, err := e.r.eval(c)
+	if err != nil {
+		return nil, err
+	}
+
+	switch e.op {
+	case "or", "and":
+		return Boolean(r), nil
+	case "=", "!=", "<", "<=", ">", ">=":
+		return compare(e.op, l, r), nil
+	case "+":
+		return Number(l) + Number(r), nil
+	case "-":
+		return Number(l) - Number(r), nil
+	case "*":
+		return Number(l) * Number(r), nil
+	case "div":
+		return Number(l) / Number(r), nil
+	case "mod":
+		return math.Mod(Number(l), Number(r)), nil
+	case "|":
+		ln, lok := l.(NodeSet)
+		rn, rok := r.(NodeSet)
+		if !lok || !rok {
+			return nil, fmt.Errorf("xpath: operands of | must be node-sets")
+		}
+		nodes := make([]Node, 0, len(ln)+len(rn))
+		nodes = append(append(nodes, ln...), rn...)
+		return c.order().sortNodes(nodes), nil
+	}
+	return nil, fmt.Errorf("xpath: unknown operator %s", e.op)
+}
+
+func (e *filterExpr) eval(c *evalContext) (any, error) {
+	v, err := e.e.eval(c)
+	if err != nil {
+		return nil, err
+	}
+	ns, ok := v.(NodeSet)
+	if !ok {
+		return nil, fmt.Errorf("xpath: predicate applied to a non node-set")
+	}
+	// Filter expression predicates always use document order
+	nodes := []Node(ns)
+	for _, pred := range e.preds {
+		nodes, err = filter(c, nodes, pred)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return NodeSet(nodes), nil
+}
+
+func (e *pathExpr) eval(c *evalContext) (any, error) {
+	var nodes NodeSet
+	switch {
+	case e.filter != nil:
+		v, err := e.filter.eval(c)
+		if err != nil {
+			return nil, err
+		}
+		ns, ok := v.(NodeSet)
+		if !ok {
+			return nil, fmt.Errorf("xpath: path applied to a non node-set")
+		}
+		nodes = ns
+	case e.absolute:
+		nodes = NodeSet{Root(c.Node)}
+	default:
+		nodes = NodeSet{c.Node}
+	}
+
+	for _, s := range e.steps {
+		var err error
+		nodes, err = s.eval(c, nodes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nodes, nil
+}
+
+// eval applies the step to each node in the input and returns the union of the results.
+func (s *step) eval(c *evalContext, in NodeSet) (NodeSet, error) {
+	var res []Node
+	for _, n := range in {
+		var nodes []Node
+		for _, m := range n.axis(s.axis) {
+			if s.test.match(m, s.axis) {
+				nodes = append(nodes, m)
+			}
+		}
+		var err error
+		for _, pred := range s.preds {
+			nodes, err = filter(c, nodes, pred)
+			if err != nil {
+				return nil, err
+			}
+		}
+		res = append(res, nodes...)
+	}
+
+	// A single context node on a forward axis, or attribute and self steps from any number of
+	// nodes, already produce document order
+	if len(in) == 1 && !s.axis.reverse() {
+		return NodeSet(res), nil
+	}
+	if s.axis == Attribute || s.axis == Self {
+		return NodeSet(res), nil
+	}
+	return c.order().sortNodes(res), nil
+}
+
+// filter retains the nodes for which pred is true, using their position in nodes as the proximity
+// position. A numeric predicate is true when it equals the position.
+func filter(c *evalContext, nodes []Node, pred expr) ([]Node, error) {
+	var res []Node
+	size := len(nodes)
+	for i, n := range nodes {
+		v, err := pred.eval(c.with(n, i+1, size))
+		if err != nil {
+			return nil, err
+		}
+		var keep bool
+		if f, ok := v.(float64); ok {
+			keep = f == float64(i+1)
+		} else {
+			keep = Boolean(v)
+		}
+		if keep {
+			res = append(res, n)
+		}
+	}
+	return res, nil
+}
+
+// match reports whether n satisfies the test. Name tests only match the principal node type of the axis.
+func (t nodeTest) match(n Node, a Axis) bool {
+	switch t.kind {
+	case testNode:
+		return true
+	case testText:
+		return n.Type == TextNode
+	case testComment:
+		return n.Type == CommentNode
+	case testPI:
+		return n.Type == ProcInstNode && (t.target == "" || t.target == n.Name().Local)
+	}
+
+	principal := ElementNode
+	switch a {
+	case Attribute:
+		principal = AttributeNode
+	case Namespace:
+		principal = NamespaceNode
+	}
+	if n.Type != principal {
+		return false
+	}
+	if t.any {
+		return true
+	}
+	name := n.Name()
+	if principal == NamespaceNode {
+		// Namespace nodes have a local name and no namespace URI
+		return t.name.Space == "" && (t.name.Local == "*" || t.name.Local == name.Local)
+	}
+	if name.Space != t.name.Space {
+		return false
+	}
+	return t.name.Local == "*" || t.name.Local == name.Local
+}
+
+// compare implements the comparison rules of section 3.4, including the existential semantics for node-sets.
+func compare(op string, l, r any) bool {
+	ln, lok := l.(NodeSet)
+	rn, rok := r.(NodeSet)
+	switch {
+	case lok && rok:
+		// Avoid recomputing the string-values on the right for every node on the left
+		rv := make([]string, len(rn))
+		for i, n := range rn {
+			rv[i] = n.Value()
+		}
+		for _, a := range ln {
+			av := a.Value()
+			for _, bv := range rv {
+				if compareAtomic(op, av, bv) {
+					return true
+				}
+			}
+		}
+		return false
+	case lok:
+		if b, ok := r.(bool); ok {
+			return compareAtomic(op, Boolean(ln), b)
+		}
+		for _, a := range ln {
+			if compareAtomic(op, a.Value(), r) {
+				return true
+			}
+		}
+		return false
+	case rok:
+		if b, ok := l.(bool); ok {
+			return compareAtomic(op, b, Boolean(rn))
+		}
+		for _, b := range rn {
+			if compareAtomic(op, l, b.Value()) {
+				return true
+			}
+		}
+		return false
+	}
+	return compareAtomic(op, l, r)
+}
+
+// compareAtomic compares two values neither of which is a node-set.
+func compareAtomic(op string, l, r any) bool {
+	if op == "=" || op == "!=" {
+		var eq bool
+		_, lb := l.(bool)
+		_, rb := r.(bool)
+		_, lf := l.(float64)
+		_, rf := r.(float64)
+		switch {
+		case lb || rb:
+			eq = Boolean(l) == Boolean(r)
+		case lf || rf:
+			eq = Number(l) == Number(r)
+		default:
+			eq = String(l) == String(r)
+		}
+		if op == "=" {
+			return eq
+		}
+		return !eq
+	}
+
+	lv, rv := Number(l), Number(r)
+	switch op {
+	case "<":
+		return lv < rv
+	case "<=":
+		return lv <= rv
+	case ">":
+		return lv > rv
+	case ">=":
+		return lv >= rv
+	}
+	return false
+}
+
+// normalize converts supplied Go values into the four XPath types.
+func normalize(v any) (any, error) {
+	switch v := v.(type) {
+	case NodeSet, string, float64, bool:
+		return v, nil
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case float32:
+		return float64(v), nil
+	case Node:
+		return NodeSet{v}, nil
+	case []Node:
+		return NodeSet(v), nil
+	case *dom.Element:
+		return NodeSet{NewNode(v)}, nil
+	case []*dom.Element:
+		ns := make(NodeSet, len(v))
+		for i, elt := range v {
+			ns[i] = NewNode(elt)
+		}
+		return ns, nil
+	case fmt.Stringer:
+		return v.String(), nil
+	}
+	return nil, fmt.Errorf("xpath: unsupported value type %T", v)
+}
+
+// String converts a value to a string using the rules of the XPath string() function.
+func String(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case bool:
+		if v {
+			return "true"
+		}
+		return "false"
+	case float64:
+		return formatNumber(v)
+	case NodeSet:
+		if len(v) == 0 {
+			return ""
+		}
+		return v[0].Value()
+	}
+	return ""
+}
+
+// Number converts a value to a number using the rules of the XPath number() function.
+func Number(v any) float64 {
+	switch v := v.(type) {
+	case float64:
+		return v
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	case string:
+		return parseNumber(v)
+	case NodeSet:
+		return parseNumber(String(v))
+	}
+	return math.NaN()
+}
+
+// Boolean converts a value to a boolean using the rules of the XPath boolean() function.
+func Boolean(v any) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case float64:
+		return v != 0 && !math.IsNaN(v)
+	case string:
+		return len(v) > 0
+	case NodeSet:
+		return len(v) > 0
+	}
+	return false
+}
+
+func formatNumber(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	case f == 0:
+		// Includes negative zero
+		return "0"
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// parseNumber accepts optional whitespace, an optional minus sign, and digits with an optional
+// decimal point. Anything else is NaN.
+func parseNumber(s string) float64 {
+	s = strings.Trim(s, " \t\n\r")
+	t := strings.TrimPrefix(s, "-")
+	if len(t) == 0 || t == "." {
+		return math.NaN()
+	}
+	dot := false
+	for i := 0; i < len(t); i++ {
+		c := t[i]
+		if c == '.' && !dot {
+			dot = true
+			continue
+		}
+		if !isDigit(c) {
+			return math.NaN()
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return math.NaN()
+	}
+	return f
+}
@@ -0,0 +1,364 @@
+package xpath
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"unicode/utf8"
+
+	dom "github.com/jphsd/xml"
+)
+
+type coreFunction struct {
+	min, max int // Argument count limits, max < 0 is unbounded
+	fn       func(c *evalContext, args []any) (any, error)
+}
+
+// coreFunctions is the XPath 1.0 core function library.
+var coreFunctions map[string]coreFunction
+
+func init() {
+	coreFunctions = map[string]coreFunction{
+		// Node set functions
+		"last":          {0, 0, fnLast},
+		"position":      {0, 0, fnPosition},
+		"count":         {1, 1, fnCount},
+		"id":            {1, 1, fnID},
+		"local-name":    {0, 1, fnLocalName},
+		"namespace-uri": {0, 1, fnNamespaceURI},
+		"name":          {0, 1, fnName},
+		// String functions
+		"string":           {0, 1, fnString},
+		"concat":           {2, -1, fnConcat},
+		"starts-with":      {2, 2, fnStartsWith},
+		"contains":         {2, 2, fnContains},
+		"substring-before": {2, 2, fnSubstringBefore},
+		"substring-after":  {2, 2, fnSubstringAfter},
+		"substring":        {2, 3, fnSubstring},
+		"string-length":    {0, 1, fnStringLength},
+		"normalize-space":  {0, 1, fnNormalizeSpace},
+		"translate":        {3, 3, fnTranslate},
+		// Boolean functions
+		"boolean": {1, 1, fnBoolean},
+		"not":     {1, 1, fnNot},
+		"true":    {0, 0, fnTrue},
+		"false":   {0, 0, fnFalse},
+		"lang":    {1, 1, fnLang},
+		// Number functions
+		"number":  {0, 1, fnNumber},
+		"sum":     {1, 1, fnSum},
+		"floor":   {1, 1, fnFloor},
+		"ceiling": {1, 1, fnCeiling},
+		"round":   {1, 1, fnRound},
+	}
+}
+
+func (e *funcExpr) eval(c *evalContext) (any, error) {
+	args := make([]any, len(e.args))
+	for i, arg := range e.args {
+		v, err := arg.eval(c)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+
+	if e.name.Space == "" {
+		if cf, ok := coreFunctions[e.name.Local]; ok {
+			return cf.fn(c, args)
+		}
+	}
+	f, ok := c.Functions[e.name]
+	if !ok {
+		return nil, fmt.Errorf("xpath: unknown function %s()", e.name.Local)
+	}
+	ctx := c.Context
+	v, err := f(&ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	return normalize(v)
+}
+
+// nodeSetArg returns argument i as a node-set, or the context node if the argument is absent.
+func nodeSetArg(c *evalContext, args []any, i int, fname string) (NodeSet, error) {
+	if i >= len(args) {
+		return NodeSet{c.Node}, nil
+	}
+	ns, ok := args[i].(NodeSet)
+	if !ok {
+		return nil, fmt.Errorf("xpath: %s() requires a node-set argument", fname)
+	}
+	return ns, nil
+}
+
+// stringArg returns argument i as a string, or the string-value of the context node if the argument is absent.
+func stringArg(c *evalContext, args []any, i int) string {
+	if i >= len(args) {
+		return c.Node.Value()
+	}
+	return String(args[i])
+}
+
+func fnLast(c *evalContext, args []any) (any, error) {
+	return float64(c.Size), nil
+}
+
+func fnPosition(c *evalContext, args []any) (any, error) {
+	return float64(c.Position), nil
+}
+
+func fnCount(c *evalContext, args []any) (any, error) {
+	ns, err := nodeSetArg(c, args, 0, "count")
+	if err != nil {
+		return nil, err
+	}
+	return float64(len(ns)), nil
+}
+
+// fnID treats attributes named id, in no namespace, and xml:id as being of type ID.
+func fnID(c *evalContext, args []any) (any, error) {
+	var ids []string
+	if ns, ok := args[0].(NodeSet); ok {
+		for _, n := range ns {
+			ids = append(ids, strings.Fields(n.Value())...)
+		}
+	} else {
+		ids = strings.Fields(String(args[0]))
+	}
+	want := make(map[string]bool)
+	for _, id := range ids {
+		want[id] = true
+	}
+
+	var res []Node
+	var walk func(elt *dom.Element)
+	walk = func(elt *dom.Element) {
+		if elt.Type == dom.Document {
+			for _, child := range elt.Children {
+				walk(child)
+			}
+		}
+		if elt.Type != dom.Node {
+			return
+		}
+		for _, attr := range elt.Attributes {
+			if (attr.Name.Local == "id" && (attr.Name.Space == "" || attr.Name.Space == xmlURL)) && want[attr.Value] {
+				res = append(res, NewNode(elt))
+				break
+			}
+		}
+		for _, child := range elt.Children {
+			walk(child)
+		}
+	}
+	if len(want) > 0 {
+		walk(Root(c.Node).Element)
+	}
+	return NodeSet(res), nil
+}
+
+func fnLocalName(c *evalContext, args []any) (any, error) {
+	ns, err := nodeSetArg(c, args, 0, "local-name")
+	if err != nil || len(ns) == 0 {
+		return "", err
+	}
+	return ns[0].Name().Local, nil
+}
+
+func fnNamespaceURI(c *evalContext, args []any) (any, error) {
+	ns, err := nodeSetArg(c, args, 0, "namespace-uri")
+	if err != nil || len(ns) == 0 {
+		return "", err
+	}
+	if ns[0].Type == NamespaceNode {
+		return "", nil
+	}
+	return ns[0].Name().Space, nil
+}
+
+// fnName returns the QName of the node using a prefix bound in the node's scope.
+func fnName(c *evalContext, args []any) (any, error) {
+	ns, err := nodeSetArg(c, args, 0, "name")
+	if err != nil || len(ns) == 0 {
+		return "", err
+	}
+	n := ns[0]
+	name := n.Name()
+	if name.Space == "" || n.Type == NamespaceNode {
+		return name.Local, nil
+	}
+	// Unbound namespaces can occur in constructed trees
+	prefix, ok := n.Element.LookupPrefix(name.Space)
+	if !ok || prefix == "" {
+		return name.Local, nil
+	}
+	return prefix + ":" + name.Local, nil
+}
+
+func fnString(c *evalContext, args []any) (any, error) {
+	return stringArg(c, args, 0), nil
+}
+
+func fnConcat(c *evalContext, args []any) (any, error) {
+	var sb strings.Builder
+	for _, arg := range args {
+		sb.WriteString(String(arg))
+	}
+	return sb.String(), nil
+}
+
+func fnStartsWith(c *evalContext, args []any) (any, error) {
+	return strings.HasPrefix(String(args[0]), String(args[1])), nil
+}
+
+func fnContains(c *evalContext, args []any) (any, error) {
+	return strings.Contains(String(args[0]), String(args[1])), nil
+}
+
+func fnSubstringBefore(c *evalContext, args []any) (any, error) {
+	s, sep := String(args[0]), String(args[1])
+	i := strings.Index(s, sep)
+	if i < 0 {
+		return "", nil
+	}
+	return s[:i], nil
+}
+
+func fnSubstringAfter(c *evalContext, args []any) (any, error) {
+	s, sep := String(args[0]), String(args[1])
+	i := strings.Index(s, sep)
+	if i < 0 {
+		return "", nil
+	}
+	return s[i+len(sep):], nil
+}
+
+// fnSubstring returns the characters whose position p satisfies round(start) <= p < round(start) + round(len).
+func fnSubstring(c *evalContext, args []any) (any, error) {
+	s := []rune(String(args[0]))
+	start := round(Number(args[1]))
+	end := math.Inf(1)
+	if len(args) > 2 {
+		end = start + round(Number(args[2]))
+	}
+	var sb strings.Builder
+	for i, r := range s {
+		p := float64(i + 1)
+		if p >= start && p < end {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String(), nil
+}
+
+func fnStringLength(c *evalContext, args []any) (any, error) {
+	return float64(utf8.RuneCountInString(stringArg(c, args, 0))), nil
+}
+
+func fnNormalizeSpace(c *evalContext, args []any) (any, error) {
+	return strings.Join(strings.FieldsFunc(stringArg(c, args, 0), func(r rune) bool {
+		return r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	}), " "), nil
+}
+
+func fnTranslate(c *evalContext, args []any) (any, error) {
+	from, to := []rune(String(args[1])), []rune(String(args[2]))
+	mapping := make(map[rune]rune)
+	for i, r := range from {
+		if _, ok := mapping[r]; ok {
+			// First occurrence wins
+			continue
+		}
+		if i < len(to) {
+			mapping[r] = to[i]
+		} else {
+			mapping[r] = -1
+		}
+	}
+	return strings.Map(func(r rune) rune {
+		if m, ok := mapping[r]; ok {
+			return m
+		}
+		return r
+	}, String(args[0])), nil
+}
+
+func fnBoolean(c *evalContext, args []any) (any, error) {
+	return Boolean(args[0]), nil
+}
+
+func fnNot(c *evalContext, args []any) (any, error) {
+	return !Boolean(args[0]), nil
+}
+
+func fnTrue(c *evalContext, args []any) (any, error) {
+	return true, nil
+}
+
+func fnFalse(c *evalContext, args []any) (any, error) {
+	return false, nil
+}
+
+// fnLang compares the argument with the nearest xml:lang, ignoring case and any suffix.
+func fnLang(c *evalContext, args []any) (any, error) {
+	want := strings.ToLower(String(args[0]))
+	elt := c.Node.Element
+	switch c.Node.Type {
+	case RootNode:
+		return false, nil
+	case TextNode, CommentNode, ProcInstNode:
+		elt = elt.Parent
+	}
+	for ; elt != nil; elt = elt.Parent {
+		lang, ok := elt.LookupAttrNS(xmlURL, "lang")
+		if !ok {
+			continue
+		}
+		lang = strings.ToLower(lang)
+		return lang == want || strings.HasPrefix(lang, want+"-"), nil
+	}
+	return false, nil
+}
+
+func fnNumber(c *evalContext, args []any) (any, error) {
+	if len(args) == 0 {
+		return parseNumber(c.Node.Value()), nil
+	}
+	return Number(args[0]), nil
+}
+
+func fnSum(c *evalContext, args []any) (any, error) {
+	ns, err := nodeSetArg(c, args, 0, "sum")
+	if err != nil {
+		return nil, err
+	}
+	sum := 0.0
+	for _, n := range ns {
+		sum += parseNumber(n.Value())
+	}
+	return sum, nil
+}
+
+func fnFloor(c *evalContext, args []any) (any, error) {
+	return math.Floor(Number(args[0])), nil
+}
+
+func fnCeiling(c *evalContext, args []any) (any, error) {
+	return math.Ceil(Number(args[0])), nil
+}
+
+func fnRound(c *evalContext, args []any) (any, error) {
+	return round(Number(args[0])), nil
+}
+
+// round rounds half up, preserving NaN, infinities and negative zero.
+func round(f float64) float64 {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return f
+	}
+	if f < 0 && f >= -0.5 {
+		return math.Copysign(0, -1)
+	}
+	return math.Floor(f + 0.5)
+}
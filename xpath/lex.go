@@ -0,0 +1,258 @@
+package xpath
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokLParen
+	tokRParen
+	tokLBracket
+	tokRBracket
+	tokDot
+	tokDotDot
+	tokAt
+	tokComma
+	tokColonColon
+	tokNameTest     // prefix and local, local may be *
+	tokNodeType     // comment, text, processing-instruction or node
+	tokOperator     // and, or, mod, div, /, //, |, +, -, =, !=, <, <=, >, >=, *
+	tokFunctionName // prefix and local
+	tokAxisName
+	tokLiteral
+	tokNumber
+	tokVariable // prefix and local
+)
+
+type token struct {
+	kind   tokenKind
+	prefix string
+	value  string // local name, operator, literal or number text
+	pos    int
+}
+
+// lex splits an expression into tokens, applying the disambiguation rules from section 3.7 of the
+// XPath 1.0 recommendation.
+func lex(s string) ([]token, error) {
+	var toks []token
+	i := 0
+	for {
+		for i < len(s) && isSpace(s[i]) {
+			i++
+		}
+		if i >= len(s) {
+			toks = append(toks, token{kind: tokEOF, pos: i})
+			return toks, nil
+		}
+		start := i
+		c := s[i]
+		switch {
+		case c == '(':
+			toks = append(toks, token{kind: tokLParen, pos: start})
+			i++
+		case c == ')':
+			toks = append(toks, token{kind: tokRParen, pos: start})
+			i++
+		case c == '[':
+			toks = append(toks, token{kind: tokLBracket, pos: start})
+			i++
+		case c == ']':
+			toks = append(toks, token{kind: tokRBracket, pos: start})
+			i++
+		case c == '@':
+			toks = append(toks, token{kind: tokAt, pos: start})
+			i++
+		case c == ',':
+			toks = append(toks, token{kind: tokComma, pos: start})
+			i++
+		case c == ':':
+			if i+1 < len(s) && s[i+1] == ':' {
+				toks = append(toks, token{kind: tokColonColon, pos: start})
+				i += 2
+			} else {
+				return nil, fmt.Errorf("xpath: unexpected ':' at %d", start)
+			}
+		case c == '.':
+			if i+1 < len(s) && s[i+1] == '.' {
+				toks = append(toks, token{kind: tokDotDot, pos: start})
+				i += 2
+			} else if i+1 < len(s) && isDigit(s[i+1]) {
+				i = scanNumber(s, i)
+				toks = append(toks, token{kind: tokNumber, value: s[start:i], pos: start})
+			} else {
+				toks = append(toks, token{kind: tokDot, pos: start})
+				i++
+			}
+		case isDigit(c):
+			i = scanNumber(s, i)
+			toks = append(toks, token{kind: tokNumber, value: s[start:i], pos: start})
+		case c == '"' || c == '\'':
+			j := strings.IndexByte(s[i+1:], c)
+			if j < 0 {
+				return nil, fmt.Errorf("xpath: unterminated literal at %d", start)
+			}
+			toks = append(toks, token{kind: tokLiteral, value: s[i+1 : i+1+j], pos: start})
+			i += j + 2
+		case c == '$':
+			i++
+			prefix, local, n := scanQName(s[i:])
+			if n == 0 || local == "*" {
+				return nil, fmt.Errorf("xpath: bad variable reference at %d", start)
+			}
+			i += n
+			toks = append(toks, token{kind: tokVariable, prefix: prefix, value: local, pos: start})
+		case c == '/':
+			if i+1 < len(s) && s[i+1] == '/' {
+				toks = append(toks, token{kind: tokOperator, value: "//", pos: start})
+				i += 2
+			} else {
+				toks = append(toks, token{kind: tokOperator, value: "/", pos: start})
+				i++
+			}
+		case c == '|' || c == '+' || c == '-' || c == '=':
+			toks = append(toks, token{kind: tokOperator, value: s[i : i+1], pos: start})
+			i++
+		case c == '!':
+			if i+1 < len(s) && s[i+1] == '=' {
+				toks = append(toks, token{kind: tokOperator, value: "!=", pos: start})
+				i += 2
+			} else {
+				return nil, fmt.Errorf("xpath: unexpected '!' at %d", start)
+			}
+		case c == '<' || c == '>':
+			if i+1 < len(s) && s[i+1] == '=' {
+				toks = append(toks, token{kind: tokOperator, value: s[i : i+2], pos: start})
+				i += 2
+			} else {
+				toks = append(toks, token{kind: tokOperator, value: s[i : i+1], pos: start})
+				i++
+			}
+		case c == '*':
+			i++
+			if operatorContext(toks) {
+				toks = append(toks, token{kind: tokOperator, value: "*", pos: start})
+			} else {
+				toks = append(toks, token{kind: tokNameTest, value: "*", pos: start})
+			}
+		default:
+			prefix, local, n := scanQName(s[i:])
+			if n == 0 {
+				r, _ := utf8.DecodeRuneInString(s[i:])
+				return nil, fmt.Errorf("xpath: unexpected %q at %d", r, start)
+			}
+			i += n
+			if operatorContext(toks) {
+				if prefix != "" || (local != "and" && local != "or" && local != "mod" && local != "div") {
+					return nil, fmt.Errorf("xpath: expected operator at %d", start)
+				}
+				toks = append(toks, token{kind: tokOperator, value: local, pos: start})
+				break
+			}
+			// Look ahead past whitespace for ( or ::
+			j := i
+			for j < len(s) && isSpace(s[j]) {
+				j++
+			}
+			switch {
+			case local == "*":
+				toks = append(toks, token{kind: tokNameTest, prefix: prefix, value: local, pos: start})
+			case j < len(s) && s[j] == '(':
+				if prefix == "" && isNodeType(local) {
+					toks = append(toks, token{kind: tokNodeType, value: local, pos: start})
+				} else {
+					toks = append(toks, token{kind: tokFunctionName, prefix: prefix, value: local, pos: start})
+				}
+			case j+1 < len(s) && s[j] == ':' && s[j+1] == ':' && prefix == "":
+				toks = append(toks, token{kind: tokAxisName, value: local, pos: start})
+			default:
+				toks = append(toks, token{kind: tokNameTest, prefix: prefix, value: local, pos: start})
+			}
+		}
+	}
+}
+
+// operatorContext reports whether the next token must be an operator, which is the case when there
+// is a preceding token and it isn't one of @, ::, (, [, , or an operator.
+func operatorContext(toks []token) bool {
+	if len(toks) == 0 {
+		return false
+	}
+	switch toks[len(toks)-1].kind {
+	case tokAt, tokColonColon, tokLParen, tokLBracket, tokComma, tokOperator:
+		return false
+	}
+	return true
+}
+
+func isNodeType(s string) bool {
+	return s == "comment" || s == "text" || s == "processing-instruction" || s == "node"
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func scanNumber(s string, i int) int {
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	if i < len(s) && s[i] == '.' {
+		i++
+		for i < len(s) && isDigit(s[i]) {
+			i++
+		}
+	}
+	return i
+}
+
+// scanQName reads an NCName, NCName:NCName or NCName:* from the start of s and returns the prefix,
+// local part and number of bytes consumed.
+func scanQName(s string) (string, string, int) {
+	n := scanNCName(s)
+	if n == 0 {
+		return "", "", 0
+	}
+	if n+1 < len(s) && s[n] == ':' {
+		if s[n+1] == '*' {
+			return s[:n], "*", n + 2
+		}
+		m := scanNCName(s[n+1:])
+		if m > 0 {
+			return s[:n], s[n+1 : n+1+m], n + 1 + m
+		}
+	}
+	return "", s[:n], n
+}
+
+func scanNCName(s string) int {
+	i := 0
+	for i < len(s) {
+		r, w := utf8.DecodeRuneInString(s[i:])
+		if i == 0 && !isNameStart(r) {
+			return 0
+		}
+		if !isNameStart(r) && !isNameChar(r) {
+			break
+		}
+		i += w
+	}
+	return i
+}
+
+func isNameStart(r rune) bool {
+	return r == '_' || unicode.IsLetter(r)
+}
+
+func isNameChar(r rune) bool {
+	return r == '-' || r == '.' || unicode.IsDigit(r) || unicode.In(r, unicode.Mn, unicode.Mc, unicode.Lm) || r == 0xb7
+}
@@ -0,0 +1,363 @@
+package xpath
+
+import (
+	"encoding/xml"
+	"sort"
+	"strings"
+
+	dom "github.com/jphsd/xml"
+)
+
+// Well known namespaces which are bound without declaration.
+const (
+	xmlURL = "http://www.w3.org/XML/1998/namespace"
+)
+
+// NodeType represents the kind of node in the XPath data model.
+type NodeType int
+
+const (
+	RootNode NodeType = iota
+	ElementNode
+	AttributeNode
+	NamespaceNode
+	TextNode
+	CommentNode
+	ProcInstNode
+)
+
+// Node is a node in the XPath data model. Element and text nodes refer directly to a DOM element.
+// Attribute and namespace nodes refer to their owning element, and the root node to the top of
+// the tree.
+type Node struct {
+	Type    NodeType
+	Element *dom.Element
+	Index   int    // Index of the attribute in Element.Attributes, or the namespace in document order
+	Prefix  string // Namespace node prefix
+}
+
+// NodeSet is a set of nodes held in document order with no duplicates.
+type NodeSet []Node
+
+// NewNode returns the node for a DOM element. Directives have no equivalent in the data model and are
+// returned as text nodes.
+func NewNode(elt *dom.Element) Node {
+	switch elt.Type {
+	case dom.Node:
+		return Node{Type: ElementNode, Element: elt}
+	case dom.Comment:
+		return Node{Type: CommentNode, Element: elt}
+	case dom.ProcInst:
+		return Node{Type: ProcInstNode, Element: elt}
+	case dom.Document:
+		return Node{Type: RootNode, Element: elt}
+	}
+	return Node{Type: TextNode, Element: elt}
+}
+
+// Root returns the root node of the tree containing n. For a tree without a Document the root node
+// is the implied parent of the top element.
+func Root(n Node) Node {
+	return Node{Type: RootNode, Element: n.Element.Root()}
+}
+
+// Name returns the expanded name of element and attribute nodes, the prefix of namespace nodes, the
+// target of processing instruction nodes and an empty name for all others.
+func (n Node) Name() xml.Name {
+	switch n.Type {
+	case ElementNode, ProcInstNode:
+		return n.Element.Name
+	case AttributeNode:
+		return n.Element.Attributes[n.Index].Name
+	case NamespaceNode:
+		return xml.Name{Local: n.Prefix}
+	}
+	return xml.Name{}
+}
+
+// Value returns the string-value of the node.
+func (n Node) Value() string {
+	switch n.Type {
+	case RootNode, ElementNode:
+		var sb strings.Builder
+		textValue(n.Element, &sb)
+		return sb.String()
+	case AttributeNode:
+		return n.Element.Attributes[n.Index].Value
+	case NamespaceNode:
+		uri, _ := n.Element.LookupNamespaceURI(n.Prefix)
+		return uri
+	case TextNode, CommentNode, ProcInstNode:
+		return string(n.Element.Content)
+	}
+	return ""
+}
+
+func textValue(elt *dom.Element, sb *strings.Builder) {
+	switch elt.Type {
+	case dom.Content:
+		sb.Write(elt.Content)
+	case dom.Node, dom.Document:
+		for _, c := range elt.Children {
+			textValue(c, sb)
+		}
+	}
+}
+
+// Elements returns the DOM elements of the element and text nodes in the set.
+func (ns NodeSet) Elements() []*dom.Element {
+	res := make([]*dom.Element, 0, len(ns))
+	for _, n := range ns {
+		if n.Type == ElementNode || n.Type == TextNode {
+			res = append(res, n.Element)
+		}
+	}
+	return res
+}
+
+// parent returns the parent of n, if it has one.
+func (n Node) parent() (Node, bool) {
+	switch n.Type {
+	case RootNode:
+		return Node{}, false
+	case AttributeNode, NamespaceNode:
+		return NewNode(n.Element), true
+	}
+	if n.Element.Parent == nil {
+		return Node{Type: RootNode, Element: n.Element}, true
+	}
+	return NewNode(n.Element.Parent), true
+}
+
+// children returns the child nodes of root and element nodes.
+func (n Node) children() []Node {
+	if n.Type == RootNode && n.Element.Type != dom.Document {
+		return []Node{NewNode(n.Element)}
+	}
+	if n.Type != RootNode && n.Type != ElementNode {
+		return nil
+	}
+	res := make([]Node, 0, len(n.Element.Children))
+	for _, c := range n.Element.Children {
+		// Neither directives nor the XML declaration are part of the data model
+		if c.Type == dom.Directive || (c.Type == dom.ProcInst && c.Name.Local == "xml") {
+			continue
+		}
+		res = append(res, NewNode(c))
+	}
+	return res
+}
+
+// siblings returns the children of n's parent and n's position amongst them.
+func (n Node) siblings() ([]Node, int) {
+	switch n.Type {
+	case RootNode, AttributeNode, NamespaceNode:
+		return nil, -1
+	}
+	p, _ := n.parent()
+	sibs := p.children()
+	for i, s := range sibs {
+		if s == n {
+			return sibs, i
+		}
+	}
+	return nil, -1
+}
+
+// attributes returns the attribute nodes of an element, excluding namespace declarations.
+func (n Node) attributes() []Node {
+	if n.Type != ElementNode {
+		return nil
+	}
+	var res []Node
+	for i, attr := range n.Element.Attributes {
+		if dom.IsNamespaceDecl(attr.Name) {
+			continue
+		}
+		res = append(res, Node{Type: AttributeNode, Element: n.Element, Index: i})
+	}
+	return res
+}
+
+// namespaces returns the namespace nodes of an element, one for each binding in scope.
+func (n Node) namespaces() []Node {
+	if n.Type != ElementNode {
+		return nil
+	}
+	prefixes := []string{"xml"}
+	for p := range n.Element.InScopeNamespaces() {
+		prefixes = append(prefixes, p)
+	}
+	sort.Strings(prefixes)
+	res := make([]Node, len(prefixes))
+	for i, p := range prefixes {
+		res[i] = Node{Type: NamespaceNode, Element: n.Element, Index: i, Prefix: p}
+	}
+	return res
+}
+
+// axis returns the nodes along the axis from n, in document order for forward axes and reverse
+// document order for reverse axes.
+func (n Node) axis(a Axis) []Node {
+	switch a {
+	case Child:
+		return n.children()
+	case Descendant:
+		return n.descendants(nil)
+	case DescendantOrSelf:
+		return n.descendants([]Node{n})
+	case Parent:
+		if p, ok := n.parent(); ok {
+			return []Node{p}
+		}
+		return nil
+	case Ancestor:
+		return n.ancestors(nil)
+	case AncestorOrSelf:
+		return n.ancestors([]Node{n})
+	case FollowingSibling:
+		sibs, i := n.siblings()
+		if i < 0 {
+			return nil
+		}
+		return sibs[i+1:]
+	case PrecedingSibling:
+		sibs, i := n.siblings()
+		if i < 0 {
+			return nil
+		}
+		res := make([]Node, i)
+		for j := range res {
+			res[j] = sibs[i-1-j]
+		}
+		return res
+	case Following:
+		var res []Node
+		cur := n
+		if n.Type == AttributeNode || n.Type == NamespaceNode {
+			// Following includes the owner's descendants
+			cur, _ = n.parent()
+			res = cur.descendants(nil)
+		}
+		for {
+			sibs, i := cur.siblings()
+			if i >= 0 {
+				for _, s := range sibs[i+1:] {
+					res = s.descendants(append(res, s))
+				}
+			}
+			p, ok := cur.parent()
+			if !ok {
+				return res
+			}
+			cur = p
+		}
+	case Preceding:
+		var res []Node
+		cur := n
+		if n.Type == AttributeNode || n.Type == NamespaceNode {
+			cur, _ = n.parent()
+		}
+		for {
+			sibs, i := cur.siblings()
+			for j := i - 1; j >= 0; j-- {
+				sub := sibs[j].descendants([]Node{sibs[j]})
+				for k := len(sub) - 1; k >= 0; k-- {
+					res = append(res, sub[k])
+				}
+			}
+			p, ok := cur.parent()
+			if !ok {
+				return res
+			}
+			cur = p
+		}
+	case Attribute:
+		return n.attributes()
+	case Namespace:
+		return n.namespaces()
+	case Self:
+		return []Node{n}
+	}
+	return nil
+}
+
+func (n Node) descendants(res []Node) []Node {
+	for _, c := range n.children() {
+		res = append(res, c)
+		res = c.descendants(res)
+	}
+	return res
+}
+
+func (n Node) ancestors(res []Node) []Node {
+	for {
+		p, ok := n.parent()
+		if !ok {
+			return res
+		}
+		res = append(res, p)
+		n = p
+	}
+}
+
+// order assigns document order positions to the elements of a tree.
+type order map[*dom.Element]int
+
+func newOrder(root Node) order {
+	o := make(order)
+	var walk func(elt *dom.Element)
+	walk = func(elt *dom.Element) {
+		o[elt] = len(o)
+		for _, c := range elt.Children {
+			walk(c)
+		}
+	}
+	walk(root.Element)
+	return o
+}
+
+// less reports whether a precedes b in document order. Namespace nodes follow their element and
+// precede its attributes, which precede its children.
+func (o order) less(a, b Node) bool {
+	if a.Type == RootNode || b.Type == RootNode {
+		return a.Type == RootNode && b.Type != RootNode
+	}
+	ia, ib := o[a.Element], o[b.Element]
+	if ia != ib {
+		return ia < ib
+	}
+	ra, rb := rank(a.Type), rank(b.Type)
+	if ra != rb {
+		return ra < rb
+	}
+	return a.Index < b.Index
+}
+
+func rank(t NodeType) int {
+	switch t {
+	case NamespaceNode:
+		return 1
+	case AttributeNode:
+		return 2
+	}
+	return 0
+}
+
+// sortNodes puts nodes into document order and removes duplicates.
+func (o order) sortNodes(nodes []Node) NodeSet {
+	less := func(i, j int) bool {
+		return o.less(nodes[i], nodes[j])
+	}
+	if !sort.SliceIsSorted(nodes, less) {
+		sort.SliceStable(nodes, less)
+	}
+	res := nodes[:0]
+	for _, n := range nodes {
+		if len(res) > 0 && n == res[len(res)-1] {
+			continue
+		}
+		res = append(res, n)
+	}
+	return NodeSet(res)
+}
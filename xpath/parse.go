@@ -0,0 +1,475 @@
+package xpath
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strconv"
+)
+
+// Axis identifies the direction of a location step.
+type Axis int
+
+const (
+	Child Axis = iota
+	Descendant
+	Parent
+	Ancestor
+	FollowingSibling
+	PrecedingSibling
+	Following
+	Preceding
+	Attribute
+	Namespace
+	Self
+	DescendantOrSelf
+	AncestorOrSelf
+)
+
+var axisNames = map[string]Axis{
+	"child":              Child,
+	"descendant":         Descendant,
+	"parent":             Parent,
+	"ancestor":           Ancestor,
+	"following-sibling":  FollowingSibling,
+	"preceding-sibling":  PrecedingSibling,
+	"following":          Following,
+	"preceding":          Preceding,
+	"attribute":          Attribute,
+	"namespace":          Namespace,
+	"self":               Self,
+	"descendant-or-self": DescendantOrSelf,
+	"ancestor-or-self":   AncestorOrSelf,
+}
+
+// reverse reports whether proximity positions along the axis run in reverse document order.
+func (a Axis) reverse() bool {
+	return a == Parent || a == Ancestor || a == AncestorOrSelf || a == Preceding || a == PrecedingSibling
+}
+
+// expr is a node of the parsed expression tree.
+type expr interface {
+	eval(c *evalContext) (any, error)
+}
+
+type (
+	binaryExpr struct {
+		op   string
+		l, r expr
+	}
+	negExpr struct {
+		e expr
+	}
+	literalExpr struct {
+		s string
+	}
+	numberExpr struct {
+		f float64
+	}
+	varExpr struct {
+		name xml.Name
+	}
+	funcExpr struct {
+		name xml.Name
+		args []expr
+	}
+	filterExpr struct {
+		e     expr
+		preds []expr
+	}
+	// pathExpr evaluates steps against the root node, the context node or the result of filter.
+	pathExpr struct {
+		filter   expr
+		absolute bool
+		steps    []*step
+	}
+)
+
+type step struct {
+	axis  Axis
+	test  nodeTest
+	preds []expr
+}
+
+type testKind int
+
+const (
+	testName testKind = iota
+	testNode
+	testText
+	testComment
+	testPI
+)
+
+// nodeTest holds a resolved name test or node type test.
+type nodeTest struct {
+	kind   testKind
+	name   xml.Name // Local is * for wildcards
+	any    bool     // Wildcard matching any namespace
+	target string   // Optional processing-instruction target
+}
+
+type parser struct {
+	toks []token
+	pos  int
+	ns   map[string]string
+	src  string
+}
+
+func parse(src string, ns map[string]string) (expr, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks, 0, ns, src}
+	e, err := p.orExpr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokEOF {
+		return nil, p.errorf("unexpected token")
+	}
+	return e, nil
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// back undoes a call to next so errors report the position of t.
+func (p *parser) back(t token) {
+	if t.kind != tokEOF {
+		p.pos--
+	}
+}
+
+func (p *parser) isOp(ops ...string) bool {
+	t := p.peek()
+	if t.kind != tokOperator {
+		return false
+	}
+	for _, op := range ops {
+		if t.value == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) expect(kind tokenKind, what string) error {
+	if p.peek().kind != kind {
+		return p.errorf("expected %s", what)
+	}
+	p.next()
+	return nil
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	return fmt.Errorf("xpath: %s at %d in %q", fmt.Sprintf(format, args...), p.peek().pos, p.src)
+}
+
+// resolve maps a prefixed name to its namespace URI using the compile time bindings.
+func (p *parser) resolve(prefix, local string) (xml.Name, error) {
+	if prefix == "" {
+		return xml.Name{Local: local}, nil
+	}
+	if prefix == "xml" {
+		return xml.Name{Space: xmlURL, Local: local}, nil
+	}
+	uri, ok := p.ns[prefix]
+	if !ok {
+		return xml.Name{}, p.errorf("undeclared prefix %s", prefix)
+	}
+	return xml.Name{Space: uri, Local: local}, nil
+}
+
+func (p *parser) binary(sub func() (expr, error), ops ...string) (expr, error) {
+	l, err := sub()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp(ops...) {
+		op := p.next().value
+		r, err := sub()
+		if err != nil {
+			return nil, err
+		}
+		l = &binaryExpr{op, l, r}
+	}
+	return l, nil
+}
+
+func (p *parser) orExpr() (expr, error) {
+	return p.binary(p.andExpr, "or")
+}
+
+func (p *parser) andExpr() (expr, error) {
+	return p.binary(p.equalityExpr, "and")
+}
+
+func (p *parser) equalityExpr() (expr, error) {
+	return p.binary(p.relationalExpr, "=", "!=")
+}
+
+func (p *parser) relationalExpr() (expr, error) {
+	return p.binary(p.additiveExpr, "<", "<=", ">", ">=")
+}
+
+func (p *parser) additiveExpr() (expr, error) {
+	return p.binary(p.multiplicativeExpr, "+", "-")
+}
+
+func (p *parser) multiplicativeExpr() (expr, error) {
+	return p.binary(p.unaryExpr, "*", "div", "mod")
+}
+
+func (p *parser) unaryExpr() (expr, error) {
+	if p.isOp("-") {
+		p.next()
+		e, err := p.unaryExpr()
+		if err != nil {
+			return nil, err
+		}
+		return &negExpr{e}, nil
+	}
+	return p.binary(p.pathExpr, "|")
+}
+
+func (p *parser) pathExpr() (expr, error) {
+	switch p.peek().kind {
+	case tokVariable, tokLParen, tokLiteral, tokNumber, tokFunctionName:
+		e, err := p.filterExpr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.isOp("/", "//") {
+			return e, nil
+		}
+		path := &pathExpr{filter: e}
+		if err := p.relativePath(path); err != nil {
+			return nil, err
+		}
+		return path, nil
+	}
+
+	path := &pathExpr{}
+	if p.isOp("/") {
+		p.next()
+		path.absolute = true
+		if !p.stepStart() {
+			return path, nil
+		}
+	} else if p.isOp("//") {
+		path.absolute = true
+	} else if !p.stepStart() {
+		return nil, p.errorf("expected expression")
+	}
+	if err := p.relativePath(path); err != nil {
+		return nil, err
+	}
+	return path, nil
+}
+
+// stepStart reports whether the next token can begin a location step.
+func (p *parser) stepStart() bool {
+	switch p.peek().kind {
+	case tokDot, tokDotDot, tokAt, tokAxisName, tokNameTest, tokNodeType:
+		return true
+	}
+	return false
+}
+
+// relativePath parses steps separated by / or //. A leading separator, if present, is consumed first.
+func (p *parser) relativePath(path *pathExpr) error {
+	first := true
+	for {
+		if p.isOp("//") {
+			p.next()
+			path.steps = append(path.steps, &step{axis: DescendantOrSelf, test: nodeTest{kind: testNode}})
+		} else if p.isOp("/") {
+			p.next()
+		} else if !first {
+			return nil
+		}
+		s, err := p.step()
+		if err != nil {
+			return err
+		}
+		path.steps = append(path.steps, s)
+		first = false
+	}
+}
+
+func (p *parser) step() (*step, error) {
+	t := p.peek()
+	switch t.kind {
+	case tokDot:
+		p.next()
+		return &step{axis: Self, test: nodeTest{kind: testNode}}, nil
+	case tokDotDot:
+		p.next()
+		return &step{axis: Parent, test: nodeTest{kind: testNode}}, nil
+	}
+
+	s := &step{axis: Child}
+	if t.kind == tokAt {
+		p.next()
+		s.axis = Attribute
+	} else if t.kind == tokAxisName {
+		p.next()
+		axis, ok := axisNames[t.value]
+		if !ok {
+			return nil, p.errorf("unknown axis %s", t.value)
+		}
+		s.axis = axis
+		if err := p.expect(tokColonColon, "::"); err != nil {
+			return nil, err
+		}
+	}
+
+	t = p.next()
+	switch t.kind {
+	case tokNameTest:
+		if t.value == "*" {
+			if t.prefix == "" {
+				s.test = nodeTest{kind: testName, name: xml.Name{Local: "*"}, any: true}
+				break
+			}
+		}
+		name, err := p.resolve(t.prefix, t.value)
+		if err != nil {
+			return nil, err
+		}
+		s.test = nodeTest{kind: testName, name: name}
+	case tokNodeType:
+		if err := p.expect(tokLParen, "("); err != nil {
+			return nil, err
+		}
+		switch t.value {
+		case "node":
+			s.test.kind = testNode
+		case "text":
+			s.test.kind = testText
+		case "comment":
+			s.test.kind = testComment
+		case "processing-instruction":
+			s.test.kind = testPI
+			if p.peek().kind == tokLiteral {
+				s.test.target = p.next().value
+			}
+		}
+		if err := p.expect(tokRParen, ")"); err != nil {
+			return nil, err
+		}
+	default:
+		p.back(t)
+		return nil, p.errorf("expected node test")
+	}
+
+	preds, err := p.predicates()
+	if err != nil {
+		return nil, err
+	}
+	s.preds = preds
+	return s, nil
+}
+
+func (p *parser) predicates() ([]expr, error) {
+	var preds []expr
+	for p.peek().kind == tokLBracket {
+		p.next()
+		e, err := p.orExpr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokRBracket, "]"); err != nil {
+			return nil, err
+		}
+		preds = append(preds, e)
+	}
+	return preds, nil
+}
+
+func (p *parser) filterExpr() (expr, error) {
+	e, err := p.primaryExpr()
+	if err != nil {
+		return nil, err
+	}
+	preds, err := p.predicates()
+	if err != nil {
+		return nil, err
+	}
+	if len(preds) == 0 {
+		return e, nil
+	}
+	return &filterExpr{e, preds}, nil
+}
+
+func (p *parser) primaryExpr() (expr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokVariable:
+		name, err := p.resolve(t.prefix, t.value)
+		if err != nil {
+			return nil, err
+		}
+		return &varExpr{name}, nil
+	case tokLParen:
+		e, err := p.orExpr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokRParen, ")"); err != nil {
+			return nil, err
+		}
+		return e, nil
+	case tokLiteral:
+		return &literalExpr{t.value}, nil
+	case tokNumber:
+		f, err := strconv.ParseFloat(t.value, 64)
+		if err != nil {
+			return nil, p.errorf("bad number %s", t.value)
+		}
+		return &numberExpr{f}, nil
+	case tokFunctionName:
+		name, err := p.resolve(t.prefix, t.value)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokLParen, "("); err != nil {
+			return nil, err
+		}
+		f := &funcExpr{name: name}
+		if p.peek().kind != tokRParen {
+			for {
+				arg, err := p.orExpr()
+				if err != nil {
+					return nil, err
+				}
+				f.args = append(f.args, arg)
+				if p.peek().kind != tokComma {
+					break
+				}
+				p.next()
+			}
+		}
+		if err := p.expect(tokRParen, ")"); err != nil {
+			return nil, err
+		}
+		if name.Space == "" {
+			if cf, ok := coreFunctions[name.Local]; ok && (len(f.args) < cf.min || (cf.max >= 0 && len(f.args) > cf.max)) {
+				return nil, p.errorf("wrong number of arguments to %s()", name.Local)
+			}
+		}
+		return f, nil
+	}
+	p.back(t)
+	return nil, p.errorf("expected primary expression")
+}
@@ -0,0 +1,195 @@
+package xpath
+
+import (
+	"fmt"
+)
+
+// Pattern is a compiled XSLT pattern, the restricted form of expression used to match nodes. A
+// pattern is a union of location paths using only the child and attribute axes and the // separator,
+// which may start with a call to id() or key().
+type Pattern struct {
+	src   string
+	paths []*pathExpr
+}
+
+// CompilePattern parses a pattern, resolving prefixes in names using the supplied bindings of prefix
+// to namespace URI.
+func CompilePattern(src string, ns map[string]string) (*Pattern, error) {
+	e, err := parse(src, ns)
+	if err != nil {
+		return nil, err
+	}
+	p := &Pattern{src: src}
+	var add func(e expr) error
+	add = func(e expr) error {
+		switch e := e.(type) {
+		case *binaryExpr:
+			if e.op == "|" {
+				if err := add(e.l); err != nil {
+					return err
+				}
+				return add(e.r)
+			}
+		case *funcExpr:
+			return add(&pathExpr{filter: e})
+		case *pathExpr:
+			if f, ok := e.filter.(*funcExpr); e.filter != nil && (!ok || f.name.Space != "" || f.name.Local != "id" && f.name.Local != "key") {
+				break
+			}
+			for i, s := range e.steps {
+				switch {
+				case s.axis == Child || s.axis == Attribute:
+				case s.axis == DescendantOrSelf && s.test.kind == testNode && len(s.preds) == 0 && i < len(e.steps)-1:
+				default:
+					return fmt.Errorf("xpath: %q isn't a pattern", src)
+				}
+			}
+			p.paths = append(p.paths, e)
+			return nil
+		}
+		return fmt.Errorf("xpath: %q isn't a pattern", src)
+	}
+	if err := add(e); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// String returns the source text of the pattern.
+func (p *Pattern) String() string {
+	return p.src
+}
+
+// Alternatives returns the location path patterns making up the union, each with the same source text.
+func (p *Pattern) Alternatives() []*Pattern {
+	res := make([]*Pattern, len(p.paths))
+	for i, path := range p.paths {
+		res[i] = &Pattern{p.src, []*pathExpr{path}}
+	}
+	return res
+}
+
+// Priority returns the default priority of the pattern, as given by section 5.5 of XSLT 1.0, or the
+// highest of them for a union.
+func (p *Pattern) Priority() float64 {
+	res := -0.5
+	for _, path := range p.paths {
+		if pri := priority(path); pri > res {
+			res = pri
+		}
+	}
+	return res
+}
+
+func priority(path *pathExpr) float64 {
+	if path.filter != nil || path.absolute || len(path.steps) != 1 || len(path.steps[0].preds) > 0 {
+		return 0.5
+	}
+	t := path.steps[0].test
+	switch {
+	case t.kind == testPI && t.target != "":
+		return 0
+	case t.kind != testName || t.any:
+		return -0.5
+	case t.name.Local == "*":
+		return -0.25
+	}
+	return 0
+}
+
+// Match reports whether the context node matches the pattern. The variables and functions of the
+// context are used by any predicates, its position and size are ignored.
+func (p *Pattern) Match(ctx *Context) (bool, error) {
+	c := &evalContext{*ctx, new(order)}
+	for _, path := range p.paths {
+		ok, err := matchSteps(c, path, ctx.Node, len(path.steps))
+		if ok || err != nil {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// matchSteps reports whether n is selected by the first i steps of path from some context.
+func matchSteps(c *evalContext, path *pathExpr, n Node, i int) (bool, error) {
+	if i == 0 {
+		switch {
+		case path.filter != nil:
+			v, err := path.filter.eval(c.with(n, 1, 1))
+			if err != nil {
+				return false, err
+			}
+			ns, ok := v.(NodeSet)
+			if !ok {
+				return false, fmt.Errorf("xpath: pattern doesn't start with a node-set")
+			}
+			return contains(ns, n), nil
+		case path.absolute:
+			return n.Type == RootNode, nil
+		}
+		return true, nil
+	}
+
+	s := path.steps[i-1]
+	if s.axis == DescendantOrSelf {
+		// Separator //, the rest of the path must select n or one of its ancestors
+		for {
+			ok, err := matchSteps(c, path, n, i-1)
+			if ok || err != nil {
+				return ok, err
+			}
+			p, ok := n.parent()
+			if !ok {
+				return false, nil
+			}
+			n = p
+		}
+	}
+
+	if !s.test.match(n, s.axis) {
+		return false, nil
+	}
+	switch n.Type {
+	case RootNode, NamespaceNode:
+		return false, nil
+	case AttributeNode:
+		if s.axis != Attribute {
+			return false, nil
+		}
+	default:
+		if s.axis != Child {
+			return false, nil
+		}
+	}
+	p, ok := n.parent()
+	if !ok {
+		return false, nil
+	}
+	if len(s.preds) > 0 {
+		var nodes []Node
+		for _, m := range p.axis(s.axis) {
+			if s.test.match(m, s.axis) {
+				nodes = append(nodes, m)
+			}
+		}
+		var err error
+		for _, pred := range s.preds {
+			if nodes, err = filter(c, nodes, pred); err != nil {
+				return false, err
+			}
+		}
+		if !contains(nodes, n) {
+			return false, nil
+		}
+	}
+	return matchSteps(c, path, p, i-1)
+}
+
+func contains(nodes []Node, n Node) bool {
+	for _, m := range nodes {
+		if m == n {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+/*
+Package xpath implements an XPath 1.0 evaluator over the xml package's Element tree.
+
+Expressions are compiled once with Compile or CompileNS and can then be evaluated against any number
+of documents. The result of an evaluation is one of NodeSet, string, float64 or bool.
+*/
+package xpath
+
+import (
+	"encoding/xml"
+	"fmt"
+
+	dom "github.com/jphsd/xml"
+)
+
+// Expr is a compiled XPath expression.
+type Expr struct {
+	src string
+	e   expr
+}
+
+// Function is an extension function callable from an expression. Arguments have already been
+// evaluated and are one of NodeSet, string, float64 or bool, as must be the result.
+type Function func(ctx *Context, args []any) (any, error)
+
+// Context holds the context node and the bindings used during evaluation. A zero Position or Size
+// is treated as 1.
+type Context struct {
+	Node      Node
+	Position  int
+	Size      int
+	Variables map[xml.Name]any      // Variable bindings
+	Functions map[xml.Name]Function // Extension functions, consulted after the core library
+}
+
+// Compile parses an expression. Any prefixes used in the expression result in an error, use
+// CompileNS to supply the namespace bindings.
+func Compile(src string) (*Expr, error) {
+	return CompileNS(src, nil)
+}
+
+// CompileNS parses an expression, resolving prefixes in names using the supplied bindings of prefix
+// to namespace URI.
+func CompileNS(src string, ns map[string]string) (*Expr, error) {
+	e, err := parse(src, ns)
+	if err != nil {
+		return nil, err
+	}
+	return &Expr{src, e}, nil
+}
+
+// MustCompile is like Compile but panics if the expression can't be parsed.
+func MustCompile(src string) *Expr {
+	e, err := Compile(src)
+	if err != nil {
+		panic(err)
+	}
+	return e
+}
+
+// String returns the source text of the expression.
+func (e *Expr) String() string {
+	return e.src
+}
+
+// Variables returns the names of the variables referenced by the expression, in the order of their
+// first reference.
+func (e *Expr) Variables() []xml.Name {
+	var res []xml.Name
+	seen := make(map[xml.Name]bool)
+	var walk func(e expr)
+	walk = func(e expr) {
+		switch e := e.(type) {
+		case *varExpr:
+			if !seen[e.name] {
+				seen[e.name] = true
+				res = append(res, e.name)
+			}
+		case *binaryExpr:
+			walk(e.l)
+			walk(e.r)
+		case *negExpr:
+			walk(e.e)
+		case *funcExpr:
+			for _, arg := range e.args {
+				walk(arg)
+			}
+		case *filterExpr:
+			walk(e.e)
+			for _, pred := range e.preds {
+				walk(pred)
+			}
+		case *pathExpr:
+			if e.filter != nil {
+				walk(e.filter)
+			}
+			for _, s := range e.steps {
+				for _, pred := range s.preds {
+					walk(pred)
+				}
+			}
+		}
+	}
+	walk(e.e)
+	return res
+}
+
+// Evaluate evaluates the expression with elt as the context node.
+func (e *Expr) Evaluate(elt *dom.Element) (any, error) {
+	return e.EvaluateContext(&Context{Node: NewNode(elt)})
+}
+
+// EvaluateContext evaluates the expression with the supplied context.
+func (e *Expr) EvaluateContext(ctx *Context) (any, error) {
+	c := &evalContext{*ctx, new(order)}
+	if c.Position == 0 {
+		c.Position = 1
+	}
+	if c.Size == 0 {
+		c.Size = 1
+	}
+	return e.e.eval(c)
+}
+
+// Select evaluates the expression with elt as the context node and returns the resulting node-set.
+func (e *Expr) Select(elt *dom.Element) (NodeSet, error) {
+	v, err := e.Evaluate(elt)
+	if err != nil {
+		return nil, err
+	}
+	ns, ok := v.(NodeSet)
+	if !ok {
+		return nil, fmt.Errorf("xpath: %s does not evaluate to a node-set", e.src)
+	}
+	return ns, nil
+}
+
+// Find compiles and evaluates src with elt as the context node and returns the DOM elements of the
+// resulting node-set.
+func Find(elt *dom.Element, src string) ([]*dom.Element, error) {
+	e, err := Compile(src)
+	if err != nil {
+		return nil, err
+	}
+	ns, err := e.Select(elt)
+	if err != nil {
+		return nil, err
+	}
+	return ns.Elements(), nil
+}
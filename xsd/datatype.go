@@ -0,0 +1,50 @@
+package xsd
+
+import (
+	"fmt"
+
+	dom "github.com/jphsd/xml"
+)
+
+// Datatype is a built-in datatype, optionally restricted by facets, for use by other schema
+// languages such as RELAX NG.
+type Datatype struct {
+	st *simpleType
+}
+
+// Facet is a facet name and value, such as maxLength and 8.
+type Facet struct {
+	Name, Value string
+}
+
+// NewDatatype returns the built-in datatype with the local name restricted by the facets. Each facet
+// is applied as a separate restriction, so repeated patterns must all match.
+func NewDatatype(name string, facets ...Facet) (*Datatype, error) {
+	t, ok := builtins[name]
+	if !ok || t.complex {
+		return nil, fmt.Errorf("xsd: unknown datatype %s", name)
+	}
+	st := t.simple
+	for _, f := range facets {
+		r := &simpleType{base: st, variety: st.variety, prim: st.prim, item: st.item, members: st.members,
+			ws: st.ws, state: resolved}
+		if err := r.facets.add(f.Name, f.Value); err != nil {
+			return nil, fmt.Errorf("xsd: %s: %v", name, err)
+		}
+		if r.facets.ws != wsUnset {
+			r.ws = r.facets.ws
+		}
+		st = r
+	}
+	return &Datatype{st}, nil
+}
+
+// Validate checks the value, resolving any QName against the scope of ctx.
+func (dt *Datatype) Validate(v string, ctx *dom.Element) error {
+	return dt.st.validate(v, ctx)
+}
+
+// Equal reports whether two valid values are equal in the datatype's value space.
+func (dt *Datatype) Equal(a, b string) bool {
+	return dt.st.equal(dt.st.normalize(a), dt.st.normalize(b))
+}
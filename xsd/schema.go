@@ -0,0 +1,890 @@
+/*
+Package xsd validates the xml package's Element trees against a subset of XML Schema 1.0.
+
+Supported are global and local element and attribute declarations, named and anonymous simple and
+complex types, derivation of complex types by extension and restriction, simple and complex content,
+sequence, choice and all model groups with occurrence constraints, element and attribute wildcards,
+model and attribute groups, substitution groups, nillable elements, xsi:type, the built-in datatypes
+with their facets, and the unique, key and keyref identity constraints.
+
+Schema documents referenced by include or import aren't loaded, they must all be passed to Parse.
+Redefine, the final and block controls, and derivation checks between types aren't supported.
+*/
+package xsd
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+
+	dom "github.com/jphsd/xml"
+	"github.com/jphsd/xml/xpath"
+)
+
+// Namespace URIs of XML Schema and of its instance attributes.
+const (
+	XSDURL = "http://www.w3.org/2001/XMLSchema"
+	XSIURL = "http://www.w3.org/2001/XMLSchema-instance"
+)
+
+// Schema holds the global components of one or more schema documents.
+type Schema struct {
+	elements   map[xml.Name]*element
+	types      map[xml.Name]*typeDef
+	attributes map[xml.Name]*attribute
+	groups     map[xml.Name]*particle
+	attrGroups map[xml.Name]*attrGroup
+	idcs       map[xml.Name]*identity
+	substs     map[*element][]*element // Members of each substitution group
+}
+
+type element struct {
+	name      xml.Name
+	typ       *typeDef
+	typeRef   xml.Name
+	substRef  xml.Name
+	nillable  bool
+	abstract  bool
+	def       *string
+	fixed     *string
+	idcs      []*identity
+	anonymous *typeDef
+	src       *dom.Element
+}
+
+// typeDef is a simple or complex type definition. Simple types have simple set and complex false,
+// complex types with simple content have both.
+type typeDef struct {
+	name     xml.Name
+	simple   *simpleType
+	complex  bool
+	mixed    bool
+	abstract bool
+	content  *particle // Effective content model, nil if empty
+	attrs    []*attribute
+	anyAttr  *wildcard
+
+	// Derivation, as declared
+	baseRef    xml.Name
+	base       *typeDef
+	extension  bool
+	own        *particle // Content declared by this type
+	ownAttrs   []*attribute
+	groupRefs  []xml.Name  // Attribute groups
+	simpleBase *simpleType // Anonymous simpleType in a simpleContent restriction
+	state      int         // Resolution state
+	src        *dom.Element
+}
+
+// Particle kinds.
+const (
+	pElement = iota
+	pSequence
+	pChoice
+	pAll
+	pAny
+	pGroup // Reference to a model group, replaced during resolution
+)
+
+type particle struct {
+	kind     int
+	min, max int // max < 0 is unbounded
+	elem     *element
+	ref      xml.Name // Element or group reference
+	children []*particle
+	wild     *wildcard
+	src      *dom.Element
+}
+
+type wildcard struct {
+	ns      []string // The namespace attribute's tokens
+	tns     string
+	process string // strict, lax or skip
+}
+
+type attribute struct {
+	name    xml.Name
+	ref     xml.Name
+	typ     *simpleType
+	typeRef xml.Name
+	use     string
+	def     *string
+	fixed   *string
+	src     *dom.Element
+}
+
+type attrGroup struct {
+	attrs     []*attribute
+	groupRefs []xml.Name
+	anyAttr   *wildcard
+	state     int
+}
+
+// Identity constraint kinds.
+const (
+	idcUnique = iota
+	idcKey
+	idcKeyRef
+)
+
+type identity struct {
+	name     xml.Name
+	kind     int
+	selector *xpath.Expr
+	fields   []*xpath.Expr
+	referRef xml.Name
+	refer    *identity
+}
+
+// Resolution states.
+const (
+	unresolved = iota
+	resolving
+	resolved
+)
+
+// schemaDoc holds the settings of the schema document being parsed.
+type schemaDoc struct {
+	s            *Schema
+	tns          string
+	qualElements bool
+	qualAttrs    bool
+}
+
+// Parse reads the schema documents, each either a Document or an xs:schema element, and resolves
+// the references between their components.
+func Parse(docs ...*dom.Element) (*Schema, error) {
+	s := &Schema{
+		elements:   make(map[xml.Name]*element),
+		types:      make(map[xml.Name]*typeDef),
+		attributes: make(map[xml.Name]*attribute),
+		groups:     make(map[xml.Name]*particle),
+		attrGroups: make(map[xml.Name]*attrGroup),
+		idcs:       make(map[xml.Name]*identity),
+		substs:     make(map[*element][]*element),
+	}
+	for name, t := range builtins {
+		s.types[xml.Name{Space: XSDURL, Local: name}] = t
+	}
+	for _, doc := range docs {
+		if doc.Type == dom.Document {
+			doc = doc.DocumentElement()
+		}
+		if doc == nil || doc.Name != (xml.Name{Space: XSDURL, Local: "schema"}) {
+			return nil, fmt.Errorf("xsd: not a schema document")
+		}
+		sd := &schemaDoc{
+			s:            s,
+			tns:          doc.Attr("targetNamespace"),
+			qualElements: doc.Attr("elementFormDefault") == "qualified",
+			qualAttrs:    doc.Attr("attributeFormDefault") == "qualified",
+		}
+		if err := sd.schema(doc); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.resolve(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// errorf returns an error located at the schema element e.
+func errorf(e *dom.Element, format string, args ...any) error {
+	msg := fmt.Sprintf(format, args...)
+	if e != nil && e.Pos.Line > 0 {
+		return fmt.Errorf("xsd: schema %s %s: %s", e.Pos, e.Path(), msg)
+	}
+	if e != nil {
+		return fmt.Errorf("xsd: schema %s: %s", e.Path(), msg)
+	}
+	return fmt.Errorf("xsd: schema: %s", msg)
+}
+
+// children returns the XSD elements in e, skipping annotations.
+func children(e *dom.Element) []*dom.Element {
+	var res []*dom.Element
+	for _, c := range e.Children {
+		if c.Type == dom.Node && c.Name.Space == XSDURL && c.Name.Local != "annotation" {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+// qname resolves a QName valued attribute of e using the namespaces in scope.
+func qname(e *dom.Element, attr string) (xml.Name, error) {
+	v := strings.TrimSpace(e.Attr(attr))
+	prefix, local, ok := strings.Cut(v, ":")
+	if !ok {
+		prefix, local = "", v
+	}
+	uri, bound := e.LookupNamespaceURI(prefix)
+	if !bound && prefix != "" {
+		return xml.Name{}, errorf(e, "prefix %s in %s isn't bound", prefix, attr)
+	}
+	return xml.Name{Space: uri, Local: local}, nil
+}
+
+func (sd *schemaDoc) schema(doc *dom.Element) error {
+	for _, c := range children(doc) {
+		name := xml.Name{Space: sd.tns, Local: c.Attr("name")}
+		var err error
+		switch c.Name.Local {
+		case "element":
+			var e *element
+			if e, err = sd.element(c, true); err == nil {
+				sd.s.elements[name] = e
+			}
+		case "complexType", "simpleType":
+			var t *typeDef
+			if t, err = sd.typeDef(c); err == nil {
+				t.name = name
+				if !t.complex {
+					t.simple.name = name
+				}
+				sd.s.types[name] = t
+			}
+		case "attribute":
+			var a *attribute
+			if a, err = sd.attribute(c, true); err == nil {
+				sd.s.attributes[name] = a
+			}
+		case "group":
+			var p *particle
+			if p, err = sd.group(c); err == nil {
+				sd.s.groups[name] = p
+			}
+		case "attributeGroup":
+			g := &attrGroup{}
+			if g.attrs, g.groupRefs, g.anyAttr, err = sd.attrUses(children(c)); err == nil {
+				sd.s.attrGroups[name] = g
+			}
+		case "include", "import", "notation":
+		default:
+			err = errorf(c, "%s isn't supported", c.Name.Local)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sd *schemaDoc) element(e *dom.Element, global bool) (*element, error) {
+	el := &element{src: e}
+	el.nillable = e.Attr("nillable") == "true"
+	el.abstract = e.Attr("abstract") == "true"
+	if v, ok := e.LookupAttr("default"); ok {
+		el.def = &v
+	}
+	if v, ok := e.LookupAttr("fixed"); ok {
+		el.fixed = &v
+	}
+	el.name.Local = e.Attr("name")
+	if global || e.Attr("form") == "qualified" || (sd.qualElements && e.Attr("form") != "unqualified") {
+		el.name.Space = sd.tns
+	}
+	var err error
+	if _, ok := e.LookupAttr("type"); ok {
+		if el.typeRef, err = qname(e, "type"); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := e.LookupAttr("substitutionGroup"); ok && global {
+		if el.substRef, err = qname(e, "substitutionGroup"); err != nil {
+			return nil, err
+		}
+	}
+	for _, c := range children(e) {
+		switch c.Name.Local {
+		case "complexType", "simpleType":
+			if el.anonymous, err = sd.typeDef(c); err != nil {
+				return nil, err
+			}
+		case "unique", "key", "keyref":
+			idc, err := sd.identity(c)
+			if err != nil {
+				return nil, err
+			}
+			el.idcs = append(el.idcs, idc)
+			sd.s.idcs[idc.name] = idc
+		default:
+			return nil, errorf(c, "unexpected %s in element", c.Name.Local)
+		}
+	}
+	return el, nil
+}
+
+func (sd *schemaDoc) identity(e *dom.Element) (*identity, error) {
+	idc := &identity{name: xml.Name{Space: sd.tns, Local: e.Attr("name")}}
+	switch e.Name.Local {
+	case "key":
+		idc.kind = idcKey
+	case "keyref":
+		idc.kind = idcKeyRef
+		var err error
+		if idc.referRef, err = qname(e, "refer"); err != nil {
+			return nil, err
+		}
+	}
+	for _, c := range children(e) {
+		x, err := xpath.CompileNS(c.Attr("xpath"), c.InScopeNamespaces())
+		if err != nil {
+			return nil, errorf(c, "%v", err)
+		}
+		switch c.Name.Local {
+		case "selector":
+			idc.selector = x
+		case "field":
+			idc.fields = append(idc.fields, x)
+		}
+	}
+	if idc.selector == nil || len(idc.fields) == 0 {
+		return nil, errorf(e, "%s needs a selector and fields", e.Name.Local)
+	}
+	return idc, nil
+}
+
+func (sd *schemaDoc) attribute(e *dom.Element, global bool) (*attribute, error) {
+	a := &attribute{use: e.Attr("use"), src: e}
+	if v, ok := e.LookupAttr("default"); ok {
+		a.def = &v
+	}
+	if v, ok := e.LookupAttr("fixed"); ok {
+		a.fixed = &v
+	}
+	var err error
+	if _, ok := e.LookupAttr("ref"); ok {
+		a.ref, err = qname(e, "ref")
+		return a, err
+	}
+	a.name.Local = e.Attr("name")
+	if global || e.Attr("form") == "qualified" || (sd.qualAttrs && e.Attr("form") != "unqualified") {
+		a.name.Space = sd.tns
+	}
+	if _, ok := e.LookupAttr("type"); ok {
+		if a.typeRef, err = qname(e, "type"); err != nil {
+			return nil, err
+		}
+	}
+	for _, c := range children(e) {
+		if c.Name.Local != "simpleType" {
+			return nil, errorf(c, "unexpected %s in attribute", c.Name.Local)
+		}
+		if a.typ, err = sd.simpleType(c); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// attrUses parses the attribute declarations, attribute group references and attribute wildcard
+// among elts.
+func (sd *schemaDoc) attrUses(elts []*dom.Element) ([]*attribute, []xml.Name, *wildcard, error) {
+	var attrs []*attribute
+	var refs []xml.Name
+	var any *wildcard
+	for _, c := range elts {
+		switch c.Name.Local {
+		case "attribute":
+			a, err := sd.attribute(c, false)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			attrs = append(attrs, a)
+		case "attributeGroup":
+			ref, err := qname(c, "ref")
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			refs = append(refs, ref)
+		case "anyAttribute":
+			any = sd.wildcard(c)
+		}
+	}
+	return attrs, refs, any, nil
+}
+
+func (sd *schemaDoc) wildcard(e *dom.Element) *wildcard {
+	w := &wildcard{ns: strings.Fields(e.Attr("namespace")), tns: sd.tns, process: e.Attr("processContents")}
+	if len(w.ns) == 0 {
+		w.ns = []string{"##any"}
+	}
+	if w.process == "" {
+		w.process = "strict"
+	}
+	return w
+}
+
+// occurs sets the occurrence constraints of p from e.
+func occurs(p *particle, e *dom.Element) error {
+	p.min, p.max = 1, 1
+	if v, ok := e.LookupAttr("minOccurs"); ok {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || n < 0 {
+			return errorf(e, "invalid minOccurs %q", v)
+		}
+		p.min = n
+	}
+	if v, ok := e.LookupAttr("maxOccurs"); ok {
+		v = strings.TrimSpace(v)
+		if v == "unbounded" {
+			p.max = -1
+			return nil
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n < p.min {
+			return errorf(e, "invalid maxOccurs %q", v)
+		}
+		p.max = n
+	}
+	return nil
+}
+
+// particle parses an element, group reference, model group or wildcard in a content model.
+func (sd *schemaDoc) particle(e *dom.Element) (*particle, error) {
+	p := &particle{src: e}
+	if err := occurs(p, e); err != nil {
+		return nil, err
+	}
+	var err error
+	switch e.Name.Local {
+	case "element":
+		p.kind = pElement
+		if _, ok := e.LookupAttr("ref"); ok {
+			p.ref, err = qname(e, "ref")
+			return p, err
+		}
+		p.elem, err = sd.element(e, false)
+		return p, err
+	case "group":
+		p.kind = pGroup
+		p.ref, err = qname(e, "ref")
+		return p, err
+	case "any":
+		p.kind = pAny
+		p.wild = sd.wildcard(e)
+		return p, nil
+	case "sequence":
+		p.kind = pSequence
+	case "choice":
+		p.kind = pChoice
+	case "all":
+		p.kind = pAll
+	default:
+		return nil, errorf(e, "unexpected %s in content model", e.Name.Local)
+	}
+	for _, c := range children(e) {
+		cp, err := sd.particle(c)
+		if err != nil {
+			return nil, err
+		}
+		if p.kind == pAll && (cp.kind != pElement || cp.max > 1) {
+			return nil, errorf(c, "all may only hold elements that occur at most once")
+		}
+		p.children = append(p.children, cp)
+	}
+	return p, nil
+}
+
+// group parses a global model group definition.
+func (sd *schemaDoc) group(e *dom.Element) (*particle, error) {
+	for _, c := range children(e) {
+		p, err := sd.particle(c)
+		if err != nil {
+			return nil, err
+		}
+		p.min, p.max = 1, 1
+		return p, nil
+	}
+	return nil, errorf(e, "empty group")
+}
+
+// typeDef parses a simpleType or complexType.
+func (sd *schemaDoc) typeDef(e *dom.Element) (*typeDef, error) {
+	if e.Name.Local == "simpleType" {
+		st, err := sd.simpleType(e)
+		if err != nil {
+			return nil, err
+		}
+		return &typeDef{simple: st, src: e}, nil
+	}
+
+	t := &typeDef{complex: true, mixed: e.Attr("mixed") == "true", abstract: e.Attr("abstract") == "true", src: e}
+	var err error
+	elts := children(e)
+	if len(elts) > 0 && (elts[0].Name.Local == "simpleContent" || elts[0].Name.Local == "complexContent") {
+		cc := elts[0]
+		if cc.Attr("mixed") == "true" {
+			t.mixed = true
+		}
+		der := children(cc)
+		if len(der) != 1 || (der[0].Name.Local != "extension" && der[0].Name.Local != "restriction") {
+			return nil, errorf(cc, "expected extension or restriction")
+		}
+		d := der[0]
+		t.extension = d.Name.Local == "extension"
+		if t.baseRef, err = qname(d, "base"); err != nil {
+			return nil, err
+		}
+		elts = children(d)
+		if cc.Name.Local == "simpleContent" {
+			// Mark as simple content, the effective type is found during resolution
+			t.simple = &simpleType{}
+			if !t.extension {
+				st, err := sd.restriction(d)
+				if err != nil {
+					return nil, err
+				}
+				t.simpleBase = st
+			}
+		}
+	} else {
+		t.baseRef = xml.Name{Space: XSDURL, Local: "anyType"}
+	}
+	var attrs []*dom.Element
+	for _, c := range elts {
+		switch c.Name.Local {
+		case "sequence", "choice", "all", "group":
+			if t.own, err = sd.particle(c); err != nil {
+				return nil, err
+			}
+		case "attribute", "attributeGroup", "anyAttribute":
+			attrs = append(attrs, c)
+		}
+	}
+	if t.ownAttrs, t.groupRefs, t.anyAttr, err = sd.attrUses(attrs); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// simpleType parses a simpleType definition.
+func (sd *schemaDoc) simpleType(e *dom.Element) (*simpleType, error) {
+	elts := children(e)
+	if len(elts) != 1 {
+		return nil, errorf(e, "expected restriction, list or union")
+	}
+	d := elts[0]
+	var err error
+	switch d.Name.Local {
+	case "restriction":
+		return sd.restriction(d)
+	case "list":
+		st := &simpleType{variety: varList, src: d}
+		if _, ok := d.LookupAttr("itemType"); ok {
+			st.itemRef, err = qname(d, "itemType")
+		} else if c := children(d); len(c) == 1 {
+			st.item, err = sd.simpleType(c[0])
+		} else {
+			err = errorf(d, "list needs an item type")
+		}
+		return st, err
+	case "union":
+		st := &simpleType{variety: varUnion, src: d}
+		for _, m := range strings.Fields(d.Attr("memberTypes")) {
+			prefix, local, ok := strings.Cut(m, ":")
+			if !ok {
+				prefix, local = "", m
+			}
+			uri, _ := d.LookupNamespaceURI(prefix)
+			st.memberRefs = append(st.memberRefs, xml.Name{Space: uri, Local: local})
+		}
+		for _, c := range children(d) {
+			m, err := sd.simpleType(c)
+			if err != nil {
+				return nil, err
+			}
+			st.members = append(st.members, m)
+		}
+		return st, nil
+	}
+	return nil, errorf(d, "unexpected %s in simpleType", d.Name.Local)
+}
+
+// restriction parses the restriction of a simple type, or of the simple content of a complex type.
+func (sd *schemaDoc) restriction(d *dom.Element) (*simpleType, error) {
+	st := &simpleType{src: d}
+	var err error
+	if _, ok := d.LookupAttr("base"); ok {
+		if st.baseRef, err = qname(d, "base"); err != nil {
+			return nil, err
+		}
+	}
+	for _, c := range children(d) {
+		switch c.Name.Local {
+		case "simpleType":
+			if st.base, err = sd.simpleType(c); err != nil {
+				return nil, err
+			}
+		case "attribute", "attributeGroup", "anyAttribute", "sequence", "choice", "all", "group":
+		default:
+			if err := st.facets.add(c.Name.Local, c.Attr("value")); err != nil {
+				return nil, errorf(c, "%v", err)
+			}
+		}
+	}
+	if st.base == nil && st.baseRef == (xml.Name{}) {
+		return nil, errorf(d, "restriction needs a base type")
+	}
+	return st, nil
+}
+
+// resolve links the references between components and computes the effective content models and
+// attributes of the complex types. Derivations are resolved before content models, which may refer
+// to the type being defined.
+func (s *Schema) resolve() error {
+	for _, e := range s.elements {
+		if err := s.resolveElement(e); err != nil {
+			return err
+		}
+		if e.substRef != (xml.Name{}) {
+			head, ok := s.elements[e.substRef]
+			if !ok {
+				return errorf(e.src, "substitution group %s isn't declared", e.substRef.Local)
+			}
+			s.substs[head] = append(s.substs[head], e)
+		}
+	}
+	for _, t := range s.types {
+		if err := s.resolveType(t); err != nil {
+			return err
+		}
+		if t.own != nil {
+			if err := s.resolveParticle(t.own, 0); err != nil {
+				return err
+			}
+		}
+	}
+	for _, a := range s.attributes {
+		if err := s.resolveAttr(a); err != nil {
+			return err
+		}
+	}
+	for _, p := range s.groups {
+		if err := s.resolveParticle(p, 0); err != nil {
+			return err
+		}
+	}
+	for _, idc := range s.idcs {
+		if idc.kind == idcKeyRef {
+			idc.refer = s.idcs[idc.referRef]
+			if idc.refer == nil || idc.refer.kind == idcKeyRef {
+				return errorf(nil, "keyref %s refers to %s which isn't a key or unique", idc.name.Local, idc.referRef.Local)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Schema) resolveElement(e *element) error {
+	if e.typ != nil {
+		return nil
+	}
+	switch {
+	case e.anonymous != nil:
+		e.typ = e.anonymous
+	case e.typeRef != (xml.Name{}):
+		e.typ = s.types[e.typeRef]
+		if e.typ == nil {
+			return errorf(e.src, "type %s isn't defined", e.typeRef.Local)
+		}
+	case e.substRef != (xml.Name{}):
+		// The type of the head element
+		if head := s.elements[e.substRef]; head != nil && head != e {
+			if err := s.resolveElement(head); err != nil {
+				return err
+			}
+			e.typ = head.typ
+		}
+	}
+	if e.typ == nil {
+		e.typ = builtins["anyType"]
+	}
+	if err := s.resolveType(e.typ); err != nil {
+		return err
+	}
+	// Named types have their content models resolved by resolve
+	if e.anonymous != nil && e.anonymous.own != nil {
+		return s.resolveParticle(e.anonymous.own, 0)
+	}
+	return nil
+}
+
+func (s *Schema) resolveAttr(a *attribute) error {
+	if a.typ != nil {
+		return s.resolveSimple(a.typ, 0)
+	}
+	if a.typeRef == (xml.Name{}) {
+		a.typ = builtins["anySimpleType"].simple
+		return nil
+	}
+	t := s.types[a.typeRef]
+	if t == nil || t.complex {
+		return errorf(a.src, "simple type %s isn't defined", a.typeRef.Local)
+	}
+	a.typ = t.simple
+	return s.resolveSimple(a.typ, 0)
+}
+
+// attrList resolves the attributes, referenced attribute groups and wildcard into a single list,
+// with references replaced by the global declarations.
+func (s *Schema) attrList(attrs []*attribute, refs []xml.Name, any *wildcard, src *dom.Element) ([]*attribute, *wildcard, error) {
+	var res []*attribute
+	for _, a := range attrs {
+		if a.ref != (xml.Name{}) {
+			g, ok := s.attributes[a.ref]
+			if !ok {
+				return nil, nil, errorf(a.src, "attribute %s isn't declared", a.ref.Local)
+			}
+			if err := s.resolveAttr(g); err != nil {
+				return nil, nil, err
+			}
+			ref := *g
+			ref.use = a.use
+			if a.def != nil {
+				ref.def = a.def
+			}
+			if a.fixed != nil {
+				ref.fixed = a.fixed
+			}
+			a = &ref
+		} else if err := s.resolveAttr(a); err != nil {
+			return nil, nil, err
+		}
+		res = append(res, a)
+	}
+	for _, ref := range refs {
+		g, ok := s.attrGroups[ref]
+		if !ok {
+			return nil, nil, errorf(src, "attribute group %s isn't defined", ref.Local)
+		}
+		if g.state == resolving {
+			return nil, nil, errorf(src, "attribute group %s refers to itself", ref.Local)
+		}
+		if g.state == unresolved {
+			g.state = resolving
+			var err error
+			if g.attrs, g.anyAttr, err = s.attrList(g.attrs, g.groupRefs, g.anyAttr, src); err != nil {
+				return nil, nil, err
+			}
+			g.groupRefs = nil
+			g.state = resolved
+		}
+		res = append(res, g.attrs...)
+		if any == nil {
+			any = g.anyAttr
+		}
+	}
+	return res, any, nil
+}
+
+func (s *Schema) resolveType(t *typeDef) error {
+	switch t.state {
+	case resolved:
+		return nil
+	case resolving:
+		return errorf(t.src, "type %s is derived from itself", t.name.Local)
+	}
+	t.state = resolving
+	if !t.complex {
+		t.state = resolved
+		return s.resolveSimple(t.simple, 0)
+	}
+
+	t.base = s.types[t.baseRef]
+	if t.base == nil {
+		return errorf(t.src, "type %s isn't defined", t.baseRef.Local)
+	}
+	if err := s.resolveType(t.base); err != nil {
+		return err
+	}
+	attrs, any, err := s.attrList(t.ownAttrs, t.groupRefs, t.anyAttr, t.src)
+	if err != nil {
+		return err
+	}
+
+	// Simple content
+	if t.simple != nil {
+		switch {
+		case t.extension && t.base.simple != nil:
+			t.simple = t.base.simple
+		case t.simpleBase != nil && t.base.simple != nil:
+			if t.simpleBase.base == nil {
+				t.simpleBase.base = t.base.simple
+			}
+			t.simple = t.simpleBase
+			if err := s.resolveSimple(t.simple, 0); err != nil {
+				return err
+			}
+		default:
+			return errorf(t.src, "simple content base %s doesn't have simple content", t.baseRef.Local)
+		}
+	}
+
+	// Effective content and attributes
+	t.content = t.own
+	if t.extension {
+		if t.base.complex && t.base.content != nil && t.base != builtins["anyType"] {
+			if t.own == nil {
+				t.content = t.base.content
+			} else {
+				t.content = &particle{kind: pSequence, min: 1, max: 1, children: []*particle{t.base.content, t.own}}
+			}
+		}
+		t.mixed = t.mixed || t.base.mixed
+	}
+	t.attrs = attrs
+	if t.base.complex {
+		// Base attributes not redeclared are inherited, those restricted to prohibited are removed
+		for _, ba := range t.base.attrs {
+			redeclared := false
+			for _, a := range attrs {
+				redeclared = redeclared || a.name == ba.name
+			}
+			if !redeclared {
+				t.attrs = append(t.attrs, ba)
+			}
+		}
+		if any == nil && t.extension && t.base != builtins["anyType"] {
+			any = t.base.anyAttr
+		}
+	}
+	t.anyAttr = any
+	t.state = resolved
+	return nil
+}
+
+// resolveParticle replaces element and group references in a content model.
+func (s *Schema) resolveParticle(p *particle, depth int) error {
+	if depth > 64 {
+		return errorf(p.src, "model groups nested too deeply")
+	}
+	switch p.kind {
+	case pElement:
+		if p.elem == nil {
+			p.elem = s.elements[p.ref]
+			if p.elem == nil {
+				return errorf(p.src, "element %s isn't declared", p.ref.Local)
+			}
+		}
+		return s.resolveElement(p.elem)
+	case pGroup:
+		g := s.groups[p.ref]
+		if g == nil {
+			return errorf(p.src, "group %s isn't defined", p.ref.Local)
+		}
+		if err := s.resolveParticle(g, depth+1); err != nil {
+			return err
+		}
+		p.kind, p.children = g.kind, g.children
+	}
+	for _, c := range p.children {
+		if err := s.resolveParticle(c, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
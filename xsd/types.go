@@ -0,0 +1,688 @@
+package xsd
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"math/big"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	dom "github.com/jphsd/xml"
+)
+
+// Simple type varieties.
+const (
+	varAtomic = iota
+	varList
+	varUnion
+)
+
+// White space handling.
+const (
+	wsUnset = iota
+	wsPreserve
+	wsReplace
+	wsCollapse
+)
+
+// simpleType is a simple type definition. Each restriction step is a separate simpleType whose base
+// is the type it restricts, values are checked against the facets of every step.
+type simpleType struct {
+	name       xml.Name
+	variety    int
+	base       *simpleType
+	baseRef    xml.Name
+	item       *simpleType
+	itemRef    xml.Name
+	members    []*simpleType
+	memberRefs []xml.Name
+	facets     facets
+	prim       *primitive        // Primitive type of an atomic type
+	lex        func(string) bool // Additional lexical check of a built-in type
+	ws         int
+	state      int
+	src        *dom.Element
+}
+
+// primitive is a primitive built-in datatype.
+type primitive struct {
+	name  string
+	check func(v string, ctx *dom.Element) error
+	order int
+}
+
+// Value space orders used by the range facets.
+const (
+	orderNone = iota
+	orderDecimal
+	orderFloat
+	orderTime
+)
+
+type facets struct {
+	length, minLength, maxLength   *int
+	totalDigits, fractionDigits    *int
+	minInc, maxInc, minExc, maxExc *string
+	patterns                       []*regexp.Regexp // Any may match
+	enum                           []string
+	ws                             int
+}
+
+// add sets the facet with the name to the value.
+func (f *facets) add(name, v string) error {
+	num := func() (*int, error) {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid %s %q", name, v)
+		}
+		return &n, nil
+	}
+	var err error
+	switch name {
+	case "length":
+		f.length, err = num()
+	case "minLength":
+		f.minLength, err = num()
+	case "maxLength":
+		f.maxLength, err = num()
+	case "totalDigits":
+		f.totalDigits, err = num()
+	case "fractionDigits":
+		f.fractionDigits, err = num()
+	case "minInclusive":
+		f.minInc = &v
+	case "maxInclusive":
+		f.maxInc = &v
+	case "minExclusive":
+		f.minExc = &v
+	case "maxExclusive":
+		f.maxExc = &v
+	case "enumeration":
+		f.enum = append(f.enum, v)
+	case "pattern":
+		re, rerr := compilePattern(v)
+		if rerr != nil {
+			return rerr
+		}
+		f.patterns = append(f.patterns, re)
+	case "whiteSpace":
+		switch v {
+		case "preserve":
+			f.ws = wsPreserve
+		case "replace":
+			f.ws = wsReplace
+		case "collapse":
+			f.ws = wsCollapse
+		default:
+			err = fmt.Errorf("invalid whiteSpace %q", v)
+		}
+	default:
+		err = fmt.Errorf("unknown facet %s", name)
+	}
+	return err
+}
+
+// resolveSimple links a simple type to its base, item and member types.
+func (s *Schema) resolveSimple(st *simpleType, depth int) error {
+	switch st.state {
+	case resolved:
+		return nil
+	case resolving:
+		return errorf(st.src, "simple type %s is derived from itself", st.name.Local)
+	}
+	if depth > 64 {
+		return errorf(st.src, "simple types nested too deeply")
+	}
+	st.state = resolving
+	lookup := func(name xml.Name) (*simpleType, error) {
+		t := s.types[name]
+		if t == nil || t.complex {
+			return nil, errorf(st.src, "simple type %s isn't defined", name.Local)
+		}
+		return t.simple, s.resolveSimple(t.simple, depth+1)
+	}
+	var err error
+	if st.baseRef != (xml.Name{}) && st.base == nil {
+		if st.base, err = lookup(st.baseRef); err != nil {
+			return err
+		}
+	}
+	if st.itemRef != (xml.Name{}) {
+		if st.item, err = lookup(st.itemRef); err != nil {
+			return err
+		}
+	}
+	for _, ref := range st.memberRefs {
+		m, err := lookup(ref)
+		if err != nil {
+			return err
+		}
+		st.members = append(st.members, m)
+	}
+	st.memberRefs = nil
+	if st.item != nil {
+		if err := s.resolveSimple(st.item, depth+1); err != nil {
+			return err
+		}
+	}
+	for _, m := range st.members {
+		if err := s.resolveSimple(m, depth+1); err != nil {
+			return err
+		}
+	}
+	if b := st.base; b != nil {
+		if err := s.resolveSimple(b, depth+1); err != nil {
+			return err
+		}
+		st.variety = b.variety
+		st.prim = b.prim
+		if st.item == nil {
+			st.item = b.item
+		}
+		if st.members == nil {
+			st.members = b.members
+		}
+		st.ws = b.ws
+	}
+	if st.variety == varList {
+		st.ws = wsCollapse
+	}
+	if st.facets.ws != wsUnset {
+		st.ws = st.facets.ws
+	}
+	st.state = resolved
+	return nil
+}
+
+// normalize applies the type's white space handling to v.
+func (st *simpleType) normalize(v string) string {
+	switch st.ws {
+	case wsReplace:
+		return strings.Map(func(r rune) rune {
+			if r == '\t' || r == '\n' || r == '\r' {
+				return ' '
+			}
+			return r
+		}, v)
+	case wsCollapse:
+		return strings.Join(strings.Fields(v), " ")
+	}
+	return v
+}
+
+// validate checks the value v, resolving any QName against the scope of ctx.
+func (st *simpleType) validate(v string, ctx *dom.Element) error {
+	v = st.normalize(v)
+	length := 0
+	switch st.variety {
+	case varList:
+		items := strings.Fields(v)
+		for _, item := range items {
+			if err := st.item.validate(item, ctx); err != nil {
+				return err
+			}
+		}
+		length = len(items)
+	case varUnion:
+		var err error
+		for _, m := range st.members {
+			if err = m.validate(v, ctx); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%q isn't valid for any member type of %s", v, st)
+		}
+	default:
+		if st.prim != nil {
+			if err := st.prim.check(v, ctx); err != nil {
+				return err
+			}
+		}
+		length = st.length(v)
+	}
+	for t := st; t != nil; t = t.base {
+		if t.lex != nil && !t.lex(v) {
+			return fmt.Errorf("%q isn't a valid %s", v, t)
+		}
+		if err := t.facets.check(v, st, length); err != nil {
+			return fmt.Errorf("%q isn't valid for %s: %v", v, st, err)
+		}
+	}
+	return nil
+}
+
+// String returns the type name for use in messages.
+func (st *simpleType) String() string {
+	if st.name.Local != "" {
+		return st.name.Local
+	}
+	return "anonymous type"
+}
+
+// derives reports whether st is, or is derived from, the named built-in type.
+func (st *simpleType) derives(name string) bool {
+	for t := st; t != nil; t = t.base {
+		if t.name == (xml.Name{Space: XSDURL, Local: name}) {
+			return true
+		}
+	}
+	return false
+}
+
+// length returns the length of an atomic value as measured by the length facets.
+func (st *simpleType) length(v string) int {
+	if st.prim != nil {
+		switch st.prim.name {
+		case "hexBinary":
+			return len(v) / 2
+		case "base64Binary":
+			b, _ := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(v), ""))
+			return len(b)
+		}
+	}
+	return utf8.RuneCountInString(v)
+}
+
+// check tests a value against one step's facets. Length is the value's length for the length facets.
+func (f *facets) check(v string, st *simpleType, length int) error {
+	switch {
+	case f.length != nil && length != *f.length:
+		return fmt.Errorf("length must be %d", *f.length)
+	case f.minLength != nil && length < *f.minLength:
+		return fmt.Errorf("length must be at least %d", *f.minLength)
+	case f.maxLength != nil && length > *f.maxLength:
+		return fmt.Errorf("length must be at most %d", *f.maxLength)
+	}
+	if len(f.patterns) > 0 {
+		ok := false
+		for _, re := range f.patterns {
+			ok = ok || re.MatchString(v)
+		}
+		if !ok {
+			return fmt.Errorf("doesn't match pattern %s", f.patterns[0])
+		}
+	}
+	if len(f.enum) > 0 {
+		ok := false
+		for _, e := range f.enum {
+			ok = ok || st.equal(v, st.normalize(e))
+		}
+		if !ok {
+			return fmt.Errorf("isn't one of %s", strings.Join(f.enum, ", "))
+		}
+	}
+	bounds := []struct {
+		lim  *string
+		name string
+		ok   func(int) bool
+	}{
+		{f.minInc, "minInclusive", func(c int) bool { return c >= 0 }},
+		{f.maxInc, "maxInclusive", func(c int) bool { return c <= 0 }},
+		{f.minExc, "minExclusive", func(c int) bool { return c > 0 }},
+		{f.maxExc, "maxExclusive", func(c int) bool { return c < 0 }},
+	}
+	for _, b := range bounds {
+		if b.lim == nil {
+			continue
+		}
+		c, ok := st.compare(v, *b.lim)
+		if ok && !b.ok(c) {
+			return fmt.Errorf("%s is %s", b.name, *b.lim)
+		}
+	}
+	if f.totalDigits != nil || f.fractionDigits != nil {
+		total, frac := digits(v)
+		if f.totalDigits != nil && total > *f.totalDigits {
+			return fmt.Errorf("more than %d digits", *f.totalDigits)
+		}
+		if f.fractionDigits != nil && frac > *f.fractionDigits {
+			return fmt.Errorf("more than %d fraction digits", *f.fractionDigits)
+		}
+	}
+	return nil
+}
+
+// equal compares two values in the value space of the type, or lexically if it isn't ordered.
+func (st *simpleType) equal(a, b string) bool {
+	if c, ok := st.compare(a, b); ok {
+		return c == 0
+	}
+	return a == b
+}
+
+// compare orders two values of an atomic type. It returns false if the type isn't ordered or either
+// value can't be parsed.
+func (st *simpleType) compare(a, b string) (int, bool) {
+	if st.prim == nil || st.variety != varAtomic {
+		return 0, false
+	}
+	switch st.prim.order {
+	case orderDecimal:
+		x, ok1 := new(big.Rat).SetString(strings.TrimPrefix(a, "+"))
+		y, ok2 := new(big.Rat).SetString(strings.TrimPrefix(b, "+"))
+		if !ok1 || !ok2 {
+			return 0, false
+		}
+		return x.Cmp(y), true
+	case orderFloat:
+		x, err1 := strconv.ParseFloat(a, 64)
+		y, err2 := strconv.ParseFloat(b, 64)
+		if err1 != nil || err2 != nil || x != x || y != y {
+			return 0, false
+		}
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	case orderTime:
+		x, err1 := parseTime(st.prim.name, a)
+		y, err2 := parseTime(st.prim.name, b)
+		if err1 != nil || err2 != nil {
+			return 0, false
+		}
+		return x.Compare(y), true
+	}
+	return 0, false
+}
+
+// digits returns the number of significant digits and fraction digits of a decimal.
+func digits(v string) (int, int) {
+	v = strings.TrimLeft(v, "+-")
+	ip, fp, _ := strings.Cut(v, ".")
+	ip = strings.TrimLeft(ip, "0")
+	fp = strings.TrimRight(fp, "0")
+	return len(ip) + len(fp), len(fp)
+}
+
+var timeLayouts = map[string]string{
+	"dateTime":   "2006-01-02T15:04:05",
+	"date":       "2006-01-02",
+	"time":       "15:04:05",
+	"gYearMonth": "2006-01",
+	"gYear":      "2006",
+	"gMonthDay":  "--01-02",
+	"gDay":       "---02",
+	"gMonth":     "--01",
+}
+
+// parseTime parses a date or time value with an optional time zone.
+func parseTime(name, v string) (time.Time, error) {
+	layout := timeLayouts[name]
+	t, err := time.Parse(layout+"Z07:00", v)
+	if err != nil {
+		t, err = time.Parse(layout, v)
+	}
+	return t, err
+}
+
+var (
+	decimalRE  = regexp.MustCompile(`^[+-]?(\d+(\.\d*)?|\.\d+)$`)
+	floatRE    = regexp.MustCompile(`^([+-]?(\d+(\.\d*)?|\.\d+)([eE][+-]?\d+)?|-?INF|NaN)$`)
+	integerRE  = regexp.MustCompile(`^[+-]?\d+$`)
+	durationRE = regexp.MustCompile(`^-?P(\d+Y)?(\d+M)?(\d+D)?(T(\d+H)?(\d+M)?(\d+(\.\d+)?S)?)?$`)
+	languageRE = regexp.MustCompile(`^[a-zA-Z]{1,8}(-[a-zA-Z0-9]{1,8})*$`)
+)
+
+func lexical(name string, re *regexp.Regexp) func(string, *dom.Element) error {
+	return func(v string, _ *dom.Element) error {
+		if !re.MatchString(v) {
+			return fmt.Errorf("%q isn't a valid %s", v, name)
+		}
+		return nil
+	}
+}
+
+var primitives = []*primitive{
+	{"string", func(string, *dom.Element) error { return nil }, orderNone},
+	{"boolean", func(v string, _ *dom.Element) error {
+		switch v {
+		case "true", "false", "1", "0":
+			return nil
+		}
+		return fmt.Errorf("%q isn't a valid boolean", v)
+	}, orderNone},
+	{"decimal", lexical("decimal", decimalRE), orderDecimal},
+	{"float", lexical("float", floatRE), orderFloat},
+	{"double", lexical("double", floatRE), orderFloat},
+	{"duration", func(v string, _ *dom.Element) error {
+		if !durationRE.MatchString(v) || strings.HasSuffix(v, "P") || strings.HasSuffix(v, "T") {
+			return fmt.Errorf("%q isn't a valid duration", v)
+		}
+		return nil
+	}, orderNone},
+	{"hexBinary", func(v string, _ *dom.Element) error {
+		if _, err := hex.DecodeString(v); err != nil {
+			return fmt.Errorf("%q isn't a valid hexBinary", v)
+		}
+		return nil
+	}, orderNone},
+	{"base64Binary", func(v string, _ *dom.Element) error {
+		if _, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(v), "")); err != nil {
+			return fmt.Errorf("%q isn't a valid base64Binary", v)
+		}
+		return nil
+	}, orderNone},
+	{"anyURI", func(v string, _ *dom.Element) error {
+		if _, err := url.Parse(v); err != nil {
+			return fmt.Errorf("%q isn't a valid anyURI", v)
+		}
+		return nil
+	}, orderNone},
+	{"QName", checkQName, orderNone},
+	{"NOTATION", checkQName, orderNone},
+}
+
+func init() {
+	for name := range timeLayouts {
+		primitives = append(primitives, &primitive{name, func(v string, _ *dom.Element) error {
+			if _, err := parseTime(name, v); err != nil {
+				return fmt.Errorf("%q isn't a valid %s", v, name)
+			}
+			return nil
+		}, orderTime})
+	}
+}
+
+// checkQName checks that a QName's prefix is bound in the scope of ctx.
+func checkQName(v string, ctx *dom.Element) error {
+	prefix, local, ok := strings.Cut(v, ":")
+	if !ok {
+		prefix, local = "", v
+	}
+	if !isNCName(local) || (ok && !isNCName(prefix)) {
+		return fmt.Errorf("%q isn't a valid QName", v)
+	}
+	if prefix != "" {
+		if _, bound := ctx.LookupNamespaceURI(prefix); !bound {
+			return fmt.Errorf("prefix %s of %q isn't bound", prefix, v)
+		}
+	}
+	return nil
+}
+
+func isNameStart(r rune) bool {
+	return unicode.IsLetter(r) || r == '_' || r == ':'
+}
+
+func isNameChar(r rune) bool {
+	return isNameStart(r) || unicode.IsDigit(r) || r == '-' || r == '.' || r == 0xB7 ||
+		unicode.Is(unicode.Mn, r) || unicode.Is(unicode.Mc, r)
+}
+
+func isName(s string) bool {
+	for i, r := range s {
+		if !isNameChar(r) || (i == 0 && !isNameStart(r)) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func isNCName(s string) bool {
+	return isName(s) && !strings.Contains(s, ":")
+}
+
+func isNmtoken(s string) bool {
+	for _, r := range s {
+		if !isNameChar(r) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// builtins holds the built-in types by local name.
+var builtins = make(map[string]*typeDef)
+
+func init() {
+	name := func(local string) xml.Name { return xml.Name{Space: XSDURL, Local: local} }
+	add := func(st *simpleType) *simpleType {
+		st.state = resolved
+		builtins[st.name.Local] = &typeDef{name: st.name, simple: st, state: resolved}
+		return st
+	}
+	// derive adds a built-in type restricting base.
+	derive := func(local, base string, ws int, lex func(string) bool, f facets) *simpleType {
+		b := builtins[base].simple
+		if ws == wsUnset {
+			ws = b.ws
+		}
+		f.ws = ws
+		return add(&simpleType{name: name(local), base: b, prim: b.prim, ws: ws, lex: lex, facets: f})
+	}
+	one := 1
+	listOf := func(local, item string) {
+		add(&simpleType{name: name(local), variety: varList, item: builtins[item].simple, ws: wsCollapse,
+			facets: facets{minLength: &one}})
+	}
+	bounded := func(local, base, min, max string) {
+		f := facets{}
+		if min != "" {
+			f.minInc = &min
+		}
+		if max != "" {
+			f.maxInc = &max
+		}
+		derive(local, base, wsUnset, nil, f)
+	}
+
+	anySimple := add(&simpleType{name: name("anySimpleType")})
+	for _, p := range primitives {
+		ws := wsCollapse
+		if p.name == "string" {
+			ws = wsPreserve
+		}
+		add(&simpleType{name: name(p.name), base: anySimple, prim: p, ws: ws})
+	}
+
+	derive("normalizedString", "string", wsReplace, nil, facets{})
+	derive("token", "normalizedString", wsCollapse, nil, facets{})
+	derive("language", "token", wsUnset, languageRE.MatchString, facets{})
+	derive("NMTOKEN", "token", wsUnset, isNmtoken, facets{})
+	derive("Name", "token", wsUnset, isName, facets{})
+	derive("NCName", "Name", wsUnset, isNCName, facets{})
+	derive("ID", "NCName", wsUnset, nil, facets{})
+	derive("IDREF", "NCName", wsUnset, nil, facets{})
+	derive("ENTITY", "NCName", wsUnset, nil, facets{})
+	listOf("NMTOKENS", "NMTOKEN")
+	listOf("IDREFS", "IDREF")
+	listOf("ENTITIES", "ENTITY")
+
+	zero := 0
+	derive("integer", "decimal", wsUnset, integerRE.MatchString, facets{fractionDigits: &zero})
+	bounded("nonPositiveInteger", "integer", "", "0")
+	bounded("negativeInteger", "nonPositiveInteger", "", "-1")
+	bounded("nonNegativeInteger", "integer", "0", "")
+	bounded("positiveInteger", "nonNegativeInteger", "1", "")
+	bounded("long", "integer", "-9223372036854775808", "9223372036854775807")
+	bounded("int", "long", "-2147483648", "2147483647")
+	bounded("short", "int", "-32768", "32767")
+	bounded("byte", "short", "-128", "127")
+	bounded("unsignedLong", "nonNegativeInteger", "", "18446744073709551615")
+	bounded("unsignedInt", "unsignedLong", "", "4294967295")
+	bounded("unsignedShort", "unsignedInt", "", "65535")
+	bounded("unsignedByte", "unsignedShort", "", "255")
+
+	// anyType allows any attributes and content
+	wild := &wildcard{ns: []string{"##any"}, process: "lax"}
+	builtins["anyType"] = &typeDef{
+		name:    name("anyType"),
+		complex: true,
+		mixed:   true,
+		content: &particle{kind: pAny, min: 0, max: -1, wild: wild},
+		anyAttr: wild,
+		state:   resolved,
+	}
+}
+
+// compilePattern translates an XML Schema regular expression, which is implicitly anchored, into a Go
+// regular expression. The multiple character escapes \i and \c are approximated, and character class
+// subtraction isn't supported.
+func compilePattern(p string) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	inClass := false
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case c == '\\' && i+1 < len(p):
+			i++
+			switch e := p[i]; e {
+			case 'i', 'I', 'c', 'C':
+				cls := `\p{L}_:`
+				if e == 'c' || e == 'C' {
+					cls = `\p{L}\p{Nd}\p{Mn}\p{Mc}._:\-`
+				}
+				switch {
+				case inClass && (e == 'I' || e == 'C'):
+					return nil, fmt.Errorf("pattern %q: negated escape in a character class isn't supported", p)
+				case inClass:
+					sb.WriteString(cls)
+				case e == 'I' || e == 'C':
+					sb.WriteString("[^" + cls + "]")
+				default:
+					sb.WriteString("[" + cls + "]")
+				}
+			case 'd':
+				sb.WriteString(`\p{Nd}`)
+			case 'D':
+				if inClass {
+					return nil, fmt.Errorf("pattern %q: \\D in a character class isn't supported", p)
+				}
+				sb.WriteString(`\P{Nd}`)
+			default:
+				sb.WriteByte('\\')
+				sb.WriteByte(e)
+			}
+		case inClass && c == '-' && i+1 < len(p) && p[i+1] == '[':
+			return nil, fmt.Errorf("pattern %q: character class subtraction isn't supported", p)
+		case c == '[':
+			inClass = true
+			sb.WriteByte(c)
+		case c == ']':
+			inClass = false
+			sb.WriteByte(c)
+		case !inClass && (c == '^' || c == '$'):
+			// Not anchors in XML Schema
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	re, err := regexp.Compile(`^(?:` + sb.String() + `)$`)
+	if err != nil {
+		return nil, fmt.Errorf("pattern %q: %v", p, err)
+	}
+	return re, nil
+}
@@ -0,0 +1,550 @@
+package xsd
+
+import (
+	"encoding/xml"
+	"fmt"
+	"slices"
+	"strings"
+
+	dom "github.com/jphsd/xml"
+	"github.com/jphsd/xml/xpath"
+)
+
+// Error reports a violation of the schema by an element, or by one of its attributes if Attr is set.
+type Error struct {
+	Element *dom.Element
+	Attr    xml.Name
+	Msg     string
+}
+
+func (e *Error) Error() string {
+	path := e.Element.Path()
+	if e.Attr.Local != "" {
+		path += "/@" + e.Attr.Local
+	}
+	if e.Element.Pos.Line > 0 {
+		return fmt.Sprintf("xsd: %s %s: %s", e.Element.Pos, path, e.Msg)
+	}
+	return fmt.Sprintf("xsd: %s: %s", path, e.Msg)
+}
+
+// Validate checks elt, a Document or the element to be validated, against the schema and returns the
+// violations found as *Error values. The element must match a global element declaration.
+func (s *Schema) Validate(elt *dom.Element) []error {
+	if elt.Type == dom.Document {
+		elt = elt.DocumentElement()
+		if elt == nil {
+			return []error{fmt.Errorf("xsd: no document element")}
+		}
+	}
+	v := &validator{s: s, ids: make(map[string]bool)}
+	decl := s.elements[elt.Name]
+	if decl == nil {
+		v.errorf(elt, "no declaration for element %s", name(elt.Name))
+		return v.errs
+	}
+	v.element(elt, decl)
+	for _, ref := range v.refs {
+		if !v.ids[ref.id] {
+			v.errs = append(v.errs, &Error{ref.elt, ref.attr, fmt.Sprintf("IDREF %q has no matching ID", ref.id)})
+		}
+	}
+	return v.errs
+}
+
+type validator struct {
+	s    *Schema
+	ids  map[string]bool
+	refs []idref
+	errs []error
+
+	// Content model matching state
+	kids     []*dom.Element
+	assigned map[int]*particle // Element or wildcard particle matching each child
+	furthest int               // Furthest child reached
+}
+
+type idref struct {
+	elt  *dom.Element
+	attr xml.Name
+	id   string
+}
+
+func (v *validator) errorf(elt *dom.Element, format string, args ...any) {
+	v.errs = append(v.errs, &Error{elt, xml.Name{}, fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) attrErrorf(elt *dom.Element, attr xml.Name, format string, args ...any) {
+	v.errs = append(v.errs, &Error{elt, attr, fmt.Sprintf(format, args...)})
+}
+
+// name formats an expanded name for messages.
+func name(n xml.Name) string {
+	if n.Space == "" {
+		return n.Local
+	}
+	return "{" + n.Space + "}" + n.Local
+}
+
+func (v *validator) element(elt *dom.Element, decl *element) {
+	if decl.abstract {
+		v.errorf(elt, "element %s is abstract", name(elt.Name))
+	}
+	typ := decl.typ
+	if xt, ok := elt.LookupAttrNS(XSIURL, "type"); ok {
+		prefix, local, found := strings.Cut(strings.TrimSpace(xt), ":")
+		if !found {
+			prefix, local = "", prefix
+		}
+		uri, _ := elt.LookupNamespaceURI(prefix)
+		if typ = v.s.types[xml.Name{Space: uri, Local: local}]; typ == nil {
+			v.errorf(elt, "xsi:type %s isn't defined", xt)
+			return
+		}
+	}
+	if typ.abstract {
+		v.errorf(elt, "type %s is abstract", typ.name.Local)
+	}
+
+	if nv, ok := elt.LookupAttrNS(XSIURL, "nil"); ok && strings.TrimSpace(nv) == "true" {
+		if !decl.nillable {
+			v.errorf(elt, "element %s isn't nillable", name(elt.Name))
+		}
+		for _, c := range elt.Children {
+			if c.Type == dom.Node || (c.Type == dom.Content && len(c.Content) > 0) {
+				v.errorf(elt, "nil element %s has content", name(elt.Name))
+				break
+			}
+		}
+		if typ.complex {
+			v.attributes(elt, typ)
+		}
+		return
+	}
+
+	if !typ.complex {
+		v.attributes(elt, nil)
+		v.simpleContent(elt, decl, typ.simple)
+	} else {
+		v.attributes(elt, typ)
+		switch {
+		case typ.simple != nil:
+			v.simpleContent(elt, decl, typ.simple)
+		default:
+			v.complexContent(elt, typ)
+		}
+	}
+	for _, idc := range decl.idcs {
+		v.identity(elt, idc)
+	}
+}
+
+// text returns the text content of elt and reports whether it has element children.
+func text(elt *dom.Element) (string, bool) {
+	var sb strings.Builder
+	nodes := false
+	for _, c := range elt.Children {
+		switch c.Type {
+		case dom.Node:
+			nodes = true
+		case dom.Content:
+			sb.Write(c.Content)
+		}
+	}
+	return sb.String(), nodes
+}
+
+func (v *validator) simpleContent(elt *dom.Element, decl *element, st *simpleType) {
+	val, nodes := text(elt)
+	if nodes {
+		v.errorf(elt, "element %s can't have element children", name(elt.Name))
+		return
+	}
+	if val == "" && decl.def != nil {
+		val = *decl.def
+	}
+	if val == "" && decl.fixed != nil {
+		val = *decl.fixed
+	}
+	if err := st.validate(val, elt); err != nil {
+		v.errorf(elt, "%v", err)
+		return
+	}
+	if decl.fixed != nil && !st.equal(st.normalize(val), st.normalize(*decl.fixed)) {
+		v.errorf(elt, "value must be %q", *decl.fixed)
+	}
+	v.ident(elt, xml.Name{}, st, val)
+}
+
+// ident records the ID and IDREF values of an element or attribute.
+func (v *validator) ident(elt *dom.Element, attr xml.Name, st *simpleType, val string) {
+	switch {
+	case st.derives("ID"):
+		val = st.normalize(val)
+		if v.ids[val] {
+			v.attrErrorf(elt, attr, "ID %q isn't unique", val)
+		}
+		v.ids[val] = true
+	case st.derives("IDREF"):
+		v.refs = append(v.refs, idref{elt, attr, st.normalize(val)})
+	case st.variety == varList && st.item.derives("IDREF"):
+		for _, id := range strings.Fields(val) {
+			v.refs = append(v.refs, idref{elt, attr, id})
+		}
+	}
+}
+
+// attributes checks the attributes of elt against those of a complex type, or against none for a
+// simple type.
+func (v *validator) attributes(elt *dom.Element, typ *typeDef) {
+	var uses []*attribute
+	var any *wildcard
+	if typ != nil {
+		uses, any = typ.attrs, typ.anyAttr
+	}
+	seen := make(map[xml.Name]bool)
+	for _, attr := range elt.Attributes {
+		if dom.IsNamespaceDecl(attr.Name) || attr.Name.Space == XSIURL {
+			continue
+		}
+		var use *attribute
+		for _, u := range uses {
+			if u.name == attr.Name {
+				use = u
+			}
+		}
+		switch {
+		case use != nil && use.use == "prohibited":
+			v.attrErrorf(elt, attr.Name, "attribute %s is prohibited", name(attr.Name))
+			continue
+		case use == nil && any != nil && any.allows(attr.Name.Space):
+			if any.process == "skip" {
+				continue
+			}
+			use = v.s.attributes[attr.Name]
+			if use == nil {
+				if any.process == "strict" {
+					v.attrErrorf(elt, attr.Name, "attribute %s isn't declared", name(attr.Name))
+				}
+				continue
+			}
+		case use == nil:
+			v.attrErrorf(elt, attr.Name, "attribute %s isn't allowed", name(attr.Name))
+			continue
+		}
+		seen[attr.Name] = true
+		if err := use.typ.validate(attr.Value, elt); err != nil {
+			v.attrErrorf(elt, attr.Name, "%v", err)
+			continue
+		}
+		if use.fixed != nil && !use.typ.equal(use.typ.normalize(attr.Value), use.typ.normalize(*use.fixed)) {
+			v.attrErrorf(elt, attr.Name, "value must be %q", *use.fixed)
+		}
+		v.ident(elt, attr.Name, use.typ, attr.Value)
+	}
+	for _, u := range uses {
+		if u.use == "required" && !seen[u.name] {
+			v.errorf(elt, "required attribute %s is missing", name(u.name))
+		}
+	}
+}
+
+// allows reports whether the wildcard matches the namespace.
+func (w *wildcard) allows(space string) bool {
+	for _, ns := range w.ns {
+		switch ns {
+		case "##any":
+			return true
+		case "##other":
+			if space != w.tns && space != "" {
+				return true
+			}
+		case "##local":
+			if space == "" {
+				return true
+			}
+		case "##targetNamespace":
+			if space == w.tns {
+				return true
+			}
+		default:
+			if space == ns {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (v *validator) complexContent(elt *dom.Element, typ *typeDef) {
+	var kids []*dom.Element
+	for _, c := range elt.Children {
+		switch c.Type {
+		case dom.Node:
+			kids = append(kids, c)
+		case dom.Content:
+			if !typ.mixed && strings.TrimSpace(string(c.Content)) != "" {
+				v.errorf(elt, "element %s can't have character content", name(elt.Name))
+				return
+			}
+		}
+	}
+
+	// Match the children, keeping the state of any enclosing match
+	saved, savedAssigned, savedFurthest := v.kids, v.assigned, v.furthest
+	v.kids, v.assigned, v.furthest = kids, make(map[int]*particle), 0
+	ok := len(kids) == 0 && typ.content == nil
+	if typ.content != nil {
+		for _, end := range v.match(typ.content, 0) {
+			ok = ok || end == len(kids)
+		}
+	}
+	assigned, furthest := v.assigned, v.furthest
+	v.kids, v.assigned, v.furthest = saved, savedAssigned, savedFurthest
+
+	if !ok {
+		switch {
+		case furthest < len(kids):
+			v.errorf(kids[furthest], "element %s isn't expected here", name(kids[furthest].Name))
+		default:
+			v.errorf(elt, "content of element %s is incomplete", name(elt.Name))
+		}
+	}
+	for i, kid := range kids {
+		p := assigned[i]
+		switch {
+		case p == nil:
+			// Unmatched after an error
+		case p.kind == pElement:
+			v.element(kid, v.substitute(p.elem, kid.Name))
+		case p.wild.process == "skip":
+		default:
+			if decl := v.s.elements[kid.Name]; decl != nil {
+				v.element(kid, decl)
+			} else if p.wild.process == "strict" {
+				v.errorf(kid, "no declaration for element %s", name(kid.Name))
+			}
+		}
+	}
+}
+
+// substitute returns the member of the substitution group headed by decl with the name, or decl.
+func (v *validator) substitute(decl *element, n xml.Name) *element {
+	if decl.name == n {
+		return decl
+	}
+	for _, m := range v.s.substs[decl] {
+		if d := v.substitute(m, n); d.name == n {
+			return d
+		}
+	}
+	return decl
+}
+
+// matches reports whether the element declaration, or a member of its substitution group, has the name.
+func (v *validator) matches(decl *element, n xml.Name) bool {
+	return v.substitute(decl, n).name == n && !v.substitute(decl, n).abstract
+}
+
+// match returns the positions in the children at which a match of p starting at i can end. Children
+// are assigned to the particles matching them, which is unambiguous for a schema that satisfies the
+// Unique Particle Attribution constraint.
+func (v *validator) match(p *particle, i int) []int {
+	var res []int
+	if p.min == 0 {
+		res = []int{i}
+	}
+	frontier := []int{i}
+	for k := 1; p.max < 0 || k <= p.max; k++ {
+		var next []int
+		for _, j := range frontier {
+			next = union(next, v.once(p, j))
+		}
+		if k >= p.min {
+			res = union(res, next)
+		}
+		if len(next) == 0 || (k >= p.min && subset(next, res) && subset(next, frontier)) {
+			break
+		}
+		if k < p.min && subset(next, frontier) && subset(frontier, next) {
+			// A repeating empty match, the remaining minimum is met
+			res = union(res, next)
+			break
+		}
+		frontier = next
+	}
+	return res
+}
+
+// once returns the end positions of a single occurrence of p starting at i.
+func (v *validator) once(p *particle, i int) []int {
+	if i > v.furthest {
+		v.furthest = i
+	}
+	switch p.kind {
+	case pElement, pAny:
+		if i >= len(v.kids) {
+			return nil
+		}
+		kid := v.kids[i]
+		if (p.kind == pElement && v.matches(p.elem, kid.Name)) || (p.kind == pAny && p.wild.allows(kid.Name.Space)) {
+			v.assigned[i] = p
+			if i+1 > v.furthest {
+				v.furthest = i + 1
+			}
+			return []int{i + 1}
+		}
+		return nil
+	case pSequence:
+		cur := []int{i}
+		for _, c := range p.children {
+			var next []int
+			for _, j := range cur {
+				next = union(next, v.match(c, j))
+			}
+			cur = next
+		}
+		return cur
+	case pChoice:
+		var res []int
+		for _, c := range p.children {
+			res = union(res, v.match(c, i))
+		}
+		return res
+	case pAll:
+		used := make([]bool, len(p.children))
+		j := i
+	next:
+		for j < len(v.kids) {
+			for n, c := range p.children {
+				if !used[n] && v.matches(c.elem, v.kids[j].Name) {
+					used[n] = true
+					v.assigned[j] = c
+					j++
+					if j > v.furthest {
+						v.furthest = j
+					}
+					continue next
+				}
+			}
+			break
+		}
+		for n, c := range p.children {
+			if !used[n] && c.min > 0 {
+				return nil
+			}
+		}
+		return []int{j}
+	}
+	return nil
+}
+
+// Sets of positions are kept as sorted slices, which positions are mostly added to in increasing
+// order, so that repeated particles over many children aren't quadratic.
+
+// union adds the positions in b to a.
+func union(a, b []int) []int {
+	for _, j := range b {
+		a, _ = insert(a, j)
+	}
+	return a
+}
+
+// insert adds j to a and reports whether it wasn't already present.
+func insert(a []int, j int) ([]int, bool) {
+	i, found := slices.BinarySearch(a, j)
+	if found {
+		return a, false
+	}
+	return slices.Insert(a, i, j), true
+}
+
+func subset(a, b []int) bool {
+	for _, j := range a {
+		if !contains(b, j) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(a []int, j int) bool {
+	_, found := slices.BinarySearch(a, j)
+	return found
+}
+
+// identity checks an identity constraint declared on the element decl against its instance elt.
+func (v *validator) identity(elt *dom.Element, idc *identity) {
+	rows, ok := v.keyTable(elt, idc, true)
+	if !ok || idc.kind != idcKeyRef {
+		return
+	}
+	keys, _ := v.keyTable(elt, idc.refer, false)
+	for _, r := range rows {
+		found := false
+		for _, k := range keys {
+			found = found || k.key == r.key
+		}
+		if !found {
+			v.errorf(r.elt, "keyref %s value %s doesn't match any %s", idc.name.Local, r.key, idc.refer.name.Local)
+		}
+	}
+}
+
+type keyRow struct {
+	elt *dom.Element
+	key string
+}
+
+// keyTable evaluates the constraint's selector and fields in the scope of elt, reporting missing and
+// duplicate values if report is set. Keyrefs are checked against the table of the referenced
+// constraint evaluated in the same scope.
+func (v *validator) keyTable(elt *dom.Element, idc *identity, report bool) ([]keyRow, bool) {
+	errorf := v.errorf
+	if !report {
+		errorf = func(*dom.Element, string, ...any) {}
+	}
+	sel, err := idc.selector.Select(elt)
+	if err != nil {
+		errorf(elt, "%s: %v", idc.name.Local, err)
+		return nil, false
+	}
+	var rows []keyRow
+	seen := make(map[string]bool)
+	for _, n := range sel {
+		target := n.Element
+		var vals []string
+		complete := true
+		for _, f := range idc.fields {
+			res, err := f.EvaluateContext(&xpath.Context{Node: n})
+			if err != nil {
+				errorf(target, "%s: %v", idc.name.Local, err)
+				return nil, false
+			}
+			if ns, ok := res.(xpath.NodeSet); ok && len(ns) > 1 {
+				errorf(target, "%s field %s selects more than one node", idc.name.Local, f)
+				complete = false
+				break
+			} else if ok && len(ns) == 0 {
+				complete = false
+				break
+			}
+			vals = append(vals, strings.Join(strings.Fields(xpath.String(res)), " "))
+		}
+		if !complete {
+			if idc.kind == idcKey {
+				errorf(target, "key %s is missing a field", idc.name.Local)
+			}
+			continue
+		}
+		key := "(" + strings.Join(vals, ", ") + ")"
+		if idc.kind != idcKeyRef {
+			if seen[key] {
+				errorf(target, "%s value %s isn't unique", idc.name.Local, key)
+			}
+			seen[key] = true
+		}
+		rows = append(rows, keyRow{target, key})
+	}
+	return rows, true
+}
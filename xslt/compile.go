@@ -0,0 +1,823 @@
+package xslt
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	dom "github.com/jphsd/xml"
+	"github.com/jphsd/xml/xpath"
+)
+
+// Parse compiles a stylesheet, elt being either a Document or the xsl:stylesheet element or, for a
+// simplified stylesheet, the literal result element. Includes, imports and documents read by
+// document() are read with load, which may be nil if there are none.
+func Parse(elt *dom.Element, load dom.Resolver) (*Stylesheet, error) {
+	s := &Stylesheet{
+		rules:    make(map[xml.Name][]*rule),
+		named:    make(map[xml.Name]*template),
+		globals:  make(map[xml.Name]*variable),
+		keys:     make(map[xml.Name][]*key),
+		formats:  make(map[xml.Name]*decimalFormat),
+		attrSets: make(map[xml.Name][]*attrSet),
+		aliases:  make(map[string]alias),
+		load:     load,
+		docs:     map[string]*dom.Element{"": elt.Root()},
+	}
+	c := &compiler{s: s, open: make(map[string]bool), outPrec: make(map[string]int)}
+	if err := c.module(elt, ""); err != nil {
+		return nil, err
+	}
+
+	for _, rules := range s.rules {
+		sort.SliceStable(rules, func(i, j int) bool {
+			a, b := rules[i], rules[j]
+			switch {
+			case a.t.prec != b.t.prec:
+				return a.t.prec > b.t.prec
+			case a.priority != b.priority:
+				return a.priority > b.priority
+			}
+			return a.pos > b.pos
+		})
+	}
+	sort.SliceStable(s.spaces, func(i, j int) bool {
+		a, b := s.spaces[i], s.spaces[j]
+		if a.prec != b.prec {
+			return a.prec > b.prec
+		}
+		return a.priority > b.priority
+	})
+	for _, call := range c.calls {
+		if _, ok := s.named[call.name]; !ok {
+			return nil, errorf(call.src, "no template named %s", call.name.Local)
+		}
+	}
+	for _, use := range c.sets {
+		if _, ok := s.attrSets[use.name]; !ok {
+			return nil, errorf(use.src, "no attribute set named %s", use.name.Local)
+		}
+	}
+	for _, v := range s.globals {
+		s.order = append(s.order, v)
+	}
+	sort.Slice(s.order, func(i, j int) bool { return c.varPos[s.order[i]] < c.varPos[s.order[j]] })
+	return s, nil
+}
+
+type compiler struct {
+	s         *Stylesheet
+	prec      int // Import precedence of the module being compiled
+	importMin int
+	next      int // Next import precedence to assign
+	pos       int // Count of template rules, for conflict resolution
+	href      string
+	open      map[string]bool // Stylesheets being read, to detect loops
+	deps      map[xml.Name]bool
+	calls     []reference
+	sets      []reference
+	varPos    map[*variable]int
+	outPrec   map[string]int // Precedence of each xsl:output attribute set so far
+}
+
+// reference is a use of a named template or attribute set, checked once all are known.
+type reference struct {
+	src  *dom.Element
+	name xml.Name
+}
+
+type topLevel struct {
+	elt        *dom.Element
+	href       string
+	simplified bool
+}
+
+func isXSL(e *dom.Element, local string) bool {
+	return e.Type == dom.Node && e.Name.Space == NamespaceURL && e.Name.Local == local
+}
+
+// module compiles a stylesheet and the stylesheets it imports, which are given lower precedences.
+func (c *compiler) module(root *dom.Element, href string) error {
+	if root.Type == dom.Document {
+		doc := root
+		if root = doc.DocumentElement(); root == nil {
+			return errorf(doc, "stylesheet has no document element")
+		}
+	}
+	var tops, imports []topLevel
+	if err := c.collect(root, href, &tops, &imports); err != nil {
+		return err
+	}
+
+	saveMin, savePrec, saveHref := c.importMin, c.prec, c.href
+	defer func() { c.importMin, c.prec, c.href = saveMin, savePrec, saveHref }()
+	importMin := c.next
+	for _, imp := range imports {
+		doc, h, err := c.read(imp.elt, imp.href)
+		if err != nil {
+			return err
+		}
+		err = c.module(doc, h)
+		delete(c.open, h)
+		if err != nil {
+			return err
+		}
+	}
+	c.importMin, c.prec = importMin, c.next
+	c.next++
+	if c.varPos == nil {
+		c.varPos = make(map[*variable]int)
+	}
+	for _, top := range tops {
+		c.href = top.href
+		var err error
+		if top.simplified {
+			err = c.simplified(top.elt)
+		} else {
+			err = c.topLevel(top.elt)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collect adds the top level elements of the stylesheet root, and those of any it includes, to tops,
+// and its imports to imports.
+func (c *compiler) collect(root *dom.Element, href string, tops, imports *[]topLevel) error {
+	if !isXSL(root, "stylesheet") && !isXSL(root, "transform") {
+		if _, ok := root.LookupAttrNS(NamespaceURL, "version"); !ok {
+			return errorf(root, "%s isn't a stylesheet", root.Name.Local)
+		}
+		*tops = append(*tops, topLevel{root, href, true})
+		return nil
+	}
+	if _, ok := root.LookupAttr("version"); !ok {
+		return errorf(root, "stylesheet has no version")
+	}
+	others := false
+	for _, e := range root.Children {
+		switch {
+		case e.Type == dom.Content:
+			if strings.TrimSpace(string(e.Content)) != "" {
+				return errorf(root, "text isn't allowed in a stylesheet")
+			}
+		case e.Type != dom.Node:
+		case isXSL(e, "import"):
+			if others {
+				return errorf(e, "import must come before other top level elements")
+			}
+			*imports = append(*imports, topLevel{e, href, false})
+		case isXSL(e, "include"):
+			others = true
+			doc, h, err := c.read(e, href)
+			if err != nil {
+				return err
+			}
+			if doc.Type == dom.Document {
+				doc = doc.DocumentElement()
+			}
+			err = c.collect(doc, h, tops, imports)
+			delete(c.open, h)
+			if err != nil {
+				return err
+			}
+		default:
+			others = true
+			*tops = append(*tops, topLevel{e, href, false})
+		}
+	}
+	return nil
+}
+
+// read returns the stylesheet referenced by the href attribute of e, and its resolved href, which is
+// marked as open until the caller is done with it.
+func (c *compiler) read(e *dom.Element, base string) (*dom.Element, string, error) {
+	href, ok := e.LookupAttr("href")
+	if !ok {
+		return nil, "", errorf(e, "%s has no href", e.Name.Local)
+	}
+	href = dom.ResolveURI(base, href)
+	if c.open[href] {
+		return nil, "", errorf(e, "%s includes or imports itself", href)
+	}
+	doc, err := c.s.document(href)
+	if err != nil {
+		return nil, "", wrap(e, err)
+	}
+	c.open[href] = true
+	return doc, href, nil
+}
+
+// document returns the document at href, reading it with the loader if it hasn't been already.
+func (s *Stylesheet) document(href string) (*dom.Element, error) {
+	if doc, ok := s.docs[href]; ok {
+		return doc, nil
+	}
+	doc, err := s.read(href)
+	if err != nil {
+		return nil, err
+	}
+	s.docs[href] = doc
+	return doc, nil
+}
+
+// read reads and parses the document at href.
+func (s *Stylesheet) read(href string) (*dom.Element, error) {
+	if s.load == nil {
+		return nil, fmt.Errorf("no loader to read %s", href)
+	}
+	data, err := s.load(href)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := dom.NewXMLDecoder(bytes.NewReader(data)).BuildDocument()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", href, err)
+	}
+	return doc, nil
+}
+
+// simplified compiles a literal result element used as a stylesheet into a template for the root.
+func (c *compiler) simplified(e *dom.Element) error {
+	body, err := c.instruction(e)
+	if err != nil {
+		return err
+	}
+	pat, err := xpath.CompilePattern("/", nil)
+	if err != nil {
+		return err
+	}
+	t := &template{src: e, prec: c.prec, importMin: c.importMin, body: []instr{body}}
+	c.pos++
+	c.s.rules[xml.Name{}] = append(c.s.rules[xml.Name{}], &rule{pat, nil, 0.5, c.pos, t})
+	return nil
+}
+
+func (c *compiler) topLevel(e *dom.Element) error {
+	if e.Name.Space != NamespaceURL {
+		if e.Name.Space == "" {
+			return errorf(e, "top level element %s must be in a namespace", e.Name.Local)
+		}
+		// Foreign elements are ignored
+		return nil
+	}
+	switch e.Name.Local {
+	case "template":
+		return c.template(e)
+	case "variable", "param":
+		return c.global(e)
+	case "key":
+		return c.key(e)
+	case "output":
+		return c.output(e)
+	case "strip-space", "preserve-space":
+		return c.space(e)
+	case "attribute-set":
+		return c.attrSet(e)
+	case "decimal-format":
+		return c.decimalFormat(e)
+	case "namespace-alias":
+		return c.namespaceAlias(e)
+	}
+	if forwards(e) {
+		return nil
+	}
+	return errorf(e, "unknown top level element %s", e.Name.Local)
+}
+
+// forwards reports whether e is processed in forwards compatible mode, as its version isn't 1.0.
+func forwards(e *dom.Element) bool {
+	for ; e != nil && e.Type == dom.Node; e = e.Parent {
+		v, ok := e.LookupAttrNS(NamespaceURL, "version")
+		if isXSL(e, "stylesheet") || isXSL(e, "transform") {
+			v, ok = e.LookupAttr("version")
+		}
+		if ok {
+			return strings.TrimSpace(v) != "1.0"
+		}
+	}
+	return false
+}
+
+// qname resolves a QName in the scope of e. Unprefixed names are in the default namespace if def is set.
+func qname(e *dom.Element, v string, def bool) (xml.Name, error) {
+	v = strings.TrimSpace(v)
+	prefix, local, ok := strings.Cut(v, ":")
+	if !ok {
+		prefix, local = "", v
+	}
+	if !isNCName(local) || (ok && !isNCName(prefix)) {
+		return xml.Name{}, fmt.Errorf("invalid name %q", v)
+	}
+	switch {
+	case prefix == "xml":
+		return xml.Name{Space: xmlURL, Local: local}, nil
+	case prefix == "" && !def:
+		return xml.Name{Local: local}, nil
+	}
+	uri, bound := e.LookupNamespaceURI(prefix)
+	if !bound && prefix != "" {
+		return xml.Name{}, fmt.Errorf("prefix %s isn't declared", prefix)
+	}
+	return xml.Name{Space: uri, Local: local}, nil
+}
+
+// attrQName resolves the QName in attribute attr of e, returning a zero Name if it's absent.
+func attrQName(e *dom.Element, attr string) (xml.Name, error) {
+	v, ok := e.LookupAttr(attr)
+	if !ok {
+		return xml.Name{}, nil
+	}
+	name, err := qname(e, v, false)
+	if err != nil {
+		return name, wrap(e, err)
+	}
+	return name, nil
+}
+
+func isNCName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		switch {
+		case r == '_' || r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= 0xc0:
+		case i > 0 && (r == '-' || r == '.' || r >= '0' && r <= '9' || r == 0xb7):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// expr compiles the expression in attribute attr of e, returning nil if it's absent and not required.
+func (c *compiler) expr(e *dom.Element, attr string, required bool) (*expr, error) {
+	src, ok := e.LookupAttr(attr)
+	if !ok {
+		if required {
+			return nil, errorf(e, "%s has no %s", e.Name.Local, attr)
+		}
+		return nil, nil
+	}
+	return c.compileExpr(e, src)
+}
+
+func (c *compiler) compileExpr(e *dom.Element, src string) (*expr, error) {
+	ns := e.InScopeNamespaces()
+	x, err := xpath.CompileNS(src, ns)
+	if err != nil {
+		return nil, wrap(e, err)
+	}
+	if c.deps != nil {
+		for _, name := range x.Variables() {
+			c.deps[name] = true
+		}
+	}
+	return &expr{x, ns, e, c.href}, nil
+}
+
+// pattern compiles the pattern in attribute attr of e, returning nil if it's absent and not required.
+func (c *compiler) pattern(e *dom.Element, attr string, required bool) (*xpath.Pattern, error) {
+	src, ok := e.LookupAttr(attr)
+	if !ok {
+		if required {
+			return nil, errorf(e, "%s has no %s", e.Name.Local, attr)
+		}
+		return nil, nil
+	}
+	p, err := xpath.CompilePattern(src, e.InScopeNamespaces())
+	if err != nil {
+		return nil, wrap(e, err)
+	}
+	return p, nil
+}
+
+// avt compiles the attribute value template in attribute attr of e, returning nil if it's absent.
+func (c *compiler) avt(e *dom.Element, attr string) (*avt, error) {
+	src, ok := e.LookupAttr(attr)
+	if !ok {
+		return nil, nil
+	}
+	return c.compileAVT(e, src)
+}
+
+func (c *compiler) compileAVT(e *dom.Element, src string) (*avt, error) {
+	a := &avt{}
+	var lit strings.Builder
+	for i := 0; i < len(src); i++ {
+		ch := src[i]
+		switch {
+		case ch == '{' && i+1 < len(src) && src[i+1] == '{', ch == '}' && i+1 < len(src) && src[i+1] == '}':
+			lit.WriteByte(ch)
+			i++
+		case ch == '}':
+			return nil, errorf(e, "unmatched } in %q", src)
+		case ch == '{':
+			// The expression ends at the first } outside a string literal
+			j := i + 1
+			var quote byte
+			for ; j < len(src) && (quote != 0 || src[j] != '}'); j++ {
+				switch {
+				case quote != 0 && src[j] == quote:
+					quote = 0
+				case quote == 0 && (src[j] == '"' || src[j] == '\''):
+					quote = src[j]
+				}
+			}
+			if j == len(src) {
+				return nil, errorf(e, "unmatched { in %q", src)
+			}
+			x, err := c.compileExpr(e, src[i+1:j])
+			if err != nil {
+				return nil, err
+			}
+			if lit.Len() > 0 {
+				a.parts = append(a.parts, avtPart{lit: lit.String()})
+				lit.Reset()
+			}
+			a.parts = append(a.parts, avtPart{x: x})
+			i = j
+		default:
+			lit.WriteByte(ch)
+		}
+	}
+	if lit.Len() > 0 || len(a.parts) == 0 {
+		a.parts = append(a.parts, avtPart{lit: lit.String()})
+	}
+	return a, nil
+}
+
+func (c *compiler) template(e *dom.Element) error {
+	t := &template{src: e, prec: c.prec, importMin: c.importMin}
+	var err error
+	if t.name, err = attrQName(e, "name"); err != nil {
+		return err
+	}
+	if t.mode, err = attrQName(e, "mode"); err != nil {
+		return err
+	}
+	pat, err := c.pattern(e, "match", false)
+	if err != nil {
+		return err
+	}
+	if pat == nil && t.name.Local == "" {
+		return errorf(e, "template has neither match nor name")
+	}
+	if pat == nil && t.mode.Local != "" {
+		return errorf(e, "template without match has a mode")
+	}
+
+	kids := children(e)
+	for len(kids) > 0 && isXSL(kids[0], "param") {
+		p, err := c.variable(kids[0])
+		if err != nil {
+			return err
+		}
+		for _, q := range t.params {
+			if q.name == p.name {
+				return errorf(kids[0], "duplicate parameter %s", p.name.Local)
+			}
+		}
+		t.params = append(t.params, p)
+		kids = kids[1:]
+	}
+	if t.body, err = c.body(e, kids); err != nil {
+		return err
+	}
+
+	if t.name.Local != "" {
+		if prev, ok := c.s.named[t.name]; ok && prev.prec == t.prec {
+			return errorf(e, "duplicate template named %s", t.name.Local)
+		}
+		c.s.named[t.name] = t
+	}
+	if pat != nil {
+		pri := math.NaN()
+		if v, ok := e.LookupAttr("priority"); ok {
+			if pri, err = strconv.ParseFloat(strings.TrimSpace(v), 64); err != nil {
+				return errorf(e, "invalid priority %q", v)
+			}
+		}
+		ns := e.InScopeNamespaces()
+		for _, alt := range pat.Alternatives() {
+			p := pri
+			if math.IsNaN(p) {
+				p = alt.Priority()
+			}
+			c.pos++
+			c.s.rules[t.mode] = append(c.s.rules[t.mode], &rule{alt, ns, p, c.pos, t})
+		}
+	}
+	return nil
+}
+
+// children returns the child nodes of e that are significant to the stylesheet: elements and text
+// that isn't white space only, unless white space is preserved.
+func children(e *dom.Element) []*dom.Element {
+	var res []*dom.Element
+	for _, k := range e.Children {
+		switch k.Type {
+		case dom.Node:
+			res = append(res, k)
+		case dom.Content:
+			if strings.TrimSpace(string(k.Content)) != "" || preserve(e) {
+				res = append(res, k)
+			}
+		}
+	}
+	return res
+}
+
+// preserve reports whether white space text in e is significant.
+func preserve(e *dom.Element) bool {
+	if isXSL(e, "text") {
+		return true
+	}
+	for ; e != nil; e = e.Parent {
+		if v, ok := e.LookupAttrNS(xmlURL, "space"); ok {
+			return v == "preserve"
+		}
+	}
+	return false
+}
+
+func (c *compiler) global(e *dom.Element) error {
+	c.deps = make(map[xml.Name]bool)
+	v, err := c.variable(e)
+	deps := c.deps
+	c.deps = nil
+	if err != nil {
+		return err
+	}
+	for name := range deps {
+		v.deps = append(v.deps, name)
+	}
+	if prev, ok := c.s.globals[v.name]; ok {
+		if prev.prec == v.prec {
+			return errorf(e, "duplicate global variable %s", v.name.Local)
+		}
+		if prev.prec > v.prec {
+			return nil
+		}
+	}
+	c.s.globals[v.name] = v
+	c.varPos[v] = len(c.varPos)
+	return nil
+}
+
+// variable compiles an xsl:variable, xsl:param or xsl:with-param.
+func (c *compiler) variable(e *dom.Element) (*variable, error) {
+	name, err := attrQName(e, "name")
+	if err != nil {
+		return nil, err
+	}
+	if name.Local == "" {
+		return nil, errorf(e, "%s has no name", e.Name.Local)
+	}
+	v := &variable{src: e, name: name, param: e.Name.Local == "param", prec: c.prec}
+	if v.sel, err = c.expr(e, "select", false); err != nil {
+		return nil, err
+	}
+	kids := children(e)
+	if v.sel != nil && len(kids) > 0 {
+		return nil, errorf(e, "%s has both select and content", e.Name.Local)
+	}
+	if v.body, err = c.body(e, kids); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (c *compiler) key(e *dom.Element) error {
+	name, err := attrQName(e, "name")
+	if err != nil {
+		return err
+	}
+	if name.Local == "" {
+		return errorf(e, "key has no name")
+	}
+	k := &key{}
+	if k.match, err = c.pattern(e, "match", true); err != nil {
+		return err
+	}
+	if k.use, err = c.expr(e, "use", true); err != nil {
+		return err
+	}
+	c.s.keys[name] = append(c.s.keys[name], k)
+	return nil
+}
+
+// output merges an xsl:output into the stylesheet's settings, each attribute taking the value with
+// the highest precedence.
+func (c *compiler) output(e *dom.Element) error {
+	o := &c.s.Output
+	for _, attr := range e.Attributes {
+		if attr.Name.Space != "" || dom.IsNamespaceDecl(attr.Name) {
+			continue
+		}
+		local := attr.Name.Local
+		if local == "cdata-section-elements" {
+			for _, f := range strings.Fields(attr.Value) {
+				name, err := qname(e, f, true)
+				if err != nil {
+					return wrap(e, err)
+				}
+				o.CDATASectionElements = append(o.CDATASectionElements, name)
+			}
+			continue
+		}
+		if prec, ok := c.outPrec[local]; ok && prec > c.prec {
+			continue
+		}
+		c.outPrec[local] = c.prec
+		v := strings.TrimSpace(attr.Value)
+		switch local {
+		case "method":
+			if v != "xml" && v != "html" && v != "text" {
+				name, err := qname(e, v, false)
+				if err != nil || name.Space == "" {
+					return errorf(e, "unknown output method %s", v)
+				}
+			}
+			o.Method = v
+		case "version":
+			o.Version = v
+		case "encoding":
+			o.Encoding = v
+		case "omit-xml-declaration":
+			o.OmitXMLDeclaration = v == "yes"
+		case "standalone":
+			o.Standalone = v
+		case "doctype-public":
+			o.DoctypePublic = v
+		case "doctype-system":
+			o.DoctypeSystem = v
+		case "indent":
+			o.Indent = v == "yes"
+		case "media-type":
+			o.MediaType = v
+		}
+	}
+	return nil
+}
+
+func (c *compiler) space(e *dom.Element) error {
+	v, ok := e.LookupAttr("elements")
+	if !ok {
+		return errorf(e, "%s has no elements", e.Name.Local)
+	}
+	for _, f := range strings.Fields(v) {
+		r := &spaceRule{strip: e.Name.Local == "strip-space", prec: c.prec}
+		switch {
+		case f == "*":
+			r.name.Local, r.any, r.priority = "*", true, -0.5
+		case strings.HasSuffix(f, ":*"):
+			name, err := qname(e, strings.TrimSuffix(f, "*")+"x", false)
+			if err != nil {
+				return wrap(e, err)
+			}
+			r.name, r.priority = xml.Name{Space: name.Space, Local: "*"}, -0.25
+		default:
+			name, err := qname(e, f, false)
+			if err != nil {
+				return wrap(e, err)
+			}
+			r.name = name
+		}
+		c.s.spaces = append(c.s.spaces, r)
+	}
+	return nil
+}
+
+func (c *compiler) attrSet(e *dom.Element) error {
+	name, err := attrQName(e, "name")
+	if err != nil {
+		return err
+	}
+	if name.Local == "" {
+		return errorf(e, "attribute-set has no name")
+	}
+	as := &attrSet{src: e, prec: c.prec}
+	if as.uses, err = c.useSets(e, "use-attribute-sets"); err != nil {
+		return err
+	}
+	for _, k := range children(e) {
+		if !isXSL(k, "attribute") {
+			return errorf(k, "attribute-set can only contain attributes")
+		}
+		in, err := c.instruction(k)
+		if err != nil {
+			return err
+		}
+		as.attrs = append(as.attrs, in)
+	}
+	// Sets of the same name are merged, those with higher precedence last
+	sets := c.s.attrSets[name]
+	i := len(sets)
+	for i > 0 && sets[i-1].prec > c.prec {
+		i--
+	}
+	sets = append(sets, nil)
+	copy(sets[i+1:], sets[i:])
+	sets[i] = as
+	c.s.attrSets[name] = sets
+	return nil
+}
+
+// useSets resolves the attribute set names in attribute attr of e.
+func (c *compiler) useSets(e *dom.Element, attr string) ([]xml.Name, error) {
+	var v string
+	var ok bool
+	if e.Name.Space == NamespaceURL {
+		v, ok = e.LookupAttr(attr)
+	} else {
+		v, ok = e.LookupAttrNS(NamespaceURL, attr)
+	}
+	if !ok {
+		return nil, nil
+	}
+	var res []xml.Name
+	for _, f := range strings.Fields(v) {
+		name, err := qname(e, f, false)
+		if err != nil {
+			return nil, wrap(e, err)
+		}
+		res = append(res, name)
+		c.sets = append(c.sets, reference{e, name})
+	}
+	return res, nil
+}
+
+func (c *compiler) decimalFormat(e *dom.Element) error {
+	name, err := attrQName(e, "name")
+	if err != nil {
+		return err
+	}
+	df := defaultFormat
+	chars := map[string]*rune{
+		"decimal-separator":  &df.decimalSep,
+		"grouping-separator": &df.groupingSep,
+		"percent":            &df.percent,
+		"per-mille":          &df.perMille,
+		"zero-digit":         &df.zero,
+		"digit":              &df.digit,
+		"pattern-separator":  &df.patternSep,
+	}
+	for attr, p := range chars {
+		if v, ok := e.LookupAttr(attr); ok {
+			r := []rune(v)
+			if len(r) != 1 {
+				return errorf(e, "%s must be a single character", attr)
+			}
+			*p = r[0]
+		}
+	}
+	if v, ok := e.LookupAttr("infinity"); ok {
+		df.infinity = v
+	}
+	if v, ok := e.LookupAttr("NaN"); ok {
+		df.nan = v
+	}
+	if v, ok := e.LookupAttr("minus-sign"); ok {
+		df.minus = v
+	}
+	if prev, ok := c.s.formats[name]; ok && *prev != df {
+		return errorf(e, "conflicting decimal-format %s", name.Local)
+	}
+	c.s.formats[name] = &df
+	return nil
+}
+
+func (c *compiler) namespaceAlias(e *dom.Element) error {
+	uri := func(attr string) (string, string, error) {
+		v, ok := e.LookupAttr(attr)
+		if !ok {
+			return "", "", errorf(e, "namespace-alias has no %s", attr)
+		}
+		prefix := strings.TrimSpace(v)
+		if prefix == "#default" {
+			prefix = ""
+		}
+		u, bound := e.LookupNamespaceURI(prefix)
+		if !bound && prefix != "" {
+			return "", "", errorf(e, "prefix %s isn't declared", prefix)
+		}
+		return prefix, u, nil
+	}
+	_, from, err := uri("stylesheet-prefix")
+	if err != nil {
+		return err
+	}
+	prefix, to, err := uri("result-prefix")
+	if err != nil {
+		return err
+	}
+	c.s.aliases[from] = alias{prefix, to}
+	return nil
+}
@@ -0,0 +1,935 @@
+package xslt
+
+import (
+	"encoding/xml"
+	"fmt"
+	"maps"
+	"math"
+	"sort"
+	"strings"
+
+	dom "github.com/jphsd/xml"
+	"github.com/jphsd/xml/xpath"
+)
+
+// maxDepth limits the nesting of template invocations, to catch infinite recursion.
+const maxDepth = 10000
+
+var (
+	childNodes = xpath.MustCompile("node()")
+	allNodes   = xpath.MustCompile("descendant-or-self::node() | descendant-or-self::*/@*")
+	paramValue = xpath.MustCompile("$v")
+)
+
+// transform holds the state of a transformation.
+type transform struct {
+	s         *Stylesheet
+	out       *dom.Element // Document or element receiving the result
+	node      xpath.Node   // Current node
+	pos, size int
+	vars      map[xml.Name]any
+	globals   map[xml.Name]any
+	params    map[string]any
+	busy      map[*variable]bool // Globals being evaluated, to detect circular definitions
+	rule      *template          // Current template rule, nil within for-each
+	mode      xml.Name
+	depth     int
+	funcs     map[xml.Name]xpath.Function
+
+	// Scope of the expression or pattern being evaluated, for functions taking QNames or URIs
+	ns   map[string]string
+	at   *dom.Element
+	base string
+
+	keys   map[keyID]map[string]xpath.NodeSet
+	orders map[*dom.Element]map[xpath.Node]int // Document order of the indexed trees
+	docs   map[string]*dom.Element             // Documents read by document()
+	bases  map[*dom.Element]string             // Locations of the documents by root
+	ids    map[xpath.Node]string
+}
+
+type keyID struct {
+	name xml.Name
+	root *dom.Element
+}
+
+// Transform applies the stylesheet to the tree containing src and returns the result Document. The top
+// level parameters named, by local name, in params are set to the supplied values, which are converted
+// to XPath values as for the results of extension functions.
+func (s *Stylesheet) Transform(src *dom.Element, params map[string]any) (*dom.Element, error) {
+	root := src.Root()
+	if s.stripping() {
+		root = root.Copy()
+		s.strip(root)
+	}
+	t := &transform{
+		s:       s,
+		out:     dom.NewDocument(),
+		node:    xpath.Root(xpath.NewNode(root)),
+		pos:     1,
+		size:    1,
+		globals: make(map[xml.Name]any),
+		params:  params,
+		busy:    make(map[*variable]bool),
+		keys:    make(map[keyID]map[string]xpath.NodeSet),
+		orders:  make(map[*dom.Element]map[xpath.Node]int),
+		docs:    make(map[string]*dom.Element),
+		bases:   make(map[*dom.Element]string),
+		ids:     make(map[xpath.Node]string),
+	}
+	for href, doc := range s.docs {
+		t.bases[doc] = href
+	}
+	t.funcs = t.functions()
+	for _, v := range s.order {
+		if _, err := t.global(v); err != nil {
+			return nil, err
+		}
+	}
+	t.vars = maps.Clone(t.globals)
+	if err := t.applyRules(xml.Name{}, math.MinInt, math.MaxInt, nil); err != nil {
+		return nil, err
+	}
+	return t.out, nil
+}
+
+// global returns the value of a top level variable or parameter, evaluating it and those it depends on
+// if necessary.
+func (t *transform) global(v *variable) (any, error) {
+	if val, ok := t.globals[v.name]; ok {
+		return val, nil
+	}
+	if t.busy[v] {
+		return nil, errorf(v.src, "circular definition of %s", v.name.Local)
+	}
+	t.busy[v] = true
+	for _, name := range v.deps {
+		if dep, ok := t.s.globals[name]; ok {
+			if _, err := t.global(dep); err != nil {
+				return nil, err
+			}
+		}
+	}
+	var val any
+	var err error
+	if p, ok := t.params[v.name.Local]; ok && v.param {
+		// Convert the value as the evaluator does for variables
+		ctx := &xpath.Context{Variables: map[xml.Name]any{{Local: "v"}: p}}
+		if val, err = paramValue.EvaluateContext(ctx); err != nil {
+			return nil, errorf(v.src, "parameter %s: %v", v.name.Local, err)
+		}
+	} else {
+		t.vars = maps.Clone(t.globals)
+		if val, err = t.value(v); err != nil {
+			return nil, err
+		}
+	}
+	t.globals[v.name] = val
+	return val, nil
+}
+
+// value evaluates a variable's select expression or content, an empty string if it has neither.
+func (t *transform) value(v *variable) (any, error) {
+	switch {
+	case v.sel != nil:
+		return t.eval(v.sel)
+	case v.body == nil:
+		return "", nil
+	}
+	return t.fragment(v.body)
+}
+
+// fragment instantiates body as a result tree fragment.
+func (t *transform) fragment(body []instr) (xpath.NodeSet, error) {
+	doc := dom.NewDocument()
+	save := t.out
+	t.out = doc
+	err := t.seq(body)
+	t.out = save
+	if err != nil {
+		return nil, err
+	}
+	return xpath.NodeSet{xpath.NewNode(doc)}, nil
+}
+
+// content instantiates body and returns the text it creates, any other nodes being ignored.
+func (t *transform) content(body []instr) (string, error) {
+	frag, err := t.fragment(body)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	for _, k := range frag[0].Element.Children {
+		if k.Type == dom.Content {
+			sb.Write(k.Content)
+		}
+	}
+	return sb.String(), nil
+}
+
+func (t *transform) eval(e *expr) (any, error) {
+	saveNS, saveAt, saveBase := t.ns, t.at, t.base
+	t.ns, t.at, t.base = e.ns, e.src, e.base
+	v, err := e.x.EvaluateContext(t.context(t.node))
+	t.ns, t.at, t.base = saveNS, saveAt, saveBase
+	if err != nil {
+		return nil, wrap(e.src, err)
+	}
+	return v, nil
+}
+
+// context returns the evaluation context for n, with the current position and size.
+func (t *transform) context(n xpath.Node) *xpath.Context {
+	return &xpath.Context{Node: n, Position: t.pos, Size: t.size, Variables: t.vars, Functions: t.funcs}
+}
+
+func (t *transform) nodes(e *expr) (xpath.NodeSet, error) {
+	v, err := t.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	ns, ok := v.(xpath.NodeSet)
+	if !ok {
+		return nil, errorf(e.src, "%s doesn't evaluate to a node-set", e.x)
+	}
+	return ns, nil
+}
+
+// str evaluates an attribute value template, returning def if it's absent.
+func (t *transform) str(a *avt, def string) (string, error) {
+	if a == nil {
+		return def, nil
+	}
+	var sb strings.Builder
+	for _, p := range a.parts {
+		if p.x == nil {
+			sb.WriteString(p.lit)
+			continue
+		}
+		v, err := t.eval(p.x)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(xpath.String(v))
+	}
+	return sb.String(), nil
+}
+
+// matches reports whether n matches the pattern p, which is used by the stylesheet element at.
+func (t *transform) matches(p *xpath.Pattern, ns map[string]string, at *dom.Element, n xpath.Node) (bool, error) {
+	saveNS, saveAt := t.ns, t.at
+	t.ns, t.at = ns, at
+	ok, err := p.Match(&xpath.Context{Node: n, Variables: t.globals, Functions: t.funcs})
+	t.ns, t.at = saveNS, saveAt
+	if err != nil {
+		return false, wrap(at, err)
+	}
+	return ok, nil
+}
+
+// seq executes a sequence of instructions. Variables bound in the sequence are in scope until its end.
+func (t *transform) seq(body []instr) error {
+	type saved struct {
+		name xml.Name
+		v    any
+		ok   bool
+	}
+	var bound []saved
+	defer func() {
+		for i := len(bound) - 1; i >= 0; i-- {
+			b := bound[i]
+			if b.ok {
+				t.vars[b.name] = b.v
+			} else {
+				delete(t.vars, b.name)
+			}
+		}
+	}()
+	for _, in := range body {
+		if v, ok := in.(*variable); ok {
+			old, had := t.vars[v.name]
+			bound = append(bound, saved{v.name, old, had})
+		}
+		if err := in.exec(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exec binds a local variable, which remains bound until the end of the enclosing sequence.
+func (v *variable) exec(t *transform) error {
+	val, err := t.value(v)
+	if err != nil {
+		return err
+	}
+	t.vars[v.name] = val
+	return nil
+}
+
+// withParams evaluates the parameters passed to a template.
+func (t *transform) withParams(params []*variable) (map[xml.Name]any, error) {
+	if len(params) == 0 {
+		return nil, nil
+	}
+	res := make(map[xml.Name]any, len(params))
+	for _, p := range params {
+		v, err := t.value(p)
+		if err != nil {
+			return nil, err
+		}
+		res[p.name] = v
+	}
+	return res, nil
+}
+
+// invoke instantiates a template with the current node, binding its parameters to the values passed
+// or their defaults.
+func (t *transform) invoke(tm *template, params map[xml.Name]any) error {
+	if t.depth >= maxDepth {
+		return errorf(tm.src, "templates nested too deeply")
+	}
+	t.depth++
+	saveVars := t.vars
+	t.vars = maps.Clone(t.globals)
+	err := t.bind(tm, params)
+	if err == nil {
+		err = t.seq(tm.body)
+	}
+	t.vars = saveVars
+	t.depth--
+	return err
+}
+
+func (t *transform) bind(tm *template, params map[xml.Name]any) error {
+	for _, p := range tm.params {
+		v, ok := params[p.name]
+		if !ok {
+			var err error
+			if v, err = t.value(p); err != nil {
+				return err
+			}
+		}
+		t.vars[p.name] = v
+	}
+	return nil
+}
+
+// apply processes each of nodes with the template rules of mode.
+func (t *transform) apply(nodes xpath.NodeSet, mode xml.Name, params map[xml.Name]any) error {
+	saveNode, savePos, saveSize, saveMode := t.node, t.pos, t.size, t.mode
+	defer func() { t.node, t.pos, t.size, t.mode = saveNode, savePos, saveSize, saveMode }()
+	t.mode = mode
+	for i, n := range nodes {
+		t.node, t.pos, t.size = n, i+1, len(nodes)
+		if err := t.applyRules(mode, math.MinInt, math.MaxInt, params); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyRules instantiates the best template rule of mode for the current node, amongst those with an
+// import precedence in [min, max), or the built-in rule if none match.
+func (t *transform) applyRules(mode xml.Name, min, max int, params map[xml.Name]any) error {
+	for _, r := range t.s.rules[mode] {
+		if r.t.prec < min || r.t.prec >= max {
+			continue
+		}
+		ok, err := t.matches(r.pat, r.ns, r.t.src, t.node)
+		if err != nil {
+			return err
+		}
+		if ok {
+			save := t.rule
+			t.rule = r.t
+			err := t.invoke(r.t, params)
+			t.rule = save
+			return err
+		}
+	}
+	return t.builtin(mode)
+}
+
+func (t *transform) builtin(mode xml.Name) error {
+	switch t.node.Type {
+	case xpath.RootNode, xpath.ElementNode:
+		v, err := childNodes.EvaluateContext(t.context(t.node))
+		if err != nil {
+			return err
+		}
+		save := t.rule
+		t.rule = nil
+		err = t.apply(v.(xpath.NodeSet), mode, nil)
+		t.rule = save
+		return err
+	case xpath.TextNode, xpath.AttributeNode:
+		t.text(t.node.Value())
+	}
+	return nil
+}
+
+// text adds text to the result.
+func (t *transform) text(s string) {
+	if s != "" {
+		t.out.AppendText(s)
+	}
+}
+
+// add adds a node to the result.
+func (t *transform) add(e *dom.Element) {
+	t.out.AppendChild(e)
+}
+
+// declare adds a namespace declaration to e, unless the prefix is already bound to uri.
+func declare(e *dom.Element, prefix, uri string) {
+	name := nsDecl(prefix, uri).Name
+	if _, ok := e.LookupAttrNS(name.Space, name.Local); ok {
+		return
+	}
+	if cur, _ := e.LookupNamespaceURI(prefix); cur == uri {
+		return
+	}
+	e.Attributes = append(e.Attributes, nsDecl(prefix, uri))
+}
+
+// declareAll adds declarations to e for the namespaces in scope at src.
+func declareAll(e, src *dom.Element) {
+	ns := src.InScopeNamespaces()
+	prefixes := make([]string, 0, len(ns))
+	for prefix := range ns {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		declare(e, prefix, ns[prefix])
+	}
+}
+
+// attribute adds an attribute to the element being created. Attributes added after its children, or
+// when there's no element, are ignored.
+func (t *transform) attribute(name xml.Name, prefix, value string) {
+	e := t.out
+	if e.Type != dom.Node || len(e.Children) > 0 {
+		return
+	}
+	if prefix != "" && name.Space != "" {
+		if _, ok := e.LookupAttrNS("xmlns", prefix); !ok {
+			declare(e, prefix, name.Space)
+		}
+	}
+	e.SetAttrNS(name.Space, name.Local, value)
+}
+
+// attrPrefix returns a non-empty prefix bound to uri in the scope of e, if there is one.
+func attrPrefix(e *dom.Element, uri string) string {
+	if uri == xmlURL {
+		return "xml"
+	}
+	for prefix, u := range e.InScopeNamespaces() {
+		if u == uri && prefix != "" {
+			return prefix
+		}
+	}
+	return ""
+}
+
+// useSets adds the attributes of the named attribute sets.
+func (t *transform) useSets(names []xml.Name, open map[xml.Name]bool) error {
+	for _, name := range names {
+		if open[name] {
+			return fmt.Errorf("attribute set %s uses itself", name.Local)
+		}
+		open[name] = true
+		for _, as := range t.s.attrSets[name] {
+			if err := t.useSets(as.uses, open); err != nil {
+				return wrap(as.src, err)
+			}
+			// Attribute sets are evaluated without local variables
+			saveVars := t.vars
+			t.vars = maps.Clone(t.globals)
+			err := t.seq(as.attrs)
+			t.vars = saveVars
+			if err != nil {
+				return err
+			}
+		}
+		delete(open, name)
+	}
+	return nil
+}
+
+// alias returns the result namespace for a stylesheet namespace.
+func (t *transform) alias(uri string) (string, string, bool) {
+	a, ok := t.s.aliases[uri]
+	return a.prefix, a.uri, ok
+}
+
+func (in *textInstr) exec(t *transform) error {
+	t.text(in.s)
+	return nil
+}
+
+func (in *literalElt) exec(t *transform) error {
+	space := in.name.Space
+	if _, uri, ok := t.alias(space); ok {
+		space = uri
+	}
+	e := dom.NewElementNS(space, in.name.Local)
+	t.add(e)
+	for _, d := range in.decls {
+		prefix := d.Name.Local
+		if d.Name.Space == "" {
+			prefix = ""
+		}
+		uri := d.Value
+		if p, u, ok := t.alias(uri); ok {
+			prefix, uri = p, u
+		}
+		declare(e, prefix, uri)
+	}
+
+	save := t.out
+	t.out = e
+	defer func() { t.out = save }()
+	if err := t.useSets(in.sets, make(map[xml.Name]bool)); err != nil {
+		return wrap(in.src, err)
+	}
+	for _, a := range in.attrs {
+		v, err := t.str(a.v, "")
+		if err != nil {
+			return err
+		}
+		name := a.name
+		if _, uri, ok := t.alias(name.Space); ok {
+			name.Space = uri
+		}
+		e.SetAttrNS(name.Space, name.Local, v)
+	}
+	return t.seq(in.body)
+}
+
+func (in *applyTemplates) exec(t *transform) error {
+	var nodes xpath.NodeSet
+	var err error
+	if in.sel == nil {
+		v, err := childNodes.EvaluateContext(t.context(t.node))
+		if err != nil {
+			return wrap(in.src, err)
+		}
+		nodes = v.(xpath.NodeSet)
+	} else if nodes, err = t.nodes(in.sel); err != nil {
+		return err
+	}
+	if nodes, err = t.sort(nodes, in.sorts); err != nil {
+		return err
+	}
+	params, err := t.withParams(in.params)
+	if err != nil {
+		return err
+	}
+	return t.apply(nodes, in.mode, params)
+}
+
+func (in *callTemplate) exec(t *transform) error {
+	params, err := t.withParams(in.params)
+	if err != nil {
+		return err
+	}
+	return t.invoke(t.s.named[in.name], params)
+}
+
+func (in *applyImports) exec(t *transform) error {
+	if t.rule == nil {
+		return errorf(in.src, "apply-imports used without a current template rule")
+	}
+	return t.applyRules(t.mode, t.rule.importMin, t.rule.prec, nil)
+}
+
+func (in *forEach) exec(t *transform) error {
+	nodes, err := t.nodes(in.sel)
+	if err != nil {
+		return err
+	}
+	if nodes, err = t.sort(nodes, in.sorts); err != nil {
+		return err
+	}
+	saveNode, savePos, saveSize, saveRule := t.node, t.pos, t.size, t.rule
+	defer func() { t.node, t.pos, t.size, t.rule = saveNode, savePos, saveSize, saveRule }()
+	t.rule = nil
+	for i, n := range nodes {
+		t.node, t.pos, t.size = n, i+1, len(nodes)
+		if err := t.seq(in.body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (in *valueOf) exec(t *transform) error {
+	v, err := t.eval(in.sel)
+	if err != nil {
+		return err
+	}
+	t.text(xpath.String(v))
+	return nil
+}
+
+func (in *copyOf) exec(t *transform) error {
+	v, err := t.eval(in.sel)
+	if err != nil {
+		return err
+	}
+	ns, ok := v.(xpath.NodeSet)
+	if !ok {
+		t.text(xpath.String(v))
+		return nil
+	}
+	for _, n := range ns {
+		t.copyNode(n)
+	}
+	return nil
+}
+
+// copyNode adds a deep copy of n to the result.
+func (t *transform) copyNode(n xpath.Node) {
+	switch n.Type {
+	case xpath.RootNode:
+		for _, k := range n.Element.Children {
+			if k.Type == dom.Directive || k.Type == dom.ProcInst && k.Name.Local == "xml" {
+				continue
+			}
+			t.copyNode(xpath.NewNode(k))
+		}
+		if n.Element.Type != dom.Document {
+			t.copyNode(xpath.NewNode(n.Element))
+		}
+	case xpath.ElementNode:
+		e := n.Element.Copy()
+		t.add(e)
+		// The copy keeps the namespaces in scope at the original
+		if p := n.Element.Parent; p != nil {
+			declareAll(e, p)
+		}
+	case xpath.AttributeNode:
+		attr := n.Element.Attributes[n.Index]
+		t.attribute(attr.Name, attrPrefix(n.Element, attr.Name.Space), attr.Value)
+	case xpath.NamespaceNode:
+		if t.out.Type == dom.Node && len(t.out.Children) == 0 && n.Prefix != "xml" {
+			declare(t.out, n.Prefix, n.Value())
+		}
+	case xpath.TextNode:
+		t.text(n.Value())
+	default:
+		t.add(n.Element.Copy())
+	}
+}
+
+func (in *copyInstr) exec(t *transform) error {
+	n := t.node
+	switch n.Type {
+	case xpath.ElementNode:
+		e := dom.NewElementNS(n.Element.Name.Space, n.Element.Name.Local)
+		t.add(e)
+		declareAll(e, n.Element)
+		save := t.out
+		t.out = e
+		defer func() { t.out = save }()
+		if err := t.useSets(in.sets, make(map[xml.Name]bool)); err != nil {
+			return err
+		}
+	case xpath.RootNode:
+	default:
+		t.copyNode(n)
+		return nil
+	}
+	return t.seq(in.body)
+}
+
+func (in *ifInstr) exec(t *transform) error {
+	v, err := t.eval(in.test)
+	if err != nil || !xpath.Boolean(v) {
+		return err
+	}
+	return t.seq(in.body)
+}
+
+func (in *choose) exec(t *transform) error {
+	for _, w := range in.whens {
+		v, err := t.eval(w.test)
+		if err != nil {
+			return err
+		}
+		if xpath.Boolean(v) {
+			return t.seq(w.body)
+		}
+	}
+	return t.seq(in.otherwise)
+}
+
+// name evaluates the name and namespace of an xsl:element or xsl:attribute, returning the prefix
+// given in the name.
+func (t *transform) name(src *dom.Element, name, ns *avt, def bool) (xml.Name, string, error) {
+	qn, err := t.str(name, "")
+	if err != nil {
+		return xml.Name{}, "", err
+	}
+	prefix, local, ok := strings.Cut(qn, ":")
+	if !ok {
+		prefix, local = "", qn
+	}
+	if !isNCName(local) || ok && !isNCName(prefix) {
+		return xml.Name{}, "", errorf(src, "invalid name %q", qn)
+	}
+	if ns != nil {
+		uri, err := t.str(ns, "")
+		if err != nil {
+			return xml.Name{}, "", err
+		}
+		return xml.Name{Space: uri, Local: local}, prefix, nil
+	}
+	res, err := qname(src, qn, def)
+	if err != nil {
+		return res, "", wrap(src, err)
+	}
+	return res, prefix, nil
+}
+
+func (in *elementInstr) exec(t *transform) error {
+	name, prefix, err := t.name(in.src, in.name, in.ns, true)
+	if err != nil {
+		return err
+	}
+	e := dom.NewElementNS(name.Space, name.Local)
+	t.add(e)
+	if name.Space != "" && name.Space != xmlURL {
+		declare(e, prefix, name.Space)
+	}
+	save := t.out
+	t.out = e
+	defer func() { t.out = save }()
+	if err := t.useSets(in.sets, make(map[xml.Name]bool)); err != nil {
+		return wrap(in.src, err)
+	}
+	return t.seq(in.body)
+}
+
+func (in *attributeInstr) exec(t *transform) error {
+	name, prefix, err := t.name(in.src, in.name, in.ns, false)
+	if err != nil {
+		return err
+	}
+	if name.Space == "" && name.Local == "xmlns" {
+		return errorf(in.src, "attribute can't be named xmlns")
+	}
+	v, err := t.content(in.body)
+	if err != nil {
+		return err
+	}
+	if prefix == "xmlns" {
+		prefix = ""
+	}
+	t.attribute(name, prefix, v)
+	return nil
+}
+
+func (in *commentInstr) exec(t *transform) error {
+	v, err := t.content(in.body)
+	if err != nil {
+		return err
+	}
+	v = strings.ReplaceAll(v, "--", "- -")
+	if strings.HasSuffix(v, "-") {
+		v += " "
+	}
+	t.add(dom.NewComment(v))
+	return nil
+}
+
+func (in *procInstInstr) exec(t *transform) error {
+	name, err := t.str(in.name, "")
+	if err != nil {
+		return err
+	}
+	name = strings.TrimSpace(name)
+	if !isNCName(name) || strings.EqualFold(name, "xml") {
+		return errorf(in.src, "invalid processing instruction name %q", name)
+	}
+	v, err := t.content(in.body)
+	if err != nil {
+		return err
+	}
+	t.add(dom.NewProcInst(name, strings.ReplaceAll(v, "?>", "? >")))
+	return nil
+}
+
+func (in *messageInstr) exec(t *transform) error {
+	frag, err := t.fragment(in.body)
+	if err != nil {
+		return err
+	}
+	msg := frag[0].Value()
+	if t.s.Messages != nil {
+		t.s.Messages(msg)
+	}
+	if in.terminate {
+		return errorf(in.src, "terminated by message: %s", msg)
+	}
+	return nil
+}
+
+func (in *block) exec(t *transform) error {
+	return t.seq(in.body)
+}
+
+func (in *unavailable) exec(t *transform) error {
+	return errorf(in.src, "%s isn't available and has no fallback", in.src.Name.Local)
+}
+
+// sortValue is a node and its sort keys.
+type sortValue struct {
+	n    xpath.Node
+	keys []any // string or float64
+}
+
+// sort orders nodes by the sort keys, leaving them unchanged if there are none.
+func (t *transform) sort(nodes xpath.NodeSet, keys []*sortKey) (xpath.NodeSet, error) {
+	if len(keys) == 0 || len(nodes) < 2 {
+		return nodes, nil
+	}
+	type spec struct {
+		number, descending, upperFirst bool
+	}
+	specs := make([]spec, len(keys))
+	for i, k := range keys {
+		dt, err := t.str(k.dataType, "text")
+		if err != nil {
+			return nil, err
+		}
+		order, err := t.str(k.order, "ascending")
+		if err != nil {
+			return nil, err
+		}
+		co, err := t.str(k.caseOrder, "upper-first")
+		if err != nil {
+			return nil, err
+		}
+		specs[i] = spec{dt == "number", order == "descending", co != "lower-first"}
+	}
+
+	vals := make([]sortValue, len(nodes))
+	saveNode, savePos, saveSize := t.node, t.pos, t.size
+	defer func() { t.node, t.pos, t.size = saveNode, savePos, saveSize }()
+	for i, n := range nodes {
+		vals[i] = sortValue{n, make([]any, len(keys))}
+		t.node, t.pos, t.size = n, i+1, len(nodes)
+		for j, k := range keys {
+			v, err := t.eval(k.sel)
+			if err != nil {
+				return nil, err
+			}
+			if specs[j].number {
+				vals[i].keys[j] = xpath.Number(v)
+			} else {
+				vals[i].keys[j] = xpath.String(v)
+			}
+		}
+	}
+
+	sort.SliceStable(vals, func(a, b int) bool {
+		for j, sp := range specs {
+			c := compareKeys(vals[a].keys[j], vals[b].keys[j], sp.upperFirst)
+			if sp.descending {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+	res := make(xpath.NodeSet, len(vals))
+	for i, v := range vals {
+		res[i] = v.n
+	}
+	return res, nil
+}
+
+// compareKeys compares sort keys, numbers with NaN first and strings ignoring case, unless they differ
+// only in case.
+func compareKeys(a, b any, upperFirst bool) int {
+	if x, ok := a.(float64); ok {
+		y := b.(float64)
+		switch {
+		case math.IsNaN(x) && math.IsNaN(y), x == y:
+			return 0
+		case math.IsNaN(x), x < y:
+			return -1
+		}
+		return 1
+	}
+	x, y := a.(string), b.(string)
+	if c := strings.Compare(strings.ToLower(x), strings.ToLower(y)); c != 0 {
+		return c
+	}
+	// Differing only in case, compare the first difference
+	rx, ry := []rune(x), []rune(y)
+	for i := range rx {
+		if rx[i] == ry[i] {
+			continue
+		}
+		upper := strings.ToUpper(string(rx[i])) == string(rx[i])
+		if upper == upperFirst {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+// stripping reports whether any elements have white space stripped.
+func (s *Stylesheet) stripping() bool {
+	for _, r := range s.spaces {
+		if r.strip {
+			return true
+		}
+	}
+	return false
+}
+
+// strip removes white space text nodes from the elements selected by xsl:strip-space, unless they're
+// within the scope of xml:space="preserve".
+func (s *Stylesheet) strip(e *dom.Element) {
+	var walk func(e *dom.Element, preserve bool)
+	walk = func(e *dom.Element, preserve bool) {
+		if v, ok := e.LookupAttrNS(xmlURL, "space"); ok {
+			preserve = v == "preserve"
+		}
+		strip := e.Type == dom.Node && !preserve && s.stripped(e.Name)
+		kids := e.Children[:0]
+		for _, k := range e.Children {
+			if strip && k.Type == dom.Content && strings.Trim(string(k.Content), " \t\r\n") == "" {
+				k.Parent = nil
+				continue
+			}
+			kids = append(kids, k)
+			walk(k, preserve)
+		}
+		for i := len(kids); i < len(e.Children); i++ {
+			e.Children[i] = nil
+		}
+		e.Children = kids
+	}
+	walk(e, false)
+}
+
+// stripped reports whether the element name has white space stripped.
+func (s *Stylesheet) stripped(name xml.Name) bool {
+	for _, r := range s.spaces {
+		switch {
+		case r.any, r.name.Local == "*" && r.name.Space == name.Space, r.name == name:
+			return r.strip
+		}
+	}
+	return false
+}
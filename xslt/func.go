@@ -0,0 +1,328 @@
+package xslt
+
+import (
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strings"
+
+	dom "github.com/jphsd/xml"
+	"github.com/jphsd/xml/xpath"
+)
+
+// instructions are the names of the XSLT instructions, for element-available().
+var instructions = map[string]bool{
+	"apply-imports": true, "apply-templates": true, "attribute": true, "call-template": true,
+	"choose": true, "comment": true, "copy": true, "copy-of": true, "element": true, "fallback": true,
+	"for-each": true, "if": true, "message": true, "number": true, "processing-instruction": true,
+	"text": true, "value-of": true, "variable": true,
+}
+
+// coreFunctions are the names of the XPath core functions, for function-available().
+var coreFunctions = map[string]bool{
+	"last": true, "position": true, "count": true, "id": true, "local-name": true, "namespace-uri": true,
+	"name": true, "string": true, "concat": true, "starts-with": true, "contains": true,
+	"substring-before": true, "substring-after": true, "substring": true, "string-length": true,
+	"normalize-space": true, "translate": true, "boolean": true, "not": true, "true": true, "false": true,
+	"lang": true, "number": true, "sum": true, "floor": true, "ceiling": true, "round": true,
+}
+
+// functions returns the XSLT additions to the core function library.
+func (t *transform) functions() map[xml.Name]xpath.Function {
+	fns := map[string]xpath.Function{
+		"current":             t.current,
+		"key":                 t.key,
+		"document":            t.document,
+		"format-number":       t.formatNumber,
+		"generate-id":         t.generateID,
+		"system-property":     t.systemProperty,
+		"element-available":   t.elementAvailable,
+		"function-available":  t.functionAvailable,
+		"unparsed-entity-uri": t.unparsedEntityURI,
+	}
+	res := make(map[xml.Name]xpath.Function, len(fns))
+	for name, f := range fns {
+		res[xml.Name{Local: name}] = f
+	}
+	return res
+}
+
+func arity(name string, args []any, min, max int) error {
+	if len(args) < min || len(args) > max {
+		return fmt.Errorf("wrong number of arguments to %s()", name)
+	}
+	return nil
+}
+
+// qname resolves a QName passed to a function with the namespaces in scope at the expression.
+func (t *transform) qname(v string) (xml.Name, error) {
+	v = strings.TrimSpace(v)
+	prefix, local, ok := strings.Cut(v, ":")
+	if !ok {
+		return xml.Name{Local: v}, nil
+	}
+	if prefix == "xml" {
+		return xml.Name{Space: xmlURL, Local: local}, nil
+	}
+	uri, bound := t.ns[prefix]
+	if !bound {
+		return xml.Name{}, fmt.Errorf("prefix %s isn't declared", prefix)
+	}
+	return xml.Name{Space: uri, Local: local}, nil
+}
+
+func (t *transform) current(ctx *xpath.Context, args []any) (any, error) {
+	if err := arity("current", args, 0, 0); err != nil {
+		return nil, err
+	}
+	return xpath.NodeSet{t.node}, nil
+}
+
+func (t *transform) key(ctx *xpath.Context, args []any) (any, error) {
+	if err := arity("key", args, 2, 2); err != nil {
+		return nil, err
+	}
+	name, err := t.qname(xpath.String(args[0]))
+	if err != nil {
+		return nil, err
+	}
+	root := xpath.Root(ctx.Node).Element
+	index, err := t.index(name, root)
+	if err != nil {
+		return nil, err
+	}
+
+	var vals []string
+	if ns, ok := args[1].(xpath.NodeSet); ok {
+		for _, n := range ns {
+			vals = append(vals, n.Value())
+		}
+	} else {
+		vals = []string{xpath.String(args[1])}
+	}
+	if len(vals) == 1 {
+		return index[vals[0]], nil
+	}
+	seen := make(map[xpath.Node]bool)
+	var res xpath.NodeSet
+	for _, v := range vals {
+		for _, n := range index[v] {
+			if !seen[n] {
+				seen[n] = true
+				res = append(res, n)
+			}
+		}
+	}
+	order := t.orders[root]
+	sort.Slice(res, func(i, j int) bool { return order[res[i]] < order[res[j]] })
+	return res, nil
+}
+
+// index returns the nodes of the tree at root by their values for the named key, building the index
+// on first use.
+func (t *transform) index(name xml.Name, root *dom.Element) (map[string]xpath.NodeSet, error) {
+	id := keyID{name, root}
+	if index, ok := t.keys[id]; ok {
+		return index, nil
+	}
+	keys, ok := t.s.keys[name]
+	if !ok {
+		return nil, fmt.Errorf("no key named %s", name.Local)
+	}
+
+	v, err := allNodes.EvaluateContext(&xpath.Context{Node: xpath.Root(xpath.NewNode(root))})
+	if err != nil {
+		return nil, err
+	}
+	nodes := v.(xpath.NodeSet)
+	if t.orders[root] == nil {
+		order := make(map[xpath.Node]int, len(nodes))
+		for i, n := range nodes {
+			order[n] = i
+		}
+		t.orders[root] = order
+	}
+
+	index := make(map[string]xpath.NodeSet)
+	add := func(v string, n xpath.Node) {
+		ns := index[v]
+		if len(ns) == 0 || ns[len(ns)-1] != n {
+			index[v] = append(ns, n)
+		}
+	}
+	saveNode, savePos, saveSize := t.node, t.pos, t.size
+	defer func() { t.node, t.pos, t.size = saveNode, savePos, saveSize }()
+	for _, n := range nodes {
+		for _, k := range keys {
+			ok, err := t.matches(k.match, k.use.ns, k.use.src, n)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+			t.node, t.pos, t.size = n, 1, 1
+			v, err := t.eval(k.use)
+			if err != nil {
+				return nil, err
+			}
+			if ns, ok := v.(xpath.NodeSet); ok {
+				for _, m := range ns {
+					add(m.Value(), n)
+				}
+			} else {
+				add(xpath.String(v), n)
+			}
+		}
+	}
+	t.keys[id] = index
+	return index, nil
+}
+
+func (t *transform) document(ctx *xpath.Context, args []any) (any, error) {
+	if err := arity("document", args, 1, 2); err != nil {
+		return nil, err
+	}
+	base, explicit := t.base, false
+	if len(args) == 2 {
+		ns, ok := args[1].(xpath.NodeSet)
+		if !ok {
+			return nil, fmt.Errorf("document() requires a node-set as its second argument")
+		}
+		if len(ns) == 0 {
+			return xpath.NodeSet{}, nil
+		}
+		base, explicit = t.bases[ns[0].Element.Root()], true
+	}
+
+	var res xpath.NodeSet
+	seen := make(map[*dom.Element]bool)
+	load := func(href, base string) error {
+		if i := strings.IndexByte(href, '#'); i >= 0 {
+			href = href[:i]
+		}
+		doc, err := t.load(dom.ResolveURI(base, href))
+		if err != nil {
+			return err
+		}
+		if !seen[doc] {
+			seen[doc] = true
+			res = append(res, xpath.Root(xpath.NewNode(doc)))
+		}
+		return nil
+	}
+	if ns, ok := args[0].(xpath.NodeSet); ok {
+		for _, n := range ns {
+			b := base
+			if !explicit {
+				// Relative to the document containing the node
+				b = t.bases[n.Element.Root()]
+			}
+			if err := load(n.Value(), b); err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	}
+	if err := load(xpath.String(args[0]), base); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// load returns the document at href, which may be a stylesheet.
+func (t *transform) load(href string) (*dom.Element, error) {
+	if doc, ok := t.s.docs[href]; ok {
+		return doc, nil
+	}
+	if doc, ok := t.docs[href]; ok {
+		return doc, nil
+	}
+	doc, err := t.s.read(href)
+	if err != nil {
+		return nil, err
+	}
+	if t.s.stripping() {
+		t.s.strip(doc)
+	}
+	t.docs[href] = doc
+	t.bases[doc] = href
+	return doc, nil
+}
+
+func (t *transform) generateID(ctx *xpath.Context, args []any) (any, error) {
+	if err := arity("generate-id", args, 0, 1); err != nil {
+		return nil, err
+	}
+	n := ctx.Node
+	if len(args) == 1 {
+		ns, ok := args[0].(xpath.NodeSet)
+		if !ok {
+			return nil, fmt.Errorf("generate-id() requires a node-set argument")
+		}
+		if len(ns) == 0 {
+			return "", nil
+		}
+		n = ns[0]
+	}
+	id, ok := t.ids[n]
+	if !ok {
+		id = fmt.Sprintf("id%d", len(t.ids)+1)
+		t.ids[n] = id
+	}
+	return id, nil
+}
+
+func (t *transform) systemProperty(ctx *xpath.Context, args []any) (any, error) {
+	if err := arity("system-property", args, 1, 1); err != nil {
+		return nil, err
+	}
+	name, err := t.qname(xpath.String(args[0]))
+	if err != nil || name.Space != NamespaceURL {
+		return "", err
+	}
+	switch name.Local {
+	case "version":
+		return 1.0, nil
+	case "vendor":
+		return "jphsd", nil
+	case "vendor-url":
+		return "https://github.com/jphsd/xml", nil
+	}
+	return "", nil
+}
+
+func (t *transform) elementAvailable(ctx *xpath.Context, args []any) (any, error) {
+	if err := arity("element-available", args, 1, 1); err != nil {
+		return nil, err
+	}
+	v := strings.TrimSpace(xpath.String(args[0]))
+	name, err := t.qname(v)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.Contains(v, ":") {
+		// Element names use the default namespace
+		name.Space = t.ns[""]
+	}
+	return name.Space == NamespaceURL && instructions[name.Local], nil
+}
+
+func (t *transform) functionAvailable(ctx *xpath.Context, args []any) (any, error) {
+	if err := arity("function-available", args, 1, 1); err != nil {
+		return nil, err
+	}
+	name, err := t.qname(xpath.String(args[0]))
+	if err != nil {
+		return nil, err
+	}
+	_, ok := t.funcs[name]
+	return ok || name.Space == "" && coreFunctions[name.Local], nil
+}
+
+func (t *transform) unparsedEntityURI(ctx *xpath.Context, args []any) (any, error) {
+	if err := arity("unparsed-entity-uri", args, 1, 1); err != nil {
+		return nil, err
+	}
+	return "", nil
+}
@@ -0,0 +1,497 @@
+package xslt
+
+import (
+	"encoding/xml"
+	"sort"
+	"strings"
+
+	dom "github.com/jphsd/xml"
+	"github.com/jphsd/xml/xpath"
+)
+
+// instr is a compiled instruction, which adds to the result tree when executed.
+type instr interface {
+	exec(t *transform) error
+}
+
+type (
+	textInstr struct {
+		s string
+	}
+	// literalElt is a literal result element.
+	literalElt struct {
+		src   *dom.Element
+		name  xml.Name
+		decls []xml.Attr // Namespace declarations copied to the result
+		attrs []literalAttr
+		sets  []xml.Name
+		body  []instr
+	}
+	literalAttr struct {
+		name xml.Name
+		v    *avt
+	}
+	applyTemplates struct {
+		src    *dom.Element
+		sel    *expr // Nil for all child nodes
+		mode   xml.Name
+		sorts  []*sortKey
+		params []*variable
+	}
+	callTemplate struct {
+		src    *dom.Element
+		name   xml.Name
+		params []*variable
+	}
+	applyImports struct {
+		src *dom.Element
+	}
+	forEach struct {
+		src   *dom.Element
+		sel   *expr
+		sorts []*sortKey
+		body  []instr
+	}
+	valueOf struct {
+		sel *expr
+	}
+	copyOf struct {
+		sel *expr
+	}
+	copyInstr struct {
+		sets []xml.Name
+		body []instr
+	}
+	ifInstr struct {
+		test *expr
+		body []instr
+	}
+	choose struct {
+		whens     []*ifInstr
+		otherwise []instr
+	}
+	elementInstr struct {
+		src      *dom.Element
+		name, ns *avt // ns is nil if the namespace attribute is absent
+		sets     []xml.Name
+		body     []instr
+	}
+	attributeInstr struct {
+		src      *dom.Element
+		name, ns *avt
+		body     []instr
+	}
+	commentInstr struct {
+		body []instr
+	}
+	procInstInstr struct {
+		src  *dom.Element
+		name *avt
+		body []instr
+	}
+	numberInstr struct {
+		src                         *dom.Element
+		level                       string
+		count, from                 *xpath.Pattern
+		value                       *expr
+		format, groupSep, groupSize *avt
+	}
+	messageInstr struct {
+		src       *dom.Element
+		terminate bool
+		body      []instr
+	}
+	// block is the fallback content of an unavailable instruction.
+	block struct {
+		body []instr
+	}
+	// unavailable is an instruction that raises an error if executed, allowed in forwards compatible mode.
+	unavailable struct {
+		src *dom.Element
+	}
+)
+
+type sortKey struct {
+	sel                              *expr
+	dataType, order, caseOrder, lang *avt
+}
+
+// body compiles the content of e.
+func (c *compiler) body(e *dom.Element, kids []*dom.Element) ([]instr, error) {
+	var res []instr
+	for _, k := range kids {
+		switch k.Type {
+		case dom.Content:
+			res = append(res, &textInstr{string(k.Content)})
+		case dom.Node:
+			if isXSL(k, "param") {
+				return nil, errorf(k, "param must come first in a template")
+			}
+			in, err := c.instruction(k)
+			if err != nil {
+				return nil, err
+			}
+			if in != nil {
+				res = append(res, in)
+			}
+		}
+	}
+	return res, nil
+}
+
+func (c *compiler) instruction(e *dom.Element) (instr, error) {
+	if e.Name.Space != NamespaceURL {
+		if namespaces(e, "extension-element-prefixes")[e.Name.Space] {
+			return c.fallback(e)
+		}
+		return c.literal(e)
+	}
+
+	var err error
+	switch e.Name.Local {
+	case "apply-templates":
+		in := &applyTemplates{src: e}
+		if in.sel, err = c.expr(e, "select", false); err != nil {
+			return nil, err
+		}
+		if in.mode, err = attrQName(e, "mode"); err != nil {
+			return nil, err
+		}
+		for _, k := range children(e) {
+			switch {
+			case isXSL(k, "sort"):
+				sk, err := c.sortKey(k)
+				if err != nil {
+					return nil, err
+				}
+				in.sorts = append(in.sorts, sk)
+			case isXSL(k, "with-param"):
+				if in.params, err = c.withParam(k, in.params); err != nil {
+					return nil, err
+				}
+			default:
+				return nil, errorf(k, "%s isn't allowed in apply-templates", k.Name.Local)
+			}
+		}
+		return in, nil
+	case "call-template":
+		in := &callTemplate{src: e}
+		if in.name, err = attrQName(e, "name"); err != nil {
+			return nil, err
+		}
+		if in.name.Local == "" {
+			return nil, errorf(e, "call-template has no name")
+		}
+		c.calls = append(c.calls, reference{e, in.name})
+		for _, k := range children(e) {
+			if !isXSL(k, "with-param") {
+				return nil, errorf(k, "%s isn't allowed in call-template", k.Name.Local)
+			}
+			if in.params, err = c.withParam(k, in.params); err != nil {
+				return nil, err
+			}
+		}
+		return in, nil
+	case "apply-imports":
+		return &applyImports{e}, nil
+	case "for-each":
+		in := &forEach{src: e}
+		if in.sel, err = c.expr(e, "select", true); err != nil {
+			return nil, err
+		}
+		kids := children(e)
+		for len(kids) > 0 && isXSL(kids[0], "sort") {
+			sk, err := c.sortKey(kids[0])
+			if err != nil {
+				return nil, err
+			}
+			in.sorts = append(in.sorts, sk)
+			kids = kids[1:]
+		}
+		if in.body, err = c.body(e, kids); err != nil {
+			return nil, err
+		}
+		return in, nil
+	case "value-of":
+		in := &valueOf{}
+		if in.sel, err = c.expr(e, "select", true); err != nil {
+			return nil, err
+		}
+		return in, nil
+	case "copy-of":
+		in := &copyOf{}
+		if in.sel, err = c.expr(e, "select", true); err != nil {
+			return nil, err
+		}
+		return in, nil
+	case "copy":
+		in := &copyInstr{}
+		if in.sets, err = c.useSets(e, "use-attribute-sets"); err != nil {
+			return nil, err
+		}
+		if in.body, err = c.body(e, children(e)); err != nil {
+			return nil, err
+		}
+		return in, nil
+	case "if":
+		return c.conditional(e)
+	case "choose":
+		in := &choose{}
+		for _, k := range children(e) {
+			switch {
+			case isXSL(k, "when") && in.otherwise == nil:
+				w, err := c.conditional(k)
+				if err != nil {
+					return nil, err
+				}
+				in.whens = append(in.whens, w)
+			case isXSL(k, "otherwise") && in.otherwise == nil && len(in.whens) > 0:
+				if in.otherwise, err = c.body(k, children(k)); err != nil {
+					return nil, err
+				}
+				if in.otherwise == nil {
+					in.otherwise = []instr{}
+				}
+			default:
+				return nil, errorf(k, "%s isn't allowed here in choose", k.Name.Local)
+			}
+		}
+		if len(in.whens) == 0 {
+			return nil, errorf(e, "choose has no when")
+		}
+		return in, nil
+	case "variable":
+		return c.variable(e)
+	case "element", "attribute":
+		name, err := c.avt(e, "name")
+		if err != nil {
+			return nil, err
+		}
+		if name == nil {
+			return nil, errorf(e, "%s has no name", e.Name.Local)
+		}
+		ns, err := c.avt(e, "namespace")
+		if err != nil {
+			return nil, err
+		}
+		body, err := c.body(e, children(e))
+		if err != nil {
+			return nil, err
+		}
+		if e.Name.Local == "attribute" {
+			return &attributeInstr{e, name, ns, body}, nil
+		}
+		sets, err := c.useSets(e, "use-attribute-sets")
+		if err != nil {
+			return nil, err
+		}
+		return &elementInstr{e, name, ns, sets, body}, nil
+	case "text":
+		var sb strings.Builder
+		for _, k := range e.Children {
+			switch k.Type {
+			case dom.Content:
+				sb.Write(k.Content)
+			case dom.Node:
+				return nil, errorf(k, "text can't contain elements")
+			}
+		}
+		return &textInstr{sb.String()}, nil
+	case "comment":
+		body, err := c.body(e, children(e))
+		if err != nil {
+			return nil, err
+		}
+		return &commentInstr{body}, nil
+	case "processing-instruction":
+		in := &procInstInstr{src: e}
+		if in.name, err = c.avt(e, "name"); err != nil {
+			return nil, err
+		}
+		if in.name == nil {
+			return nil, errorf(e, "processing-instruction has no name")
+		}
+		if in.body, err = c.body(e, children(e)); err != nil {
+			return nil, err
+		}
+		return in, nil
+	case "number":
+		return c.number(e)
+	case "message":
+		in := &messageInstr{src: e, terminate: strings.TrimSpace(e.Attr("terminate")) == "yes"}
+		if in.body, err = c.body(e, children(e)); err != nil {
+			return nil, err
+		}
+		return in, nil
+	case "fallback":
+		return nil, nil
+	}
+	if forwards(e) {
+		return c.fallback(e)
+	}
+	return nil, errorf(e, "unknown instruction %s", e.Name.Local)
+}
+
+// fallback compiles the xsl:fallback content of an unavailable instruction.
+func (c *compiler) fallback(e *dom.Element) (instr, error) {
+	found := false
+	var body []instr
+	for _, k := range children(e) {
+		if isXSL(k, "fallback") {
+			found = true
+			b, err := c.body(k, children(k))
+			if err != nil {
+				return nil, err
+			}
+			body = append(body, b...)
+		}
+	}
+	if !found {
+		return &unavailable{e}, nil
+	}
+	return &block{body}, nil
+}
+
+// namespaces returns the namespaces listed in the attribute attr, such as exclude-result-prefixes, of
+// e and its ancestors, along with the XSLT namespace.
+func namespaces(e *dom.Element, attr string) map[string]bool {
+	res := map[string]bool{NamespaceURL: true}
+	for a := e; a != nil && a.Type == dom.Node; a = a.Parent {
+		var v string
+		switch {
+		case isXSL(a, "stylesheet"), isXSL(a, "transform"):
+			v = a.Attr(attr)
+		case a.Name.Space != NamespaceURL:
+			v = a.AttrNS(NamespaceURL, attr)
+		}
+		for _, prefix := range strings.Fields(v) {
+			if prefix == "#default" {
+				prefix = ""
+			}
+			if uri, ok := a.LookupNamespaceURI(prefix); ok {
+				res[uri] = true
+			}
+		}
+	}
+	return res
+}
+
+// literal compiles a literal result element.
+func (c *compiler) literal(e *dom.Element) (instr, error) {
+	in := &literalElt{src: e, name: e.Name}
+	excluded := namespaces(e, "exclude-result-prefixes")
+	for uri := range namespaces(e, "extension-element-prefixes") {
+		excluded[uri] = true
+	}
+	for prefix, uri := range e.InScopeNamespaces() {
+		if !excluded[uri] {
+			in.decls = append(in.decls, nsDecl(prefix, uri))
+		}
+	}
+	sort.Slice(in.decls, func(i, j int) bool { return in.decls[i].Name.Local < in.decls[j].Name.Local })
+
+	var err error
+	for _, attr := range e.Attributes {
+		if dom.IsNamespaceDecl(attr.Name) || attr.Name.Space == NamespaceURL {
+			continue
+		}
+		v, err := c.compileAVT(e, attr.Value)
+		if err != nil {
+			return nil, err
+		}
+		in.attrs = append(in.attrs, literalAttr{attr.Name, v})
+	}
+	if in.sets, err = c.useSets(e, "use-attribute-sets"); err != nil {
+		return nil, err
+	}
+	if in.body, err = c.body(e, children(e)); err != nil {
+		return nil, err
+	}
+	return in, nil
+}
+
+// nsDecl returns the attribute declaring the prefix, the empty prefix being the default namespace.
+func nsDecl(prefix, uri string) xml.Attr {
+	if prefix == "" {
+		return xml.Attr{Name: xml.Name{Local: "xmlns"}, Value: uri}
+	}
+	return xml.Attr{Name: xml.Name{Space: "xmlns", Local: prefix}, Value: uri}
+}
+
+func (c *compiler) conditional(e *dom.Element) (*ifInstr, error) {
+	in := &ifInstr{}
+	var err error
+	if in.test, err = c.expr(e, "test", true); err != nil {
+		return nil, err
+	}
+	if in.body, err = c.body(e, children(e)); err != nil {
+		return nil, err
+	}
+	return in, nil
+}
+
+// withParam adds the xsl:with-param e to params.
+func (c *compiler) withParam(e *dom.Element, params []*variable) ([]*variable, error) {
+	p, err := c.variable(e)
+	if err != nil {
+		return nil, err
+	}
+	for _, q := range params {
+		if q.name == p.name {
+			return nil, errorf(e, "duplicate parameter %s", p.name.Local)
+		}
+	}
+	return append(params, p), nil
+}
+
+func (c *compiler) sortKey(e *dom.Element) (*sortKey, error) {
+	sk := &sortKey{}
+	var err error
+	if sk.sel, err = c.expr(e, "select", false); err != nil {
+		return nil, err
+	}
+	if sk.sel == nil {
+		if sk.sel, err = c.compileExpr(e, "."); err != nil {
+			return nil, err
+		}
+	}
+	for _, a := range []struct {
+		attr string
+		p    **avt
+	}{{"data-type", &sk.dataType}, {"order", &sk.order}, {"case-order", &sk.caseOrder}, {"lang", &sk.lang}} {
+		if *a.p, err = c.avt(e, a.attr); err != nil {
+			return nil, err
+		}
+	}
+	return sk, nil
+}
+
+func (c *compiler) number(e *dom.Element) (instr, error) {
+	in := &numberInstr{src: e, level: "single"}
+	if v, ok := e.LookupAttr("level"); ok {
+		in.level = strings.TrimSpace(v)
+		if in.level != "single" && in.level != "multiple" && in.level != "any" {
+			return nil, errorf(e, "invalid level %q", v)
+		}
+	}
+	var err error
+	if in.count, err = c.pattern(e, "count", false); err != nil {
+		return nil, err
+	}
+	if in.from, err = c.pattern(e, "from", false); err != nil {
+		return nil, err
+	}
+	if in.value, err = c.expr(e, "value", false); err != nil {
+		return nil, err
+	}
+	if in.format, err = c.avt(e, "format"); err != nil {
+		return nil, err
+	}
+	if in.groupSep, err = c.avt(e, "grouping-separator"); err != nil {
+		return nil, err
+	}
+	if in.groupSize, err = c.avt(e, "grouping-size"); err != nil {
+		return nil, err
+	}
+	return in, nil
+}
@@ -0,0 +1,424 @@
+package xslt
+
+import (
+	"encoding/xml"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/jphsd/xml/xpath"
+)
+
+var (
+	ancestors       = xpath.MustCompile("ancestor-or-self::node()")
+	precedingSibs   = xpath.MustCompile("preceding-sibling::node()")
+	precedingOrSelf = xpath.MustCompile("preceding::node() | ancestor-or-self::node()")
+)
+
+func (in *numberInstr) exec(t *transform) error {
+	var nums []int
+	if in.value != nil {
+		v, err := t.eval(in.value)
+		if err != nil {
+			return err
+		}
+		f := xpath.Number(v)
+		if math.IsNaN(f) || math.IsInf(f, 0) || f < 0.5 {
+			t.text(xpath.String(f))
+			return nil
+		}
+		nums = []int{int(math.Floor(f + 0.5))}
+	} else {
+		var err error
+		if nums, err = t.count(in); err != nil {
+			return err
+		}
+	}
+
+	format, err := t.str(in.format, "1")
+	if err != nil {
+		return err
+	}
+	sep, err := t.str(in.groupSep, "")
+	if err != nil {
+		return err
+	}
+	size, err := t.str(in.groupSize, "")
+	if err != nil {
+		return err
+	}
+	group, _ := strconv.Atoi(strings.TrimSpace(size))
+	if sep == "" {
+		group = 0
+	}
+	t.text(formatList(nums, format, sep, group))
+	return nil
+}
+
+// count returns the numbers of the current node given by the level, count and from attributes.
+func (t *transform) count(in *numberInstr) ([]int, error) {
+	cur := t.node
+	ns := in.src.InScopeNamespaces()
+	match := func(p *xpath.Pattern, n xpath.Node) (bool, error) {
+		if p == nil {
+			return false, nil
+		}
+		return t.matches(p, ns, in.src, n)
+	}
+	counted := func(n xpath.Node) (bool, error) {
+		if in.count == nil {
+			return n.Type == cur.Type && n.Name() == cur.Name(), nil
+		}
+		return match(in.count, n)
+	}
+	axis := func(x *xpath.Expr, n xpath.Node) (xpath.NodeSet, error) {
+		v, err := x.EvaluateContext(&xpath.Context{Node: n})
+		if err != nil {
+			return nil, err
+		}
+		return v.(xpath.NodeSet), nil
+	}
+	// position returns 1 more than the number of counted preceding siblings of n
+	position := func(n xpath.Node) (int, error) {
+		sibs, err := axis(precedingSibs, n)
+		if err != nil {
+			return 0, err
+		}
+		res := 1
+		for _, s := range sibs {
+			ok, err := counted(s)
+			if err != nil {
+				return 0, err
+			}
+			if ok {
+				res++
+			}
+		}
+		return res, nil
+	}
+
+	if in.level == "any" {
+		nodes, err := axis(precedingOrSelf, cur)
+		if err != nil {
+			return nil, err
+		}
+		n := 0
+		for i := len(nodes) - 1; i >= 0; i-- {
+			if ok, err := match(in.from, nodes[i]); err != nil {
+				return nil, err
+			} else if ok {
+				break
+			}
+			ok, err := counted(nodes[i])
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				n++
+			}
+		}
+		if n == 0 {
+			return nil, nil
+		}
+		return []int{n}, nil
+	}
+
+	nodes, err := axis(ancestors, cur)
+	if err != nil {
+		return nil, err
+	}
+	var res []int
+	for i := len(nodes) - 1; i >= 0; i-- {
+		ok, err := counted(nodes[i])
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			p, err := position(nodes[i])
+			if err != nil {
+				return nil, err
+			}
+			res = append([]int{p}, res...)
+			if in.level == "single" {
+				break
+			}
+		}
+		if ok, err := match(in.from, nodes[i]); err != nil {
+			return nil, err
+		} else if ok {
+			break
+		}
+	}
+	return res, nil
+}
+
+// formatList formats a list of numbers with an xsl:number format string, made up of alphanumeric
+// tokens separated by other characters.
+func formatList(nums []int, format, sep string, group int) string {
+	var toks, seps []string
+	prefix, suffix := "", ""
+	rs := []rune(format)
+	alnum := func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }
+	i := 0
+	for i < len(rs) && !alnum(rs[i]) {
+		i++
+	}
+	prefix = string(rs[:i])
+	for i < len(rs) {
+		j := i
+		for j < len(rs) && alnum(rs[j]) {
+			j++
+		}
+		toks = append(toks, string(rs[i:j]))
+		k := j
+		for k < len(rs) && !alnum(rs[k]) {
+			k++
+		}
+		if k == len(rs) {
+			suffix = string(rs[j:k])
+		} else {
+			seps = append(seps, string(rs[j:k]))
+		}
+		i = k
+	}
+	if len(toks) == 0 {
+		toks = []string{"1"}
+	}
+
+	var sb strings.Builder
+	sb.WriteString(prefix)
+	for i, n := range nums {
+		if i > 0 {
+			switch {
+			case len(seps) == 0:
+				sb.WriteString(".")
+			case i-1 < len(seps):
+				sb.WriteString(seps[i-1])
+			default:
+				sb.WriteString(seps[len(seps)-1])
+			}
+		}
+		sb.WriteString(formatToken(n, toks[min(i, len(toks)-1)], sep, group))
+	}
+	sb.WriteString(suffix)
+	return sb.String()
+}
+
+// formatToken formats a number with a single format token.
+func formatToken(n int, tok, sep string, group int) string {
+	switch tok {
+	case "A", "a":
+		if n > 0 {
+			return alphabetic(n, rune(tok[0]))
+		}
+	case "I", "i":
+		if n > 0 && n < 4000 {
+			s := roman(n)
+			if tok == "i" {
+				s = strings.ToLower(s)
+			}
+			return s
+		}
+	}
+
+	// Decimal, with the width and digits of the token if it's a run of zeros ending in one
+	rs := []rune(tok)
+	zero, width := '0', 1
+	if last := rs[len(rs)-1]; unicode.IsDigit(last) && unicode.IsDigit(last-1) {
+		zero = last - 1
+		width = len(rs)
+		for _, r := range rs[:len(rs)-1] {
+			if r != zero {
+				zero, width = '0', 1
+				break
+			}
+		}
+	}
+	digits := []rune(strconv.Itoa(n))
+	for len(digits) < width {
+		digits = append([]rune{'0'}, digits...)
+	}
+	var sb strings.Builder
+	for i, d := range digits {
+		if group > 0 && i > 0 && (len(digits)-i)%group == 0 {
+			sb.WriteString(sep)
+		}
+		sb.WriteRune(zero + d - '0')
+	}
+	return sb.String()
+}
+
+// alphabetic returns the letter sequence for n: a, b, ... z, aa, ab and so on.
+func alphabetic(n int, a rune) string {
+	var rs []rune
+	for n > 0 {
+		n--
+		rs = append([]rune{a + rune(n%26)}, rs...)
+		n /= 26
+	}
+	return string(rs)
+}
+
+func roman(n int) string {
+	vals := []int{1000, 900, 500, 400, 100, 90, 50, 40, 10, 9, 5, 4, 1}
+	syms := []string{"M", "CM", "D", "CD", "C", "XC", "L", "XL", "X", "IX", "V", "IV", "I"}
+	var sb strings.Builder
+	for i, v := range vals {
+		for n >= v {
+			sb.WriteString(syms[i])
+			n -= v
+		}
+	}
+	return sb.String()
+}
+
+func (t *transform) formatNumber(ctx *xpath.Context, args []any) (any, error) {
+	if err := arity("format-number", args, 2, 3); err != nil {
+		return nil, err
+	}
+	df := &defaultFormat
+	if len(args) == 3 {
+		name, err := t.qname(xpath.String(args[2]))
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if df, ok = t.s.formats[name]; !ok {
+			return nil, fmt.Errorf("no decimal-format named %s", name.Local)
+		}
+	} else if f, ok := t.s.formats[xml.Name{}]; ok {
+		df = f
+	}
+	return df.format(xpath.Number(args[0]), xpath.String(args[1]))
+}
+
+// subPattern is the positive or negative part of a format-number pattern.
+type subPattern struct {
+	prefix, suffix   string
+	minInt, group    int
+	minFrac, maxFrac int
+	scale            float64
+}
+
+// parse parses one part of a format-number pattern.
+func (df *decimalFormat) parse(p string) (subPattern, error) {
+	sp := subPattern{scale: 1}
+	rs := []rune(p)
+	active := func(r rune) bool {
+		return r == df.digit || r == df.zero || r == df.decimalSep || r == df.groupingSep
+	}
+	i := 0
+	for i < len(rs) && !active(rs[i]) {
+		i++
+	}
+	sp.prefix = string(rs[:i])
+	j := i
+	for j < len(rs) && active(rs[j]) {
+		j++
+	}
+	sp.suffix = string(rs[j:])
+	if i == j {
+		return sp, fmt.Errorf("format-number pattern %q has no digits", p)
+	}
+
+	intPart, fracPart, dot := strings.Cut(string(rs[i:j]), string(df.decimalSep))
+	if dot && strings.ContainsRune(fracPart, df.decimalSep) {
+		return sp, fmt.Errorf("format-number pattern %q has more than one decimal separator", p)
+	}
+	lastGroup := -1
+	for k, r := range []rune(intPart) {
+		switch r {
+		case df.zero:
+			sp.minInt++
+		case df.groupingSep:
+			lastGroup = k
+		}
+	}
+	if lastGroup >= 0 {
+		sp.group = len([]rune(intPart)) - lastGroup - 1
+	}
+	for _, r := range fracPart {
+		switch r {
+		case df.zero:
+			sp.minFrac++
+			sp.maxFrac++
+		case df.digit:
+			sp.maxFrac++
+		default:
+			return sp, fmt.Errorf("format-number pattern %q has an invalid fraction", p)
+		}
+	}
+	for _, s := range []string{sp.prefix, sp.suffix} {
+		switch {
+		case strings.ContainsRune(s, df.percent):
+			sp.scale = 100
+		case strings.ContainsRune(s, df.perMille):
+			sp.scale = 1000
+		}
+	}
+	return sp, nil
+}
+
+// format formats f with a format-number pattern.
+func (df *decimalFormat) format(f float64, pattern string) (string, error) {
+	pos, neg, hasNeg := strings.Cut(pattern, string(df.patternSep))
+	p, err := df.parse(pos)
+	if err != nil {
+		return "", err
+	}
+	if math.IsNaN(f) {
+		return df.nan, nil
+	}
+	prefix, suffix := p.prefix, p.suffix
+	if f < 0 || f == 0 && math.Signbit(f) {
+		if hasNeg {
+			n, err := df.parse(neg)
+			if err != nil {
+				return "", err
+			}
+			prefix, suffix = n.prefix, n.suffix
+		} else {
+			prefix = df.minus + prefix
+		}
+		f = -f
+	}
+	if math.IsInf(f, 0) {
+		return prefix + df.infinity + suffix, nil
+	}
+
+	s := strconv.FormatFloat(f*p.scale, 'f', p.maxFrac, 64)
+	intDigits, fracDigits, _ := strings.Cut(s, ".")
+	for len(fracDigits) > p.minFrac && strings.HasSuffix(fracDigits, "0") {
+		fracDigits = fracDigits[:len(fracDigits)-1]
+	}
+	intDigits = strings.TrimLeft(intDigits, "0")
+	for len(intDigits) < p.minInt {
+		intDigits = "0" + intDigits
+	}
+	if intDigits == "" && fracDigits == "" {
+		intDigits = "0"
+	}
+	if strings.Trim(intDigits+fracDigits, "0") == "" && prefix != p.prefix && !hasNeg {
+		// Rounded to zero, without a sign
+		prefix = p.prefix
+	}
+
+	var sb strings.Builder
+	sb.WriteString(prefix)
+	for i, d := range intDigits {
+		if p.group > 0 && i > 0 && (len(intDigits)-i)%p.group == 0 {
+			sb.WriteRune(df.groupingSep)
+		}
+		sb.WriteRune(df.zero + d - '0')
+	}
+	if fracDigits != "" {
+		sb.WriteRune(df.decimalSep)
+		for _, d := range fracDigits {
+			sb.WriteRune(df.zero + d - '0')
+		}
+	}
+	sb.WriteString(suffix)
+	return sb.String(), nil
+}
@@ -0,0 +1,249 @@
+package xslt
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	dom "github.com/jphsd/xml"
+)
+
+// voidElements are the HTML elements written without an end tag.
+var voidElements = map[string]bool{
+	"area": true, "base": true, "basefont": true, "br": true, "col": true, "frame": true, "hr": true,
+	"img": true, "input": true, "isindex": true, "link": true, "meta": true, "param": true,
+}
+
+// Write serializes a result Document produced by Transform according to the stylesheet's xsl:output
+// settings, in any encoding supported by CharsetWriter of the xml package. Without a method, the html
+// method is used if the document element is an html element in no namespace and xml otherwise.
+func (s *Stylesheet) Write(w io.Writer, res *dom.Element) error {
+	o := s.Output
+	encoding := "UTF-8"
+	if o.Encoding != "" && !strings.EqualFold(o.Encoding, encoding) {
+		cw, err := dom.CharsetWriter(o.Encoding, w)
+		if err != nil {
+			return err
+		}
+		if err := s.write(cw, res, o.Encoding); err != nil {
+			return err
+		}
+		return cw.Close()
+	}
+	return s.write(w, res, encoding)
+}
+
+// write serializes the result as UTF-8, declaring it to be in the encoding and writing the characters
+// that the encoding can't represent as character references where they can be.
+func (s *Stylesheet) write(w io.Writer, res *dom.Element, encoding string) error {
+	o := s.Output
+	encodable, err := dom.CharsetEncodable(encoding)
+	if err != nil {
+		return err
+	}
+	hw := &htmlWriter{bufio.NewWriter(w), encodable, encoding}
+	method := o.Method
+	if method == "" {
+		method = "xml"
+		if de := res.DocumentElement(); de != nil && de.Name.Space == "" && strings.EqualFold(de.Name.Local, "html") {
+			method = "html"
+		}
+	}
+
+	bw := hw.w
+	switch method {
+	case "text":
+		bw.WriteString(res.Text())
+	case "html":
+		if o.DoctypePublic != "" || o.DoctypeSystem != "" {
+			bw.WriteString("<!DOCTYPE html")
+			writeExternalID(bw, o.DoctypePublic, o.DoctypeSystem)
+			bw.WriteString(">\n")
+		}
+		for _, k := range res.Children {
+			if err := hw.write(k); err != nil {
+				return err
+			}
+		}
+	case "xml":
+		if !o.OmitXMLDeclaration {
+			version := o.Version
+			if version == "" {
+				version = "1.0"
+			}
+			fmt.Fprintf(bw, `<?xml version="%s" encoding="%s"`, version, encoding)
+			if o.Standalone != "" {
+				fmt.Fprintf(bw, ` standalone="%s"`, o.Standalone)
+			}
+			bw.WriteString("?>\n")
+		}
+		de := res.DocumentElement()
+		if o.DoctypeSystem != "" && de != nil {
+			bw.WriteString("<!DOCTYPE " + qualifiedName(de))
+			writeExternalID(bw, o.DoctypePublic, o.DoctypeSystem)
+			bw.WriteString(">\n")
+		}
+		opts := &dom.EncodeOptions{Encoding: encoding, NoConvert: true}
+		if o.Indent {
+			opts.Indent = "  "
+		}
+		if len(o.CDATASectionElements) > 0 {
+			res = res.Copy()
+			cdataSections(res, o.CDATASectionElements)
+		}
+		for _, k := range res.Children {
+			if err := k.Encode(bw, opts); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("xslt: unsupported output method %s", method)
+	}
+	return bw.Flush()
+}
+
+// cdataSections marks the text children of the named elements within e to be written as CDATA sections.
+func cdataSections(e *dom.Element, names []xml.Name) {
+	cdata := slices.Contains(names, e.Name)
+	for _, k := range e.Children {
+		switch {
+		case k.Type == dom.Content:
+			k.CDATA = k.CDATA || cdata
+		case k.Type == dom.Node:
+			cdataSections(k, names)
+		}
+	}
+}
+
+func writeExternalID(w *bufio.Writer, public, system string) {
+	switch {
+	case public != "":
+		fmt.Fprintf(w, ` PUBLIC "%s"`, public)
+		if system != "" {
+			fmt.Fprintf(w, ` "%s"`, system)
+		}
+	case system != "":
+		fmt.Fprintf(w, ` SYSTEM "%s"`, system)
+	}
+}
+
+// qualifiedName returns the name of e with the prefix bound to its namespace, if any.
+func qualifiedName(e *dom.Element) string {
+	if prefix, ok := e.LookupPrefix(e.Name.Space); ok && prefix != "" {
+		return prefix + ":" + e.Name.Local
+	}
+	return e.Name.Local
+}
+
+// htmlWriter writes elements using HTML syntax for an output encoding.
+type htmlWriter struct {
+	w         *bufio.Writer
+	encodable func(rune) bool // Reports whether the output encoding can represent a character
+	encoding  string
+}
+
+// write writes e using HTML syntax, elements in a namespace being written as XML.
+func (hw *htmlWriter) write(e *dom.Element) error {
+	w := hw.w
+	switch e.Type {
+	case dom.Content:
+		hw.writeEscaped(string(e.Content), false)
+	case dom.Comment:
+		if err := hw.check(string(e.Content), "comment"); err != nil {
+			return err
+		}
+		w.WriteString("<!--")
+		w.Write(e.Content)
+		w.WriteString("-->")
+	case dom.ProcInst:
+		if err := hw.check(e.Name.Local+" "+string(e.Content), "processing instruction"); err != nil {
+			return err
+		}
+		w.WriteString("<?" + e.Name.Local)
+		if len(e.Content) > 0 {
+			w.WriteByte(' ')
+			w.Write(e.Content)
+		}
+		w.WriteByte('>')
+	case dom.Node:
+		if e.Name.Space != "" {
+			return e.Encode(w, &dom.EncodeOptions{Encoding: hw.encoding, NoConvert: true})
+		}
+		if err := hw.check(e.Name.Local, "element name"); err != nil {
+			return err
+		}
+		w.WriteString("<" + e.Name.Local)
+		for _, attr := range e.Attributes {
+			if dom.IsNamespaceDecl(attr.Name) {
+				continue
+			}
+			name := attr.Name.Local
+			if prefix := attrPrefix(e, attr.Name.Space); prefix != "" {
+				name = prefix + ":" + name
+			}
+			if err := hw.check(name, "attribute name"); err != nil {
+				return err
+			}
+			w.WriteString(" " + name + `="`)
+			hw.writeEscaped(attr.Value, true)
+			w.WriteByte('"')
+		}
+		w.WriteByte('>')
+		local := strings.ToLower(e.Name.Local)
+		if voidElements[local] {
+			return nil
+		}
+		raw := local == "script" || local == "style"
+		for _, k := range e.Children {
+			if raw && k.Type == dom.Content {
+				if err := hw.check(string(k.Content), local+" content"); err != nil {
+					return err
+				}
+				w.Write(k.Content)
+				continue
+			}
+			if err := hw.write(k); err != nil {
+				return err
+			}
+		}
+		w.WriteString("</" + e.Name.Local + ">")
+	}
+	return nil
+}
+
+// check returns an error if s holds a character that the output encoding can't represent, where a
+// character reference can't be used instead.
+func (hw *htmlWriter) check(s, what string) error {
+	for _, r := range s {
+		if !hw.encodable(r) {
+			return fmt.Errorf("xslt: character %U in %s can't be written in %s", r, what, hw.encoding)
+		}
+	}
+	return nil
+}
+
+// writeEscaped writes text with the characters that would be mistaken for markup escaped, and those
+// that the output encoding can't represent as character references. In attribute values < isn't
+// escaped, but quotes are.
+func (hw *htmlWriter) writeEscaped(s string, attr bool) {
+	w := hw.w
+	for _, r := range s {
+		switch {
+		case r == '&':
+			w.WriteString("&amp;")
+		case r == '<' && !attr:
+			w.WriteString("&lt;")
+		case r == '>' && !attr:
+			w.WriteString("&gt;")
+		case r == '"' && attr:
+			w.WriteString("&quot;")
+		case !hw.encodable(r):
+			fmt.Fprintf(w, "&#x%X;", r)
+		default:
+			w.WriteRune(r)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+/*
+Package xslt implements XSLT 1.0 transformations of the xml package's Element trees.
+
+A stylesheet is compiled once with Parse and can then be used by any number of concurrent calls to
+Transform. The result of a transformation is a Document, which can be used directly, for example by
+the svg package, or serialized according to the stylesheet's xsl:output settings with Write.
+
+All the XSLT 1.0 instructions and functions are supported, with these limitations:
+  - disable-output-escaping is ignored
+  - sorting compares strings case insensitively, with case-order breaking ties, regardless of lang
+  - unparsed-entity-uri() always returns an empty string
+  - extension elements are unavailable, so only their xsl:fallback content is used
+*/
+package xslt
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+
+	dom "github.com/jphsd/xml"
+	"github.com/jphsd/xml/xpath"
+)
+
+// NamespaceURL is the XSLT namespace URI.
+const NamespaceURL = "http://www.w3.org/1999/XSL/Transform"
+
+const xmlURL = "http://www.w3.org/XML/1998/namespace"
+
+// Output holds the xsl:output settings of a stylesheet.
+type Output struct {
+	Method               string // xml, html or text, empty to choose html or xml from the result
+	Version              string
+	Encoding             string
+	OmitXMLDeclaration   bool
+	Standalone           string // yes, no or empty
+	DoctypePublic        string
+	DoctypeSystem        string
+	CDATASectionElements []xml.Name
+	Indent               bool
+	MediaType            string
+}
+
+// Stylesheet is a compiled stylesheet.
+type Stylesheet struct {
+	Output   Output           // Merged xsl:output settings
+	Messages func(msg string) // Called with the content of each xsl:message, which are discarded if nil
+
+	rules    map[xml.Name][]*rule // Template rules by mode, in order of preference
+	named    map[xml.Name]*template
+	globals  map[xml.Name]*variable // Top level variables and parameters
+	order    []*variable            // Globals in document order
+	keys     map[xml.Name][]*key
+	formats  map[xml.Name]*decimalFormat
+	spaces   []*spaceRule
+	attrSets map[xml.Name][]*attrSet // In increasing import precedence
+	aliases  map[string]alias        // Result namespace by stylesheet namespace
+	load     dom.Resolver
+	docs     map[string]*dom.Element // Stylesheet documents by href, for document("")
+}
+
+// Error is an error in a stylesheet, or one raised while running it, located at a stylesheet element.
+type Error struct {
+	Element *dom.Element
+	Err     error
+}
+
+func (e *Error) Error() string {
+	if e.Element.Pos.Line > 0 {
+		return fmt.Sprintf("xslt: %s %s: %v", e.Element.Pos, e.Element.Path(), e.Err)
+	}
+	return fmt.Sprintf("xslt: %s: %v", e.Element.Path(), e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func errorf(e *dom.Element, format string, args ...any) error {
+	return &Error{e, fmt.Errorf(format, args...)}
+}
+
+// wrap locates err at e, unless it's already located.
+func wrap(e *dom.Element, err error) error {
+	var xe *Error
+	if err == nil || errors.As(err, &xe) {
+		return err
+	}
+	return &Error{e, err}
+}
+
+// expr is a compiled expression with the namespace bindings needed by functions taking QNames.
+type expr struct {
+	x    *xpath.Expr
+	ns   map[string]string
+	src  *dom.Element
+	base string // Location of the stylesheet, for document()
+}
+
+// avt is an attribute value template, a sequence of literal strings and expressions.
+type avt struct {
+	parts []avtPart
+}
+
+type avtPart struct {
+	lit string
+	x   *expr
+}
+
+type template struct {
+	src       *dom.Element
+	name      xml.Name
+	mode      xml.Name
+	prec      int // Import precedence
+	importMin int // Lowest precedence of the stylesheets imported by this one, for apply-imports
+	params    []*variable
+	body      []instr
+}
+
+// rule is one alternative of a template's match pattern.
+type rule struct {
+	pat      *xpath.Pattern
+	ns       map[string]string
+	priority float64
+	pos      int
+	t        *template
+}
+
+// variable is an xsl:variable, xsl:param or xsl:with-param.
+type variable struct {
+	src   *dom.Element
+	name  xml.Name
+	param bool
+	sel   *expr
+	body  []instr
+	prec  int
+	deps  []xml.Name // Variables referenced by a global's value
+}
+
+type key struct {
+	match *xpath.Pattern
+	use   *expr
+}
+
+type spaceRule struct {
+	name     xml.Name // Local is * for wildcards
+	any      bool     // Matches any namespace
+	strip    bool
+	prec     int
+	priority float64
+}
+
+type attrSet struct {
+	src   *dom.Element
+	prec  int
+	uses  []xml.Name
+	attrs []instr
+}
+
+type alias struct {
+	prefix, uri string
+}
+
+// decimalFormat holds the symbols of an xsl:decimal-format.
+type decimalFormat struct {
+	decimalSep, groupingSep, percent, perMille, zero, digit, patternSep rune
+	infinity, nan, minus                                                string
+}
+
+var defaultFormat = decimalFormat{'.', ',', '%', '‰', '0', '#', ';', "Infinity", "NaN", "-"}